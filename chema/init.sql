@@ -1,22 +1,170 @@
+CREATE TABLE layers
+(
+    id serial NOT NULL UNIQUE,
+    slug varchar(255) PRIMARY KEY,
+    description text,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
 CREATE TABLE segments
 (
+    id serial NOT NULL UNIQUE,
     slug varchar(255) PRIMARY KEY,
-    percent integer 
+    percent integer,
+    display_name varchar(255),
+    description text,
+    owner varchar(255),
+    bucketing_version smallint NOT NULL DEFAULT 1,
+    salt varchar(255),
+    hash_function varchar(32),
+    basis_points integer,
+    created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    layer varchar(255) REFERENCES layers(slug),
+    layer_offset integer,
+    state varchar(16) NOT NULL DEFAULT 'active',
+    starts_at timestamptz,
+    ends_at timestamptz,
+    schedule jsonb,
+    max_members integer CHECK (max_members > 0),
+    default_ttl varchar(32),
+    max_ttl varchar(32),
+    CHECK (starts_at < ends_at)
 );
 
+CREATE TABLE segment_state_history
+(
+    id serial PRIMARY KEY,
+    segment_id integer NOT NULL,
+    segment varchar(255) NOT NULL,
+    from_state varchar(16) NOT NULL,
+    to_state varchar(16) NOT NULL,
+    comment text,
+    changed_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+
+CREATE TABLE segment_variants
+(
+    segment varchar(255) NOT NULL REFERENCES segments(slug) ON DELETE CASCADE ON UPDATE CASCADE,
+    name varchar(255) NOT NULL,
+    weight integer NOT NULL CHECK (weight > 0),
+    position smallint NOT NULL,
+    PRIMARY KEY (segment, name)
+);
+
+CREATE TABLE segment_tags
+(
+    segment varchar(255) NOT NULL REFERENCES segments(slug) ON DELETE CASCADE ON UPDATE CASCADE,
+    tag varchar(255) NOT NULL,
+    PRIMARY KEY (segment, tag)
+);
+
+CREATE INDEX segment_tags_tag ON segment_tags(tag);
+
+CREATE TABLE segment_parents
+(
+    segment varchar(255) PRIMARY KEY REFERENCES segments(slug) ON DELETE CASCADE ON UPDATE CASCADE,
+    parent varchar(255) NOT NULL REFERENCES segments(slug) ON UPDATE CASCADE,
+    CHECK (segment <> parent)
+);
+
+CREATE INDEX segment_parents_parent ON segment_parents(parent);
+
+CREATE TABLE segment_expressions
+(
+    segment varchar(255) PRIMARY KEY REFERENCES segments(slug) ON DELETE CASCADE ON UPDATE CASCADE,
+    expression text NOT NULL
+);
+
+CREATE TABLE segment_expression_refs
+(
+    segment varchar(255) NOT NULL REFERENCES segment_expressions(segment) ON DELETE CASCADE ON UPDATE CASCADE,
+    ref varchar(255) NOT NULL REFERENCES segments(slug) ON UPDATE CASCADE,
+    PRIMARY KEY (segment, ref)
+);
+
+CREATE INDEX segment_expression_refs_ref ON segment_expression_refs(ref);
+
+CREATE TABLE segment_targeting
+(
+    segment varchar(255) PRIMARY KEY REFERENCES segments(slug) ON DELETE CASCADE ON UPDATE CASCADE,
+    rule text NOT NULL
+);
+
+CREATE TABLE segment_rules
+(
+    id serial PRIMARY KEY,
+    kind varchar(16) NOT NULL,
+    segment varchar(255) REFERENCES segments(slug) ON DELETE CASCADE ON UPDATE CASCADE,
+    other varchar(255) REFERENCES segments(slug) ON DELETE CASCADE ON UPDATE CASCADE,
+    tag varchar(255),
+    max_segments integer CHECK (max_segments > 0),
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE ramp_plans
+(
+    id serial PRIMARY KEY,
+    segment varchar(255) NOT NULL REFERENCES segments(slug) ON DELETE CASCADE ON UPDATE CASCADE,
+    status varchar(16) NOT NULL DEFAULT 'active',
+    next_step smallint NOT NULL DEFAULT 0,
+    next_step_at timestamptz,
+    paused_at timestamptz,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX ramp_plans_running ON ramp_plans (segment) WHERE status IN ('active', 'paused');
+
+CREATE TABLE ramp_steps
+(
+    plan_id integer NOT NULL REFERENCES ramp_plans(id) ON DELETE CASCADE,
+    position smallint NOT NULL,
+    percentage integer NOT NULL CHECK (percentage BETWEEN 0 AND 100),
+    after varchar(32) NOT NULL,
+    applied_at timestamptz,
+    PRIMARY KEY (plan_id, position)
+);
 
 CREATE TABLE user_segments
 (
     user_id integer NOT NULL,
-    segment varchar(255) NOT NULL REFERENCES segments(slug) ON DELETE CASCADE,
-    expiration_time timestamp,
+    segment varchar(255) NOT NULL REFERENCES segments(slug) ON DELETE CASCADE ON UPDATE CASCADE,
+    expiration_time timestamptz,
+    active_from timestamptz,
+    PRIMARY KEY (user_id, segment)
+);
+
+CREATE INDEX user_segments_pending ON user_segments(active_from) WHERE active_from IS NOT NULL;
+
+CREATE TABLE user_percentage_segments
+(
+    user_id integer NOT NULL,
+    segment varchar(255) NOT NULL REFERENCES segments(slug) ON DELETE CASCADE ON UPDATE CASCADE,
     PRIMARY KEY (user_id, segment)
 );
 
+CREATE TABLE change_sets
+(
+    id serial PRIMARY KEY,
+    kind varchar(32) NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    reverted_by integer REFERENCES change_sets(id),
+    irreversible boolean NOT NULL DEFAULT false
+);
+
 CREATE TABLE user_segments_history
 (
+    id bigserial PRIMARY KEY,
     user_id integer NOT NULL,
     segment varchar(255) NOT NULL,
+    segment_id integer,
     operation boolean NOT NULL,
-    operation_datetime timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+    reason varchar(32) NOT NULL DEFAULT 'manual',
+    variant varchar(255),
+    operation_datetime timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    change_set integer REFERENCES change_sets(id),
+    expiration_time timestamptz
 );
+
+CREATE INDEX user_segments_history_change_set ON user_segments_history(change_set) WHERE change_set IS NOT NULL;
@@ -20,23 +20,23 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
-        "/segments/": {
+        "/change-sets/{id}": {
             "get": {
-                "description": "You can also use the request body to send data, but not here :)\np.s. For example, via curl",
+                "description": "Returns the history entries written by one patch, set or segment deletion, in the order they were written.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "user-segments"
+                    "change-set"
                 ],
-                "summary": "Get User Segments",
-                "operationId": "get-user-segments",
+                "summary": "Get Change Set",
+                "operationId": "get-change-set",
                 "parameters": [
                     {
                         "type": "integer",
-                        "description": "User id",
-                        "name": "user_id",
-                        "in": "query",
+                        "description": "Id of change set",
+                        "name": "id",
+                        "in": "path",
                         "required": true
                     }
                 ],
@@ -44,7 +44,7 @@ const docTemplate = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/handler.validGetUserSegmentsResponse"
+                            "$ref": "#/definitions/structures.ChangeSet"
                         }
                     },
                     "400": {
@@ -72,35 +72,33 @@ const docTemplate = `{
                         }
                     }
                 }
-            },
+            }
+        },
+        "/change-sets/{id}/revert": {
             "post": {
-                "consumes": [
-                    "application/json"
-                ],
+                "description": "Restores the memberships the change set removed, with the expiration they had, and removes the ones it added.\nFails with 409 if any of them has changed since, a change set is reverted at most once and segment deletions are not reverted.\nA change set marked irreversible also set expirations or delayed memberships, which history does not record, and is not reverted.\nThe revert is a change set of its own, which is returned.",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "segment"
+                    "change-set"
                 ],
-                "summary": "Create Segment",
-                "operationId": "create-segment",
+                "summary": "Revert Change Set",
+                "operationId": "revert-change-set",
                 "parameters": [
                     {
-                        "description": "Slug of segment",
-                        "name": "input",
-                        "in": "body",
-                        "required": true,
-                        "schema": {
-                            "$ref": "#/definitions/structures.Segment"
-                        }
+                        "type": "integer",
+                        "description": "Id of change set",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/handler.validCreateSegmentResponse"
+                            "$ref": "#/definitions/structures.ChangeSet"
                         }
                     },
                     "400": {
@@ -115,6 +113,12 @@ const docTemplate = `{
                             "$ref": "#/definitions/handler.errorResponse"
                         }
                     },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
@@ -128,8 +132,11 @@ const docTemplate = `{
                         }
                     }
                 }
-            },
-            "delete": {
+            }
+        },
+        "/layers/": {
+            "post": {
+                "description": "Percentage segments of one layer get non-overlapping ranges of its traffic,\nso a user is never in two of them at once.",
                 "consumes": [
                     "application/json"
                 ],
@@ -137,18 +144,18 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "segment"
+                    "layer"
                 ],
-                "summary": "Delete Segment",
-                "operationId": "delete-segment",
+                "summary": "Create Layer",
+                "operationId": "create-layer",
                 "parameters": [
                     {
-                        "description": "Slug of segment",
+                        "description": "Slug of layer",
                         "name": "input",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/structures.Segment"
+                            "$ref": "#/definitions/structures.Layer"
                         }
                     }
                 ],
@@ -156,7 +163,61 @@ const docTemplate = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/handler.validDeleteSegmentResponse"
+                            "$ref": "#/definitions/handler.validCreateLayerResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/layers/{slug}": {
+            "get": {
+                "description": "Returns the ranges of the layer taken by its segments and the basis points left",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "layer"
+                ],
+                "summary": "Get Layer",
+                "operationId": "get-layer",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Slug of layer",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/structures.Layer"
                         }
                     },
                     "400": {
@@ -184,8 +245,74 @@ const docTemplate = `{
                         }
                     }
                 }
+            }
+        },
+        "/ramps/advance/": {
+            "post": {
+                "description": "Applies the due steps of the active ramp plans, called by cron every minute.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "ramp"
+                ],
+                "summary": "Advance Ramp Plans",
+                "operationId": "advance-ramp-plans",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handler.validAdvanceRampPlansResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/rules/": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "rule"
+                ],
+                "summary": "Get Rules",
+                "operationId": "get-rules",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handler.validGetRulesResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
             },
-            "patch": {
+            "post": {
+                "description": "Constrains the explicit segments of users: requires allows segment only along with other,\nexcludes never allows both, max_tagged allows at most max_segments segments tagged tag.\nPatches, sets and reverts that would break a rule fail with 409 and the code rule_violation.\nOnly active, unexpired explicit memberships are checked, percentage rollouts are not.",
                 "consumes": [
                     "application/json"
                 ],
@@ -193,18 +320,18 @@ const docTemplate = `{
                     "application/json"
                 ],
                 "tags": [
-                    "user-segments"
+                    "rule"
                 ],
-                "summary": "Patch Segment",
-                "operationId": "patch-segment",
+                "summary": "Create Rule",
+                "operationId": "create-rule",
                 "parameters": [
                     {
-                        "description": "Patch data",
+                        "description": "Rule",
                         "name": "input",
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/structures.UserSegments"
+                            "$ref": "#/definitions/structures.Rule"
                         }
                     }
                 ],
@@ -212,7 +339,7 @@ const docTemplate = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/handler.validPatchResponse"
+                            "$ref": "#/definitions/structures.Rule"
                         }
                     },
                     "400": {
@@ -242,21 +369,42 @@ const docTemplate = `{
                 }
             }
         },
-        "/users/expired-segments/": {
+        "/rules/{id}": {
             "delete": {
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "user"
+                    "rule"
+                ],
+                "summary": "Delete Rule",
+                "operationId": "delete-rule",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Id of rule",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
                 ],
-                "summary": "Delete Expired User Segments",
-                "operationId": "delete-user-expired-segments",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "integer"
+                            "$ref": "#/definitions/handler.validDeleteRuleResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
                         }
                     },
                     "500": {
@@ -274,37 +422,37 @@ const docTemplate = `{
                 }
             }
         },
-        "/users/history/": {
+        "/segments/": {
             "get": {
-                "description": "You can also use the request body to send data, but not here :)\np.s. For example, via curl",
+                "description": "Only active segments are returned, memberships of paused segments are kept but left out.\nSegments outside of their activation window are left out as well.\nMemberships added with active_from are left out until then.\nSegments with variants also get the variant assigned to the user.\nThe ancestors of the segments of the user are returned along with them, if they are active themselves.\nComposite segments are returned when their expression holds for the explicit and percentage segments of the user and their ancestors.\nAttributes of the request such as ctx.city=Moscow or ctx.app_version=7.2 are matched against\nthe targeting rules of percentage segments, a targeted segment is given only when its rule matches.\nAn explicit segment of a layer keeps the user out of the rollout of the other segments of the layer.\nA targeted placement is recorded in the history once its rule matches and closed by a read whose attributes no longer match.\nYou can also use the request body to send data, but not here :)\np.s. For example, via curl",
                 "produces": [
                     "application/json"
                 ],
                 "tags": [
-                    "user"
+                    "user-segments"
                 ],
-                "summary": "Get User History",
-                "operationId": "get-user-history",
+                "summary": "Get User Segments",
+                "operationId": "get-user-segments",
                 "parameters": [
                     {
                         "type": "integer",
+                        "description": "User id",
                         "name": "user_id",
                         "in": "query",
                         "required": true
                     },
                     {
                         "type": "string",
-                        "example": "YYYY-MM",
-                        "name": "year_month",
-                        "in": "query",
-                        "required": true
+                        "description": "Attribute matched against targeting rules, any name after ctx.",
+                        "name": "ctx.name",
+                        "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/handler.validGetUserHistoryResponse"
+                            "$ref": "#/definitions/handler.validGetUserSegmentsResponse"
                         }
                     },
                     "400": {
@@ -332,79 +480,2021 @@ const docTemplate = `{
                         }
                     }
                 }
-            }
-        }
-    },
-    "definitions": {
-        "handler.errorResponse": {
-            "type": "object",
-            "properties": {
-                "message": {
-                    "type": "string"
+            },
+            "post": {
+                "description": "A segment with an expression is composite: its members are the users for whom the expression\nover other segments holds, it takes no percentage and no explicit members.\nA segment with targeting is given through the percentage rollout only to users whose attributes,\npassed as ctx.\u003cname\u003e query parameters when their segments are read, match the rule.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segment"
+                ],
+                "summary": "Create Segment",
+                "operationId": "create-segment",
+                "parameters": [
+                    {
+                        "description": "Slug of segment",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/structures.Segment"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handler.validCreateSegmentResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
                 }
-            }
-        },
-        "handler.validCreateSegmentResponse": {
+            },
+            "delete": {
+                "description": "With dry_run=true nothing is deleted, the response is a structures.SegmentDeletion\nlisting the memberships and history rows the deletion would remove and write.\nA segment with children is deleted only with children=detach, which makes them top-level segments,\nor children=reparent, which moves them under the parent of the deleted segment.\nA segment used by the expression of a composite segment cannot be deleted.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segment"
+                ],
+                "summary": "Delete Segment",
+                "operationId": "delete-segment",
+                "parameters": [
+                    {
+                        "description": "Slug of segment",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/structures.Segment"
+                        }
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Report the deletion without applying it",
+                        "name": "dry_run",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "detach",
+                            "reparent"
+                        ],
+                        "type": "string",
+                        "description": "What happens to the children of the segment",
+                        "name": "children",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handler.validDeleteSegmentResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            },
+            "patch": {
+                "description": "Adding the user to a segment that reached its max_members fails with 409 and the code segment_full.\nThe expiration is an RFC 3339 timestamp or a ttl such as 72h, the response echoes the resolved expirations.\nA segment to add is a slug or an object with its own expires_at or ttl, which take precedence over those of the request.\nWith the mode upsert a segment the user already has gets the new expiration, a segment to delete they lack is skipped,\nand the response reports for each segment whether it was added, removed, had its expiration updated or stayed unchanged.\nA new membership with active_from in the future stays hidden until then, its ttl counts from that moment, and it counts towards max_members right away.\nWith dry_run=true the patch is validated and rolled back, the response reports the changes and the history rows it would write.\nA layer gives a user at most one segment, adding a second segment of the same layer fails with 400.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "user-segments"
+                ],
+                "summary": "Patch Segment",
+                "operationId": "patch-segment",
+                "parameters": [
+                    {
+                        "description": "Patch data",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/structures.UserSegments"
+                        }
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Report the patch without applying it",
+                        "name": "dry_run",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handler.validPatchResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/list": {
+            "get": {
+                "description": "Archived segments are listed only when filtered by state.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segment"
+                ],
+                "summary": "List Segments",
+                "operationId": "list-segments",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "example": 20,
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "example": 0,
+                        "name": "offset",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "name": "owner",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "name": "search",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "example": "paused",
+                        "description": "State lists the segments in the state, archived segments are listed only this way.",
+                        "name": "state",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handler.validGetSegmentsResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/{slug}": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segment"
+                ],
+                "summary": "Get Segment",
+                "operationId": "get-segment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Slug of segment",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/structures.Segment"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            },
+            "patch": {
+                "description": "Omitted fields are left unchanged.\nRaising the percentage keeps every user already in the segment,\nlowering it drops a deterministic subset of them.\nSetting bucketing_version to 2 opts the segment into salted basis point bucketing.\nSetting layer moves the segment into a layer, an empty layer detaches it; a member with another segment of the layer is rejected.\nSetting variants replaces them; once a segment has users its variants, salt and hash function are fixed, since the history keeps the variant each user saw.\nSetting starts_at or ends_at moves the activation window of the segment.\nSetting clear_starts_at or clear_ends_at removes that bound of the window.\nSetting schedule replaces the weekly schedule, a schedule without intervals removes it.\nSetting parent moves the segment under another one, an empty parent detaches it; a parent descending from the segment is rejected.\nSetting expression makes the segment composite, an empty expression makes it a regular segment again.\nSetting targeting replaces the targeting rule, an empty targeting removes it; a targeted segment needs a percentage.\nSetting a rule keeps the recorded placements, reads whose attributes no longer match close them.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segment"
+                ],
+                "summary": "Update Segment",
+                "operationId": "update-segment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Slug of segment",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Segment data",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/structures.SegmentUpdate"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/structures.Segment"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/{slug}/clone": {
+            "post": {
+                "description": "Creates a segment with the settings, tags, parent, variants, expression and targeting of the segment, keeping its salt so the percentage rollout of a segment outside of a layer reaches the same users.\nThe clone is left out of the layer of the segment, so the clone of a layered segment buckets users by its salt and reaches other users.\nThe clone of an archived segment is a draft.\nWith copy_members the explicit memberships are copied as well and recorded in history as one change set,\nwith copy_expirations they keep their expirations. Expired memberships are not copied.\nCopied members beyond the max_members of the segment fail with 409 and the code segment_full,\ncopied members breaking a max_tagged rule on its tags fail with 409 and the code rule_violation.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segment"
+                ],
+                "summary": "Clone Segment",
+                "operationId": "clone-segment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Slug of segment",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Slug of clone and what to copy",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/structures.SegmentClone"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/structures.SegmentCloneResult"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/{slug}/ramp": {
+            "get": {
+                "description": "Returns the latest ramp plan of the segment with the time each step was applied",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "ramp"
+                ],
+                "summary": "Get Ramp Plan",
+                "operationId": "get-ramp-plan",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Slug of segment",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/structures.RampPlan"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Raises the percentage of the segment step by step, each step applies once its offset from the creation of the plan has passed.\nOffsets are durations such as 30m, 24h or 3d, an empty offset applies the step at once.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "ramp"
+                ],
+                "summary": "Create Ramp Plan",
+                "operationId": "create-ramp-plan",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Slug of segment",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Steps of ramp plan",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/structures.RampPlan"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/structures.RampPlan"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/{slug}/ramp/{action}": {
+            "post": {
+                "description": "A resumed plan is shifted by the time it spent paused. An aborted plan keeps the percentage it reached.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "ramp"
+                ],
+                "summary": "Pause, Resume Or Abort Ramp Plan",
+                "operationId": "set-ramp-plan-status",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Slug of segment",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "pause, resume or abort",
+                        "name": "action",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/structures.RampPlan"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/{slug}/rename": {
+            "post": {
+                "description": "Memberships and history are kept, history of the old and new slug is linked by segment id,\nexpressions referring to the segment follow the new slug",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segment"
+                ],
+                "summary": "Rename Segment",
+                "operationId": "rename-segment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Slug of segment",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "New slug of segment",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/structures.SegmentRename"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handler.validRenameSegmentResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/{slug}/schedule": {
+            "get": {
+                "description": "Next intervals of activity of the segment by its schedule, clipped to its activation window.\nTimes are in the time zone of the schedule.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segment"
+                ],
+                "summary": "Preview Segment Schedule",
+                "operationId": "get-segment-schedule",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Slug of segment",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of intervals, 5 by default",
+                        "name": "count",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handler.validGetSegmentScheduleResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/{slug}/state": {
+            "post": {
+                "description": "Paused segments keep their memberships but are not given to users.\nArchived segments are read-only and hidden from the list, they are restored as paused.\nAllowed transitions: draft -\u003e active, active \u003c-\u003e paused, any -\u003e archived, archived -\u003e paused.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segment"
+                ],
+                "summary": "Set Segment State",
+                "operationId": "set-segment-state",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Slug of segment",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "New state of segment",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/structures.SegmentStateChange"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/structures.Segment"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/{slug}/states": {
+            "get": {
+                "description": "State transitions of the segment, oldest first",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "segment"
+                ],
+                "summary": "Get Segment States",
+                "operationId": "get-segment-states",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Slug of segment",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handler.validGetSegmentStatesResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/segments/{slug}/users": {
+            "get": {
+                "description": "Returns the users with an explicit membership in the segment that is active already,\nwith include_descendants=true the members of its descendants as well.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "user-segments"
+                ],
+                "summary": "Get Segment Users",
+                "operationId": "get-segment-users",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Slug of segment",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Include the members of the descendants of the segment",
+                        "name": "include_descendants",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handler.validGetSegmentUsersResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/activations/": {
+            "get": {
+                "description": "Lists the memberships added with active_from that are not active yet, the soonest first.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "user-segments"
+                ],
+                "summary": "Get Upcoming Activations",
+                "operationId": "get-upcoming-activations",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "name": "segment",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "name": "user_id",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handler.validGetActivationsResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/expired-segments/": {
+            "delete": {
+                "description": "Also closes the memberships of segments whose activation window has ended.\nDelayed memberships whose active_from has come are recorded in the history first.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "user"
+                ],
+                "summary": "Delete Expired User Segments",
+                "operationId": "delete-user-expired-segments",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "integer"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/history/": {
+            "get": {
+                "description": "You can also use the request body to send data, but not here :)\np.s. For example, via curl",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "user"
+                ],
+                "summary": "Get User History",
+                "operationId": "get-user-history",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "name": "user_id",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "example": "YYYY-MM",
+                        "name": "year_month",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handler.validGetUserHistoryResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/users/{id}/segments": {
+            "put": {
+                "description": "Replaces the explicit segments of the user with the given set: the missing ones are added, the ones left out are removed.\nA segment is a slug or an object with its own expires_at or ttl, the segments the user keeps get that expiration.\nThe response reports for each segment whether it was added, removed, had its expiration updated or stayed unchanged,\nonly additions and removals are written to the history. Percentage segments are not affected,\nand neither are memberships in archived segments, which are kept whether the set names them or not.\nA set with two segments of the same layer fails with 400.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "user-segments"
+                ],
+                "summary": "Set User Segments",
+                "operationId": "set-user-segments",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "User id",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Segments of the user",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/structures.UserSegmentsSet"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/handler.validPatchResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    },
+                    "default": {
+                        "description": "",
+                        "schema": {
+                            "$ref": "#/definitions/handler.errorResponse"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "handler.errorResponse": {
+            "type": "object",
+            "properties": {
+                "code": {
+                    "type": "string",
+                    "example": "segment_full"
+                },
+                "message": {
+                    "type": "string"
+                },
+                "rule": {
+                    "type": "integer"
+                }
+            }
+        },
+        "handler.validAdvanceRampPlansResponse": {
+            "type": "object",
+            "properties": {
+                "applied_steps": {
+                    "type": "integer"
+                }
+            }
+        },
+        "handler.validCreateLayerResponse": {
+            "type": "object",
+            "properties": {
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "handler.validCreateSegmentResponse": {
+            "type": "object",
+            "properties": {
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "handler.validDeleteRuleResponse": {
+            "type": "object",
+            "properties": {
+                "id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "handler.validDeleteSegmentResponse": {
+            "type": "object",
+            "properties": {
+                "change_set": {
+                    "type": "integer"
+                },
+                "children": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "handler.validGetActivationsResponse": {
+            "type": "object",
+            "properties": {
+                "activations": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/structures.Activation"
+                    }
+                }
+            }
+        },
+        "handler.validGetRulesResponse": {
+            "type": "object",
+            "properties": {
+                "rules": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/structures.Rule"
+                    }
+                }
+            }
+        },
+        "handler.validGetSegmentScheduleResponse": {
+            "type": "object",
+            "properties": {
+                "intervals": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/structures.ActivityInterval"
+                    }
+                },
+                "schedule": {
+                    "$ref": "#/definitions/structures.SegmentSchedule"
+                },
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "handler.validGetSegmentStatesResponse": {
+            "type": "object",
+            "properties": {
+                "slug": {
+                    "type": "string"
+                },
+                "transitions": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/structures.SegmentStateTransition"
+                    }
+                }
+            }
+        },
+        "handler.validGetSegmentUsersResponse": {
+            "type": "object",
+            "properties": {
+                "slug": {
+                    "type": "string"
+                },
+                "users": {
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                }
+            }
+        },
+        "handler.validGetSegmentsResponse": {
+            "type": "object",
+            "properties": {
+                "limit": {
+                    "type": "integer"
+                },
+                "offset": {
+                    "type": "integer"
+                },
+                "segments": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/structures.Segment"
+                    }
+                },
+                "total": {
+                    "type": "integer"
+                }
+            }
+        },
+        "handler.validGetUserHistoryResponse": {
+            "type": "object",
+            "properties": {
+                "report": {
+                    "type": "string",
+                    "example": "http://localhost:8000/files/reports/user_history_YYYY-MM_0.csv"
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "handler.validGetUserSegmentsResponse": {
+            "type": "object",
+            "properties": {
+                "segments": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "user_id": {
+                    "type": "integer"
+                },
+                "variants": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "handler.validPatchResponse": {
+            "type": "object",
+            "properties": {
+                "active_from": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "change_set": {
+                    "type": "integer"
+                },
+                "changes": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "dry_run": {
+                    "type": "boolean"
+                },
+                "expirations": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "history": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/structures.HistoryEntry"
+                    }
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "handler.validRenameSegmentResponse": {
+            "type": "object",
+            "properties": {
+                "previous_slug": {
+                    "type": "string"
+                },
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "structures.Activation": {
+            "type": "object",
+            "properties": {
+                "active_from": {
+                    "type": "string"
+                },
+                "expires_at": {
+                    "type": "string"
+                },
+                "slug": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "structures.ActivityInterval": {
+            "type": "object",
+            "properties": {
+                "ends_at": {
+                    "type": "string"
+                },
+                "starts_at": {
+                    "type": "string"
+                }
+            }
+        },
+        "structures.ChangeSet": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "entries": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/structures.HistoryEntry"
+                    }
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "irreversible": {
+                    "description": "Irreversible marks a change set that also made changes history does not record,\nsuch as new expirations or delayed adds, so it cannot be reverted.",
+                    "type": "boolean"
+                },
+                "kind": {
+                    "type": "string",
+                    "example": "patch"
+                },
+                "reverted_by": {
+                    "type": "integer"
+                }
+            }
+        },
+        "structures.HistoryEntry": {
+            "type": "object",
+            "properties": {
+                "at": {
+                    "type": "string"
+                },
+                "expires_at": {
+                    "type": "string"
+                },
+                "operation": {
+                    "type": "string",
+                    "example": "add"
+                },
+                "reason": {
+                    "type": "string",
+                    "example": "manual"
+                },
+                "slug": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "structures.Layer": {
+            "type": "object",
+            "required": [
+                "slug"
+            ],
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "free_basis_points": {
+                    "type": "integer",
+                    "example": 8750
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "segments": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/structures.LayerSegment"
+                    }
+                },
+                "slug": {
+                    "type": "string",
+                    "example": "checkout-experiments"
+                }
+            }
+        },
+        "structures.LayerSegment": {
             "type": "object",
             "properties": {
+                "offset": {
+                    "type": "integer",
+                    "example": 0
+                },
                 "slug": {
                     "type": "string"
+                },
+                "width": {
+                    "type": "integer",
+                    "example": 1250
                 }
             }
         },
-        "handler.validDeleteSegmentResponse": {
+        "structures.RampPlan": {
             "type": "object",
+            "required": [
+                "steps"
+            ],
             "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "next_step_at": {
+                    "type": "string"
+                },
                 "slug": {
                     "type": "string"
+                },
+                "status": {
+                    "type": "string"
+                },
+                "steps": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/structures.RampStep"
+                    }
                 }
             }
         },
-        "handler.validGetUserHistoryResponse": {
+        "structures.RampStep": {
             "type": "object",
             "properties": {
-                "report": {
+                "after": {
                     "type": "string",
-                    "example": "http://localhost:8000/files/reports/user_history_YYYY-MM_0.csv"
+                    "example": "24h"
                 },
-                "user_id": {
+                "applied_at": {
+                    "type": "string"
+                },
+                "percentage": {
+                    "type": "integer",
+                    "example": 5
+                }
+            }
+        },
+        "structures.Rule": {
+            "type": "object",
+            "required": [
+                "kind"
+            ],
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "id": {
                     "type": "integer"
+                },
+                "kind": {
+                    "type": "string",
+                    "example": "requires"
+                },
+                "max_segments": {
+                    "type": "integer",
+                    "example": 2
+                },
+                "other": {
+                    "type": "string",
+                    "example": "AVITO_DISCOUNT_30"
+                },
+                "segment": {
+                    "type": "string",
+                    "example": "AVITO_DISCOUNT_50"
+                },
+                "tag": {
+                    "type": "string",
+                    "example": "discount"
                 }
             }
         },
-        "handler.validGetUserSegmentsResponse": {
+        "structures.ScheduleInterval": {
             "type": "object",
             "properties": {
-                "segments": {
+                "days": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    },
+                    "example": [
+                        "mon",
+                        "tue",
+                        "wed",
+                        "thu",
+                        "fri"
+                    ]
+                },
+                "end": {
+                    "type": "string",
+                    "example": "23:00"
+                },
+                "start": {
+                    "type": "string",
+                    "example": "18:00"
+                }
+            }
+        },
+        "structures.Segment": {
+            "type": "object",
+            "required": [
+                "slug"
+            ],
+            "properties": {
+                "basis_points": {
+                    "type": "integer",
+                    "example": 1250
+                },
+                "bucketing_version": {
+                    "type": "integer",
+                    "example": 2
+                },
+                "children": {
                     "type": "array",
                     "items": {
                         "type": "string"
                     }
                 },
-                "user_id": {
+                "created_at": {
+                    "type": "string"
+                },
+                "default_ttl": {
+                    "description": "DefaultTTL is the membership duration applied when a user is added without an expiration,\nMaxTTL is the longest allowed one. Both are durations such as 12h or 14d.",
+                    "type": "string",
+                    "example": "14d"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "display_name": {
+                    "type": "string",
+                    "example": "Voice messages"
+                },
+                "ends_at": {
+                    "type": "string",
+                    "example": "2023-09-15T00:00:00+03:00"
+                },
+                "expression": {
+                    "description": "Expression makes the segment composite: its members are the users for whom the expression\nover other segments holds, such as premium AND NOT churn_risk, rather than explicit ones.",
+                    "type": "string",
+                    "example": "premium AND NOT churn_risk"
+                },
+                "hash_function": {
+                    "type": "string",
+                    "example": "murmur3"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "layer": {
+                    "type": "string",
+                    "example": "checkout-experiments"
+                },
+                "layer_offset": {
+                    "type": "integer",
+                    "example": 0
+                },
+                "max_members": {
+                    "description": "MaxMembers caps the number of users added to the segment, Members is reported in the details of the segment.",
+                    "type": "integer",
+                    "example": 1000
+                },
+                "max_ttl": {
+                    "type": "string",
+                    "example": "30d"
+                },
+                "members": {
+                    "type": "integer",
+                    "example": 250
+                },
+                "owner": {
+                    "type": "string",
+                    "example": "messenger-team"
+                },
+                "parent": {
+                    "description": "Parent is implied for every member of the segment, Children are reported in the details of the segment.",
+                    "type": "string",
+                    "example": "AVITO_DISCOUNTS"
+                },
+                "percentage": {
                     "type": "integer"
+                },
+                "salt": {
+                    "type": "string"
+                },
+                "schedule": {
+                    "description": "Schedule limits the segment to recurring weekly intervals within its window.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/structures.SegmentSchedule"
+                        }
+                    ]
+                },
+                "slug": {
+                    "type": "string"
+                },
+                "starts_at": {
+                    "description": "StartsAt and EndsAt limit the segment to a window, outside of it nobody gets the segment.",
+                    "type": "string",
+                    "example": "2023-09-01T00:00:00+03:00"
+                },
+                "state": {
+                    "description": "State is draft or active on creation, active by default.",
+                    "type": "string",
+                    "example": "active"
+                },
+                "tags": {
+                    "description": "Tags group segments for the rules that limit how many of them a user may be in.",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    },
+                    "example": [
+                        "discount"
+                    ]
+                },
+                "targeting": {
+                    "description": "Targeting narrows the percentage rollout to users whose attributes, passed when their segments are read,\nmatch the rule, such as city in [\"Moscow\", \"SPb\"] \u0026\u0026 semver(app_version) \u003e= \"7.0\".",
+                    "type": "string",
+                    "example": "city in [\"Moscow\", \"SPb\"] \u0026\u0026 semver(app_version) \u003e= \"7.0\""
+                },
+                "updated_at": {
+                    "type": "string"
+                },
+                "variants": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/structures.SegmentVariant"
+                    }
                 }
             }
         },
-        "handler.validPatchResponse": {
+        "structures.SegmentClone": {
             "type": "object",
+            "required": [
+                "new_slug"
+            ],
             "properties": {
-                "user_id": {
+                "copy_expirations": {
+                    "type": "boolean"
+                },
+                "copy_members": {
+                    "type": "boolean"
+                },
+                "new_slug": {
+                    "type": "string",
+                    "example": "AVITO_VOICE_MESSAGES_V2"
+                }
+            }
+        },
+        "structures.SegmentCloneResult": {
+            "type": "object",
+            "properties": {
+                "change_set": {
+                    "type": "integer"
+                },
+                "members": {
                     "type": "integer"
+                },
+                "slug": {
+                    "type": "string"
+                },
+                "source": {
+                    "type": "string"
                 }
             }
         },
-        "structures.Segment": {
+        "structures.SegmentRename": {
             "type": "object",
             "required": [
-                "slug"
+                "new_slug"
             ],
             "properties": {
-                "percentage": {
-                    "type": "integer"
+                "new_slug": {
+                    "type": "string",
+                    "example": "AVITO_VOICE_MESSAGES_V2"
+                }
+            }
+        },
+        "structures.SegmentSchedule": {
+            "type": "object",
+            "properties": {
+                "intervals": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/structures.ScheduleInterval"
+                    }
+                },
+                "timezone": {
+                    "type": "string",
+                    "example": "Europe/Moscow"
+                }
+            }
+        },
+        "structures.SegmentStateChange": {
+            "type": "object",
+            "required": [
+                "state"
+            ],
+            "properties": {
+                "comment": {
+                    "type": "string",
+                    "example": "incident INC-123"
+                },
+                "state": {
+                    "type": "string",
+                    "example": "paused"
+                }
+            }
+        },
+        "structures.SegmentStateTransition": {
+            "type": "object",
+            "properties": {
+                "changed_at": {
+                    "type": "string"
+                },
+                "comment": {
+                    "type": "string"
+                },
+                "from": {
+                    "type": "string",
+                    "example": "active"
+                },
+                "to": {
+                    "type": "string",
+                    "example": "paused"
+                }
+            }
+        },
+        "structures.SegmentToAdd": {
+            "type": "object",
+            "properties": {
+                "active_from": {
+                    "type": "string",
+                    "example": "2023-08-28T10:00:00+03:00"
+                },
+                "expires_at": {
+                    "type": "string",
+                    "example": "2023-08-30T12:00:00+03:00"
                 },
                 "slug": {
+                    "type": "string",
+                    "example": "AVITO_VOICE_MESSAGES"
+                },
+                "ttl": {
+                    "type": "string",
+                    "example": "72h"
+                }
+            }
+        },
+        "structures.SegmentUpdate": {
+            "type": "object",
+            "properties": {
+                "basis_points": {
+                    "type": "integer",
+                    "example": 1250
+                },
+                "bucketing_version": {
+                    "type": "integer",
+                    "example": 2
+                },
+                "clear_ends_at": {
+                    "type": "boolean"
+                },
+                "clear_starts_at": {
+                    "description": "ClearStartsAt and ClearEndsAt remove the bounds of the window, a null starts_at or ends_at leaves them unchanged.",
+                    "type": "boolean"
+                },
+                "default_ttl": {
+                    "description": "DefaultTTL and MaxTTL replace the membership durations of the segment, an empty string removes them.",
+                    "type": "string",
+                    "example": "14d"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "display_name": {
+                    "type": "string"
+                },
+                "ends_at": {
+                    "type": "string",
+                    "example": "2023-09-15T00:00:00+03:00"
+                },
+                "expression": {
+                    "description": "Expression replaces the expression of the segment, an empty string makes it a regular segment.",
+                    "type": "string",
+                    "example": "(beta OR staff) AND android_new_ui"
+                },
+                "hash_function": {
+                    "type": "string",
+                    "example": "murmur3"
+                },
+                "layer": {
+                    "description": "Layer moves the segment to another layer, an empty string detaches it.",
+                    "type": "string",
+                    "example": "checkout-experiments"
+                },
+                "max_members": {
+                    "description": "MaxMembers replaces the cap on the members of the segment, 0 removes it.",
+                    "type": "integer",
+                    "example": 1000
+                },
+                "max_ttl": {
+                    "type": "string",
+                    "example": "30d"
+                },
+                "owner": {
+                    "type": "string"
+                },
+                "parent": {
+                    "description": "Parent moves the segment under another one, an empty string detaches it.",
+                    "type": "string",
+                    "example": "AVITO_DISCOUNTS"
+                },
+                "percentage": {
+                    "type": "integer",
+                    "example": 30
+                },
+                "salt": {
                     "type": "string"
+                },
+                "schedule": {
+                    "description": "Schedule replaces the schedule of the segment, a schedule without intervals removes it.",
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/structures.SegmentSchedule"
+                        }
+                    ]
+                },
+                "starts_at": {
+                    "type": "string",
+                    "example": "2023-09-01T00:00:00+03:00"
+                },
+                "tags": {
+                    "description": "Tags replaces the tags of the segment, an empty list removes them.",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    },
+                    "example": [
+                        "discount"
+                    ]
+                },
+                "targeting": {
+                    "description": "Targeting replaces the targeting rule of the segment, an empty string removes it.",
+                    "type": "string",
+                    "example": "semver(app_version) \u003e= \"7.0\""
+                },
+                "variants": {
+                    "description": "Variants replaces the variants of the segment, an empty list removes them.",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/structures.SegmentVariant"
+                    }
+                }
+            }
+        },
+        "structures.SegmentVariant": {
+            "type": "object",
+            "properties": {
+                "name": {
+                    "type": "string",
+                    "example": "control"
+                },
+                "weight": {
+                    "type": "integer",
+                    "example": 50
                 }
             }
         },
@@ -416,15 +2506,21 @@ const docTemplate = `{
                 "user_id"
             ],
             "properties": {
+                "mode": {
+                    "description": "Mode is strict by default. In the upsert mode a segment the user already has gets the expiration of the request,\nwhich extends or clears it, and a segment to delete the user lacks is skipped.",
+                    "type": "string",
+                    "example": "upsert"
+                },
                 "segments_to_add": {
                     "type": "array",
                     "items": {
-                        "type": "string"
+                        "$ref": "#/definitions/structures.SegmentToAdd"
                     }
                 },
                 "segments_to_add_expiration": {
+                    "description": "SegmentsToAddExpiration is an RFC 3339 timestamp, the naive 2006-01-02 15:04:05 is read in the time zone of the server.\nTTL sets the expiration relative to the request instead. Both apply to the segments without their own expiration.",
                     "type": "string",
-                    "example": "2023-08-30 12:00:00"
+                    "example": "2023-08-30T12:00:00+03:00"
                 },
                 "segments_to_delete": {
                     "type": "array",
@@ -432,10 +2528,28 @@ const docTemplate = `{
                         "type": "string"
                     }
                 },
+                "ttl": {
+                    "type": "string",
+                    "example": "72h"
+                },
                 "user_id": {
                     "type": "integer"
                 }
             }
+        },
+        "structures.UserSegmentsSet": {
+            "type": "object",
+            "required": [
+                "segments"
+            ],
+            "properties": {
+                "segments": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/structures.SegmentToAdd"
+                    }
+                }
+            }
         }
     }
 }`
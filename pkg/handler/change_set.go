@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// @Summary Get Change Set
+// @Description Returns the history entries written by one patch, set or segment deletion, in the order they were written.
+// @Tags change-set
+// @ID get-change-set
+// @Produce  json
+// @Param id path int true "Id of change set"
+// @Success 200 {object} structures.ChangeSet
+// @Failure 400,404 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /change-sets/{id} [get]
+func (h *Handler) getChangeSet(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, "invalid change set id")
+		return
+	}
+
+	changeSet, err := h.services.GetChangeSet(id)
+	if err != nil {
+		newServiceErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, changeSet)
+}
+
+// @Summary Revert Change Set
+// @Description Restores the memberships the change set removed, with the expiration they had, and removes the ones it added.
+// @Description Fails with 409 if any of them has changed since, a change set is reverted at most once and segment deletions are not reverted.
+// @Description A change set marked irreversible also set expirations or delayed memberships, which history does not record, and is not reverted.
+// @Description The revert is a change set of its own, which is returned.
+// @Tags change-set
+// @ID revert-change-set
+// @Produce  json
+// @Param id path int true "Id of change set"
+// @Success 200 {object} structures.ChangeSet
+// @Failure 400,404,409 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /change-sets/{id}/revert [post]
+func (h *Handler) revertChangeSet(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, "invalid change set id")
+		return
+	}
+
+	revert, err := h.services.RevertChangeSet(id)
+	if err != nil {
+		newServiceErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, revert)
+}
@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"avito/pkg/service"
+	mock_service "avito/pkg/service/mocks"
+	"avito/pkg/structures"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/magiconair/properties/assert"
+)
+
+func TestHandler_getChangeSet(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockChangeSet)
+
+	createdAt := time.Date(2023, 8, 28, 20, 0, 0, 0, time.UTC)
+	expiresAt := createdAt.Add(72 * time.Hour)
+
+	tests := []struct {
+		name                 string
+		id                   string
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name: "OK",
+			id:   "7",
+			mockBehavior: func(s *mock_service.MockChangeSet) {
+				s.EXPECT().GetChangeSet(7).Return(structures.ChangeSet{
+					Id:        7,
+					Kind:      "patch",
+					CreatedAt: createdAt,
+					Entries: []structures.HistoryEntry{
+						{UserId: 1, Segment: "AVITO_SALE", Operation: "add", Reason: "manual", ExpiresAt: &expiresAt, At: &createdAt},
+						{UserId: 1, Segment: "AVITO_VOICE", Operation: "remove", Reason: "manual", At: &createdAt},
+					},
+				}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"id":7,"kind":"patch","created_at":"2023-08-28T20:00:00Z","entries":[{"user_id":1,"slug":"AVITO_SALE","operation":"add","reason":"manual","expires_at":"2023-08-31T20:00:00Z","at":"2023-08-28T20:00:00Z"},{"user_id":1,"slug":"AVITO_VOICE","operation":"remove","reason":"manual","at":"2023-08-28T20:00:00Z"}]}`,
+		},
+		{
+			name:                 "InvalidId",
+			id:                   "seven",
+			mockBehavior:         func(s *mock_service.MockChangeSet) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid change set id"}`,
+		},
+		{
+			name: "NotFound",
+			id:   "8",
+			mockBehavior: func(s *mock_service.MockChangeSet) {
+				s.EXPECT().GetChangeSet(8).Return(structures.ChangeSet{}, structures.ChangeSetNotFoundError{Id: 8})
+			},
+			expectedStatusCode:   404,
+			expectedResponseBody: `{"message":"change set 8 does not exist"}`,
+		},
+		{
+			name: "ServiceFail",
+			id:   "7",
+			mockBehavior: func(s *mock_service.MockChangeSet) {
+				s.EXPECT().GetChangeSet(7).Return(structures.ChangeSet{}, errors.New("service fail"))
+			},
+			expectedStatusCode:   500,
+			expectedResponseBody: `{"message":"service fail"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockChangeSet(ctl)
+			testCase.mockBehavior(mock)
+
+			services := &service.Service{ChangeSet: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.GET("/change-sets/:id", h.getChangeSet)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/change-sets/"+testCase.id, nil)
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
+
+func TestHandler_revertChangeSet(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockChangeSet)
+
+	createdAt := time.Date(2023, 8, 28, 20, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name                 string
+		id                   string
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name: "OK",
+			id:   "7",
+			mockBehavior: func(s *mock_service.MockChangeSet) {
+				s.EXPECT().RevertChangeSet(7).Return(structures.ChangeSet{
+					Id:        9,
+					Kind:      "revert",
+					CreatedAt: createdAt,
+					Entries: []structures.HistoryEntry{
+						{UserId: 1, Segment: "AVITO_SALE", Operation: "remove", Reason: "revert"},
+					},
+				}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"id":9,"kind":"revert","created_at":"2023-08-28T20:00:00Z","entries":[{"user_id":1,"slug":"AVITO_SALE","operation":"remove","reason":"revert"}]}`,
+		},
+		{
+			name:                 "InvalidId",
+			id:                   "seven",
+			mockBehavior:         func(s *mock_service.MockChangeSet) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid change set id"}`,
+		},
+		{
+			name: "Conflict",
+			id:   "7",
+			mockBehavior: func(s *mock_service.MockChangeSet) {
+				s.EXPECT().RevertChangeSet(7).Return(structures.ChangeSet{}, structures.ChangeSetConflictError{Id: 7, UserId: 1, Segment: "AVITO_SALE"})
+			},
+			expectedStatusCode:   409,
+			expectedResponseBody: `{"message":"change set 7 cannot be reverted, segment AVITO_SALE of user 1 changed since"}`,
+		},
+		{
+			name: "AlreadyReverted",
+			id:   "7",
+			mockBehavior: func(s *mock_service.MockChangeSet) {
+				s.EXPECT().RevertChangeSet(7).Return(structures.ChangeSet{}, structures.ValidationError{Message: "change set 7 is already reverted by change set 9"})
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"change set 7 is already reverted by change set 9"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockChangeSet(ctl)
+			testCase.mockBehavior(mock)
+
+			services := &service.Service{ChangeSet: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.POST("/change-sets/:id/revert", h.revertChangeSet)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/change-sets/"+testCase.id+"/revert", nil)
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
@@ -2,6 +2,8 @@ package handler
 
 import (
 	"avito/pkg/service"
+	"errors"
+	"strconv"
 
 	_ "avito/docs"
 
@@ -39,14 +41,66 @@ func (h *Handler) InitRoutes() *gin.Engine {
 			segments.DELETE("/", h.deleteSegment)
 			segments.PATCH("/", h.patchSegment)
 			segments.GET("/", h.getUsersInSegment)
+			segments.GET("/list", h.getSegments)
+			segments.GET("/:slug", h.getSegment)
+			segments.PATCH("/:slug", h.updateSegment)
+			segments.GET("/:slug/users", h.getSegmentUsers)
+			segments.POST("/:slug/rename", h.renameSegment)
+			segments.POST("/:slug/clone", h.cloneSegment)
+			segments.POST("/:slug/state", h.setSegmentState)
+			segments.GET("/:slug/states", h.getSegmentStates)
+			segments.GET("/:slug/schedule", h.getSegmentSchedule)
+			segments.POST("/:slug/ramp", h.createRampPlan)
+			segments.GET("/:slug/ramp", h.getRampPlan)
+			segments.POST("/:slug/ramp/:action", h.setRampPlanStatus)
+		}
+
+		layers := api.Group("/layers")
+		{
+			layers.POST("/", h.createLayer)
+			layers.GET("/:slug", h.getLayer)
+		}
+
+		ramps := api.Group("/ramps")
+		{
+			ramps.POST("/advance/", h.advanceRampPlans)
 		}
 
 		users := api.Group(("/users"))
 		{
 			users.GET("/history/", h.getUserHistory)
 			users.DELETE("/expired-segments/", h.deleteExpiredSegments)
+			users.PUT("/:id/segments", h.setUserSegments)
+			users.GET("/activations/", h.getUpcomingActivations)
+		}
+
+		rules := api.Group("/rules")
+		{
+			rules.POST("/", h.createRule)
+			rules.GET("/", h.getRules)
+			rules.DELETE("/:id", h.deleteRule)
+		}
+
+		changeSets := api.Group("/change-sets")
+		{
+			changeSets.GET("/:id", h.getChangeSet)
+			changeSets.POST("/:id/revert", h.revertChangeSet)
 		}
 	}
 
 	return router
 }
+
+// dryRun reads the dry_run query parameter, a request without it is applied.
+func dryRun(c *gin.Context) (bool, error) {
+	value := c.Query("dry_run")
+	if value == "" {
+		return false, nil
+	}
+
+	dryRun, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("invalid dry_run, use true or false")
+	}
+	return dryRun, nil
+}
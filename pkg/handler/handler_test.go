@@ -95,11 +95,27 @@ func TestInitRoutes(t *testing.T) {
 	router := handler.InitRoutes()
 
 	testRequest(t, router, "GET", "/api/segments/", http.StatusBadRequest)
+	testRequest(t, router, "GET", "/api/segments/list?limit=abc", http.StatusBadRequest)
+	testRequest(t, router, "GET", "/api/segments/invalid-", http.StatusBadRequest)
+	testRequest(t, router, "POST", "/api/segments/example/rename", http.StatusBadRequest)
+	testRequest(t, router, "POST", "/api/segments/example/state", http.StatusBadRequest)
+	testRequest(t, router, "GET", "/api/segments/invalid-/states", http.StatusBadRequest)
+	testRequest(t, router, "GET", "/api/segments/invalid-/schedule", http.StatusBadRequest)
+	testRequest(t, router, "POST", "/api/segments/example/ramp", http.StatusBadRequest)
+	testRequest(t, router, "GET", "/api/segments/invalid-/ramp", http.StatusBadRequest)
+	testRequest(t, router, "POST", "/api/segments/example/ramp/restart", http.StatusBadRequest)
+	testRequest(t, router, "PATCH", "/api/segments/example", http.StatusBadRequest)
 	testRequest(t, router, "POST", "/api/segments/", http.StatusBadRequest)
 	testRequest(t, router, "PATCH", "/api/segments/", http.StatusBadRequest)
 	testRequest(t, router, "DELETE", "/api/segments/", http.StatusBadRequest)
+	testRequest(t, router, "POST", "/api/layers/", http.StatusBadRequest)
+	testRequest(t, router, "GET", "/api/layers/invalid-", http.StatusBadRequest)
 	testRequest(t, router, "GET", "/api/users/history/", http.StatusBadRequest)
 	testRequest(t, router, "DELETE", "/api/users/expired-segments/", http.StatusInternalServerError)
+	testRequest(t, router, "PUT", "/api/users/invalid/segments", http.StatusBadRequest)
+	testRequest(t, router, "DELETE", "/api/rules/invalid", http.StatusBadRequest)
+	testRequest(t, router, "GET", "/api/change-sets/invalid", http.StatusBadRequest)
+	testRequest(t, router, "POST", "/api/change-sets/invalid/revert", http.StatusBadRequest)
 }
 
 func testRequest(t *testing.T, router http.Handler, method, url string, expectedStatusCode int) {
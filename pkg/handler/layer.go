@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"avito/pkg/structures"
+	"avito/pkg/utils"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// @Summary Create Layer
+// @Description Percentage segments of one layer get non-overlapping ranges of its traffic,
+// @Description so a user is never in two of them at once.
+// @Tags layer
+// @ID create-layer
+// @Accept  json
+// @Produce  json
+// @Param input body structures.Layer true "Slug of layer"
+// @Success 200 {object} validCreateLayerResponse
+// @Failure 400,404 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /layers/ [post]
+func (h *Handler) createLayer(c *gin.Context) {
+	var input structures.Layer
+
+	if err := c.BindJSON(&input); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := utils.ValidateSlug(input.Slug); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	slug, err := h.services.CreateLayer(input)
+	if err != nil {
+		newServiceErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, validCreateLayerResponse{
+		Layer: slug,
+	})
+}
+
+// @Summary Get Layer
+// @Description Returns the ranges of the layer taken by its segments and the basis points left
+// @Tags layer
+// @ID get-layer
+// @Produce  json
+// @Param slug path string true "Slug of layer"
+// @Success 200 {object} structures.Layer
+// @Failure 400,404 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /layers/{slug} [get]
+func (h *Handler) getLayer(c *gin.Context) {
+	input := structures.Layer{Slug: c.Param("slug")}
+
+	if err := utils.ValidateSlug(input.Slug); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	layer, err := h.services.GetLayer(input)
+	if err != nil {
+		newServiceErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, layer)
+}
@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"avito/pkg/service"
+	mock_service "avito/pkg/service/mocks"
+	"avito/pkg/structures"
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/magiconair/properties/assert"
+)
+
+func TestHandler_createLayer(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockLayer, layer structures.Layer)
+
+	tests := []struct {
+		name                 string
+		inputBody            string
+		inputLayer           structures.Layer
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name:       "OK",
+			inputBody:  `{"slug": "checkout"}`,
+			inputLayer: structures.Layer{Slug: "checkout"},
+			mockBehavior: func(s *mock_service.MockLayer, layer structures.Layer) {
+				s.EXPECT().CreateLayer(layer).Return("checkout", nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"slug":"checkout"}`,
+		},
+		{
+			name:      "EmptySlug",
+			inputBody: `{"slug": ""}`,
+			mockBehavior: func(s *mock_service.MockLayer, layer structures.Layer) {
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"Key: 'Layer.Slug' Error:Field validation for 'Slug' failed on the 'required' tag"}`,
+		},
+		{
+			name:      "InvalidSlug",
+			inputBody: `{"slug": "checkout-"}`,
+			mockBehavior: func(s *mock_service.MockLayer, layer structures.Layer) {
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid slug"}`,
+		},
+		{
+			name:       "ServiceFail",
+			inputBody:  `{"slug": "checkout"}`,
+			inputLayer: structures.Layer{Slug: "checkout"},
+			mockBehavior: func(s *mock_service.MockLayer, layer structures.Layer) {
+				s.EXPECT().CreateLayer(layer).Return("", errors.New("service fail"))
+			},
+			expectedStatusCode:   500,
+			expectedResponseBody: `{"message":"service fail"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockLayer(ctl)
+			testCase.mockBehavior(mock, testCase.inputLayer)
+
+			services := &service.Service{Layer: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.POST("/layers/", h.createLayer)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/layers/", bytes.NewBufferString(testCase.inputBody))
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
+
+func TestHandler_getLayer(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockLayer, layer structures.Layer)
+
+	tests := []struct {
+		name                 string
+		slug                 string
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name: "OK",
+			slug: "checkout",
+			mockBehavior: func(s *mock_service.MockLayer, layer structures.Layer) {
+				s.EXPECT().GetLayer(layer).Return(structures.Layer{
+					Slug:            "checkout",
+					Segments:        []structures.LayerSegment{{Slug: "checkout-a", Offset: 0, Width: 1250}},
+					FreeBasisPoints: 8750,
+				}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"slug":"checkout","description":null,"segments":[{"slug":"checkout-a","offset":0,"width":1250}],"free_basis_points":8750}`,
+		},
+		{
+			name: "InvalidSlug",
+			slug: "checkout-",
+			mockBehavior: func(s *mock_service.MockLayer, layer structures.Layer) {
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid slug"}`,
+		},
+		{
+			name: "NotFound",
+			slug: "checkout",
+			mockBehavior: func(s *mock_service.MockLayer, layer structures.Layer) {
+				s.EXPECT().GetLayer(layer).Return(structures.Layer{}, structures.LayerNotFoundError{Slug: layer.Slug})
+			},
+			expectedStatusCode:   404,
+			expectedResponseBody: `{"message":"layer with slug checkout does not exist"}`,
+		},
+		{
+			name: "ServiceFail",
+			slug: "checkout",
+			mockBehavior: func(s *mock_service.MockLayer, layer structures.Layer) {
+				s.EXPECT().GetLayer(layer).Return(structures.Layer{}, errors.New("service fail"))
+			},
+			expectedStatusCode:   500,
+			expectedResponseBody: `{"message":"service fail"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockLayer(ctl)
+			testCase.mockBehavior(mock, structures.Layer{Slug: testCase.slug})
+
+			services := &service.Service{Layer: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.GET("/layers/:slug", h.getLayer)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/layers/"+testCase.slug, nil)
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"avito/pkg/structures"
+	"avito/pkg/utils"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// @Summary Create Ramp Plan
+// @Description Raises the percentage of the segment step by step, each step applies once its offset from the creation of the plan has passed.
+// @Description Offsets are durations such as 30m, 24h or 3d, an empty offset applies the step at once.
+// @Tags ramp
+// @ID create-ramp-plan
+// @Accept  json
+// @Produce  json
+// @Param slug path string true "Slug of segment"
+// @Param input body structures.RampPlan true "Steps of ramp plan"
+// @Success 200 {object} structures.RampPlan
+// @Failure 400,404,409 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /segments/{slug}/ramp [post]
+func (h *Handler) createRampPlan(c *gin.Context) {
+	var input structures.RampPlan
+	if err := c.BindJSON(&input); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	input.Segment = c.Param("slug")
+	if err := utils.ValidateSlug(input.Segment); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := utils.ValidateRampSteps(input.Steps); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	plan, err := h.services.CreateRampPlan(input)
+	if err != nil {
+		newServiceErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, plan)
+}
+
+// @Summary Get Ramp Plan
+// @Description Returns the latest ramp plan of the segment with the time each step was applied
+// @Tags ramp
+// @ID get-ramp-plan
+// @Produce  json
+// @Param slug path string true "Slug of segment"
+// @Success 200 {object} structures.RampPlan
+// @Failure 400,404 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /segments/{slug}/ramp [get]
+func (h *Handler) getRampPlan(c *gin.Context) {
+	input := structures.Segment{Slug: c.Param("slug")}
+
+	if err := utils.ValidateSlug(input.Slug); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	plan, err := h.services.GetRampPlan(input)
+	if err != nil {
+		newServiceErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, plan)
+}
+
+// @Summary Pause, Resume Or Abort Ramp Plan
+// @Description A resumed plan is shifted by the time it spent paused. An aborted plan keeps the percentage it reached.
+// @Tags ramp
+// @ID set-ramp-plan-status
+// @Produce  json
+// @Param slug path string true "Slug of segment"
+// @Param action path string true "pause, resume or abort"
+// @Success 200 {object} structures.RampPlan
+// @Failure 400,404 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /segments/{slug}/ramp/{action} [post]
+func (h *Handler) setRampPlanStatus(c *gin.Context) {
+	input := structures.RampPlanStatusChange{Segment: c.Param("slug")}
+
+	if err := utils.ValidateSlug(input.Segment); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	status, err := utils.RampPlanActionStatus(c.Param("action"))
+	if err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	input.Status = status
+
+	plan, err := h.services.SetRampPlanStatus(input)
+	if err != nil {
+		newServiceErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, plan)
+}
+
+// @Summary Advance Ramp Plans
+// @Description Applies the due steps of the active ramp plans, called by cron every minute.
+// @Tags ramp
+// @ID advance-ramp-plans
+// @Produce  json
+// @Success 200 {object} validAdvanceRampPlansResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /ramps/advance/ [post]
+func (h *Handler) advanceRampPlans(c *gin.Context) {
+	applied, err := h.services.AdvanceRampPlans()
+	if err != nil {
+		NewErrorResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, validAdvanceRampPlansResponse{
+		AppliedSteps: applied,
+	})
+}
@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"avito/pkg/service"
+	mock_service "avito/pkg/service/mocks"
+	"avito/pkg/structures"
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/magiconair/properties/assert"
+)
+
+func TestHandler_createRampPlan(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockRamp, plan structures.RampPlan)
+
+	createdAt := time.Date(2023, 8, 28, 20, 0, 0, 0, time.UTC)
+	nextStepAt := createdAt.Add(24 * time.Hour)
+
+	tests := []struct {
+		name                 string
+		inputBody            string
+		inputPlan            structures.RampPlan
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name:      "OK",
+			inputBody: `{"steps": [{"percentage": 1}, {"percentage": 5, "after": "24h"}]}`,
+			inputPlan: structures.RampPlan{Segment: "example", Steps: []structures.RampStep{{Percentage: 1}, {Percentage: 5, After: "24h"}}},
+			mockBehavior: func(s *mock_service.MockRamp, plan structures.RampPlan) {
+				s.EXPECT().CreateRampPlan(plan).Return(structures.RampPlan{
+					Id:      1,
+					Segment: plan.Segment,
+					Status:  "active",
+					Steps: []structures.RampStep{
+						{Percentage: 1, AppliedAt: &createdAt},
+						{Percentage: 5, After: "24h"},
+					},
+					NextStepAt: &nextStepAt,
+					CreatedAt:  &createdAt,
+				}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"id":1,"slug":"example","status":"active","steps":[{"percentage":1,"after":"","applied_at":"2023-08-28T20:00:00Z"},{"percentage":5,"after":"24h"}],"next_step_at":"2023-08-29T20:00:00Z","created_at":"2023-08-28T20:00:00Z"}`,
+		},
+		{
+			name:                 "NoSteps",
+			inputBody:            `{"steps": []}`,
+			mockBehavior:         func(s *mock_service.MockRamp, plan structures.RampPlan) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"ramp plan needs at least one step"}`,
+		},
+		{
+			name:                 "InvalidOffset",
+			inputBody:            `{"steps": [{"percentage": 1, "after": "week"}]}`,
+			mockBehavior:         func(s *mock_service.MockRamp, plan structures.RampPlan) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid after week, use a duration such as 30m, 24h or 3d"}`,
+		},
+		{
+			name:      "SegmentNotFound",
+			inputBody: `{"steps": [{"percentage": 1}]}`,
+			inputPlan: structures.RampPlan{Segment: "example", Steps: []structures.RampStep{{Percentage: 1}}},
+			mockBehavior: func(s *mock_service.MockRamp, plan structures.RampPlan) {
+				s.EXPECT().CreateRampPlan(plan).Return(structures.RampPlan{}, structures.SegmentNotFoundError{Slug: plan.Segment})
+			},
+			expectedStatusCode:   404,
+			expectedResponseBody: `{"message":"segment with slug example does not exist"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockRamp(ctl)
+			testCase.mockBehavior(mock, testCase.inputPlan)
+
+			services := &service.Service{Ramp: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.POST("/segments/:slug/ramp", h.createRampPlan)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/segments/example/ramp", bytes.NewBufferString(testCase.inputBody))
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
+
+func TestHandler_setRampPlanStatus(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockRamp, change structures.RampPlanStatusChange)
+
+	tests := []struct {
+		name                 string
+		action               string
+		inputChange          structures.RampPlanStatusChange
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name:        "OK",
+			action:      "pause",
+			inputChange: structures.RampPlanStatusChange{Segment: "example", Status: "paused"},
+			mockBehavior: func(s *mock_service.MockRamp, change structures.RampPlanStatusChange) {
+				s.EXPECT().SetRampPlanStatus(change).Return(structures.RampPlan{
+					Id:      1,
+					Segment: change.Segment,
+					Status:  "paused",
+					Steps:   []structures.RampStep{{Percentage: 100}},
+				}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"id":1,"slug":"example","status":"paused","steps":[{"percentage":100,"after":""}]}`,
+		},
+		{
+			name:                 "InvalidAction",
+			action:               "restart",
+			mockBehavior:         func(s *mock_service.MockRamp, change structures.RampPlanStatusChange) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid action, use pause, resume or abort"}`,
+		},
+		{
+			name:        "NotFound",
+			action:      "abort",
+			inputChange: structures.RampPlanStatusChange{Segment: "example", Status: "aborted"},
+			mockBehavior: func(s *mock_service.MockRamp, change structures.RampPlanStatusChange) {
+				s.EXPECT().SetRampPlanStatus(change).Return(structures.RampPlan{}, structures.RampPlanNotFoundError{Slug: change.Segment})
+			},
+			expectedStatusCode:   404,
+			expectedResponseBody: `{"message":"segment with slug example has no ramp plan"}`,
+		},
+		{
+			name:        "InvalidTransition",
+			action:      "resume",
+			inputChange: structures.RampPlanStatusChange{Segment: "example", Status: "active"},
+			mockBehavior: func(s *mock_service.MockRamp, change structures.RampPlanStatusChange) {
+				s.EXPECT().SetRampPlanStatus(change).Return(structures.RampPlan{}, structures.ValidationError{Message: "ramp plan cannot go from completed to active"})
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"ramp plan cannot go from completed to active"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockRamp(ctl)
+			testCase.mockBehavior(mock, testCase.inputChange)
+
+			services := &service.Service{Ramp: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.POST("/segments/:slug/ramp/:action", h.setRampPlanStatus)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/segments/example/ramp/"+testCase.action, nil)
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
+
+func TestHandler_advanceRampPlans(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockRamp)
+
+	tests := []struct {
+		name                 string
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name: "OK",
+			mockBehavior: func(s *mock_service.MockRamp) {
+				s.EXPECT().AdvanceRampPlans().Return(2, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"applied_steps":2}`,
+		},
+		{
+			name: "ServiceFail",
+			mockBehavior: func(s *mock_service.MockRamp) {
+				s.EXPECT().AdvanceRampPlans().Return(0, errors.New("service fail"))
+			},
+			expectedStatusCode:   500,
+			expectedResponseBody: `{"message":"service fail"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockRamp(ctl)
+			testCase.mockBehavior(mock)
+
+			services := &service.Service{Ramp: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.POST("/ramps/advance/", h.advanceRampPlans)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/ramps/advance/", nil)
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
@@ -1,27 +1,51 @@
 package handler
 
 import (
+	"avito/pkg/structures"
+	"errors"
 	"log"
+	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 type errorResponse struct {
 	Message string `json:"message"`
+	Code    string `json:"code,omitempty" example:"segment_full"`
+	Rule    *int   `json:"rule,omitempty"`
 }
 
+// Codes of errors that clients are expected to handle.
+const (
+	errorCodeSegmentFull   = "segment_full"
+	errorCodeRuleViolation = "rule_violation"
+)
+
 type validGetUserHistoryResponse struct {
 	Report string `json:"report" example:"http://localhost:8000/files/reports/user_history_YYYY-MM_0.csv"`
 	UserId int    `json:"user_id"`
 }
 
 type validGetUserSegmentsResponse struct {
-	Segments []string `json:"segments"`
-	UserId   int      `json:"user_id"`
+	Segments []string          `json:"segments"`
+	Variants map[string]string `json:"variants,omitempty"`
+	UserId   int               `json:"user_id"`
 }
 
 type validPatchResponse struct {
-	UserId int `json:"user_id"`
+	UserId      int                  `json:"user_id"`
+	Expirations map[string]time.Time `json:"expirations,omitempty"`
+	ActiveFrom  map[string]time.Time `json:"active_from,omitempty"`
+	Changes     map[string]string    `json:"changes,omitempty"`
+	ChangeSet   *int                 `json:"change_set,omitempty"`
+
+	DryRun  bool                      `json:"dry_run,omitempty"`
+	History []structures.HistoryEntry `json:"history,omitempty"`
+}
+
+type validGetActivationsResponse struct {
+	Activations []structures.Activation `json:"activations"`
 }
 
 type validCreateSegmentResponse struct {
@@ -29,10 +53,90 @@ type validCreateSegmentResponse struct {
 }
 
 type validDeleteSegmentResponse struct {
+	Segment   string   `json:"slug"`
+	ChangeSet *int     `json:"change_set,omitempty"`
+	Children  []string `json:"children,omitempty"`
+}
+
+type validGetSegmentUsersResponse struct {
 	Segment string `json:"slug"`
+	Users   []int  `json:"users"`
+}
+
+type validRenameSegmentResponse struct {
+	Segment         string `json:"slug"`
+	PreviousSegment string `json:"previous_slug"`
+}
+
+type validCreateLayerResponse struct {
+	Layer string `json:"slug"`
+}
+
+type validGetSegmentStatesResponse struct {
+	Segment     string                              `json:"slug"`
+	Transitions []structures.SegmentStateTransition `json:"transitions"`
+}
+
+type validGetSegmentScheduleResponse struct {
+	Segment   string                        `json:"slug"`
+	Schedule  structures.SegmentSchedule    `json:"schedule"`
+	Intervals []structures.ActivityInterval `json:"intervals"`
+}
+
+type validAdvanceRampPlansResponse struct {
+	AppliedSteps int `json:"applied_steps"`
+}
+
+type validGetRulesResponse struct {
+	Rules []structures.Rule `json:"rules"`
+}
+
+type validDeleteRuleResponse struct {
+	Rule int `json:"id"`
+}
+
+type validGetSegmentsResponse struct {
+	Segments []structures.Segment `json:"segments"`
+	Total    int                  `json:"total"`
+	Limit    int                  `json:"limit"`
+	Offset   int                  `json:"offset"`
 }
 
 func NewErrorResponse(c *gin.Context, statusCode int, message string) {
 	log.Print(message)
-	c.AbortWithStatusJSON(statusCode, errorResponse{message})
+	c.AbortWithStatusJSON(statusCode, errorResponse{Message: message})
+}
+
+func newCodedErrorResponse(c *gin.Context, statusCode int, code, message string) {
+	log.Print(message)
+	c.AbortWithStatusJSON(statusCode, errorResponse{Message: message, Code: code})
+}
+
+func newServiceErrorResponse(c *gin.Context, err error) {
+	var notFound structures.SegmentNotFoundError
+	var layerNotFound structures.LayerNotFoundError
+	var validation structures.ValidationError
+	var archived structures.SegmentArchivedError
+	var rampPlanNotFound structures.RampPlanNotFoundError
+	var changeSetNotFound structures.ChangeSetNotFoundError
+	var changeSetConflict structures.ChangeSetConflictError
+	var full structures.SegmentFullError
+	var ruleNotFound structures.RuleNotFoundError
+	var violation structures.RuleViolationError
+	switch {
+	case errors.As(err, &notFound), errors.As(err, &layerNotFound), errors.As(err, &rampPlanNotFound), errors.As(err, &changeSetNotFound),
+		errors.As(err, &ruleNotFound):
+		NewErrorResponse(c, http.StatusNotFound, err.Error())
+	case errors.As(err, &archived), errors.As(err, &changeSetConflict):
+		NewErrorResponse(c, http.StatusConflict, err.Error())
+	case errors.As(err, &full):
+		newCodedErrorResponse(c, http.StatusConflict, errorCodeSegmentFull, err.Error())
+	case errors.As(err, &violation):
+		log.Print(err.Error())
+		c.AbortWithStatusJSON(http.StatusConflict, errorResponse{Message: err.Error(), Code: errorCodeRuleViolation, Rule: &violation.Rule})
+	case errors.As(err, &validation):
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+	default:
+		NewErrorResponse(c, http.StatusInternalServerError, err.Error())
+	}
 }
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"avito/pkg/structures"
+	"avito/pkg/utils"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// @Summary Create Rule
+// @Description Constrains the explicit segments of users: requires allows segment only along with other,
+// @Description excludes never allows both, max_tagged allows at most max_segments segments tagged tag.
+// @Description Patches, sets and reverts that would break a rule fail with 409 and the code rule_violation.
+// @Description Only active, unexpired explicit memberships are checked, percentage rollouts are not.
+// @Tags rule
+// @ID create-rule
+// @Accept  json
+// @Produce  json
+// @Param input body structures.Rule true "Rule"
+// @Success 200 {object} structures.Rule
+// @Failure 400,404 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /rules/ [post]
+func (h *Handler) createRule(c *gin.Context) {
+	var input structures.Rule
+
+	if err := c.BindJSON(&input); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := utils.ValidateRule(input); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rule, err := h.services.CreateRule(input)
+	if err != nil {
+		newServiceErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, rule)
+}
+
+// @Summary Get Rules
+// @Tags rule
+// @ID get-rules
+// @Produce  json
+// @Success 200 {object} validGetRulesResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /rules/ [get]
+func (h *Handler) getRules(c *gin.Context) {
+	rules, err := h.services.GetRules()
+	if err != nil {
+		newServiceErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, validGetRulesResponse{
+		Rules: rules,
+	})
+}
+
+// @Summary Delete Rule
+// @Tags rule
+// @ID delete-rule
+// @Produce  json
+// @Param id path int true "Id of rule"
+// @Success 200 {object} validDeleteRuleResponse
+// @Failure 400,404 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /rules/{id} [delete]
+func (h *Handler) deleteRule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, "invalid rule id")
+		return
+	}
+
+	if err := h.services.DeleteRule(id); err != nil {
+		newServiceErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, validDeleteRuleResponse{
+		Rule: id,
+	})
+}
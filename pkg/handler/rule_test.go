@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"avito/pkg/service"
+	mock_service "avito/pkg/service/mocks"
+	"avito/pkg/structures"
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/magiconair/properties/assert"
+)
+
+func TestHandler_createRule(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockRule, rule structures.Rule)
+
+	segment, other := "AVITO_DISCOUNT_50", "AVITO_DISCOUNT_30"
+	createdAt := time.Date(2023, 8, 28, 20, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name                 string
+		inputBody            string
+		inputRule            structures.Rule
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name:      "OK",
+			inputBody: `{"kind": "requires", "segment": "AVITO_DISCOUNT_50", "other": "AVITO_DISCOUNT_30"}`,
+			inputRule: structures.Rule{Kind: "requires", Segment: &segment, Other: &other},
+			mockBehavior: func(s *mock_service.MockRule, rule structures.Rule) {
+				created := rule
+				created.Id = 3
+				created.CreatedAt = &createdAt
+				s.EXPECT().CreateRule(rule).Return(created, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"id":3,"kind":"requires","segment":"AVITO_DISCOUNT_50","other":"AVITO_DISCOUNT_30","created_at":"2023-08-28T20:00:00Z"}`,
+		},
+		{
+			name:                 "InvalidKind",
+			inputBody:            `{"kind": "implies", "segment": "AVITO_DISCOUNT_50", "other": "AVITO_DISCOUNT_30"}`,
+			mockBehavior:         func(s *mock_service.MockRule, rule structures.Rule) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid kind, use requires, excludes or max_tagged"}`,
+		},
+		{
+			name:                 "MissingTag",
+			inputBody:            `{"kind": "max_tagged", "max_segments": 2}`,
+			mockBehavior:         func(s *mock_service.MockRule, rule structures.Rule) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"max_tagged rule needs tag and max_segments"}`,
+		},
+		{
+			name:      "SegmentNotFound",
+			inputBody: `{"kind": "requires", "segment": "AVITO_DISCOUNT_50", "other": "AVITO_DISCOUNT_30"}`,
+			inputRule: structures.Rule{Kind: "requires", Segment: &segment, Other: &other},
+			mockBehavior: func(s *mock_service.MockRule, rule structures.Rule) {
+				s.EXPECT().CreateRule(rule).Return(structures.Rule{}, structures.SegmentNotFoundError{Slug: other})
+			},
+			expectedStatusCode:   404,
+			expectedResponseBody: `{"message":"segment with slug AVITO_DISCOUNT_30 does not exist"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockRule(ctl)
+			testCase.mockBehavior(mock, testCase.inputRule)
+
+			services := &service.Service{Rule: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.POST("/rules/", h.createRule)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/rules/", bytes.NewBufferString(testCase.inputBody))
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
+
+func TestHandler_deleteRule(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockRule)
+
+	tests := []struct {
+		name                 string
+		id                   string
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name: "OK",
+			id:   "3",
+			mockBehavior: func(s *mock_service.MockRule) {
+				s.EXPECT().DeleteRule(3).Return(nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"id":3}`,
+		},
+		{
+			name:                 "InvalidId",
+			id:                   "three",
+			mockBehavior:         func(s *mock_service.MockRule) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid rule id"}`,
+		},
+		{
+			name: "NotFound",
+			id:   "4",
+			mockBehavior: func(s *mock_service.MockRule) {
+				s.EXPECT().DeleteRule(4).Return(structures.RuleNotFoundError{Id: 4})
+			},
+			expectedStatusCode:   404,
+			expectedResponseBody: `{"message":"rule 4 does not exist"}`,
+		},
+		{
+			name: "ServiceFail",
+			id:   "3",
+			mockBehavior: func(s *mock_service.MockRule) {
+				s.EXPECT().DeleteRule(3).Return(errors.New("service fail"))
+			},
+			expectedStatusCode:   500,
+			expectedResponseBody: `{"message":"service fail"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockRule(ctl)
+			testCase.mockBehavior(mock)
+
+			services := &service.Service{Rule: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.DELETE("/rules/:id", h.deleteRule)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("DELETE", "/rules/"+testCase.id, nil)
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
@@ -4,11 +4,25 @@ import (
 	"avito/pkg/structures"
 	"avito/pkg/utils"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	defaultSegmentsLimit = 20
+	maxSegmentsLimit     = 100
+
+	defaultScheduleIntervals = 5
+	maxScheduleIntervals     = 50
+)
+
 // @Summary Create Segment
+// @Description A segment with an expression is composite: its members are the users for whom the expression
+// @Description over other segments holds, it takes no percentage and no explicit members.
+// @Description A segment with targeting is given through the percentage rollout only to users whose attributes,
+// @Description passed as ctx.<name> query parameters when their segments are read, match the rule.
 // @Tags segment
 // @ID create-segment
 // @Accept  json
@@ -37,9 +51,75 @@ func (h *Handler) createSegment(c *gin.Context) {
 		return
 	}
 
+	if err := utils.ValidateRollout(input); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if input.Layer != nil {
+		if err := utils.ValidateSlug(*input.Layer); err != nil {
+			NewErrorResponse(c, http.StatusBadRequest, err.Error()+" (layer: "+*input.Layer+")")
+			return
+		}
+	}
+
+	if input.Parent != nil {
+		if err := utils.ValidateSlug(*input.Parent); err != nil {
+			NewErrorResponse(c, http.StatusBadRequest, err.Error()+" (parent: "+*input.Parent+")")
+			return
+		}
+	}
+
+	if err := utils.ValidateCompositeSegment(input); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := utils.ValidateTargeting(input); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := utils.ValidateVariants(input.Variants); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := utils.ValidateTags(input.Tags); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if input.State != "" && input.State != utils.SegmentStateDraft && input.State != utils.SegmentStateActive {
+		NewErrorResponse(c, http.StatusBadRequest, "segment can only be created as draft or active")
+		return
+	}
+
+	if err := utils.ValidateWindow(input.StartsAt, input.EndsAt); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if input.Schedule != nil && len(input.Schedule.Intervals) > 0 {
+		if err := utils.ValidateSchedule(*input.Schedule); err != nil {
+			NewErrorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if input.MaxMembers != nil && *input.MaxMembers <= 0 {
+		NewErrorResponse(c, http.StatusBadRequest, "invalid max_members")
+		return
+	}
+
+	if err := utils.ValidateTTL(input.DefaultTTL, input.MaxTTL); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	slug, err := h.services.Segment.Create(input)
 	if err != nil {
-		NewErrorResponse(c, http.StatusInternalServerError, err.Error())
+		newServiceErrorResponse(c, err)
 		return
 	}
 
@@ -49,11 +129,18 @@ func (h *Handler) createSegment(c *gin.Context) {
 }
 
 // @Summary Delete Segment
+// @Description With dry_run=true nothing is deleted, the response is a structures.SegmentDeletion
+// @Description listing the memberships and history rows the deletion would remove and write.
+// @Description A segment with children is deleted only with children=detach, which makes them top-level segments,
+// @Description or children=reparent, which moves them under the parent of the deleted segment.
+// @Description A segment used by the expression of a composite segment cannot be deleted.
 // @Tags segment
 // @ID delete-segment
 // @Accept  json
 // @Produce  json
 // @Param input body structures.Segment true "Slug of segment"
+// @Param dry_run query boolean false "Report the deletion without applying it"
+// @Param children query string false "What happens to the children of the segment" Enums(detach, reparent)
 // @Success 200 {object} validDeleteSegmentResponse
 // @Failure 400,404 {object} errorResponse
 // @Failure 500 {object} errorResponse
@@ -72,13 +159,479 @@ func (h *Handler) deleteSegment(c *gin.Context) {
 		return
 	}
 
-	slug, err := h.services.Segment.Delete(input)
+	preview, err := dryRun(c)
 	if err != nil {
-		NewErrorResponse(c, http.StatusInternalServerError, err.Error())
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	children := c.Query("children")
+	if err := utils.ValidateChildrenDecision(children); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if preview {
+		deletion, err := h.services.Segment.DeleteDryRun(input, children)
+		if err != nil {
+			newServiceErrorResponse(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, deletion)
+		return
+	}
+
+	deletion, err := h.services.Segment.Delete(input, children)
+	if err != nil {
+		newServiceErrorResponse(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, validDeleteSegmentResponse{
-		Segment: slug,
+		Segment:   deletion.Slug,
+		ChangeSet: deletion.ChangeSet,
+		Children:  deletion.Children,
+	})
+}
+
+// @Summary Get Segment
+// @Tags segment
+// @ID get-segment
+// @Produce  json
+// @Param slug path string true "Slug of segment"
+// @Success 200 {object} structures.Segment
+// @Failure 400,404 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /segments/{slug} [get]
+func (h *Handler) getSegment(c *gin.Context) {
+	input := structures.Segment{Slug: c.Param("slug")}
+
+	if err := utils.ValidateSlug(input.Slug); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	segment, err := h.services.Segment.Get(input)
+	if err != nil {
+		newServiceErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, segment)
+}
+
+// @Summary Update Segment
+// @Description Omitted fields are left unchanged.
+// @Description Raising the percentage keeps every user already in the segment,
+// @Description lowering it drops a deterministic subset of them.
+// @Description Setting bucketing_version to 2 opts the segment into salted basis point bucketing.
+// @Description Setting layer moves the segment into a layer, an empty layer detaches it; a member with another segment of the layer is rejected.
+// @Description Setting variants replaces them; once a segment has users its variants, salt and hash function are fixed, since the history keeps the variant each user saw.
+// @Description Setting starts_at or ends_at moves the activation window of the segment.
+// @Description Setting clear_starts_at or clear_ends_at removes that bound of the window.
+// @Description Setting schedule replaces the weekly schedule, a schedule without intervals removes it.
+// @Description Setting parent moves the segment under another one, an empty parent detaches it; a parent descending from the segment is rejected.
+// @Description Setting expression makes the segment composite, an empty expression makes it a regular segment again.
+// @Description Setting targeting replaces the targeting rule, an empty targeting removes it; a targeted segment needs a percentage.
+// @Description Setting a rule keeps the recorded placements, reads whose attributes no longer match close them.
+// @Tags segment
+// @ID update-segment
+// @Accept  json
+// @Produce  json
+// @Param slug path string true "Slug of segment"
+// @Param input body structures.SegmentUpdate true "Segment data"
+// @Success 200 {object} structures.Segment
+// @Failure 400,404,409 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /segments/{slug} [patch]
+func (h *Handler) updateSegment(c *gin.Context) {
+	var input structures.SegmentUpdate
+	if err := c.BindJSON(&input); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	input.Slug = c.Param("slug")
+	if err := utils.ValidateSlug(input.Slug); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if input.Percentage != nil && (0 > *input.Percentage || *input.Percentage > 100) {
+		NewErrorResponse(c, http.StatusBadRequest, "invalid percentage")
+		return
+	}
+
+	if input.BucketingVersion != nil && *input.BucketingVersion != utils.BucketingV1 && *input.BucketingVersion != utils.BucketingV2 {
+		NewErrorResponse(c, http.StatusBadRequest, "invalid bucketing version")
+		return
+	}
+
+	if input.BasisPoints != nil && (0 > *input.BasisPoints || *input.BasisPoints > utils.Buckets) {
+		NewErrorResponse(c, http.StatusBadRequest, "invalid basis points")
+		return
+	}
+
+	if input.HashFunction != nil {
+		if err := utils.ValidateHashFunction(*input.HashFunction); err != nil {
+			NewErrorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if input.Layer != nil && *input.Layer != "" {
+		if err := utils.ValidateSlug(*input.Layer); err != nil {
+			NewErrorResponse(c, http.StatusBadRequest, err.Error()+" (layer: "+*input.Layer+")")
+			return
+		}
+	}
+
+	if input.Variants != nil {
+		if err := utils.ValidateVariants(*input.Variants); err != nil {
+			NewErrorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if input.Tags != nil {
+		if err := utils.ValidateTags(*input.Tags); err != nil {
+			NewErrorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if input.Parent != nil && *input.Parent != "" {
+		if err := utils.ValidateSlug(*input.Parent); err != nil {
+			NewErrorResponse(c, http.StatusBadRequest, err.Error()+" (parent: "+*input.Parent+")")
+			return
+		}
+	}
+
+	if input.Expression != nil && *input.Expression != "" {
+		if _, err := utils.ParseExpression(*input.Expression); err != nil {
+			NewErrorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if input.Targeting != nil && *input.Targeting != "" {
+		if _, err := utils.ParseTargeting(*input.Targeting); err != nil {
+			NewErrorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if err := utils.ValidateWindow(input.StartsAt, input.EndsAt); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if input.ClearStartsAt && input.StartsAt != nil {
+		NewErrorResponse(c, http.StatusBadRequest, "starts_at cannot be set and cleared at once")
+		return
+	}
+
+	if input.ClearEndsAt && input.EndsAt != nil {
+		NewErrorResponse(c, http.StatusBadRequest, "ends_at cannot be set and cleared at once")
+		return
+	}
+
+	if input.Schedule != nil && len(input.Schedule.Intervals) > 0 {
+		if err := utils.ValidateSchedule(*input.Schedule); err != nil {
+			NewErrorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if input.MaxMembers != nil && *input.MaxMembers < 0 {
+		NewErrorResponse(c, http.StatusBadRequest, "invalid max_members")
+		return
+	}
+
+	if err := utils.ValidateTTL(input.DefaultTTL, input.MaxTTL); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	segment, err := h.services.Segment.Update(input)
+	if err != nil {
+		newServiceErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, segment)
+}
+
+// @Summary List Segments
+// @Description Archived segments are listed only when filtered by state.
+// @Tags segment
+// @ID list-segments
+// @Produce  json
+// @Param input query structures.SegmentsFilter false "Pagination and filters"
+// @Success 200 {object} validGetSegmentsResponse
+// @Failure 400,404 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /segments/list [get]
+func (h *Handler) getSegments(c *gin.Context) {
+	var input structures.SegmentsFilter
+	if err := c.BindQuery(&input); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if input.Limit == 0 {
+		input.Limit = defaultSegmentsLimit
+	}
+
+	if input.Limit < 0 || input.Limit > maxSegmentsLimit {
+		NewErrorResponse(c, http.StatusBadRequest, "invalid limit")
+		return
+	}
+
+	if input.Offset < 0 {
+		NewErrorResponse(c, http.StatusBadRequest, "invalid offset")
+		return
+	}
+
+	if input.State != nil {
+		if err := utils.ValidateSegmentState(*input.State); err != nil {
+			NewErrorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	segments, total, err := h.services.Segment.List(input)
+	if err != nil {
+		NewErrorResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, validGetSegmentsResponse{
+		Segments: segments,
+		Total:    total,
+		Limit:    input.Limit,
+		Offset:   input.Offset,
+	})
+}
+
+// @Summary Rename Segment
+// @Description Memberships and history are kept, history of the old and new slug is linked by segment id,
+// @Description expressions referring to the segment follow the new slug
+// @Tags segment
+// @ID rename-segment
+// @Accept  json
+// @Produce  json
+// @Param slug path string true "Slug of segment"
+// @Param input body structures.SegmentRename true "New slug of segment"
+// @Success 200 {object} validRenameSegmentResponse
+// @Failure 400,404,409 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /segments/{slug}/rename [post]
+func (h *Handler) renameSegment(c *gin.Context) {
+	var input structures.SegmentRename
+	if err := c.BindJSON(&input); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	input.Slug = c.Param("slug")
+	if err := utils.ValidateSlug(input.Slug); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := utils.ValidateSlug(input.NewSlug); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error()+" (new slug: "+input.NewSlug+")")
+		return
+	}
+
+	slug, err := h.services.Segment.Rename(input)
+	if err != nil {
+		newServiceErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, validRenameSegmentResponse{
+		Segment:         slug,
+		PreviousSegment: input.Slug,
+	})
+}
+
+// @Summary Clone Segment
+// @Description Creates a segment with the settings, tags, parent, variants, expression and targeting of the segment, keeping its salt so the percentage rollout of a segment outside of a layer reaches the same users.
+// @Description The clone is left out of the layer of the segment, so the clone of a layered segment buckets users by its salt and reaches other users.
+// @Description The clone of an archived segment is a draft.
+// @Description With copy_members the explicit memberships are copied as well and recorded in history as one change set,
+// @Description with copy_expirations they keep their expirations. Expired memberships are not copied.
+// @Description Copied members beyond the max_members of the segment fail with 409 and the code segment_full,
+// @Description copied members breaking a max_tagged rule on its tags fail with 409 and the code rule_violation.
+// @Tags segment
+// @ID clone-segment
+// @Accept  json
+// @Produce  json
+// @Param slug path string true "Slug of segment"
+// @Param input body structures.SegmentClone true "Slug of clone and what to copy"
+// @Success 200 {object} structures.SegmentCloneResult
+// @Failure 400,404,409 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /segments/{slug}/clone [post]
+func (h *Handler) cloneSegment(c *gin.Context) {
+	var input structures.SegmentClone
+	if err := c.BindJSON(&input); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	input.Slug = c.Param("slug")
+	if err := utils.ValidateSlug(input.Slug); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := utils.ValidateSlug(input.NewSlug); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error()+" (new slug: "+input.NewSlug+")")
+		return
+	}
+
+	if input.CopyExpirations && !input.CopyMembers {
+		NewErrorResponse(c, http.StatusBadRequest, "copy_expirations needs copy_members")
+		return
+	}
+
+	result, err := h.services.Segment.Clone(input)
+	if err != nil {
+		newServiceErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// @Summary Set Segment State
+// @Description Paused segments keep their memberships but are not given to users.
+// @Description Archived segments are read-only and hidden from the list, they are restored as paused.
+// @Description Allowed transitions: draft -> active, active <-> paused, any -> archived, archived -> paused.
+// @Tags segment
+// @ID set-segment-state
+// @Accept  json
+// @Produce  json
+// @Param slug path string true "Slug of segment"
+// @Param input body structures.SegmentStateChange true "New state of segment"
+// @Success 200 {object} structures.Segment
+// @Failure 400,404 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /segments/{slug}/state [post]
+func (h *Handler) setSegmentState(c *gin.Context) {
+	var input structures.SegmentStateChange
+	if err := c.BindJSON(&input); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	input.Slug = c.Param("slug")
+	if err := utils.ValidateSlug(input.Slug); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := utils.ValidateSegmentState(input.State); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	segment, err := h.services.Segment.SetState(input)
+	if err != nil {
+		newServiceErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, segment)
+}
+
+// @Summary Get Segment States
+// @Description State transitions of the segment, oldest first
+// @Tags segment
+// @ID get-segment-states
+// @Produce  json
+// @Param slug path string true "Slug of segment"
+// @Success 200 {object} validGetSegmentStatesResponse
+// @Failure 400,404 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /segments/{slug}/states [get]
+func (h *Handler) getSegmentStates(c *gin.Context) {
+	input := structures.Segment{Slug: c.Param("slug")}
+
+	if err := utils.ValidateSlug(input.Slug); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	transitions, err := h.services.Segment.GetStateHistory(input)
+	if err != nil {
+		newServiceErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, validGetSegmentStatesResponse{
+		Segment:     input.Slug,
+		Transitions: transitions,
+	})
+}
+
+// @Summary Preview Segment Schedule
+// @Description Next intervals of activity of the segment by its schedule, clipped to its activation window.
+// @Description Times are in the time zone of the schedule.
+// @Tags segment
+// @ID get-segment-schedule
+// @Produce  json
+// @Param slug path string true "Slug of segment"
+// @Param count query integer false "Number of intervals, 5 by default"
+// @Success 200 {object} validGetSegmentScheduleResponse
+// @Failure 400,404 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /segments/{slug}/schedule [get]
+func (h *Handler) getSegmentSchedule(c *gin.Context) {
+	input := structures.Segment{Slug: c.Param("slug")}
+
+	if err := utils.ValidateSlug(input.Slug); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	count := defaultScheduleIntervals
+	if value := c.Query("count"); value != "" {
+		var err error
+		count, err = strconv.Atoi(value)
+		if err != nil || count < 1 || count > maxScheduleIntervals {
+			NewErrorResponse(c, http.StatusBadRequest, "invalid count")
+			return
+		}
+	}
+
+	segment, err := h.services.Segment.Get(input)
+	if err != nil {
+		newServiceErrorResponse(c, err)
+		return
+	}
+
+	intervals, err := utils.NextActivityIntervals(segment, time.Now(), count)
+	if err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, validGetSegmentScheduleResponse{
+		Segment:   segment.Slug,
+		Schedule:  *segment.Schedule,
+		Intervals: intervals,
 	})
 }
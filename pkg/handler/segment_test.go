@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang/mock/gomock"
@@ -20,6 +21,12 @@ func TestHandler_createSegment(t *testing.T) {
 
 	var validPercentage = 77
 	var invalidPercentage = 101
+	var validBasisPoints = 1250
+	var xxhash = "xxhash"
+	var layer = "checkout"
+	var parent = "vip"
+	var expression = "premium AND NOT churn_risk"
+	var targeting = `city in ["Moscow", "SPb"] && semver(app_version) >= "7.0"`
 
 	tests := []struct {
 		name                 string
@@ -41,6 +48,94 @@ func TestHandler_createSegment(t *testing.T) {
 			expectedStatusCode:   200,
 			expectedResponseBody: `{"slug":"example-slug"}`,
 		},
+		{
+			name:      "WithParent",
+			inputBody: `{"slug": "vip-moscow", "parent": "vip"}`,
+			inputSegment: structures.Segment{
+				Slug:   "vip-moscow",
+				Parent: &parent,
+			},
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().Create(segment).Return("vip-moscow", nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"slug":"vip-moscow"}`,
+		},
+		{
+			name:                 "InvalidParent",
+			inputBody:            `{"slug": "vip-moscow", "parent": "vip-"}`,
+			mockBehavior:         func(s *mock_service.MockSegment, segment structures.Segment) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid slug (parent: vip-)"}`,
+		},
+		{
+			name:      "Composite",
+			inputBody: `{"slug": "premium_retained", "expression": "premium AND NOT churn_risk"}`,
+			inputSegment: structures.Segment{
+				Slug:       "premium_retained",
+				Expression: &expression,
+			},
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().Create(segment).Return("premium_retained", nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"slug":"premium_retained"}`,
+		},
+		{
+			name:                 "CompositeWithPercentage",
+			inputBody:            `{"slug": "premium_retained", "expression": "premium AND NOT churn_risk", "percentage": 77}`,
+			mockBehavior:         func(s *mock_service.MockSegment, segment structures.Segment) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"composite segment cannot have a percentage"}`,
+		},
+		{
+			name:                 "InvalidExpression",
+			inputBody:            `{"slug": "premium_retained", "expression": "premium AND NOT"}`,
+			mockBehavior:         func(s *mock_service.MockSegment, segment structures.Segment) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid expression, it ends too early"}`,
+		},
+		{
+			name:      "UnknownSegmentInExpression",
+			inputBody: `{"slug": "premium_retained", "expression": "premium AND NOT churn_risk"}`,
+			inputSegment: structures.Segment{
+				Slug:       "premium_retained",
+				Expression: &expression,
+			},
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().Create(segment).Return("", structures.SegmentNotFoundError{Slug: "churn_risk"})
+			},
+			expectedStatusCode:   404,
+			expectedResponseBody: `{"message":"segment with slug churn_risk does not exist"}`,
+		},
+		{
+			name:      "Targeting",
+			inputBody: `{"slug": "new-checkout", "percentage": 77, "targeting": "city in [\"Moscow\", \"SPb\"] && semver(app_version) >= \"7.0\""}`,
+			inputSegment: structures.Segment{
+				Slug:       "new-checkout",
+				Percentage: &validPercentage,
+				Targeting:  &targeting,
+			},
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().Create(segment).Return("new-checkout", nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"slug":"new-checkout"}`,
+		},
+		{
+			name:                 "TargetingWithoutPercentage",
+			inputBody:            `{"slug": "new-checkout", "targeting": "city == \"Moscow\""}`,
+			mockBehavior:         func(s *mock_service.MockSegment, segment structures.Segment) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"targeting needs a percentage, use 100 to reach every matching user"}`,
+		},
+		{
+			name:                 "InvalidTargeting",
+			inputBody:            `{"slug": "new-checkout", "percentage": 77, "targeting": "semver(app_version) >= \"7.x\""}`,
+			mockBehavior:         func(s *mock_service.MockSegment, segment structures.Segment) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid targeting, invalid version \"7.x\""}`,
+		},
 		{
 			name:      "EmptySlug",
 			inputBody: `{"slug": ""}`,
@@ -91,6 +186,156 @@ func TestHandler_createSegment(t *testing.T) {
 			expectedStatusCode:   400,
 			expectedResponseBody: `{"message":"invalid percentage"}`,
 		},
+		{
+			name:      "BucketingV2",
+			inputBody: fmt.Sprintf(`{"slug": "example", "bucketing_version": 2, "basis_points": %d, "hash_function": "xxhash"}`, validBasisPoints),
+			inputSegment: structures.Segment{
+				Slug:             "example",
+				BucketingVersion: 2,
+				BasisPoints:      &validBasisPoints,
+				HashFunction:     &xxhash,
+			},
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().Create(segment).Return("example", nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"slug":"example"}`,
+		},
+		{
+			name:      "LayerNotFound",
+			inputBody: fmt.Sprintf(`{"slug": "example", "percentage": %d, "layer": "checkout"}`, validPercentage),
+			inputSegment: structures.Segment{
+				Slug:       "example",
+				Percentage: &validPercentage,
+				Layer:      &layer,
+			},
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().Create(segment).Return("", structures.LayerNotFoundError{Slug: *segment.Layer})
+			},
+			expectedStatusCode:   404,
+			expectedResponseBody: `{"message":"layer with slug checkout does not exist"}`,
+		},
+		{
+			name:      "LayerFull",
+			inputBody: fmt.Sprintf(`{"slug": "example", "percentage": %d, "layer": "checkout"}`, validPercentage),
+			inputSegment: structures.Segment{
+				Slug:       "example",
+				Percentage: &validPercentage,
+				Layer:      &layer,
+			},
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().Create(segment).Return("", structures.ValidationError{Message: "layer checkout has no free range of 7700 basis points"})
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"layer checkout has no free range of 7700 basis points"}`,
+		},
+		{
+			name:      "InvalidLayer",
+			inputBody: `{"slug": "example", "layer": "checkout-"}`,
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid slug (layer: checkout-)"}`,
+		},
+		{
+			name:      "Variants",
+			inputBody: `{"slug": "example", "variants": [{"name": "control", "weight": 50}, {"name": "a", "weight": 25}, {"name": "b", "weight": 25}]}`,
+			inputSegment: structures.Segment{
+				Slug:     "example",
+				Variants: []structures.SegmentVariant{{Name: "control", Weight: 50}, {Name: "a", Weight: 25}, {Name: "b", Weight: 25}},
+			},
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().Create(segment).Return("example", nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"slug":"example"}`,
+		},
+		{
+			name:      "InvalidVariants",
+			inputBody: `{"slug": "example", "variants": [{"name": "control", "weight": 50}, {"name": "a", "weight": 0}]}`,
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid weight of variant a"}`,
+		},
+		{
+			name:      "Draft",
+			inputBody: `{"slug": "example", "state": "draft"}`,
+			inputSegment: structures.Segment{
+				Slug:  "example",
+				State: "draft",
+			},
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().Create(segment).Return("example", nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"slug":"example"}`,
+		},
+		{
+			name:      "InvalidState",
+			inputBody: `{"slug": "example", "state": "paused"}`,
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"segment can only be created as draft or active"}`,
+		},
+		{
+			name:      "EmptyWindow",
+			inputBody: `{"slug": "example", "starts_at": "2023-09-15T00:00:00+03:00", "ends_at": "2023-09-01T00:00:00+03:00"}`,
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"starts_at must be before ends_at"}`,
+		},
+		{
+			name:      "InvalidMaxMembers",
+			inputBody: `{"slug": "example", "max_members": 0}`,
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid max_members"}`,
+		},
+		{
+			name:      "DefaultBeyondMaxTTL",
+			inputBody: `{"slug": "example", "default_ttl": "30d", "max_ttl": "14d"}`,
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"default_ttl must not exceed max_ttl"}`,
+		},
+		{
+			name:      "InvalidSchedule",
+			inputBody: `{"slug": "example", "schedule": {"timezone": "Europe/Moscow", "intervals": [{"days": ["weekend"], "start": "18:00", "end": "23:00"}]}}`,
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid day weekend, use mon, tue, wed, thu, fri, sat or sun"}`,
+		},
+		{
+			name:      "BucketingV2Percentage",
+			inputBody: fmt.Sprintf(`{"slug": "example", "bucketing_version": 2, "percentage": %d}`, validPercentage),
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"percentage is not supported by bucketing version 2, use basis points"}`,
+		},
+		{
+			name:      "BasisPointsWithoutV2",
+			inputBody: fmt.Sprintf(`{"slug": "example", "basis_points": %d}`, validBasisPoints),
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"basis points require bucketing version 2"}`,
+		},
 		{
 			name:      "InvalidJSON",
 			inputBody: `{"slug":example-slug"}`,
@@ -147,6 +392,7 @@ func TestHandler_deleteSegment(t *testing.T) {
 
 	tests := []struct {
 		name                string
+		query               string
 		inputBody           string
 		inputSegment        structures.Segment
 		mockBehavior        mockBehavior
@@ -160,10 +406,80 @@ func TestHandler_deleteSegment(t *testing.T) {
 				Slug: "example-slug",
 			},
 			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
-				s.EXPECT().Delete(segment).Return("example-slug", nil)
+				changeSet := 7
+				s.EXPECT().Delete(segment, "").Return(structures.SegmentDeletion{Slug: "example-slug", ChangeSet: &changeSet}, nil)
+			},
+			expectedStatusCode:  200,
+			expectedRequestBody: `{"slug":"example-slug","change_set":7}`,
+		},
+		{
+			name:      "DryRun",
+			query:     "?dry_run=true",
+			inputBody: `{"slug": "example-slug"}`,
+			inputSegment: structures.Segment{
+				Slug: "example-slug",
+			},
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().DeleteDryRun(segment, "").Return(structures.SegmentDeletion{
+					Slug:            "example-slug",
+					DryRun:          true,
+					AffectedUsers:   1,
+					Users:           []int{1},
+					PercentageUsers: []int{},
+					History:         []structures.HistoryEntry{{UserId: 1, Segment: "example-slug", Operation: "remove", Reason: "segment_deleted"}},
+				}, nil)
+			},
+			expectedStatusCode:  200,
+			expectedRequestBody: `{"slug":"example-slug","dry_run":true,"affected_users":1,"users":[1],"percentage_users":[],"history":[{"user_id":1,"slug":"example-slug","operation":"remove","reason":"segment_deleted"}]}`,
+		},
+		{
+			name:      "DryRunNotFound",
+			query:     "?dry_run=1",
+			inputBody: `{"slug": "example-slug"}`,
+			inputSegment: structures.Segment{
+				Slug: "example-slug",
+			},
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().DeleteDryRun(segment, "").Return(structures.SegmentDeletion{}, structures.SegmentNotFoundError{Slug: "example-slug"})
+			},
+			expectedStatusCode:  404,
+			expectedRequestBody: `{"message":"segment with slug example-slug does not exist"}`,
+		},
+		{
+			name:      "Children",
+			query:     "?children=reparent",
+			inputBody: `{"slug": "example-slug"}`,
+			inputSegment: structures.Segment{
+				Slug: "example-slug",
+			},
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().Delete(segment, "reparent").Return(structures.SegmentDeletion{Slug: "example-slug", Children: []string{"example-child"}}, nil)
 			},
 			expectedStatusCode:  200,
-			expectedRequestBody: `{"slug":"example-slug"}`,
+			expectedRequestBody: `{"slug":"example-slug","children":["example-child"]}`,
+		},
+		{
+			name:      "ChildrenUndecided",
+			inputBody: `{"slug": "example-slug"}`,
+			inputSegment: structures.Segment{
+				Slug: "example-slug",
+			},
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().Delete(segment, "").Return(structures.SegmentDeletion{}, structures.ValidationError{Message: "segment example-slug has children, use children=detach or children=reparent"})
+			},
+			expectedStatusCode:  400,
+			expectedRequestBody: `{"message":"segment example-slug has children, use children=detach or children=reparent"}`,
+		},
+		{
+			name:      "InvalidChildren",
+			query:     "?children=delete",
+			inputBody: `{"slug": "example-slug"}`,
+			inputSegment: structures.Segment{
+				Slug: "example-slug",
+			},
+			mockBehavior:        func(s *mock_service.MockSegment, segment structures.Segment) {},
+			expectedStatusCode:  400,
+			expectedRequestBody: `{"message":"invalid children, use detach or reparent"}`,
 		},
 		{
 			name:      "EmptySlug",
@@ -208,7 +524,7 @@ func TestHandler_deleteSegment(t *testing.T) {
 				Slug: "example-slug",
 			},
 			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
-				s.EXPECT().Delete(segment).Return("example-slug", errors.New("service fail"))
+				s.EXPECT().Delete(segment, "").Return(structures.SegmentDeletion{}, errors.New("service fail"))
 			},
 			expectedStatusCode:  500,
 			expectedRequestBody: `{"message":"service fail"}`,
@@ -230,7 +546,7 @@ func TestHandler_deleteSegment(t *testing.T) {
 			r.DELETE("/segments/", h.deleteSegment)
 
 			w := httptest.NewRecorder()
-			req := httptest.NewRequest("DELETE", "/segments/", bytes.NewBufferString(testCase.inputBody))
+			req := httptest.NewRequest("DELETE", "/segments/"+testCase.query, bytes.NewBufferString(testCase.inputBody))
 
 			r.ServeHTTP(w, req)
 
@@ -239,3 +555,766 @@ func TestHandler_deleteSegment(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_getSegment(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockSegment, segment structures.Segment)
+
+	var percentage = 50
+	var owner = "example-team"
+
+	tests := []struct {
+		name                 string
+		slug                 string
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name: "OK",
+			slug: "example-slug",
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().Get(segment).Return(structures.Segment{
+					Slug:       "example-slug",
+					Percentage: &percentage,
+					Owner:      &owner,
+				}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"slug":"example-slug","percentage":50,"display_name":null,"description":null,"owner":"example-team"}`,
+		},
+		{
+			name: "InvalidSlug",
+			slug: "iueefiuwq-",
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid slug"}`,
+		},
+		{
+			name: "NotFound",
+			slug: "example-slug",
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().Get(segment).Return(structures.Segment{}, structures.SegmentNotFoundError{Slug: segment.Slug})
+			},
+			expectedStatusCode:   404,
+			expectedResponseBody: `{"message":"segment with slug example-slug does not exist"}`,
+		},
+		{
+			name: "ServiceFail",
+			slug: "example-slug",
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().Get(segment).Return(structures.Segment{}, errors.New("service fail"))
+			},
+			expectedStatusCode:   500,
+			expectedResponseBody: `{"message":"service fail"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockSegment(ctl)
+			testCase.mockBehavior(mock, structures.Segment{Slug: testCase.slug})
+
+			services := &service.Service{Segment: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.GET("/segments/:slug", h.getSegment)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/segments/"+testCase.slug, nil)
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
+
+func TestHandler_getSegments(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockSegment)
+
+	var owner = "example-team"
+
+	tests := []struct {
+		name                 string
+		query                string
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name:  "OK",
+			query: "",
+			mockBehavior: func(s *mock_service.MockSegment) {
+				s.EXPECT().List(structures.SegmentsFilter{Limit: 20}).
+					Return([]structures.Segment{{Slug: "example-slug"}}, 1, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"segments":[{"slug":"example-slug","percentage":null,"display_name":null,"description":null,"owner":null}],"total":1,"limit":20,"offset":0}`,
+		},
+		{
+			name:  "Filtered",
+			query: "?limit=5&offset=10&owner=example-team",
+			mockBehavior: func(s *mock_service.MockSegment) {
+				s.EXPECT().List(structures.SegmentsFilter{Limit: 5, Offset: 10, Owner: &owner}).
+					Return([]structures.Segment{}, 10, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"segments":[],"total":10,"limit":5,"offset":10}`,
+		},
+		{
+			name:  "InvalidLimit",
+			query: "?limit=1000",
+			mockBehavior: func(s *mock_service.MockSegment) {
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid limit"}`,
+		},
+		{
+			name:  "InvalidOffset",
+			query: "?offset=-1",
+			mockBehavior: func(s *mock_service.MockSegment) {
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid offset"}`,
+		},
+		{
+			name:  "ServiceFail",
+			query: "",
+			mockBehavior: func(s *mock_service.MockSegment) {
+				s.EXPECT().List(structures.SegmentsFilter{Limit: 20}).
+					Return(nil, 0, errors.New("service fail"))
+			},
+			expectedStatusCode:   500,
+			expectedResponseBody: `{"message":"service fail"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockSegment(ctl)
+			testCase.mockBehavior(mock)
+
+			services := &service.Service{Segment: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.GET("/segments/list", h.getSegments)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/segments/list"+testCase.query, nil)
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
+
+func TestHandler_renameSegment(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockSegment, rename structures.SegmentRename)
+
+	tests := []struct {
+		name                 string
+		slug                 string
+		inputBody            string
+		inputRename          structures.SegmentRename
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name:        "OK",
+			slug:        "example-slug",
+			inputBody:   `{"new_slug": "example-slug-v2"}`,
+			inputRename: structures.SegmentRename{Slug: "example-slug", NewSlug: "example-slug-v2"},
+			mockBehavior: func(s *mock_service.MockSegment, rename structures.SegmentRename) {
+				s.EXPECT().Rename(rename).Return("example-slug-v2", nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"slug":"example-slug-v2","previous_slug":"example-slug"}`,
+		},
+		{
+			name:      "EmptyNewSlug",
+			slug:      "example-slug",
+			inputBody: `{}`,
+			mockBehavior: func(s *mock_service.MockSegment, rename structures.SegmentRename) {
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"Key: 'SegmentRename.NewSlug' Error:Field validation for 'NewSlug' failed on the 'required' tag"}`,
+		},
+		{
+			name:      "InvalidNewSlug",
+			slug:      "example-slug",
+			inputBody: `{"new_slug": "example-slug-"}`,
+			mockBehavior: func(s *mock_service.MockSegment, rename structures.SegmentRename) {
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid slug (new slug: example-slug-)"}`,
+		},
+		{
+			name:        "NotFound",
+			slug:        "example-slug",
+			inputBody:   `{"new_slug": "example-slug-v2"}`,
+			inputRename: structures.SegmentRename{Slug: "example-slug", NewSlug: "example-slug-v2"},
+			mockBehavior: func(s *mock_service.MockSegment, rename structures.SegmentRename) {
+				s.EXPECT().Rename(rename).Return("", structures.SegmentNotFoundError{Slug: rename.Slug})
+			},
+			expectedStatusCode:   404,
+			expectedResponseBody: `{"message":"segment with slug example-slug does not exist"}`,
+		},
+		{
+			name:        "Archived",
+			slug:        "example-slug",
+			inputBody:   `{"new_slug": "example-slug-v2"}`,
+			inputRename: structures.SegmentRename{Slug: "example-slug", NewSlug: "example-slug-v2"},
+			mockBehavior: func(s *mock_service.MockSegment, rename structures.SegmentRename) {
+				s.EXPECT().Rename(rename).Return("", structures.SegmentArchivedError{Slug: rename.Slug})
+			},
+			expectedStatusCode:   409,
+			expectedResponseBody: `{"message":"segment with slug example-slug is archived"}`,
+		},
+		{
+			name:        "ServiceFail",
+			slug:        "example-slug",
+			inputBody:   `{"new_slug": "example-slug-v2"}`,
+			inputRename: structures.SegmentRename{Slug: "example-slug", NewSlug: "example-slug-v2"},
+			mockBehavior: func(s *mock_service.MockSegment, rename structures.SegmentRename) {
+				s.EXPECT().Rename(rename).Return("", errors.New("service fail"))
+			},
+			expectedStatusCode:   500,
+			expectedResponseBody: `{"message":"service fail"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockSegment(ctl)
+			testCase.mockBehavior(mock, testCase.inputRename)
+
+			services := &service.Service{Segment: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.POST("/segments/:slug/rename", h.renameSegment)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/segments/"+testCase.slug+"/rename", bytes.NewBufferString(testCase.inputBody))
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
+
+func TestHandler_cloneSegment(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockSegment, clone structures.SegmentClone)
+
+	changeSet := 7
+
+	tests := []struct {
+		name                 string
+		inputBody            string
+		inputClone           structures.SegmentClone
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name:       "OK",
+			inputBody:  `{"new_slug": "example-slug-v2"}`,
+			inputClone: structures.SegmentClone{Slug: "example-slug", NewSlug: "example-slug-v2"},
+			mockBehavior: func(s *mock_service.MockSegment, clone structures.SegmentClone) {
+				s.EXPECT().Clone(clone).Return(structures.SegmentCloneResult{Slug: clone.NewSlug, Source: clone.Slug}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"slug":"example-slug-v2","source":"example-slug","members":0}`,
+		},
+		{
+			name:       "Members",
+			inputBody:  `{"new_slug": "example-slug-v2", "copy_members": true, "copy_expirations": true}`,
+			inputClone: structures.SegmentClone{Slug: "example-slug", NewSlug: "example-slug-v2", CopyMembers: true, CopyExpirations: true},
+			mockBehavior: func(s *mock_service.MockSegment, clone structures.SegmentClone) {
+				s.EXPECT().Clone(clone).Return(structures.SegmentCloneResult{Slug: clone.NewSlug, Source: clone.Slug, Members: 1500, ChangeSet: &changeSet}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"slug":"example-slug-v2","source":"example-slug","members":1500,"change_set":7}`,
+		},
+		{
+			name:                 "ExpirationsWithoutMembers",
+			inputBody:            `{"new_slug": "example-slug-v2", "copy_expirations": true}`,
+			mockBehavior:         func(s *mock_service.MockSegment, clone structures.SegmentClone) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"copy_expirations needs copy_members"}`,
+		},
+		{
+			name:                 "InvalidNewSlug",
+			inputBody:            `{"new_slug": "example-"}`,
+			mockBehavior:         func(s *mock_service.MockSegment, clone structures.SegmentClone) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid slug (new slug: example-)"}`,
+		},
+		{
+			name:       "NotFound",
+			inputBody:  `{"new_slug": "example-slug-v2"}`,
+			inputClone: structures.SegmentClone{Slug: "example-slug", NewSlug: "example-slug-v2"},
+			mockBehavior: func(s *mock_service.MockSegment, clone structures.SegmentClone) {
+				s.EXPECT().Clone(clone).Return(structures.SegmentCloneResult{}, structures.SegmentNotFoundError{Slug: clone.Slug})
+			},
+			expectedStatusCode:   404,
+			expectedResponseBody: `{"message":"segment with slug example-slug does not exist"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockSegment(ctl)
+			testCase.mockBehavior(mock, testCase.inputClone)
+
+			services := &service.Service{Segment: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.POST("/segments/:slug/clone", h.cloneSegment)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/segments/example-slug/clone", bytes.NewBufferString(testCase.inputBody))
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
+
+func TestHandler_updateSegment(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockSegment, update structures.SegmentUpdate)
+
+	var percentage = 30
+
+	tests := []struct {
+		name                 string
+		slug                 string
+		inputBody            string
+		inputUpdate          structures.SegmentUpdate
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name:        "OK",
+			slug:        "example-slug",
+			inputBody:   `{"percentage": 30}`,
+			inputUpdate: structures.SegmentUpdate{Slug: "example-slug", Percentage: &percentage},
+			mockBehavior: func(s *mock_service.MockSegment, update structures.SegmentUpdate) {
+				s.EXPECT().Update(update).Return(structures.Segment{Slug: "example-slug", Percentage: &percentage}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"slug":"example-slug","percentage":30,"display_name":null,"description":null,"owner":null}`,
+		},
+		{
+			name:      "InvalidPercentage",
+			slug:      "example-slug",
+			inputBody: `{"percentage": 101}`,
+			mockBehavior: func(s *mock_service.MockSegment, update structures.SegmentUpdate) {
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid percentage"}`,
+		},
+		{
+			name:      "InvalidVariants",
+			slug:      "example-slug",
+			inputBody: `{"variants": [{"name": "control", "weight": 50}]}`,
+			mockBehavior: func(s *mock_service.MockSegment, update structures.SegmentUpdate) {
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"a segment needs at least two variants"}`,
+		},
+		{
+			name:      "InvalidExpression",
+			slug:      "example-slug",
+			inputBody: `{"expression": "(beta OR staff AND android_new_ui"}`,
+			mockBehavior: func(s *mock_service.MockSegment, update structures.SegmentUpdate) {
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid expression, missing )"}`,
+		},
+		{
+			name:      "InvalidTargeting",
+			slug:      "example-slug",
+			inputBody: `{"targeting": "app_version >= \"7.0\""}`,
+			mockBehavior: func(s *mock_service.MockSegment, update structures.SegmentUpdate) {
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid targeting, \u003e= compares numbers, use semver(app_version) for versions"}`,
+		},
+		{
+			name:        "ClearEndsAt",
+			slug:        "example-slug",
+			inputBody:   `{"clear_ends_at": true}`,
+			inputUpdate: structures.SegmentUpdate{Slug: "example-slug", ClearEndsAt: true},
+			mockBehavior: func(s *mock_service.MockSegment, update structures.SegmentUpdate) {
+				s.EXPECT().Update(update).Return(structures.Segment{Slug: "example-slug", Percentage: &percentage}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"slug":"example-slug","percentage":30,"display_name":null,"description":null,"owner":null}`,
+		},
+		{
+			name:      "SetAndClearStartsAt",
+			slug:      "example-slug",
+			inputBody: `{"starts_at": "2023-09-01T00:00:00+03:00", "clear_starts_at": true}`,
+			mockBehavior: func(s *mock_service.MockSegment, update structures.SegmentUpdate) {
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"starts_at cannot be set and cleared at once"}`,
+		},
+		{
+			name:      "InvalidBucketingVersion",
+			slug:      "example-slug",
+			inputBody: `{"bucketing_version": 3}`,
+			mockBehavior: func(s *mock_service.MockSegment, update structures.SegmentUpdate) {
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid bucketing version"}`,
+		},
+		{
+			name:      "InvalidBasisPoints",
+			slug:      "example-slug",
+			inputBody: `{"basis_points": 10001}`,
+			mockBehavior: func(s *mock_service.MockSegment, update structures.SegmentUpdate) {
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid basis points"}`,
+		},
+		{
+			name:      "UnknownHashFunction",
+			slug:      "example-slug",
+			inputBody: `{"hash_function": "md5"}`,
+			mockBehavior: func(s *mock_service.MockSegment, update structures.SegmentUpdate) {
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"unknown hash function md5"}`,
+		},
+		{
+			name:        "ValidationFail",
+			slug:        "example-slug",
+			inputBody:   `{"percentage": 30}`,
+			inputUpdate: structures.SegmentUpdate{Slug: "example-slug", Percentage: &percentage},
+			mockBehavior: func(s *mock_service.MockSegment, update structures.SegmentUpdate) {
+				s.EXPECT().Update(update).Return(structures.Segment{}, structures.ValidationError{Message: "percentage is not supported by bucketing version 2, use basis points"})
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"percentage is not supported by bucketing version 2, use basis points"}`,
+		},
+		{
+			name:      "InvalidSlug",
+			slug:      "example-slug-",
+			inputBody: `{"percentage": 30}`,
+			mockBehavior: func(s *mock_service.MockSegment, update structures.SegmentUpdate) {
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid slug"}`,
+		},
+		{
+			name:        "NotFound",
+			slug:        "example-slug",
+			inputBody:   `{"percentage": 30}`,
+			inputUpdate: structures.SegmentUpdate{Slug: "example-slug", Percentage: &percentage},
+			mockBehavior: func(s *mock_service.MockSegment, update structures.SegmentUpdate) {
+				s.EXPECT().Update(update).Return(structures.Segment{}, structures.SegmentNotFoundError{Slug: update.Slug})
+			},
+			expectedStatusCode:   404,
+			expectedResponseBody: `{"message":"segment with slug example-slug does not exist"}`,
+		},
+		{
+			name:        "ServiceFail",
+			slug:        "example-slug",
+			inputBody:   `{"percentage": 30}`,
+			inputUpdate: structures.SegmentUpdate{Slug: "example-slug", Percentage: &percentage},
+			mockBehavior: func(s *mock_service.MockSegment, update structures.SegmentUpdate) {
+				s.EXPECT().Update(update).Return(structures.Segment{}, errors.New("service fail"))
+			},
+			expectedStatusCode:   500,
+			expectedResponseBody: `{"message":"service fail"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockSegment(ctl)
+			testCase.mockBehavior(mock, testCase.inputUpdate)
+
+			services := &service.Service{Segment: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.PATCH("/segments/:slug", h.updateSegment)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("PATCH", "/segments/"+testCase.slug, bytes.NewBufferString(testCase.inputBody))
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
+
+func TestHandler_setSegmentState(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockSegment, change structures.SegmentStateChange)
+
+	comment := "incident"
+
+	tests := []struct {
+		name                 string
+		slug                 string
+		inputBody            string
+		inputChange          structures.SegmentStateChange
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name:        "OK",
+			slug:        "example",
+			inputBody:   `{"state": "paused", "comment": "incident"}`,
+			inputChange: structures.SegmentStateChange{Slug: "example", State: "paused", Comment: &comment},
+			mockBehavior: func(s *mock_service.MockSegment, change structures.SegmentStateChange) {
+				s.EXPECT().SetState(change).Return(structures.Segment{Id: 1, Slug: "example", State: "paused"}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"id":1,"slug":"example","percentage":null,"display_name":null,"description":null,"owner":null,"state":"paused"}`,
+		},
+		{
+			name:      "EmptyState",
+			slug:      "example",
+			inputBody: `{}`,
+			mockBehavior: func(s *mock_service.MockSegment, change structures.SegmentStateChange) {
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"Key: 'SegmentStateChange.State' Error:Field validation for 'State' failed on the 'required' tag"}`,
+		},
+		{
+			name:      "InvalidState",
+			slug:      "example",
+			inputBody: `{"state": "deleted"}`,
+			mockBehavior: func(s *mock_service.MockSegment, change structures.SegmentStateChange) {
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid state"}`,
+		},
+		{
+			name:        "InvalidTransition",
+			slug:        "example",
+			inputBody:   `{"state": "active"}`,
+			inputChange: structures.SegmentStateChange{Slug: "example", State: "active"},
+			mockBehavior: func(s *mock_service.MockSegment, change structures.SegmentStateChange) {
+				s.EXPECT().SetState(change).Return(structures.Segment{}, structures.ValidationError{Message: "segment cannot go from archived to active"})
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"segment cannot go from archived to active"}`,
+		},
+		{
+			name:        "NotFound",
+			slug:        "example",
+			inputBody:   `{"state": "paused"}`,
+			inputChange: structures.SegmentStateChange{Slug: "example", State: "paused"},
+			mockBehavior: func(s *mock_service.MockSegment, change structures.SegmentStateChange) {
+				s.EXPECT().SetState(change).Return(structures.Segment{}, structures.SegmentNotFoundError{Slug: change.Slug})
+			},
+			expectedStatusCode:   404,
+			expectedResponseBody: `{"message":"segment with slug example does not exist"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockSegment(ctl)
+			testCase.mockBehavior(mock, testCase.inputChange)
+
+			services := &service.Service{Segment: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.POST("/segments/:slug/state", h.setSegmentState)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/segments/"+testCase.slug+"/state", bytes.NewBufferString(testCase.inputBody))
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
+
+func TestHandler_getSegmentStates(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockSegment, segment structures.Segment)
+
+	changedAt := time.Date(2023, 8, 28, 20, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name                 string
+		slug                 string
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name: "OK",
+			slug: "example",
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().GetStateHistory(segment).Return([]structures.SegmentStateTransition{
+					{From: "active", To: "paused", ChangedAt: changedAt},
+				}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"slug":"example","transitions":[{"from":"active","to":"paused","changed_at":"2023-08-28T20:00:00Z"}]}`,
+		},
+		{
+			name:                 "InvalidSlug",
+			slug:                 "example-",
+			mockBehavior:         func(s *mock_service.MockSegment, segment structures.Segment) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid slug"}`,
+		},
+		{
+			name: "NotFound",
+			slug: "example",
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().GetStateHistory(segment).Return(nil, structures.SegmentNotFoundError{Slug: segment.Slug})
+			},
+			expectedStatusCode:   404,
+			expectedResponseBody: `{"message":"segment with slug example does not exist"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockSegment(ctl)
+			testCase.mockBehavior(mock, structures.Segment{Slug: testCase.slug})
+
+			services := &service.Service{Segment: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.GET("/segments/:slug/states", h.getSegmentStates)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/segments/"+testCase.slug+"/states", nil)
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
+
+func TestHandler_getSegmentSchedule(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockSegment, segment structures.Segment)
+
+	endedAt := time.Date(2023, 8, 28, 20, 0, 0, 0, time.UTC)
+	schedule := structures.SegmentSchedule{
+		Timezone:  "Europe/Moscow",
+		Intervals: []structures.ScheduleInterval{{Days: []string{"sat", "sun"}, Start: "18:00", End: "23:00"}},
+	}
+
+	tests := []struct {
+		name                 string
+		slug                 string
+		query                string
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name: "Ended",
+			slug: "example",
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().Get(segment).Return(structures.Segment{Slug: "example", EndsAt: &endedAt, Schedule: &schedule}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"slug":"example","schedule":{"timezone":"Europe/Moscow","intervals":[{"days":["sat","sun"],"start":"18:00","end":"23:00"}]},"intervals":[]}`,
+		},
+		{
+			name: "NoSchedule",
+			slug: "example",
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().Get(segment).Return(structures.Segment{Slug: "example"}, nil)
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"segment has no schedule"}`,
+		},
+		{
+			name:                 "InvalidCount",
+			slug:                 "example",
+			query:                "?count=0",
+			mockBehavior:         func(s *mock_service.MockSegment, segment structures.Segment) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid count"}`,
+		},
+		{
+			name: "NotFound",
+			slug: "example",
+			mockBehavior: func(s *mock_service.MockSegment, segment structures.Segment) {
+				s.EXPECT().Get(segment).Return(structures.Segment{}, structures.SegmentNotFoundError{Slug: segment.Slug})
+			},
+			expectedStatusCode:   404,
+			expectedResponseBody: `{"message":"segment with slug example does not exist"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockSegment(ctl)
+			testCase.mockBehavior(mock, structures.Segment{Slug: testCase.slug})
+
+			services := &service.Service{Segment: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.GET("/segments/:slug/schedule", h.getSegmentSchedule)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/segments/"+testCase.slug+"/schedule"+testCase.query, nil)
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
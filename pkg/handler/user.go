@@ -58,6 +58,8 @@ func (h *Handler) getUserHistory(c *gin.Context) {
 }
 
 // @Summary Delete Expired User Segments
+// @Description Also closes the memberships of segments whose activation window has ended.
+// @Description Delayed memberships whose active_from has come are recorded in the history first.
 // @Tags user
 // @ID delete-user-expired-segments
 // @Accpet json
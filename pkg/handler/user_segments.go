@@ -6,18 +6,28 @@ import (
 	"net/http"
 	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
 // @Summary Patch Segment
+// @Description Adding the user to a segment that reached its max_members fails with 409 and the code segment_full.
+// @Description The expiration is an RFC 3339 timestamp or a ttl such as 72h, the response echoes the resolved expirations.
+// @Description A segment to add is a slug or an object with its own expires_at or ttl, which take precedence over those of the request.
+// @Description With the mode upsert a segment the user already has gets the new expiration, a segment to delete they lack is skipped,
+// @Description and the response reports for each segment whether it was added, removed, had its expiration updated or stayed unchanged.
+// @Description A new membership with active_from in the future stays hidden until then, its ttl counts from that moment, and it counts towards max_members right away.
+// @Description With dry_run=true the patch is validated and rolled back, the response reports the changes and the history rows it would write.
+// @Description A layer gives a user at most one segment, adding a second segment of the same layer fails with 400.
 // @Tags user-segments
 // @ID patch-segment
 // @Accept  json
 // @Produce  json
 // @Param input body structures.UserSegments true "Patch data"
+// @Param dry_run query boolean false "Report the patch without applying it"
 // @Success 200 {object} validPatchResponse
-// @Failure 400,404 {object} errorResponse
+// @Failure 400,404,409 {object} errorResponse
 // @Failure 500 {object} errorResponse
 // @Failure default {object} errorResponse
 // @Router /segments/ [patch]
@@ -30,8 +40,8 @@ func (h *Handler) patchSegment(c *gin.Context) {
 	}
 
 	for _, segment := range input.SegmentsToAdd {
-		if err := utils.ValidateSlug(segment); err != nil {
-			NewErrorResponse(c, http.StatusBadRequest, err.Error()+" (segment to add: "+segment+")")
+		if err := utils.ValidateSlug(segment.Slug); err != nil {
+			NewErrorResponse(c, http.StatusBadRequest, err.Error()+" (segment to add: "+segment.Slug+")")
 			return
 		}
 	}
@@ -43,18 +53,140 @@ func (h *Handler) patchSegment(c *gin.Context) {
 		}
 	}
 
-	user_id, err := h.services.UserSegments.Patch(input)
+	if err := utils.ValidatePatchMode(input.Mode); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var err error
+	if input.DryRun, err = dryRun(c); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := h.services.UserSegments.Patch(input)
 	if err != nil {
-		NewErrorResponse(c, http.StatusInternalServerError, err.Error())
+		newServiceErrorResponse(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, validPatchResponse{
+		UserId:      result.UserId,
+		Expirations: result.Expirations,
+		ActiveFrom:  result.ActiveFrom,
+		Changes:     result.Changes,
+		ChangeSet:   result.ChangeSet,
+		DryRun:      result.DryRun,
+		History:     result.History,
+	})
+}
+
+// @Summary Set User Segments
+// @Description Replaces the explicit segments of the user with the given set: the missing ones are added, the ones left out are removed.
+// @Description A segment is a slug or an object with its own expires_at or ttl, the segments the user keeps get that expiration.
+// @Description The response reports for each segment whether it was added, removed, had its expiration updated or stayed unchanged,
+// @Description only additions and removals are written to the history. Percentage segments are not affected,
+// @Description and neither are memberships in archived segments, which are kept whether the set names them or not.
+// @Description A set with two segments of the same layer fails with 400.
+// @Tags user-segments
+// @ID set-user-segments
+// @Accept  json
+// @Produce  json
+// @Param id path integer true "User id"
+// @Param input body structures.UserSegmentsSet true "Segments of the user"
+// @Success 200 {object} validPatchResponse
+// @Failure 400,404,409 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /users/{id}/segments [put]
+func (h *Handler) setUserSegments(c *gin.Context) {
+	var input structures.UserSegmentsSet
+
+	userId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	if err := c.BindJSON(&input); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	input.UserId = userId
+
+	listed := map[string]bool{}
+	for _, segment := range input.Segments {
+		if err := utils.ValidateSlug(segment.Slug); err != nil {
+			NewErrorResponse(c, http.StatusBadRequest, err.Error()+" (segment: "+segment.Slug+")")
+			return
+		}
+		if listed[segment.Slug] {
+			NewErrorResponse(c, http.StatusBadRequest, "segment "+segment.Slug+" is listed more than once")
+			return
+		}
+		listed[segment.Slug] = true
+	}
+
+	result, err := h.services.UserSegments.SetUserSegments(input)
+	if err != nil {
+		newServiceErrorResponse(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, validPatchResponse{
-		UserId: user_id,
+		UserId:      result.UserId,
+		Expirations: result.Expirations,
+		ActiveFrom:  result.ActiveFrom,
+		Changes:     result.Changes,
+		ChangeSet:   result.ChangeSet,
 	})
 }
 
+// @Summary Get Upcoming Activations
+// @Description Lists the memberships added with active_from that are not active yet, the soonest first.
+// @Tags user-segments
+// @ID get-upcoming-activations
+// @Produce json
+// @Param input query structures.ActivationsFilter false "Filters"
+// @Success 200 {object} validGetActivationsResponse
+// @Failure 400 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /users/activations/ [get]
+func (h *Handler) getUpcomingActivations(c *gin.Context) {
+	var input structures.ActivationsFilter
+	if err := c.BindQuery(&input); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if input.Segment != nil {
+		if err := utils.ValidateSlug(*input.Segment); err != nil {
+			NewErrorResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	activations, err := h.services.UserSegments.GetUpcomingActivations(input)
+	if err != nil {
+		NewErrorResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, validGetActivationsResponse{Activations: activations})
+}
+
 // @Summary Get User Segments
+// @Description Only active segments are returned, memberships of paused segments are kept but left out.
+// @Description Segments outside of their activation window are left out as well.
+// @Description Memberships added with active_from are left out until then.
+// @Description Segments with variants also get the variant assigned to the user.
+// @Description The ancestors of the segments of the user are returned along with them, if they are active themselves.
+// @Description Composite segments are returned when their expression holds for the explicit and percentage segments of the user and their ancestors.
+// @Description Attributes of the request such as ctx.city=Moscow or ctx.app_version=7.2 are matched against
+// @Description the targeting rules of percentage segments, a targeted segment is given only when its rule matches.
+// @Description An explicit segment of a layer keeps the user out of the rollout of the other segments of the layer.
+// @Description A targeted placement is recorded in the history once its rule matches and closed by a read whose attributes no longer match.
 // @Description You can also use the request body to send data, but not here :)
 // @Description p.s. For example, via curl
 // @Tags user-segments
@@ -62,6 +194,7 @@ func (h *Handler) patchSegment(c *gin.Context) {
 // @Accpet json
 // @Produce json
 // @Param user_id query integer true "User id"
+// @Param ctx.name query string false "Attribute matched against targeting rules, any name after ctx."
 // @Success 200 {object} validGetUserSegmentsResponse
 // @Failure 400,404 {object} errorResponse
 // @Failure 500 {object} errorResponse
@@ -97,42 +230,237 @@ func (h *Handler) getUsersInSegment(c *gin.Context) {
 		return
 	}
 
+	compositeSegments, err := h.services.GetCompositeSegments()
+	if err != nil {
+		NewErrorResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	if segments == nil {
 		segments = []string{}
 	}
 
-	segments = mergeUserSegmentsAndPercentageSegments(segments, input.Id, percentageSegments)
+	// Explicit segments take their layers, looked up only when a layered rollout could give the user another one.
+	var takenLayers []string
+	if len(segments) > 0 && hasLayeredSegments(percentageSegments) {
+		takenLayers, err = h.services.GetSegmentLayers(segments)
+		if err != nil {
+			NewErrorResponse(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	ctx := targetingContext(c)
+	segments, fromPercentage, unmatched := mergeUserSegmentsAndPercentageSegments(segments, takenLayers, input.Id, ctx, percentageSegments)
+
+	if len(fromPercentage) > 0 {
+		if err := h.services.RecordPercentageSegments(input, fromPercentage); err != nil {
+			NewErrorResponse(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	if len(unmatched) > 0 {
+		if err := h.services.ClosePercentageSegments(input, unmatched); err != nil {
+			NewErrorResponse(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	// Expressions may refer to parents, so composites are evaluated once the ancestors are in,
+	// and the ancestors of the composites that hold are added after them.
+	segments, err = h.withImpliedSegments(segments)
+	if err != nil {
+		NewErrorResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if fromComposites := newCompositeSegments(segments, compositeSegments); len(fromComposites) > 0 {
+		segments = append(append([]string{}, segments...), fromComposites...)
+		sort.Strings(segments)
+
+		segments, err = h.withImpliedSegments(segments)
+		if err != nil {
+			NewErrorResponse(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	var variants map[string]string
+	if len(segments) > 0 {
+		variants, err = h.services.GetUserVariants(input, segments)
+		if err != nil {
+			NewErrorResponse(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
 
 	c.JSON(http.StatusOK, validGetUserSegmentsResponse{
 		UserId:   input.Id,
 		Segments: segments,
+		Variants: variants,
+	})
+}
+
+// @Summary Get Segment Users
+// @Description Returns the users with an explicit membership in the segment that is active already,
+// @Description with include_descendants=true the members of its descendants as well.
+// @Tags user-segments
+// @ID get-segment-users
+// @Produce json
+// @Param slug path string true "Slug of segment"
+// @Param include_descendants query boolean false "Include the members of the descendants of the segment"
+// @Success 200 {object} validGetSegmentUsersResponse
+// @Failure 400 {object} errorResponse
+// @Failure 500 {object} errorResponse
+// @Failure default {object} errorResponse
+// @Router /segments/{slug}/users [get]
+func (h *Handler) getSegmentUsers(c *gin.Context) {
+	var input structures.SegmentUsersFilter
+	if err := c.BindQuery(&input); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	input.Slug = c.Param("slug")
+	if err := utils.ValidateSlug(input.Slug); err != nil {
+		NewErrorResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	users, err := h.services.GetSegmentUsers(input)
+	if err != nil {
+		NewErrorResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if users == nil {
+		users = []int{}
+	}
+
+	c.JSON(http.StatusOK, validGetSegmentUsersResponse{
+		Segment: input.Slug,
+		Users:   users,
 	})
 }
 
-func mergeUserSegmentsAndPercentageSegments(segments1 []string, user_id int, segments2 map[string]int) []string {
+const targetingParamPrefix = "ctx."
+
+// targetingContext collects the attributes of the request matched against targeting rules,
+// ctx.city=Moscow becomes city: Moscow.
+func targetingContext(c *gin.Context) map[string]string {
+	ctx := make(map[string]string)
+	for name, values := range c.Request.URL.Query() {
+		if attr, ok := strings.CutPrefix(name, targetingParamPrefix); ok && attr != "" && len(values) > 0 {
+			ctx[attr] = values[0]
+		}
+	}
+	return ctx
+}
+
+// mergeUserSegmentsAndPercentageSegments returns the merged segments of the user,
+// the segments the user got only through the percentage rollout, which are recorded,
+// and the targeted segments whose rule does not match the attributes of the request although the rollout has the user,
+// their recorded placements are closed.
+// A layer gives the user at most one segment: the layers of the explicit segments
+// are taken before the rollout of the others.
+func mergeUserSegmentsAndPercentageSegments(segments1 []string, layers []string, user_id int, ctx map[string]string, segments2 []structures.Segment) ([]string, []string, []string) {
 	merged := make(map[string]bool)
 
 	for _, item := range segments1 {
 		merged[item] = true
 	}
 
-	addedFromSegments2 := false
+	takenLayers := make(map[string]bool)
+	for _, layer := range layers {
+		takenLayers[layer] = true
+	}
 
-	for slug, probability := range segments2 {
-		if !merged[slug] && utils.Probability(slug, int64(user_id), probability) {
-			merged[slug] = true
-			addedFromSegments2 = true
+	var addedFromSegments2 []string
+	var unmatched []string
+
+	for _, segment := range segments2 {
+		if segment.Layer != nil && takenLayers[*segment.Layer] {
+			continue
+		}
+
+		if merged[segment.Slug] || !utils.InRollout(segment, int64(user_id)) {
+			continue
+		}
+
+		if !utils.InTargeting(segment, ctx) {
+			unmatched = append(unmatched, segment.Slug)
+			continue
+		}
+
+		merged[segment.Slug] = true
+		addedFromSegments2 = append(addedFromSegments2, segment.Slug)
+		if segment.Layer != nil {
+			takenLayers[*segment.Layer] = true
 		}
 	}
 
-	if addedFromSegments2 {
+	sort.Strings(unmatched)
+
+	if len(addedFromSegments2) > 0 {
 		result := make([]string, 0, len(merged))
 		for item := range merged {
 			result = append(result, item)
 		}
 		sort.Strings(result)
-		return result
+		sort.Strings(addedFromSegments2)
+		return result, addedFromSegments2, unmatched
+	}
+
+	return segments1, nil, unmatched
+}
+
+// hasLayeredSegments reports whether any of the percentage segments is in a layer.
+func hasLayeredSegments(segments []structures.Segment) bool {
+	for _, segment := range segments {
+		if segment.Layer != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// withImpliedSegments adds the active ancestors of the segments to them, sorted.
+func (h *Handler) withImpliedSegments(segments []string) ([]string, error) {
+	if len(segments) == 0 {
+		return segments, nil
 	}
 
-	return segments1
+	implied, err := h.services.GetImpliedSegments(segments)
+	if err != nil {
+		return nil, err
+	}
+	if len(implied) == 0 {
+		return segments, nil
+	}
+
+	segments = append(append([]string{}, segments...), implied...)
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// newCompositeSegments returns the composite segments whose expressions hold for the segments of the user
+// and that are not among them yet.
+func newCompositeSegments(segments []string, composites []structures.Segment) []string {
+	if len(composites) == 0 {
+		return nil
+	}
+
+	has := make(map[string]bool)
+	for _, slug := range segments {
+		has[slug] = true
+	}
+
+	var added []string
+	for _, slug := range utils.CompositeSegments(segments, composites) {
+		if !has[slug] {
+			added = append(added, slug)
+		}
+	}
+	return added
 }
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang/mock/gomock"
@@ -17,8 +18,12 @@ import (
 func TestHandler_patchSegment(t *testing.T) {
 	type mockBehavior func(s *mock_service.MockUserSegments, input structures.UserSegments)
 
+	ttl := "72h"
+	invalidTTL := "3 days"
+
 	tests := []struct {
 		name                 string
+		query                string
 		inputBody            string
 		inputData            structures.UserSegments
 		mockBehavior         mockBehavior
@@ -30,21 +35,146 @@ func TestHandler_patchSegment(t *testing.T) {
 			inputBody: `{"user_id": 1, "segments_to_add": ["segment1", "segment2"], "segments_to_delete": ["segment3"]}`,
 			inputData: structures.UserSegments{
 				UserId:           1,
-				SegmentsToAdd:    []string{"segment1", "segment2"},
+				SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1"}, {Slug: "segment2"}},
 				SegmentsToDelete: []string{"segment3"},
 			},
 			mockBehavior: func(s *mock_service.MockUserSegments, input structures.UserSegments) {
-				s.EXPECT().Patch(input).Return(1, nil)
+				s.EXPECT().Patch(input).Return(structures.PatchResult{UserId: 1}, nil)
 			},
 			expectedStatusCode:   200,
 			expectedResponseBody: `{"user_id":1}`,
 		},
+		{
+			name:      "TTL",
+			inputBody: `{"user_id": 1, "segments_to_add": ["segment1"], "ttl": "72h", "segments_to_delete": []}`,
+			inputData: structures.UserSegments{
+				UserId:           1,
+				SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1"}},
+				TTL:              &ttl,
+				SegmentsToDelete: []string{},
+			},
+			mockBehavior: func(s *mock_service.MockUserSegments, input structures.UserSegments) {
+				s.EXPECT().Patch(input).Return(structures.PatchResult{
+					UserId:      1,
+					Expirations: map[string]time.Time{"segment1": time.Date(2023, 8, 31, 12, 0, 0, 0, time.FixedZone("", 3*60*60))},
+				}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"user_id":1,"expirations":{"segment1":"2023-08-31T12:00:00+03:00"}}`,
+		},
+		{
+			name:      "PerSegmentExpiration",
+			inputBody: `{"user_id": 1, "segments_to_add": ["segment1", {"slug": "segment2", "ttl": "72h"}], "segments_to_delete": []}`,
+			inputData: structures.UserSegments{
+				UserId:           1,
+				SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1"}, {Slug: "segment2", TTL: &ttl}},
+				SegmentsToDelete: []string{},
+			},
+			mockBehavior: func(s *mock_service.MockUserSegments, input structures.UserSegments) {
+				s.EXPECT().Patch(input).Return(structures.PatchResult{
+					UserId:      1,
+					Expirations: map[string]time.Time{"segment2": time.Date(2023, 8, 31, 12, 0, 0, 0, time.UTC)},
+				}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"user_id":1,"expirations":{"segment2":"2023-08-31T12:00:00Z"}}`,
+		},
+		{
+			name:      "InvalidSegmentToAddShape",
+			inputBody: `{"user_id": 1, "segments_to_add": [42], "segments_to_delete": []}`,
+			mockBehavior: func(s *mock_service.MockUserSegments, input structures.UserSegments) {
+
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"json: cannot unmarshal number into Go value of type structures.segmentToAdd"}`,
+		},
+		{
+			name:      "InvalidTTL",
+			inputBody: `{"user_id": 1, "segments_to_add": ["segment1"], "ttl": "3 days", "segments_to_delete": []}`,
+			inputData: structures.UserSegments{
+				UserId:           1,
+				SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1"}},
+				TTL:              &invalidTTL,
+				SegmentsToDelete: []string{},
+			},
+			mockBehavior: func(s *mock_service.MockUserSegments, input structures.UserSegments) {
+				s.EXPECT().Patch(input).Return(structures.PatchResult{}, structures.ValidationError{Message: "invalid ttl 3 days, use a duration such as 72h or 14d"})
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid ttl 3 days, use a duration such as 72h or 14d"}`,
+		},
+		{
+			name:      "Upsert",
+			inputBody: `{"user_id": 1, "segments_to_add": ["segment1", "segment2"], "segments_to_delete": ["segment3"], "mode": "upsert"}`,
+			inputData: structures.UserSegments{
+				UserId:           1,
+				SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1"}, {Slug: "segment2"}},
+				SegmentsToDelete: []string{"segment3"},
+				Mode:             "upsert",
+			},
+			mockBehavior: func(s *mock_service.MockUserSegments, input structures.UserSegments) {
+				s.EXPECT().Patch(input).Return(structures.PatchResult{
+					UserId: 1,
+					Changes: map[string]string{
+						"segment1": "added",
+						"segment2": "expiration_updated",
+						"segment3": "unchanged",
+					},
+				}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"user_id":1,"changes":{"segment1":"added","segment2":"expiration_updated","segment3":"unchanged"}}`,
+		},
+		{
+			name:      "InvalidMode",
+			inputBody: `{"user_id": 1, "segments_to_add": ["segment1"], "segments_to_delete": [], "mode": "merge"}`,
+			inputData: structures.UserSegments{
+				UserId:           1,
+				SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1"}},
+				SegmentsToDelete: []string{},
+				Mode:             "merge",
+			},
+			mockBehavior: func(s *mock_service.MockUserSegments, input structures.UserSegments) {
+
+			},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid mode, use strict or upsert"}`,
+		},
+		{
+			name:      "DryRun",
+			query:     "?dry_run=true",
+			inputBody: `{"user_id": 1, "segments_to_add": ["segment1"], "segments_to_delete": []}`,
+			inputData: structures.UserSegments{
+				UserId:           1,
+				SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1"}},
+				SegmentsToDelete: []string{},
+				DryRun:           true,
+			},
+			mockBehavior: func(s *mock_service.MockUserSegments, input structures.UserSegments) {
+				s.EXPECT().Patch(input).Return(structures.PatchResult{
+					UserId:  1,
+					Changes: map[string]string{"segment1": "added"},
+					DryRun:  true,
+					History: []structures.HistoryEntry{{UserId: 1, Segment: "segment1", Operation: "add", Reason: "manual"}},
+				}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"user_id":1,"changes":{"segment1":"added"},"dry_run":true,"history":[{"user_id":1,"slug":"segment1","operation":"add","reason":"manual"}]}`,
+		},
+		{
+			name:                 "InvalidDryRun",
+			query:                "?dry_run=maybe",
+			inputBody:            `{"user_id": 1, "segments_to_add": ["segment1"], "segments_to_delete": []}`,
+			mockBehavior:         func(s *mock_service.MockUserSegments, input structures.UserSegments) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid dry_run, use true or false"}`,
+		},
 		{
 			name:      "InvaligSegmentToAdd",
 			inputBody: `{"user_id": 1, "segments_to_add": ["segment1-", "segment2"], "segments_to_delete": ["segment3"]}`,
 			inputData: structures.UserSegments{
 				UserId:           1,
-				SegmentsToAdd:    []string{"segment1-", "segment2"},
+				SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1-"}, {Slug: "segment2"}},
 				SegmentsToDelete: []string{"segment3"},
 			},
 			mockBehavior: func(s *mock_service.MockUserSegments, input structures.UserSegments) {
@@ -58,7 +188,7 @@ func TestHandler_patchSegment(t *testing.T) {
 			inputBody: `{"user_id": 1, "segments_to_add": ["segment1", "segment2"], "segments_to_delete": ["_segment3/"]}`,
 			inputData: structures.UserSegments{
 				UserId:           1,
-				SegmentsToAdd:    []string{"segment1", "segment2"},
+				SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1"}, {Slug: "segment2"}},
 				SegmentsToDelete: []string{"_segment3/"},
 			},
 			mockBehavior: func(s *mock_service.MockUserSegments, input structures.UserSegments) {
@@ -72,7 +202,7 @@ func TestHandler_patchSegment(t *testing.T) {
 			inputBody: `"user_id": 1, "segments_to_add": ["segment1", "segment2"], "segments_to_delete": ["segment3"]}`,
 			inputData: structures.UserSegments{
 				UserId:           1,
-				SegmentsToAdd:    []string{"segment1", "segment2"},
+				SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1"}, {Slug: "segment2"}},
 				SegmentsToDelete: []string{"segment3"},
 			},
 			mockBehavior: func(s *mock_service.MockUserSegments, input structures.UserSegments) {
@@ -81,16 +211,58 @@ func TestHandler_patchSegment(t *testing.T) {
 			expectedStatusCode:   400,
 			expectedResponseBody: `{"message":"json: cannot unmarshal string into Go value of type structures.UserSegments"}`,
 		},
+		{
+			name:      "ArchivedSegment",
+			inputBody: `{"user_id": 1, "segments_to_add": ["segment1"], "segments_to_delete": []}`,
+			inputData: structures.UserSegments{
+				UserId:           1,
+				SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1"}},
+				SegmentsToDelete: []string{},
+			},
+			mockBehavior: func(s *mock_service.MockUserSegments, input structures.UserSegments) {
+				s.EXPECT().Patch(input).Return(structures.PatchResult{}, structures.SegmentArchivedError{Slug: "segment1"})
+			},
+			expectedStatusCode:   409,
+			expectedResponseBody: `{"message":"segment with slug segment1 is archived"}`,
+		},
+		{
+			name:      "SegmentFull",
+			inputBody: `{"user_id": 1, "segments_to_add": ["segment1"], "segments_to_delete": []}`,
+			inputData: structures.UserSegments{
+				UserId:           1,
+				SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1"}},
+				SegmentsToDelete: []string{},
+			},
+			mockBehavior: func(s *mock_service.MockUserSegments, input structures.UserSegments) {
+				s.EXPECT().Patch(input).Return(structures.PatchResult{}, structures.SegmentFullError{Slug: "segment1", MaxMembers: 100})
+			},
+			expectedStatusCode:   409,
+			expectedResponseBody: `{"message":"segment with slug segment1 is full, it is limited to 100 members","code":"segment_full"}`,
+		},
+		{
+			name:      "RuleViolation",
+			inputBody: `{"user_id": 1, "segments_to_add": ["segment1"], "segments_to_delete": []}`,
+			inputData: structures.UserSegments{
+				UserId:           1,
+				SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1"}},
+				SegmentsToDelete: []string{},
+			},
+			mockBehavior: func(s *mock_service.MockUserSegments, input structures.UserSegments) {
+				s.EXPECT().Patch(input).Return(structures.PatchResult{}, structures.RuleViolationError{Rule: 3, UserId: 1, Message: "segment segment1 excludes segment segment2"})
+			},
+			expectedStatusCode:   409,
+			expectedResponseBody: `{"message":"user 1 breaks rule 3: segment segment1 excludes segment segment2","code":"rule_violation","rule":3}`,
+		},
 		{
 			name:      "ServiceFail",
 			inputBody: `{"user_id": 1, "segments_to_add": ["segment1", "segment2"], "segments_to_delete": ["segment3"]}`,
 			inputData: structures.UserSegments{
 				UserId:           1,
-				SegmentsToAdd:    []string{"segment1", "segment2"},
+				SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1"}, {Slug: "segment2"}},
 				SegmentsToDelete: []string{"segment3"},
 			},
 			mockBehavior: func(s *mock_service.MockUserSegments, input structures.UserSegments) {
-				s.EXPECT().Patch(input).Return(0, errors.New("service fail"))
+				s.EXPECT().Patch(input).Return(structures.PatchResult{}, errors.New("service fail"))
 			},
 			expectedStatusCode:   500,
 			expectedResponseBody: `{"message":"service fail"}`,
@@ -112,7 +284,132 @@ func TestHandler_patchSegment(t *testing.T) {
 			r.PATCH("/segments/", h.patchSegment)
 
 			w := httptest.NewRecorder()
-			req := httptest.NewRequest("PATCH", "/segments/", bytes.NewBufferString(testCase.inputBody))
+			req := httptest.NewRequest("PATCH", "/segments/"+testCase.query, bytes.NewBufferString(testCase.inputBody))
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
+
+func TestHandler_setUserSegments(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockUserSegments, input structures.UserSegmentsSet)
+
+	ttl := "72h"
+
+	tests := []struct {
+		name                 string
+		userId               string
+		inputBody            string
+		inputData            structures.UserSegmentsSet
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name:      "OK",
+			userId:    "1",
+			inputBody: `{"segments": ["segment1", {"slug": "segment2", "ttl": "72h"}]}`,
+			inputData: structures.UserSegmentsSet{
+				UserId:   1,
+				Segments: []structures.SegmentToAdd{{Slug: "segment1"}, {Slug: "segment2", TTL: &ttl}},
+			},
+			mockBehavior: func(s *mock_service.MockUserSegments, input structures.UserSegmentsSet) {
+				s.EXPECT().SetUserSegments(input).Return(structures.PatchResult{
+					UserId: 1,
+					Changes: map[string]string{
+						"segment1": "unchanged",
+						"segment2": "added",
+						"segment3": "removed",
+					},
+				}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"user_id":1,"changes":{"segment1":"unchanged","segment2":"added","segment3":"removed"}}`,
+		},
+		{
+			name:      "Empty",
+			userId:    "1",
+			inputBody: `{"segments": []}`,
+			inputData: structures.UserSegmentsSet{
+				UserId:   1,
+				Segments: []structures.SegmentToAdd{},
+			},
+			mockBehavior: func(s *mock_service.MockUserSegments, input structures.UserSegmentsSet) {
+				s.EXPECT().SetUserSegments(input).Return(structures.PatchResult{
+					UserId:  1,
+					Changes: map[string]string{"segment1": "removed"},
+				}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"user_id":1,"changes":{"segment1":"removed"}}`,
+		},
+		{
+			name:                 "InvalidUserId",
+			userId:               "one",
+			inputBody:            `{"segments": ["segment1"]}`,
+			mockBehavior:         func(s *mock_service.MockUserSegments, input structures.UserSegmentsSet) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid user id"}`,
+		},
+		{
+			name:                 "NoSegments",
+			userId:               "1",
+			inputBody:            `{}`,
+			mockBehavior:         func(s *mock_service.MockUserSegments, input structures.UserSegmentsSet) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"Key: 'UserSegmentsSet.Segments' Error:Field validation for 'Segments' failed on the 'required' tag"}`,
+		},
+		{
+			name:                 "InvalidSlug",
+			userId:               "1",
+			inputBody:            `{"segments": ["segment1-"]}`,
+			mockBehavior:         func(s *mock_service.MockUserSegments, input structures.UserSegmentsSet) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid slug (segment: segment1-)"}`,
+		},
+		{
+			name:                 "Duplicate",
+			userId:               "1",
+			inputBody:            `{"segments": ["segment1", {"slug": "segment1", "ttl": "72h"}]}`,
+			mockBehavior:         func(s *mock_service.MockUserSegments, input structures.UserSegmentsSet) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"segment segment1 is listed more than once"}`,
+		},
+		{
+			name:      "Archived",
+			userId:    "1",
+			inputBody: `{"segments": ["segment1"]}`,
+			inputData: structures.UserSegmentsSet{
+				UserId:   1,
+				Segments: []structures.SegmentToAdd{{Slug: "segment1"}},
+			},
+			mockBehavior: func(s *mock_service.MockUserSegments, input structures.UserSegmentsSet) {
+				s.EXPECT().SetUserSegments(input).Return(structures.PatchResult{}, structures.SegmentArchivedError{Slug: "segment1"})
+			},
+			expectedStatusCode:   409,
+			expectedResponseBody: `{"message":"segment with slug segment1 is archived"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockUserSegments(ctl)
+			testCase.mockBehavior(mock, testCase.inputData)
+
+			services := &service.Service{UserSegments: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.PUT("/users/:id/segments", h.setUserSegments)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("PUT", "/users/"+testCase.userId+"/segments", bytes.NewBufferString(testCase.inputBody))
 
 			r.ServeHTTP(w, req)
 
@@ -125,6 +422,17 @@ func TestHandler_patchSegment(t *testing.T) {
 func TestHandler_getUsersInSegment(t *testing.T) {
 	type mockBehavior func(us *mock_service.MockUserSegments, s *mock_service.MockSegment, input structures.User)
 
+	var fullPercentage = 100
+	var halfPercentage = 50
+	var layer = "checkout"
+	var firstHalf = 0
+	var secondHalf = 5000
+	var premiumRetained = "premium AND NOT churn_risk"
+	var newUITesters = "(beta OR staff) AND android_new_ui"
+	var vipRetained = "vip AND NOT churn_risk"
+	var moscowTargeting = `city in ["Moscow", "SPb"] && semver(app_version) >= "7.0"`
+	var iosTargeting = `platform == "ios"`
+
 	tests := []struct {
 		name                 string
 		queryParams          map[string]string
@@ -143,7 +451,10 @@ func TestHandler_getUsersInSegment(t *testing.T) {
 			},
 			mockBehavior: func(us *mock_service.MockUserSegments, s *mock_service.MockSegment, input structures.User) {
 				us.EXPECT().GetUsersInSegment(input).Return([]string{"segment1", "segment2"}, nil)
-				s.EXPECT().GetPercentageSegments().Return(map[string]int{}, nil)
+				s.EXPECT().GetPercentageSegments().Return([]structures.Segment{}, nil)
+				s.EXPECT().GetCompositeSegments().Return(nil, nil)
+				s.EXPECT().GetImpliedSegments([]string{"segment1", "segment2"}).Return(nil, nil)
+				us.EXPECT().GetUserVariants(input, []string{"segment1", "segment2"}).Return(map[string]string{}, nil)
 			},
 			expectedStatusCode:   200,
 			expectedResponseBody: `{"segments":["segment1","segment2"],"user_id":1}`,
@@ -157,10 +468,244 @@ func TestHandler_getUsersInSegment(t *testing.T) {
 			},
 			mockBehavior: func(us *mock_service.MockUserSegments, s *mock_service.MockSegment, input structures.User) {
 				us.EXPECT().GetUsersInSegment(input).Return([]string{"segment1", "segment2"}, nil)
-				s.EXPECT().GetPercentageSegments().Return(map[string]int{"segment3": 100}, nil)
+				s.EXPECT().GetPercentageSegments().Return([]structures.Segment{{Slug: "segment3", Percentage: &fullPercentage}}, nil)
+				s.EXPECT().GetCompositeSegments().Return(nil, nil)
+				us.EXPECT().RecordPercentageSegments(input, []string{"segment3"}).Return(nil)
+				s.EXPECT().GetImpliedSegments([]string{"segment1", "segment2", "segment3"}).Return(nil, nil)
+				us.EXPECT().GetUserVariants(input, []string{"segment1", "segment2", "segment3"}).Return(map[string]string{"segment3": "treatment"}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"segments":["segment1","segment2","segment3"],"variants":{"segment3":"treatment"},"user_id":1}`,
+		},
+		{
+			name:        "Ancestors",
+			queryParams: map[string]string{"user_id": "1"},
+			inputBody:   `{"id": 1}`,
+			inputData: structures.User{
+				Id: 1,
+			},
+			mockBehavior: func(us *mock_service.MockUserSegments, s *mock_service.MockSegment, input structures.User) {
+				us.EXPECT().GetUsersInSegment(input).Return([]string{"vip-moscow"}, nil)
+				s.EXPECT().GetPercentageSegments().Return([]structures.Segment{}, nil)
+				s.EXPECT().GetCompositeSegments().Return(nil, nil)
+				s.EXPECT().GetImpliedSegments([]string{"vip-moscow"}).Return([]string{"loyal", "vip"}, nil)
+				us.EXPECT().GetUserVariants(input, []string{"loyal", "vip", "vip-moscow"}).Return(map[string]string{}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"segments":["loyal","vip","vip-moscow"],"user_id":1}`,
+		},
+		{
+			name:        "Composite",
+			queryParams: map[string]string{"user_id": "1"},
+			inputBody:   `{"id": 1}`,
+			inputData: structures.User{
+				Id: 1,
+			},
+			mockBehavior: func(us *mock_service.MockUserSegments, s *mock_service.MockSegment, input structures.User) {
+				us.EXPECT().GetUsersInSegment(input).Return([]string{"premium"}, nil)
+				s.EXPECT().GetPercentageSegments().Return([]structures.Segment{}, nil)
+				s.EXPECT().GetCompositeSegments().Return([]structures.Segment{
+					{Slug: "premium_retained", Expression: &premiumRetained},
+					{Slug: "new_ui_testers", Expression: &newUITesters},
+				}, nil)
+				s.EXPECT().GetImpliedSegments([]string{"premium"}).Return(nil, nil)
+				s.EXPECT().GetImpliedSegments([]string{"premium", "premium_retained"}).Return(nil, nil)
+				us.EXPECT().GetUserVariants(input, []string{"premium", "premium_retained"}).Return(map[string]string{}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"segments":["premium","premium_retained"],"user_id":1}`,
+		},
+		{
+			name:        "CompositeOverParent",
+			queryParams: map[string]string{"user_id": "1"},
+			inputBody:   `{"id": 1}`,
+			inputData: structures.User{
+				Id: 1,
+			},
+			mockBehavior: func(us *mock_service.MockUserSegments, s *mock_service.MockSegment, input structures.User) {
+				us.EXPECT().GetUsersInSegment(input).Return([]string{"vip-moscow"}, nil)
+				s.EXPECT().GetPercentageSegments().Return([]structures.Segment{}, nil)
+				s.EXPECT().GetCompositeSegments().Return([]structures.Segment{
+					{Slug: "vip_retained", Expression: &vipRetained},
+				}, nil)
+				s.EXPECT().GetImpliedSegments([]string{"vip-moscow"}).Return([]string{"vip"}, nil)
+				s.EXPECT().GetImpliedSegments([]string{"vip", "vip-moscow", "vip_retained"}).Return([]string{"retention"}, nil)
+				us.EXPECT().GetUserVariants(input, []string{"retention", "vip", "vip-moscow", "vip_retained"}).Return(map[string]string{}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"segments":["retention","vip","vip-moscow","vip_retained"],"user_id":1}`,
+		},
+		{
+			name:        "Targeting",
+			queryParams: map[string]string{"user_id": "1", "ctx.city": "Moscow", "ctx.app_version": "7.2"},
+			inputBody:   `{"id": 1}`,
+			inputData: structures.User{
+				Id: 1,
+			},
+			mockBehavior: func(us *mock_service.MockUserSegments, s *mock_service.MockSegment, input structures.User) {
+				us.EXPECT().GetUsersInSegment(input).Return(nil, nil)
+				s.EXPECT().GetPercentageSegments().Return([]structures.Segment{
+					{Slug: "new-checkout", Percentage: &fullPercentage, Targeting: &moscowTargeting},
+					{Slug: "ios-onboarding", Percentage: &fullPercentage, Targeting: &iosTargeting},
+					{Slug: "dark-mode", Percentage: &fullPercentage},
+				}, nil)
+				s.EXPECT().GetCompositeSegments().Return(nil, nil)
+				us.EXPECT().RecordPercentageSegments(input, []string{"dark-mode", "new-checkout"}).Return(nil)
+				us.EXPECT().ClosePercentageSegments(input, []string{"ios-onboarding"}).Return(nil)
+				s.EXPECT().GetImpliedSegments([]string{"dark-mode", "new-checkout"}).Return(nil, nil)
+				us.EXPECT().GetUserVariants(input, []string{"dark-mode", "new-checkout"}).Return(map[string]string{}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"segments":["dark-mode","new-checkout"],"user_id":1}`,
+		},
+		{
+			name:        "TargetingWithoutContext",
+			queryParams: map[string]string{"user_id": "1"},
+			inputBody:   `{"id": 1}`,
+			inputData: structures.User{
+				Id: 1,
+			},
+			mockBehavior: func(us *mock_service.MockUserSegments, s *mock_service.MockSegment, input structures.User) {
+				us.EXPECT().GetUsersInSegment(input).Return(nil, nil)
+				s.EXPECT().GetPercentageSegments().Return([]structures.Segment{
+					{Slug: "new-checkout", Percentage: &fullPercentage, Targeting: &moscowTargeting},
+				}, nil)
+				s.EXPECT().GetCompositeSegments().Return(nil, nil)
+				us.EXPECT().ClosePercentageSegments(input, []string{"new-checkout"}).Return(nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"segments":[],"user_id":1}`,
+		},
+		{
+			name:        "ClosePercentageSegmentsFail",
+			queryParams: map[string]string{"user_id": "1"},
+			inputBody:   `{"id": 1}`,
+			inputData: structures.User{
+				Id: 1,
+			},
+			mockBehavior: func(us *mock_service.MockUserSegments, s *mock_service.MockSegment, input structures.User) {
+				us.EXPECT().GetUsersInSegment(input).Return(nil, nil)
+				s.EXPECT().GetPercentageSegments().Return([]structures.Segment{
+					{Slug: "new-checkout", Percentage: &fullPercentage, Targeting: &moscowTargeting},
+				}, nil)
+				s.EXPECT().GetCompositeSegments().Return(nil, nil)
+				us.EXPECT().ClosePercentageSegments(input, []string{"new-checkout"}).Return(errors.New("service fail"))
+			},
+			expectedStatusCode:   500,
+			expectedResponseBody: `{"message":"service fail"}`,
+		},
+		{
+			name:        "CompositeSegmentsFail",
+			queryParams: map[string]string{"user_id": "1"},
+			inputBody:   `{"id": 1}`,
+			inputData: structures.User{
+				Id: 1,
+			},
+			mockBehavior: func(us *mock_service.MockUserSegments, s *mock_service.MockSegment, input structures.User) {
+				us.EXPECT().GetUsersInSegment(input).Return([]string{"premium"}, nil)
+				s.EXPECT().GetPercentageSegments().Return([]structures.Segment{}, nil)
+				s.EXPECT().GetCompositeSegments().Return(nil, errors.New("service fail"))
+			},
+			expectedStatusCode:   500,
+			expectedResponseBody: `{"message":"service fail"}`,
+		},
+		{
+			name:        "Layer",
+			queryParams: map[string]string{"user_id": "1"},
+			inputBody:   `{"id": 1}`,
+			inputData: structures.User{
+				Id: 1,
+			},
+			mockBehavior: func(us *mock_service.MockUserSegments, s *mock_service.MockSegment, input structures.User) {
+				us.EXPECT().GetUsersInSegment(input).Return(nil, nil)
+				s.EXPECT().GetPercentageSegments().Return([]structures.Segment{
+					{Slug: "checkout-a", Percentage: &halfPercentage, Layer: &layer, LayerOffset: &firstHalf},
+					{Slug: "checkout-b", Percentage: &halfPercentage, Layer: &layer, LayerOffset: &secondHalf},
+				}, nil)
+				s.EXPECT().GetCompositeSegments().Return(nil, nil)
+				us.EXPECT().RecordPercentageSegments(input, []string{"checkout-a"}).Return(nil)
+				s.EXPECT().GetImpliedSegments([]string{"checkout-a"}).Return(nil, nil)
+				us.EXPECT().GetUserVariants(input, []string{"checkout-a"}).Return(map[string]string{}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"segments":["checkout-a"],"user_id":1}`,
+		},
+		{
+			name:        "LayerTakenExplicitly",
+			queryParams: map[string]string{"user_id": "1"},
+			inputBody:   `{"id": 1}`,
+			inputData: structures.User{
+				Id: 1,
+			},
+			mockBehavior: func(us *mock_service.MockUserSegments, s *mock_service.MockSegment, input structures.User) {
+				us.EXPECT().GetUsersInSegment(input).Return([]string{"checkout-b"}, nil)
+				s.EXPECT().GetPercentageSegments().Return([]structures.Segment{
+					{Slug: "checkout-a", Percentage: &halfPercentage, Layer: &layer, LayerOffset: &firstHalf},
+					{Slug: "checkout-b", Percentage: &halfPercentage, Layer: &layer, LayerOffset: &secondHalf},
+				}, nil)
+				s.EXPECT().GetCompositeSegments().Return(nil, nil)
+				s.EXPECT().GetSegmentLayers([]string{"checkout-b"}).Return([]string{layer}, nil)
+				s.EXPECT().GetImpliedSegments([]string{"checkout-b"}).Return(nil, nil)
+				us.EXPECT().GetUserVariants(input, []string{"checkout-b"}).Return(map[string]string{}, nil)
 			},
 			expectedStatusCode:   200,
-			expectedResponseBody: `{"segments":["segment1","segment2","segment3"],"user_id":1}`,
+			expectedResponseBody: `{"segments":["checkout-b"],"user_id":1}`,
+		},
+		{
+			name:        "LayerTakenWithoutRollout",
+			queryParams: map[string]string{"user_id": "1"},
+			inputBody:   `{"id": 1}`,
+			inputData: structures.User{
+				Id: 1,
+			},
+			mockBehavior: func(us *mock_service.MockUserSegments, s *mock_service.MockSegment, input structures.User) {
+				us.EXPECT().GetUsersInSegment(input).Return([]string{"checkout-manual"}, nil)
+				s.EXPECT().GetPercentageSegments().Return([]structures.Segment{
+					{Slug: "checkout-a", Percentage: &halfPercentage, Layer: &layer, LayerOffset: &firstHalf},
+					{Slug: "checkout-b", Percentage: &halfPercentage, Layer: &layer, LayerOffset: &secondHalf},
+				}, nil)
+				s.EXPECT().GetCompositeSegments().Return(nil, nil)
+				s.EXPECT().GetSegmentLayers([]string{"checkout-manual"}).Return([]string{layer}, nil)
+				s.EXPECT().GetImpliedSegments([]string{"checkout-manual"}).Return(nil, nil)
+				us.EXPECT().GetUserVariants(input, []string{"checkout-manual"}).Return(map[string]string{}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"segments":["checkout-manual"],"user_id":1}`,
+		},
+		{
+			name:        "SegmentLayersFail",
+			queryParams: map[string]string{"user_id": "1"},
+			inputBody:   `{"id": 1}`,
+			inputData: structures.User{
+				Id: 1,
+			},
+			mockBehavior: func(us *mock_service.MockUserSegments, s *mock_service.MockSegment, input structures.User) {
+				us.EXPECT().GetUsersInSegment(input).Return([]string{"checkout-manual"}, nil)
+				s.EXPECT().GetPercentageSegments().Return([]structures.Segment{
+					{Slug: "checkout-a", Percentage: &halfPercentage, Layer: &layer, LayerOffset: &firstHalf},
+				}, nil)
+				s.EXPECT().GetCompositeSegments().Return(nil, nil)
+				s.EXPECT().GetSegmentLayers([]string{"checkout-manual"}).Return(nil, errors.New("service fail"))
+			},
+			expectedStatusCode:   500,
+			expectedResponseBody: `{"message":"service fail"}`,
+		},
+		{
+			name:        "VariantsFail",
+			queryParams: map[string]string{"user_id": "1"},
+			inputBody:   `{"id": 1}`,
+			inputData: structures.User{
+				Id: 1,
+			},
+			mockBehavior: func(us *mock_service.MockUserSegments, s *mock_service.MockSegment, input structures.User) {
+				us.EXPECT().GetUsersInSegment(input).Return([]string{"segment1"}, nil)
+				s.EXPECT().GetPercentageSegments().Return([]structures.Segment{}, nil)
+				s.EXPECT().GetCompositeSegments().Return(nil, nil)
+				s.EXPECT().GetImpliedSegments([]string{"segment1"}).Return(nil, nil)
+				us.EXPECT().GetUserVariants(input, []string{"segment1"}).Return(nil, errors.New("service fail"))
+			},
+			expectedStatusCode:   500,
+			expectedResponseBody: `{"message":"service fail"}`,
 		},
 		{
 			name:        "EmptySegments",
@@ -171,7 +716,8 @@ func TestHandler_getUsersInSegment(t *testing.T) {
 			},
 			mockBehavior: func(us *mock_service.MockUserSegments, s *mock_service.MockSegment, input structures.User) {
 				us.EXPECT().GetUsersInSegment(input).Return(nil, nil)
-				s.EXPECT().GetPercentageSegments().Return(map[string]int{}, nil)
+				s.EXPECT().GetPercentageSegments().Return([]structures.Segment{}, nil)
+				s.EXPECT().GetCompositeSegments().Return(nil, nil)
 			},
 			expectedStatusCode:   200,
 			expectedResponseBody: `{"segments":[],"user_id":1}`,
@@ -225,6 +771,22 @@ func TestHandler_getUsersInSegment(t *testing.T) {
 			expectedStatusCode:   500,
 			expectedResponseBody: `{"message":"service fail"}`,
 		},
+		{
+			name:        "RecordFail",
+			queryParams: map[string]string{"user_id": "1"},
+			inputBody:   `{"id": 1}`,
+			inputData: structures.User{
+				Id: 1,
+			},
+			mockBehavior: func(us *mock_service.MockUserSegments, s *mock_service.MockSegment, input structures.User) {
+				us.EXPECT().GetUsersInSegment(input).Return([]string{"segment1"}, nil)
+				s.EXPECT().GetPercentageSegments().Return([]structures.Segment{{Slug: "segment2", Percentage: &fullPercentage}, {Slug: "segment1", Percentage: &fullPercentage}}, nil)
+				s.EXPECT().GetCompositeSegments().Return(nil, nil)
+				us.EXPECT().RecordPercentageSegments(input, []string{"segment2"}).Return(errors.New("service fail"))
+			},
+			expectedStatusCode:   500,
+			expectedResponseBody: `{"message":"service fail"}`,
+		},
 	}
 
 	for _, testCase := range tests {
@@ -259,3 +821,166 @@ func TestHandler_getUsersInSegment(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_getUpcomingActivations(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockUserSegments, input structures.ActivationsFilter)
+
+	userId := 1
+	activeFrom := time.Date(2023, 9, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name                 string
+		query                string
+		inputData            structures.ActivationsFilter
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name:      "OK",
+			query:     "?user_id=1",
+			inputData: structures.ActivationsFilter{UserId: &userId},
+			mockBehavior: func(s *mock_service.MockUserSegments, input structures.ActivationsFilter) {
+				s.EXPECT().GetUpcomingActivations(input).Return([]structures.Activation{
+					{UserId: 1, Segment: "AVITO_LAUNCH", ActiveFrom: activeFrom},
+				}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"activations":[{"user_id":1,"slug":"AVITO_LAUNCH","active_from":"2023-09-01T10:00:00Z"}]}`,
+		},
+		{
+			name:                 "InvalidUserId",
+			query:                "?user_id=one",
+			mockBehavior:         func(s *mock_service.MockUserSegments, input structures.ActivationsFilter) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"strconv.ParseInt: parsing \"one\": invalid syntax"}`,
+		},
+		{
+			name:                 "InvalidSegment",
+			query:                "?segment=launch-",
+			mockBehavior:         func(s *mock_service.MockUserSegments, input structures.ActivationsFilter) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid slug"}`,
+		},
+		{
+			name:      "ServiceError",
+			inputData: structures.ActivationsFilter{},
+			mockBehavior: func(s *mock_service.MockUserSegments, input structures.ActivationsFilter) {
+				s.EXPECT().GetUpcomingActivations(input).Return(nil, errors.New("something went wrong"))
+			},
+			expectedStatusCode:   500,
+			expectedResponseBody: `{"message":"something went wrong"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockUserSegments(ctl)
+			testCase.mockBehavior(mock, testCase.inputData)
+
+			services := &service.Service{UserSegments: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.GET("/users/activations/", h.getUpcomingActivations)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/users/activations/"+testCase.query, nil)
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
+
+func TestHandler_getSegmentUsers(t *testing.T) {
+	type mockBehavior func(s *mock_service.MockUserSegments, input structures.SegmentUsersFilter)
+
+	tests := []struct {
+		name                 string
+		slug                 string
+		query                string
+		inputData            structures.SegmentUsersFilter
+		mockBehavior         mockBehavior
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{
+			name:      "OK",
+			slug:      "vip",
+			inputData: structures.SegmentUsersFilter{Slug: "vip"},
+			mockBehavior: func(s *mock_service.MockUserSegments, input structures.SegmentUsersFilter) {
+				s.EXPECT().GetSegmentUsers(input).Return([]int{1, 2}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"slug":"vip","users":[1,2]}`,
+		},
+		{
+			name:      "IncludeDescendants",
+			slug:      "vip",
+			query:     "?include_descendants=true",
+			inputData: structures.SegmentUsersFilter{Slug: "vip", IncludeDescendants: true},
+			mockBehavior: func(s *mock_service.MockUserSegments, input structures.SegmentUsersFilter) {
+				s.EXPECT().GetSegmentUsers(input).Return([]int{1, 2, 3}, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"slug":"vip","users":[1,2,3]}`,
+		},
+		{
+			name:      "Empty",
+			slug:      "vip",
+			inputData: structures.SegmentUsersFilter{Slug: "vip"},
+			mockBehavior: func(s *mock_service.MockUserSegments, input structures.SegmentUsersFilter) {
+				s.EXPECT().GetSegmentUsers(input).Return(nil, nil)
+			},
+			expectedStatusCode:   200,
+			expectedResponseBody: `{"slug":"vip","users":[]}`,
+		},
+		{
+			name:                 "InvalidSlug",
+			slug:                 "vip-",
+			mockBehavior:         func(s *mock_service.MockUserSegments, input structures.SegmentUsersFilter) {},
+			expectedStatusCode:   400,
+			expectedResponseBody: `{"message":"invalid slug"}`,
+		},
+		{
+			name:      "ServiceError",
+			slug:      "vip",
+			inputData: structures.SegmentUsersFilter{Slug: "vip"},
+			mockBehavior: func(s *mock_service.MockUserSegments, input structures.SegmentUsersFilter) {
+				s.EXPECT().GetSegmentUsers(input).Return(nil, errors.New("something went wrong"))
+			},
+			expectedStatusCode:   500,
+			expectedResponseBody: `{"message":"something went wrong"}`,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctl := gomock.NewController(t)
+			defer ctl.Finish()
+
+			mock := mock_service.NewMockUserSegments(ctl)
+			testCase.mockBehavior(mock, testCase.inputData)
+
+			services := &service.Service{UserSegments: mock}
+			h := Handler{services}
+
+			r := gin.New()
+			r.GET("/segments/:slug/users", h.getSegmentUsers)
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/segments/"+testCase.slug+"/users"+testCase.query, nil)
+
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, testCase.expectedStatusCode, w.Code)
+			assert.Equal(t, testCase.expectedResponseBody, w.Body.String())
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package repository
+
+import (
+	"avito/pkg/structures"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type ChangeSetDB struct {
+	db *sql.DB
+}
+
+func NewChangeSetDB(db *sql.DB) *ChangeSetDB {
+	return &ChangeSetDB{db: db}
+}
+
+func (r *ChangeSetDB) GetChangeSet(id int) (structures.ChangeSet, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return structures.ChangeSet{}, err
+	}
+
+	changeSet, err := getChangeSet(tx, id, false)
+	if err != nil {
+		tx.Rollback()
+		return structures.ChangeSet{}, err
+	}
+
+	return changeSet, tx.Commit()
+}
+
+// RevertChangeSet undoes the memberships changed by the change set: the removed ones are restored
+// with the expiration they had, the added ones are removed. It fails if any of them has changed since,
+// either through a later history entry or by a membership that is no longer in the state the change set left.
+// Removed memberships whose expiration has passed meanwhile are not restored,
+// and the revert fails like any other change if it would break a rule.
+// A change set that also made changes history does not record is irreversible and is not reverted.
+// The revert is a change set of its own, which is returned.
+func (r *ChangeSetDB) RevertChangeSet(id int) (structures.ChangeSet, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return structures.ChangeSet{}, err
+	}
+
+	changeSet, err := getChangeSet(tx, id, true)
+	if err != nil {
+		tx.Rollback()
+		return structures.ChangeSet{}, err
+	}
+
+	if changeSet.RevertedBy != nil {
+		tx.Rollback()
+		return structures.ChangeSet{}, structures.ValidationError{Message: fmt.Sprintf("change set %d is already reverted by change set %d", id, *changeSet.RevertedBy)}
+	}
+	if changeSet.Kind == changeSetSegmentDeletion {
+		tx.Rollback()
+		return structures.ChangeSet{}, structures.ValidationError{Message: fmt.Sprintf("change set %d deleted a segment and cannot be reverted", id)}
+	}
+	if changeSet.Irreversible {
+		tx.Rollback()
+		return structures.ChangeSet{}, structures.ValidationError{Message: fmt.Sprintf("change set %d changed expirations or delayed memberships, which history does not record, and cannot be reverted", id)}
+	}
+
+	// The last entry of a membership is the state the change set left it in.
+	var changed []membership
+	last := map[membership]structures.HistoryEntry{}
+	for _, entry := range changeSet.Entries {
+		m := membership{userId: entry.UserId, segment: entry.Segment}
+		if _, ok := last[m]; !ok {
+			changed = append(changed, m)
+		}
+		last[m] = entry
+	}
+
+	if err := checkChangedSince(tx, id); err != nil {
+		tx.Rollback()
+		return structures.ChangeSet{}, err
+	}
+
+	now := time.Now()
+	var slugs []string
+	var restoredUsers []int
+	toRestore := map[int][]string{}
+	for _, m := range changed {
+		var exists bool
+		existsQuery := fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE user_id = $1 AND segment = $2)", userSegmentsTable)
+		if err := tx.QueryRow(existsQuery, m.userId, m.segment).Scan(&exists); err != nil {
+			tx.Rollback()
+			return structures.ChangeSet{}, err
+		}
+
+		added := last[m].Operation == "add"
+		if exists != added {
+			tx.Rollback()
+			return structures.ChangeSet{}, structures.ChangeSetConflictError{Id: id, UserId: m.userId, Segment: m.segment}
+		}
+
+		slugs = append(slugs, m.segment)
+		if expiresAt := last[m].ExpiresAt; !added && (expiresAt == nil || expiresAt.After(now)) {
+			if _, ok := toRestore[m.userId]; !ok {
+				restoredUsers = append(restoredUsers, m.userId)
+			}
+			toRestore[m.userId] = append(toRestore[m.userId], m.segment)
+		}
+	}
+
+	if err := checkSegmentsNotArchived(tx, slugs); err != nil {
+		tx.Rollback()
+		return structures.ChangeSet{}, err
+	}
+
+	for _, userId := range restoredUsers {
+		if err := checkSegmentsCapacity(tx, userId, toRestore[userId]); err != nil {
+			tx.Rollback()
+			return structures.ChangeSet{}, err
+		}
+	}
+
+	history := newHistoryLog(changeSetRevert)
+	if err := history.open(tx); err != nil {
+		tx.Rollback()
+		return structures.ChangeSet{}, err
+	}
+
+	for _, m := range changed {
+		entry := last[m]
+		if entry.Operation == "add" {
+			if _, err := deleteUserSegment(tx, &history, m.userId, m.segment, reasonRevert); err != nil {
+				tx.Rollback()
+				return structures.ChangeSet{}, err
+			}
+			continue
+		}
+
+		if entry.ExpiresAt != nil && !entry.ExpiresAt.After(now) {
+			continue
+		}
+
+		restoreQuery := fmt.Sprintf("INSERT INTO %s (user_id, segment, expiration_time) VALUES ($1, $2, $3)", userSegmentsTable)
+		if _, err := tx.Exec(restoreQuery, m.userId, m.segment, entry.ExpiresAt); err != nil {
+			tx.Rollback()
+			return structures.ChangeSet{}, fmt.Errorf("error occurred while processing segment to add '%s': %v", m.segment, err)
+		}
+		if err := history.write(tx, m.segment, m.userId, true, reasonRevert, entry.ExpiresAt, nil); err != nil {
+			tx.Rollback()
+			return structures.ChangeSet{}, err
+		}
+	}
+
+	rules, err := getSegmentRules(tx)
+	if err != nil {
+		tx.Rollback()
+		return structures.ChangeSet{}, err
+	}
+
+	var changedUsers []int
+	changedSegments := map[int][]string{}
+	for _, m := range changed {
+		if _, ok := changedSegments[m.userId]; !ok {
+			changedUsers = append(changedUsers, m.userId)
+		}
+		changedSegments[m.userId] = append(changedSegments[m.userId], m.segment)
+	}
+	for _, userId := range changedUsers {
+		if err := checkSegmentRules(tx, rules, userId, changedSegments[userId]); err != nil {
+			tx.Rollback()
+			return structures.ChangeSet{}, err
+		}
+	}
+
+	for _, userId := range restoredUsers {
+		if err := checkLayerMemberships(tx, userId, toRestore[userId]); err != nil {
+			tx.Rollback()
+			return structures.ChangeSet{}, err
+		}
+	}
+
+	markRevertedQuery := fmt.Sprintf("UPDATE %s SET reverted_by = $2 WHERE id = $1", changeSetsTable)
+	if _, err := tx.Exec(markRevertedQuery, id, *history.changeSet); err != nil {
+		tx.Rollback()
+		return structures.ChangeSet{}, err
+	}
+
+	revert := structures.ChangeSet{
+		Id:        *history.changeSet,
+		Kind:      changeSetRevert,
+		CreatedAt: history.createdAt,
+		Entries:   append([]structures.HistoryEntry{}, history.entries...),
+	}
+	return revert, tx.Commit()
+}
+
+// getChangeSet reads the change set with its history entries in the order they were written,
+// locking it when it is about to be reverted. Entries carry the current slugs of their segments,
+// so a change set written before a rename is reverted on the renamed segment.
+func getChangeSet(tx *sql.Tx, id int, lock bool) (structures.ChangeSet, error) {
+	getChangeSetQuery := fmt.Sprintf("SELECT id, kind, created_at, reverted_by, irreversible FROM %s WHERE id = $1", changeSetsTable)
+	if lock {
+		getChangeSetQuery += " FOR UPDATE"
+	}
+
+	var changeSet structures.ChangeSet
+	err := tx.QueryRow(getChangeSetQuery, id).Scan(&changeSet.Id, &changeSet.Kind, &changeSet.CreatedAt, &changeSet.RevertedBy, &changeSet.Irreversible)
+	if err == sql.ErrNoRows {
+		return structures.ChangeSet{}, structures.ChangeSetNotFoundError{Id: id}
+	}
+	if err != nil {
+		return structures.ChangeSet{}, err
+	}
+
+	getEntriesQuery := fmt.Sprintf(
+		"SELECT h.user_id, %s, h.operation, h.reason, h.expiration_time, h.operation_datetime FROM %s WHERE h.change_set = $1 ORDER BY h.id",
+		historySegment, historyWithSegments)
+	rows, err := tx.Query(getEntriesQuery, id)
+	if err != nil {
+		return structures.ChangeSet{}, err
+	}
+	defer rows.Close()
+
+	changeSet.Entries = []structures.HistoryEntry{}
+	for rows.Next() {
+		var entry structures.HistoryEntry
+		var operation bool
+		var at time.Time
+		if err := rows.Scan(&entry.UserId, &entry.Segment, &operation, &entry.Reason, &entry.ExpiresAt, &at); err != nil {
+			return structures.ChangeSet{}, err
+		}
+		entry.Operation = "remove"
+		if operation {
+			entry.Operation = "add"
+		}
+		entry.At = &at
+		changeSet.Entries = append(changeSet.Entries, entry)
+	}
+
+	return changeSet, rows.Err()
+}
+
+// checkChangedSince fails with the first membership of the change set that has a history entry written after it,
+// entries of a segment written before and after its rename are the same membership.
+func checkChangedSince(tx *sql.Tx, id int) error {
+	getChangedQuery := fmt.Sprintf(
+		`SELECT h.user_id, %[1]s FROM %[2]s
+		JOIN (SELECT h.user_id, %[1]s AS segment, MAX(h.id) AS last_id FROM %[2]s WHERE h.change_set = $1 GROUP BY 1, 2) c
+		ON c.user_id = h.user_id AND c.segment = %[1]s
+		WHERE h.id > c.last_id ORDER BY h.id LIMIT 1`,
+		historySegment, historyWithSegments)
+
+	var m membership
+	err := tx.QueryRow(getChangedQuery, id).Scan(&m.userId, &m.segment)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return structures.ChangeSetConflictError{Id: id, UserId: m.userId, Segment: m.segment}
+}
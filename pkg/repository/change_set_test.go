@@ -0,0 +1,312 @@
+package repository_test
+
+import (
+	"avito/pkg/repository"
+	"avito/pkg/structures"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	changeSetColumns      = []string{"id", "kind", "created_at", "reverted_by", "irreversible"}
+	changeSetEntryColumns = []string{"user_id", "segment", "operation", "reason", "expiration_time", "operation_datetime"}
+)
+
+func TestChangeSet_GetChangeSet(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewChangeSetDB(db)
+
+	createdAt := time.Date(2023, 8, 28, 20, 0, 0, 0, time.UTC)
+	expiresAt := createdAt.Add(72 * time.Hour)
+
+	tests := []struct {
+		name          string
+		mockBehavior  func()
+		want          structures.ChangeSet
+		expectedError string
+	}{
+		{
+			name: "Success",
+			mockBehavior: func() {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id, kind, created_at, reverted_by, irreversible FROM change_sets").
+					WithArgs(7).
+					WillReturnRows(sqlmock.NewRows(changeSetColumns).AddRow(7, "patch", createdAt, nil, false))
+				mock.ExpectQuery("SELECT (.+) FROM user_segments_history h LEFT JOIN segments s ON s.id = h.segment_id WHERE h.change_set = (.+) ORDER BY h.id").
+					WithArgs(7).
+					WillReturnRows(sqlmock.NewRows(changeSetEntryColumns).
+						AddRow(1, "AVITO_SALE", true, "manual", expiresAt, createdAt).
+						AddRow(1, "AVITO_VOICE", false, "manual", nil, createdAt))
+				mock.ExpectCommit()
+			},
+			want: structures.ChangeSet{
+				Id:        7,
+				Kind:      "patch",
+				CreatedAt: createdAt,
+				Entries: []structures.HistoryEntry{
+					{UserId: 1, Segment: "AVITO_SALE", Operation: "add", Reason: "manual", ExpiresAt: &expiresAt, At: &createdAt},
+					{UserId: 1, Segment: "AVITO_VOICE", Operation: "remove", Reason: "manual", At: &createdAt},
+				},
+			},
+		},
+		{
+			name: "NotFound",
+			mockBehavior: func() {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id, kind, created_at, reverted_by, irreversible FROM change_sets").
+					WithArgs(7).
+					WillReturnRows(sqlmock.NewRows(changeSetColumns))
+				mock.ExpectRollback()
+			},
+			expectedError: "change set 7 does not exist",
+		},
+		{
+			name: "EntriesError",
+			mockBehavior: func() {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id, kind, created_at, reverted_by, irreversible FROM change_sets").
+					WithArgs(7).
+					WillReturnRows(sqlmock.NewRows(changeSetColumns).AddRow(7, "patch", createdAt, nil, false))
+				mock.ExpectQuery("SELECT (.+) FROM user_segments_history").
+					WithArgs(7).
+					WillReturnError(errors.New("query error"))
+				mock.ExpectRollback()
+			},
+			expectedError: "query error",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior()
+
+			got, err := repo.GetChangeSet(7)
+			if testCase.expectedError != "" {
+				assert.EqualError(t, err, testCase.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testCase.want, got)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestChangeSet_RevertChangeSet(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewChangeSetDB(db)
+
+	createdAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	expiresAt := time.Now().Add(72 * time.Hour).Truncate(time.Second)
+	expiredAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	revertedBy := 8
+
+	expectChangeSet := func(revertedBy *int, kind string, entries *sqlmock.Rows) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT id, kind, created_at, reverted_by, irreversible FROM change_sets WHERE id = (.+) FOR UPDATE").
+			WithArgs(7).
+			WillReturnRows(sqlmock.NewRows(changeSetColumns).AddRow(7, kind, createdAt, revertedBy, false))
+		mock.ExpectQuery("SELECT (.+) FROM user_segments_history h LEFT JOIN segments s ON s.id = h.segment_id WHERE h.change_set").
+			WithArgs(7).
+			WillReturnRows(entries)
+	}
+
+	tests := []struct {
+		name          string
+		mockBehavior  func()
+		want          structures.ChangeSet
+		expectedError string
+	}{
+		{
+			name: "Success",
+			mockBehavior: func() {
+				expectChangeSet(nil, "patch", sqlmock.NewRows(changeSetEntryColumns).
+					AddRow(1, "segment1", true, "manual", nil, createdAt).
+					AddRow(1, "segment2", false, "manual", expiresAt, createdAt).
+					AddRow(1, "segment3", false, "manual", expiredAt, createdAt))
+				mock.ExpectQuery("SELECT h.user_id, COALESCE\\(s.slug, h.segment\\) FROM user_segments_history h").
+					WithArgs(7).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "segment"}))
+				mock.ExpectQuery("SELECT EXISTS").
+					WithArgs(1, "segment1").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectQuery("SELECT EXISTS").
+					WithArgs(1, "segment2").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectQuery("SELECT EXISTS").
+					WithArgs(1, "segment3").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array([]string{"segment1", "segment2", "segment3"}), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array([]string{"segment2"})).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+
+				mock.ExpectQuery("INSERT INTO change_sets").
+					WithArgs("revert", false).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(9, createdAt))
+
+				mock.ExpectQuery("DELETE FROM user_segments").
+					WithArgs(1, "segment1").
+					WillReturnRows(sqlmock.NewRows([]string{"active_from", "expiration_time"}).AddRow(nil, nil))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"segment1"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, "segment1", false, "revert", nil, nil, 9, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+
+				mock.ExpectExec("INSERT INTO user_segments").
+					WithArgs(1, "segment2", expiresAt).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"segment2"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, "segment2", true, "revert", nil, nil, 9, expiresAt).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+
+				expectNoRules(mock)
+				expectNoLayerConflict(mock, 1)
+				mock.ExpectExec("UPDATE change_sets SET reverted_by").
+					WithArgs(7, 9).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			want: structures.ChangeSet{
+				Id:        9,
+				Kind:      "revert",
+				CreatedAt: createdAt,
+				Entries: []structures.HistoryEntry{
+					{UserId: 1, Segment: "segment1", Operation: "remove", Reason: "revert"},
+					{UserId: 1, Segment: "segment2", Operation: "add", Reason: "revert", ExpiresAt: &expiresAt},
+				},
+			},
+		},
+		{
+			name: "AlreadyReverted",
+			mockBehavior: func() {
+				expectChangeSet(&revertedBy, "patch", sqlmock.NewRows(changeSetEntryColumns))
+				mock.ExpectRollback()
+			},
+			expectedError: "change set 7 is already reverted by change set 8",
+		},
+		{
+			name: "SegmentDeletion",
+			mockBehavior: func() {
+				expectChangeSet(nil, "segment_deletion", sqlmock.NewRows(changeSetEntryColumns).
+					AddRow(1, "segment1", false, "segment_deleted", nil, createdAt))
+				mock.ExpectRollback()
+			},
+			expectedError: "change set 7 deleted a segment and cannot be reverted",
+		},
+		{
+			name: "ChangedSince",
+			mockBehavior: func() {
+				expectChangeSet(nil, "patch", sqlmock.NewRows(changeSetEntryColumns).
+					AddRow(1, "segment1", true, "manual", nil, createdAt))
+				mock.ExpectQuery("SELECT h.user_id, COALESCE\\(s.slug, h.segment\\) FROM user_segments_history h").
+					WithArgs(7).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "segment"}).AddRow(1, "segment1"))
+				mock.ExpectRollback()
+			},
+			expectedError: "change set 7 cannot be reverted, segment segment1 of user 1 changed since",
+		},
+		{
+			name: "ExpiredSince",
+			mockBehavior: func() {
+				expectChangeSet(nil, "patch", sqlmock.NewRows(changeSetEntryColumns).
+					AddRow(1, "segment1", true, "manual", expiredAt, createdAt))
+				mock.ExpectQuery("SELECT h.user_id, COALESCE\\(s.slug, h.segment\\) FROM user_segments_history h").
+					WithArgs(7).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "segment"}))
+				mock.ExpectQuery("SELECT EXISTS").
+					WithArgs(1, "segment1").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectRollback()
+			},
+			expectedError: "change set 7 cannot be reverted, segment segment1 of user 1 changed since",
+		},
+		{
+			name: "SegmentFull",
+			mockBehavior: func() {
+				expectChangeSet(nil, "set", sqlmock.NewRows(changeSetEntryColumns).
+					AddRow(1, "segment1", false, "manual", nil, createdAt))
+				mock.ExpectQuery("SELECT h.user_id, COALESCE\\(s.slug, h.segment\\) FROM user_segments_history h").
+					WithArgs(7).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "segment"}))
+				mock.ExpectQuery("SELECT EXISTS").
+					WithArgs(1, "segment1").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array([]string{"segment1"}), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array([]string{"segment1"})).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}).AddRow("segment1", 10))
+				mock.ExpectQuery("SELECT segment, count(.+) FROM user_segments").
+					WithArgs(pq.Array([]string{"segment1"}), 1).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "count"}).AddRow("segment1", 10))
+				mock.ExpectRollback()
+			},
+			expectedError: "segment with slug segment1 is full, it is limited to 10 members",
+		},
+		{
+			name: "Irreversible",
+			mockBehavior: func() {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id, kind, created_at, reverted_by, irreversible FROM change_sets").
+					WithArgs(7).
+					WillReturnRows(sqlmock.NewRows(changeSetColumns).AddRow(7, "patch", createdAt, nil, true))
+				mock.ExpectQuery("SELECT (.+) FROM user_segments_history h LEFT JOIN segments s ON s.id = h.segment_id WHERE h.change_set").
+					WithArgs(7).
+					WillReturnRows(sqlmock.NewRows(changeSetEntryColumns).AddRow(1, "segment1", true, "manual", nil, createdAt))
+				mock.ExpectRollback()
+			},
+			expectedError: "change set 7 changed expirations or delayed memberships, which history does not record, and cannot be reverted",
+		},
+		{
+			name: "NotFound",
+			mockBehavior: func() {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id, kind, created_at, reverted_by, irreversible FROM change_sets").
+					WithArgs(7).
+					WillReturnRows(sqlmock.NewRows(changeSetColumns))
+				mock.ExpectRollback()
+			},
+			expectedError: "change set 7 does not exist",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior()
+
+			got, err := repo.RevertChangeSet(7)
+			if testCase.expectedError != "" {
+				assert.EqualError(t, err, testCase.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testCase.want, got)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
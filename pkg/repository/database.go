@@ -8,10 +8,23 @@ import (
 )
 
 const (
-	usersTable               = "users"
-	segmentsTable            = "segments"
-	userSegmentsTable        = "user_segments"
-	userSegmentsHistoryTable = "user_segments_history"
+	usersTable                 = "users"
+	segmentsTable              = "segments"
+	userSegmentsTable          = "user_segments"
+	userSegmentsHistoryTable   = "user_segments_history"
+	userPercentageSegments     = "user_percentage_segments"
+	layersTable                = "layers"
+	segmentVariantsTable       = "segment_variants"
+	segmentStateHistoryTable   = "segment_state_history"
+	rampPlansTable             = "ramp_plans"
+	rampStepsTable             = "ramp_steps"
+	changeSetsTable            = "change_sets"
+	segmentTagsTable           = "segment_tags"
+	segmentRulesTable          = "segment_rules"
+	segmentParentsTable        = "segment_parents"
+	segmentExpressionsTable    = "segment_expressions"
+	segmentExpressionRefsTable = "segment_expression_refs"
+	segmentTargetingTable      = "segment_targeting"
 )
 
 type Config struct {
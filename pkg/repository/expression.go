@@ -0,0 +1,274 @@
+package repository
+
+import (
+	"avito/pkg/structures"
+	"avito/pkg/utils"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// GetCompositeSegments returns the composite segments with their expressions that are evaluated for users:
+// active, within their activation window and schedule.
+func (r *SegmentDB) GetCompositeSegments() ([]structures.Segment, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	getSegmentsQuery := fmt.Sprintf(
+		"SELECT %s FROM %s WHERE slug IN (SELECT segment FROM %s) AND state = $1 AND %s ORDER BY slug",
+		segmentColumns, segmentsTable, segmentExpressionsTable, fmt.Sprintf(segmentInWindow, ""))
+	rows, err := tx.Query(getSegmentsQuery, utils.SegmentStateActive)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var segments []structures.Segment
+	var slugs []string
+	for rows.Next() {
+		segment, err := scanSegment(rows)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if !utils.InSchedule(segment.Schedule, now) {
+			continue
+		}
+		segments = append(segments, segment)
+		slugs = append(slugs, segment.Slug)
+	}
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	expressions, err := getSegmentsExpressions(tx, slugs)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for i := range segments {
+		if expression, ok := expressions[segments[i].Slug]; ok {
+			segments[i].Expression = &expression
+		}
+	}
+
+	return segments, tx.Commit()
+}
+
+func getSegmentExpression(q queryer, slug string) (*string, error) {
+	expressions, err := getSegmentsExpressions(q, []string{slug})
+	if err != nil {
+		return nil, err
+	}
+
+	if expression, ok := expressions[slug]; ok {
+		return &expression, nil
+	}
+	return nil, nil
+}
+
+func getSegmentsExpressions(q queryer, slugs []string) (map[string]string, error) {
+	expressions := map[string]string{}
+	if len(slugs) == 0 {
+		return expressions, nil
+	}
+
+	getExpressionsQuery := fmt.Sprintf("SELECT segment, expression FROM %s WHERE segment = ANY($1)", segmentExpressionsTable)
+	rows, err := q.Query(getExpressionsQuery, pq.Array(slugs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var slug, expression string
+		if err := rows.Scan(&slug, &expression); err != nil {
+			return nil, err
+		}
+		expressions[slug] = expression
+	}
+
+	return expressions, rows.Err()
+}
+
+// setSegmentExpression makes the segment composite with the expression, an empty expression makes it regular again.
+// The expression must refer to existing segments other than this one and must not reach it back through
+// the expressions of the composite segments it refers to; the references are locked, so concurrent changes
+// cannot close a cycle together. A segment with explicit members cannot become composite.
+func setSegmentExpression(tx *sql.Tx, slug string, value string) error {
+	if _, err := tx.Exec(fmt.Sprintf("LOCK TABLE %s IN EXCLUSIVE MODE", segmentExpressionRefsTable)); err != nil {
+		return err
+	}
+
+	if value == "" {
+		removeQuery := fmt.Sprintf("DELETE FROM %s WHERE segment = $1", segmentExpressionsTable)
+		_, err := tx.Exec(removeQuery, slug)
+		return err
+	}
+
+	expression, err := utils.ParseExpression(value)
+	if err != nil {
+		return structures.ValidationError{Message: err.Error()}
+	}
+
+	refs := expression.Slugs()
+	for _, ref := range refs {
+		if ref == slug {
+			return structures.ValidationError{Message: fmt.Sprintf("expression of segment %s cannot refer to the segment itself", slug)}
+		}
+	}
+
+	existing := map[string]bool{}
+	getExistingQuery := fmt.Sprintf("SELECT slug FROM %s WHERE slug = ANY($1)", segmentsTable)
+	rows, err := tx.Query(getExistingQuery, pq.Array(refs))
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var ref string
+		if err := rows.Scan(&ref); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[ref] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if !existing[ref] {
+			return structures.SegmentNotFoundError{Slug: ref}
+		}
+	}
+
+	var cycle bool
+	getCycleQuery := fmt.Sprintf(
+		`WITH RECURSIVE reached AS (
+			SELECT ref FROM %[1]s WHERE segment = ANY($1)
+			UNION
+			SELECT r.ref FROM %[1]s r JOIN reached d ON r.segment = d.ref
+		)
+		SELECT EXISTS (SELECT 1 FROM reached WHERE ref = $2)`,
+		segmentExpressionRefsTable)
+	if err := tx.QueryRow(getCycleQuery, pq.Array(refs), slug).Scan(&cycle); err != nil {
+		return err
+	}
+	if cycle {
+		return structures.ValidationError{Message: fmt.Sprintf("expression of segment %s refers to a segment whose expression refers back to it", slug)}
+	}
+
+	var hasMembers bool
+	getMembersQuery := fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE segment = $1)", userSegmentsTable)
+	if err := tx.QueryRow(getMembersQuery, slug).Scan(&hasMembers); err != nil {
+		return err
+	}
+	if hasMembers {
+		return structures.ValidationError{Message: fmt.Sprintf("segment %s has explicit members and cannot become composite", slug)}
+	}
+
+	setExpressionQuery := fmt.Sprintf(
+		"INSERT INTO %s (segment, expression) VALUES ($1, $2) ON CONFLICT (segment) DO UPDATE SET expression = EXCLUDED.expression",
+		segmentExpressionsTable)
+	if _, err := tx.Exec(setExpressionQuery, slug, expression.String()); err != nil {
+		return err
+	}
+
+	removeRefsQuery := fmt.Sprintf("DELETE FROM %s WHERE segment = $1", segmentExpressionRefsTable)
+	if _, err := tx.Exec(removeRefsQuery, slug); err != nil {
+		return err
+	}
+	insertRefQuery := fmt.Sprintf("INSERT INTO %s (segment, ref) VALUES ($1, $2)", segmentExpressionRefsTable)
+	for _, ref := range refs {
+		if _, err := tx.Exec(insertRefQuery, slug, ref); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// renameExpressionRefs rewrites the expressions that refer to a renamed segment, their references
+// already follow the new slug through ON UPDATE CASCADE.
+func renameExpressionRefs(tx *sql.Tx, slug, newSlug string) error {
+	getReferringQuery := fmt.Sprintf(
+		"SELECT segment, expression FROM %s WHERE segment IN (SELECT segment FROM %s WHERE ref = $1)",
+		segmentExpressionsTable, segmentExpressionRefsTable)
+	rows, err := tx.Query(getReferringQuery, newSlug)
+	if err != nil {
+		return err
+	}
+
+	renamed := map[string]string{}
+	var segments []string
+	for rows.Next() {
+		var segment, value string
+		if err := rows.Scan(&segment, &value); err != nil {
+			rows.Close()
+			return err
+		}
+		expression, err := utils.ParseExpression(value)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		expression.Rename(slug, newSlug)
+		renamed[segment] = expression.String()
+		segments = append(segments, segment)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	updateExpressionQuery := fmt.Sprintf("UPDATE %s SET expression = $2 WHERE segment = $1", segmentExpressionsTable)
+	for _, segment := range segments {
+		if _, err := tx.Exec(updateExpressionQuery, segment, renamed[segment]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkSegmentUnreferenced fails when the expression of another segment refers to the segment about to be deleted.
+func checkSegmentUnreferenced(tx *sql.Tx, slug string) error {
+	var referring string
+	getReferringQuery := fmt.Sprintf("SELECT segment FROM %s WHERE ref = $1 ORDER BY segment LIMIT 1", segmentExpressionRefsTable)
+	err := tx.QueryRow(getReferringQuery, slug).Scan(&referring)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return structures.ValidationError{Message: fmt.Sprintf("segment %s is used by the expression of segment %s", slug, referring)}
+}
+
+// checkSegmentsNotComposite fails with the first composite segment of the slugs,
+// the members of composite segments are computed and cannot be added.
+func checkSegmentsNotComposite(tx *sql.Tx, slugs []string) error {
+	if len(slugs) == 0 {
+		return nil
+	}
+
+	var slug string
+	getCompositeQuery := fmt.Sprintf("SELECT segment FROM %s WHERE segment = ANY($1) ORDER BY segment LIMIT 1", segmentExpressionsTable)
+	err := tx.QueryRow(getCompositeQuery, pq.Array(slugs)).Scan(&slug)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return structures.ValidationError{Message: fmt.Sprintf("segment %s is composite, its members are computed from its expression", slug)}
+}
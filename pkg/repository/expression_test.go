@@ -0,0 +1,97 @@
+package repository_test
+
+import (
+	"avito/pkg/repository"
+	"avito/pkg/structures"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegment_GetCompositeSegments(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewSegmentDB(db)
+
+	createdAt := time.Date(2023, 8, 28, 20, 0, 0, 0, time.UTC)
+	expression := "premium AND NOT churn_risk"
+
+	type mockBehavior func()
+
+	tests := []struct {
+		name          string
+		mockBehavior  mockBehavior
+		want          []structures.Segment
+		expectedError string
+	}{
+		{
+			name: "OK",
+			mockBehavior: func() {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM segments WHERE slug IN \\(SELECT segment FROM segment_expressions\\)").
+					WithArgs("active").
+					WillReturnRows(sqlmock.NewRows(rampSegmentColumns).
+						AddRow(1, "premium_retained", nil, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{"premium_retained"})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}).AddRow("premium_retained", expression))
+				mock.ExpectCommit()
+			},
+			want: []structures.Segment{{
+				Id:               1,
+				Slug:             "premium_retained",
+				BucketingVersion: 1,
+				State:            "active",
+				Expression:       &expression,
+				CreatedAt:        &createdAt,
+				UpdatedAt:        &createdAt,
+			}},
+		},
+		{
+			name: "None",
+			mockBehavior: func() {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM segments WHERE slug IN \\(SELECT segment FROM segment_expressions\\)").
+					WithArgs("active").
+					WillReturnRows(sqlmock.NewRows(rampSegmentColumns))
+				mock.ExpectCommit()
+			},
+			want: nil,
+		},
+		{
+			name: "QueryError",
+			mockBehavior: func() {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM segments WHERE slug IN \\(SELECT segment FROM segment_expressions\\)").
+					WithArgs("active").
+					WillReturnError(errors.New("query error"))
+				mock.ExpectRollback()
+			},
+			expectedError: "query error",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior()
+
+			got, err := repo.GetCompositeSegments()
+			if testCase.expectedError != "" {
+				assert.EqualError(t, err, testCase.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testCase.want, got)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package repository
+
+import (
+	"avito/pkg/structures"
+	"avito/pkg/utils"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// GetImpliedSegments returns the ancestors of the segments that are given to their members along with them:
+// active, within their activation window and schedule, and not among the segments already.
+func (r *SegmentDB) GetImpliedSegments(slugs []string) ([]string, error) {
+	if len(slugs) == 0 {
+		return nil, nil
+	}
+
+	getAncestorsQuery := fmt.Sprintf(
+		`WITH RECURSIVE ancestors AS (
+			SELECT parent FROM %[1]s WHERE segment = ANY($1)
+			UNION
+			SELECT p.parent FROM %[1]s p JOIN ancestors a ON p.segment = a.parent
+		)
+		SELECT s.slug, s.schedule FROM ancestors a JOIN %[2]s s ON s.slug = a.parent
+		WHERE s.slug <> ALL($1) AND s.state = $2 AND %[3]s ORDER BY s.slug`,
+		segmentParentsTable, segmentsTable, fmt.Sprintf(segmentInWindow, "s."))
+	rows, err := r.db.Query(getAncestorsQuery, pq.Array(slugs), utils.SegmentStateActive)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var implied []string
+	for rows.Next() {
+		var slug string
+		var schedule []byte
+		if err := rows.Scan(&slug, &schedule); err != nil {
+			return nil, err
+		}
+
+		if schedule != nil {
+			var segmentSchedule structures.SegmentSchedule
+			if err := json.Unmarshal(schedule, &segmentSchedule); err != nil {
+				return nil, err
+			}
+			if !utils.InSchedule(&segmentSchedule, now) {
+				continue
+			}
+		}
+
+		implied = append(implied, slug)
+	}
+
+	return implied, rows.Err()
+}
+
+// getSegmentFamily returns the parent and the children of the segment.
+func getSegmentFamily(q queryer, slug string) (*string, []string, error) {
+	getFamilyQuery := fmt.Sprintf("SELECT segment, parent FROM %s WHERE segment = $1 OR parent = $1 ORDER BY segment", segmentParentsTable)
+	rows, err := q.Query(getFamilyQuery, slug)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var parent *string
+	var children []string
+	for rows.Next() {
+		var segment, segmentParent string
+		if err := rows.Scan(&segment, &segmentParent); err != nil {
+			return nil, nil, err
+		}
+		if segment == slug {
+			parent = &segmentParent
+		} else {
+			children = append(children, segment)
+		}
+	}
+
+	return parent, children, rows.Err()
+}
+
+// setSegmentParent moves the segment under the parent, an empty parent detaches it.
+// A parent that descends from the segment is rejected, as it would close a cycle;
+// the hierarchy is locked, so concurrent moves cannot close one together.
+func setSegmentParent(tx *sql.Tx, slug string, parent string) error {
+	if _, err := tx.Exec(fmt.Sprintf("LOCK TABLE %s IN EXCLUSIVE MODE", segmentParentsTable)); err != nil {
+		return err
+	}
+
+	if parent == "" {
+		detachQuery := fmt.Sprintf("DELETE FROM %s WHERE segment = $1", segmentParentsTable)
+		_, err := tx.Exec(detachQuery, slug)
+		return err
+	}
+
+	if parent == slug {
+		return structures.ValidationError{Message: fmt.Sprintf("segment %s cannot be its own parent", slug)}
+	}
+
+	var id int
+	getParentQuery := fmt.Sprintf("SELECT id FROM %s WHERE slug = $1", segmentsTable)
+	err := tx.QueryRow(getParentQuery, parent).Scan(&id)
+	if err == sql.ErrNoRows {
+		return structures.SegmentNotFoundError{Slug: parent}
+	}
+	if err != nil {
+		return err
+	}
+
+	var cycle bool
+	getCycleQuery := fmt.Sprintf(
+		`WITH RECURSIVE ancestors AS (
+			SELECT parent FROM %[1]s WHERE segment = $1
+			UNION
+			SELECT p.parent FROM %[1]s p JOIN ancestors a ON p.segment = a.parent
+		)
+		SELECT EXISTS (SELECT 1 FROM ancestors WHERE parent = $2)`,
+		segmentParentsTable)
+	if err := tx.QueryRow(getCycleQuery, parent, slug).Scan(&cycle); err != nil {
+		return err
+	}
+	if cycle {
+		return structures.ValidationError{Message: fmt.Sprintf("segment %s cannot be the parent of %s, it descends from it", parent, slug)}
+	}
+
+	setParentQuery := fmt.Sprintf(
+		"INSERT INTO %s (segment, parent) VALUES ($1, $2) ON CONFLICT (segment) DO UPDATE SET parent = EXCLUDED.parent",
+		segmentParentsTable)
+	_, err = tx.Exec(setParentQuery, slug, parent)
+	return err
+}
+
+// releaseSegmentChildren detaches the children of a segment about to be deleted or moves them under its parent,
+// as decided; a segment with children cannot be deleted without a decision. The released children are returned.
+func releaseSegmentChildren(tx *sql.Tx, slug string, decision string) ([]string, error) {
+	parent, children, err := getSegmentFamily(tx, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(children) == 0 {
+		return nil, nil
+	}
+	if decision == "" {
+		return nil, structures.ValidationError{Message: fmt.Sprintf("segment %s has children, use children=detach or children=reparent", slug)}
+	}
+
+	if decision == utils.ChildrenReparent && parent != nil {
+		reparentQuery := fmt.Sprintf("UPDATE %s SET parent = $2 WHERE parent = $1", segmentParentsTable)
+		_, err = tx.Exec(reparentQuery, slug, *parent)
+	} else {
+		detachQuery := fmt.Sprintf("DELETE FROM %s WHERE parent = $1", segmentParentsTable)
+		_, err = tx.Exec(detachQuery, slug)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return children, nil
+}
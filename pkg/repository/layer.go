@@ -0,0 +1,202 @@
+package repository
+
+import (
+	"avito/pkg/structures"
+	"avito/pkg/utils"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// layerWidth is the number of layer buckets a segment takes, see utils.RolloutWidth.
+const layerWidth = "CASE WHEN bucketing_version = 2 THEN COALESCE(basis_points, 0) ELSE COALESCE(percent, 0) * 100 END"
+
+type LayerDB struct {
+	db *sql.DB
+}
+
+func NewLayerDB(db *sql.DB) *LayerDB {
+	return &LayerDB{db: db}
+}
+
+func (r *LayerDB) CreateLayer(layer structures.Layer) (string, error) {
+	var slug string
+	createLayerQuery := fmt.Sprintf("INSERT INTO %s (slug, description) VALUES ($1, $2) RETURNING slug", layersTable)
+	if err := r.db.QueryRow(createLayerQuery, layer.Slug, layer.Description).Scan(&slug); err != nil {
+		return "", err
+	}
+
+	return slug, nil
+}
+
+func (r *LayerDB) GetLayer(layer structures.Layer) (structures.Layer, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return structures.Layer{}, err
+	}
+
+	var result structures.Layer
+	var createdAt time.Time
+	getLayerQuery := fmt.Sprintf("SELECT id, slug, description, created_at FROM %s WHERE slug = $1", layersTable)
+	err = tx.QueryRow(getLayerQuery, layer.Slug).Scan(&result.Id, &result.Slug, &result.Description, &createdAt)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return structures.Layer{}, structures.LayerNotFoundError{Slug: layer.Slug}
+	}
+	if err != nil {
+		tx.Rollback()
+		return structures.Layer{}, err
+	}
+	result.CreatedAt = &createdAt
+
+	result.Segments, err = getLayerSegments(tx, layer.Slug, "")
+	if err != nil {
+		tx.Rollback()
+		return structures.Layer{}, err
+	}
+
+	result.FreeBasisPoints = utils.Buckets
+	for _, segment := range result.Segments {
+		result.FreeBasisPoints -= segment.Width
+	}
+
+	return result, tx.Commit()
+}
+
+// getLayerSegments returns the ranges taken in the layer by every segment except the given one.
+func getLayerSegments(tx *sql.Tx, layer string, except string) ([]structures.LayerSegment, error) {
+	getSegmentsQuery := fmt.Sprintf(
+		"SELECT slug, layer_offset, %s FROM %s WHERE layer = $1 AND slug <> $2 AND layer_offset IS NOT NULL ORDER BY layer_offset",
+		layerWidth, segmentsTable)
+	rows, err := tx.Query(getSegmentsQuery, layer, except)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	segments := []structures.LayerSegment{}
+	for rows.Next() {
+		var segment structures.LayerSegment
+		if err := rows.Scan(&segment.Slug, &segment.Offset, &segment.Width); err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+
+	return segments, rows.Err()
+}
+
+// lockLayer locks the layer row, so concurrent changes of the same layer cannot overlap.
+func lockLayer(tx *sql.Tx, layer string) error {
+	var slug string
+	lockLayerQuery := fmt.Sprintf("SELECT slug FROM %s WHERE slug = $1 FOR UPDATE", layersTable)
+	err := tx.QueryRow(lockLayerQuery, layer).Scan(&slug)
+	if err == sql.ErrNoRows {
+		return structures.LayerNotFoundError{Slug: layer}
+	}
+
+	return err
+}
+
+// allocateLayerRange finds the range of the segment in the layer.
+func allocateLayerRange(tx *sql.Tx, layer string, segment string, width int, preferred *int) (int, error) {
+	if err := lockLayer(tx, layer); err != nil {
+		return 0, err
+	}
+
+	taken, err := getLayerSegments(tx, layer, segment)
+	if err != nil {
+		return 0, err
+	}
+
+	offset, ok := utils.AllocateLayerRange(taken, width, preferred)
+	if !ok && preferred != nil {
+		return 0, structures.ValidationError{Message: fmt.Sprintf("layer %s has no free range of %d basis points at offset %d", layer, width, *preferred)}
+	}
+	if !ok {
+		return 0, structures.ValidationError{Message: fmt.Sprintf("layer %s has no free range of %d basis points", layer, width)}
+	}
+
+	return offset, nil
+}
+
+// checkLayerMemberships fails when the explicit segments of the user, once the changed ones are written,
+// include two segments of the same layer: a layer gives a user at most one segment, explicit or rolled out.
+// Delayed memberships count as the user will get them. Changes of the same user are serialized
+// by the advisory lock shared with checkSegmentRules.
+func checkLayerMemberships(tx *sql.Tx, userId int, changed []string) error {
+	if len(changed) == 0 {
+		return nil
+	}
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", userId); err != nil {
+		return err
+	}
+
+	var layer, first, second string
+	getConflictQuery := fmt.Sprintf(
+		`SELECT s.layer, MIN(s.slug), MAX(s.slug) FROM %[1]s us JOIN %[2]s s ON s.slug = us.segment
+		WHERE us.user_id = $1 AND s.layer IN (SELECT layer FROM %[2]s WHERE slug = ANY($2) AND layer IS NOT NULL)
+		GROUP BY s.layer HAVING count(*) > 1 ORDER BY s.layer LIMIT 1`,
+		userSegmentsTable, segmentsTable)
+	err := tx.QueryRow(getConflictQuery, userId, pq.Array(changed)).Scan(&layer, &first, &second)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return structures.ValidationError{Message: fmt.Sprintf("user %d cannot be in both %s and %s, layer %s gives a user at most one segment", userId, first, second, layer)}
+}
+
+// checkLayerSegmentMembers fails when an explicit member of the segment moved into the layer
+// is already a member of another segment of it.
+func checkLayerSegmentMembers(tx *sql.Tx, segment string, layer string) error {
+	var userId int
+	var other string
+	getConflictQuery := fmt.Sprintf(
+		`SELECT us.user_id, MIN(o.segment) FROM %[1]s us
+		JOIN %[1]s o ON o.user_id = us.user_id AND o.segment <> us.segment
+		JOIN %[2]s s ON s.slug = o.segment
+		WHERE us.segment = $1 AND s.layer = $2
+		GROUP BY us.user_id ORDER BY us.user_id LIMIT 1`,
+		userSegmentsTable, segmentsTable)
+	err := tx.QueryRow(getConflictQuery, segment, layer).Scan(&userId, &other)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return structures.ValidationError{Message: fmt.Sprintf("user %d cannot be in both %s and %s, layer %s gives a user at most one segment", userId, segment, other, layer)}
+}
+
+// GetSegmentLayers returns the layers of the segments, the explicit segments of a user take their layers
+// before the rollout of the other segments of them.
+func (r *SegmentDB) GetSegmentLayers(slugs []string) ([]string, error) {
+	if len(slugs) == 0 {
+		return nil, nil
+	}
+
+	getLayersQuery := fmt.Sprintf("SELECT DISTINCT layer FROM %s WHERE slug = ANY($1) AND layer IS NOT NULL ORDER BY layer", segmentsTable)
+	rows, err := r.db.Query(getLayersQuery, pq.Array(slugs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var layers []string
+	for rows.Next() {
+		var layer string
+		if err := rows.Scan(&layer); err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+
+	return layers, rows.Err()
+}
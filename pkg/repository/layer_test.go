@@ -0,0 +1,238 @@
+package repository_test
+
+import (
+	"avito/pkg/repository"
+	"avito/pkg/structures"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLayer_CreateLayer(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewLayerDB(db)
+
+	var description = "Checkout experiments"
+
+	type mockBehavior func(layer structures.Layer)
+
+	tests := []struct {
+		name          string
+		layer         structures.Layer
+		mockBehavior  mockBehavior
+		wantErr       bool
+		expectedError string
+	}{
+		{
+			name:  "OK",
+			layer: structures.Layer{Slug: "checkout", Description: &description},
+			mockBehavior: func(layer structures.Layer) {
+				mock.ExpectQuery("INSERT INTO layers").
+					WithArgs(layer.Slug, description).
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(layer.Slug))
+			},
+		},
+		{
+			name:  "DuplicateSlug",
+			layer: structures.Layer{Slug: "checkout"},
+			mockBehavior: func(layer structures.Layer) {
+				mock.ExpectQuery("INSERT INTO layers").
+					WithArgs(layer.Slug, nil).
+					WillReturnError(errors.New("duplicate slug"))
+			},
+			wantErr:       true,
+			expectedError: "duplicate slug",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior(testCase.layer)
+
+			got, err := repo.CreateLayer(testCase.layer)
+			if testCase.wantErr {
+				assert.EqualError(t, err, testCase.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testCase.layer.Slug, got)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestLayer_GetLayer(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewLayerDB(db)
+
+	createdAt := time.Date(2023, 8, 28, 20, 0, 0, 0, time.UTC)
+
+	type mockBehavior func(slug string)
+
+	tests := []struct {
+		name          string
+		slug          string
+		mockBehavior  mockBehavior
+		expected      structures.Layer
+		wantErr       bool
+		expectedError string
+	}{
+		{
+			name: "OK",
+			slug: "checkout",
+			mockBehavior: func(slug string) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id, slug, description, created_at FROM layers").
+					WithArgs(slug).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "description", "created_at"}).AddRow(1, slug, nil, createdAt))
+				mock.ExpectQuery("SELECT slug, layer_offset, (.+) FROM segments WHERE layer").
+					WithArgs(slug, "").
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "layer_offset", "width"}).
+						AddRow("checkout-a", 0, 1250).
+						AddRow("checkout-b", 1250, 2500))
+				mock.ExpectCommit()
+			},
+			expected: structures.Layer{
+				Id:        1,
+				Slug:      "checkout",
+				CreatedAt: &createdAt,
+				Segments: []structures.LayerSegment{
+					{Slug: "checkout-a", Offset: 0, Width: 1250},
+					{Slug: "checkout-b", Offset: 1250, Width: 2500},
+				},
+				FreeBasisPoints: 6250,
+			},
+		},
+		{
+			name: "NotFound",
+			slug: "checkout",
+			mockBehavior: func(slug string) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id, slug, description, created_at FROM layers").
+					WithArgs(slug).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "description", "created_at"}))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "layer with slug checkout does not exist",
+		},
+		{
+			name: "SegmentsError",
+			slug: "checkout",
+			mockBehavior: func(slug string) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id, slug, description, created_at FROM layers").
+					WithArgs(slug).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "description", "created_at"}).AddRow(1, slug, nil, createdAt))
+				mock.ExpectQuery("SELECT slug, layer_offset, (.+) FROM segments WHERE layer").
+					WithArgs(slug, "").
+					WillReturnError(errors.New("query error"))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "query error",
+		},
+		{
+			name: "BeginError",
+			slug: "checkout",
+			mockBehavior: func(slug string) {
+				mock.ExpectBegin().WillReturnError(errors.New("begin error"))
+			},
+			wantErr:       true,
+			expectedError: "begin error",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior(testCase.slug)
+
+			got, err := repo.GetLayer(structures.Layer{Slug: testCase.slug})
+			if testCase.wantErr {
+				assert.EqualError(t, err, testCase.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testCase.expected, got)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSegment_GetSegmentLayers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewSegmentDB(db)
+
+	type mockBehavior func(slugs []string)
+
+	tests := []struct {
+		name          string
+		slugs         []string
+		mockBehavior  mockBehavior
+		expected      []string
+		wantErr       bool
+		expectedError string
+	}{
+		{
+			name:  "OK",
+			slugs: []string{"checkout-manual", "dark-mode"},
+			mockBehavior: func(slugs []string) {
+				mock.ExpectQuery("SELECT DISTINCT layer FROM segments").
+					WithArgs(pq.Array(slugs)).
+					WillReturnRows(sqlmock.NewRows([]string{"layer"}).AddRow("checkout"))
+			},
+			expected: []string{"checkout"},
+		},
+		{
+			name:         "NoSegments",
+			slugs:        nil,
+			mockBehavior: func(slugs []string) {},
+		},
+		{
+			name:  "QueryError",
+			slugs: []string{"checkout-manual"},
+			mockBehavior: func(slugs []string) {
+				mock.ExpectQuery("SELECT DISTINCT layer FROM segments").
+					WithArgs(pq.Array(slugs)).
+					WillReturnError(errors.New("query error"))
+			},
+			wantErr:       true,
+			expectedError: "query error",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior(testCase.slugs)
+
+			got, err := repo.GetSegmentLayers(testCase.slugs)
+			if testCase.wantErr {
+				assert.EqualError(t, err, testCase.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testCase.expected, got)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
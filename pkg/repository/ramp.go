@@ -0,0 +1,312 @@
+package repository
+
+import (
+	"avito/pkg/structures"
+	"avito/pkg/utils"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type RampDB struct {
+	db *sql.DB
+}
+
+func NewRampDB(db *sql.DB) *RampDB {
+	return &RampDB{db: db}
+}
+
+// CreateRampPlan attaches the plan to the segment, the steps that are already due are applied right away.
+func (r *RampDB) CreateRampPlan(plan structures.RampPlan) (structures.RampPlan, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return structures.RampPlan{}, err
+	}
+
+	var state string
+	getStateQuery := fmt.Sprintf("SELECT state FROM %s WHERE slug = $1 FOR UPDATE", segmentsTable)
+	err = tx.QueryRow(getStateQuery, plan.Segment).Scan(&state)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return structures.RampPlan{}, structures.SegmentNotFoundError{Slug: plan.Segment}
+	}
+	if err != nil {
+		tx.Rollback()
+		return structures.RampPlan{}, err
+	}
+	if state == utils.SegmentStateArchived {
+		tx.Rollback()
+		return structures.RampPlan{}, structures.SegmentArchivedError{Slug: plan.Segment}
+	}
+
+	var running string
+	getRunningQuery := fmt.Sprintf("SELECT status FROM %s WHERE segment = $1 AND status IN ($2, $3)", rampPlansTable)
+	err = tx.QueryRow(getRunningQuery, plan.Segment, utils.RampPlanActive, utils.RampPlanPaused).Scan(&running)
+	if err == nil {
+		tx.Rollback()
+		return structures.RampPlan{}, structures.ValidationError{Message: fmt.Sprintf("segment %s already has a running ramp plan", plan.Segment)}
+	}
+	if err != sql.ErrNoRows {
+		tx.Rollback()
+		return structures.RampPlan{}, err
+	}
+
+	offset, err := utils.ParseRampOffset(plan.Steps[0].After)
+	if err != nil {
+		tx.Rollback()
+		return structures.RampPlan{}, structures.ValidationError{Message: err.Error()}
+	}
+
+	var id int
+	createPlanQuery := fmt.Sprintf("INSERT INTO %s (segment, status, next_step_at) VALUES ($1, $2, $3) RETURNING id", rampPlansTable)
+	err = tx.QueryRow(createPlanQuery, plan.Segment, utils.RampPlanActive, time.Now().Add(offset)).Scan(&id)
+	if err != nil {
+		tx.Rollback()
+		return structures.RampPlan{}, err
+	}
+
+	createStepQuery := fmt.Sprintf("INSERT INTO %s (plan_id, position, percentage, after) VALUES ($1, $2, $3, $4)", rampStepsTable)
+	for i, step := range plan.Steps {
+		if _, err := tx.Exec(createStepQuery, id, i, step.Percentage, step.After); err != nil {
+			tx.Rollback()
+			return structures.RampPlan{}, err
+		}
+	}
+
+	if _, err := advanceRampPlan(tx, id, time.Now()); err != nil {
+		tx.Rollback()
+		return structures.RampPlan{}, err
+	}
+
+	result, err := getRampPlan(tx, plan.Segment)
+	if err != nil {
+		tx.Rollback()
+		return structures.RampPlan{}, err
+	}
+
+	return result, tx.Commit()
+}
+
+// GetRampPlan returns the latest plan of the segment.
+func (r *RampDB) GetRampPlan(segment structures.Segment) (structures.RampPlan, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return structures.RampPlan{}, err
+	}
+
+	plan, err := getRampPlan(tx, segment.Slug)
+	if err != nil {
+		tx.Rollback()
+		return structures.RampPlan{}, err
+	}
+
+	return plan, tx.Commit()
+}
+
+// SetRampPlanStatus pauses, resumes or aborts the latest plan of the segment.
+// A resumed plan is shifted by the time it spent paused, so the steps keep their spacing.
+func (r *RampDB) SetRampPlanStatus(change structures.RampPlanStatusChange) (structures.RampPlan, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return structures.RampPlan{}, err
+	}
+
+	var id int
+	var from string
+	getPlanQuery := fmt.Sprintf("SELECT id, status FROM %s WHERE segment = $1 ORDER BY id DESC LIMIT 1 FOR UPDATE", rampPlansTable)
+	err = tx.QueryRow(getPlanQuery, change.Segment).Scan(&id, &from)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return structures.RampPlan{}, structures.RampPlanNotFoundError{Slug: change.Segment}
+	}
+	if err != nil {
+		tx.Rollback()
+		return structures.RampPlan{}, err
+	}
+
+	if err := utils.ValidateRampPlanTransition(from, change.Status); err != nil {
+		tx.Rollback()
+		return structures.RampPlan{}, structures.ValidationError{Message: err.Error()}
+	}
+
+	setStatusQuery := fmt.Sprintf(
+		`UPDATE %s SET
+			next_step_at = CASE WHEN status = $3 AND $2 = $4 THEN next_step_at + (NOW() - paused_at) ELSE next_step_at END,
+			paused_at = CASE WHEN $2 = $3 THEN NOW() END,
+			status = $2
+		WHERE id = $1`,
+		rampPlansTable)
+	if _, err := tx.Exec(setStatusQuery, id, change.Status, utils.RampPlanPaused, utils.RampPlanActive); err != nil {
+		tx.Rollback()
+		return structures.RampPlan{}, err
+	}
+
+	plan, err := getRampPlan(tx, change.Segment)
+	if err != nil {
+		tx.Rollback()
+		return structures.RampPlan{}, err
+	}
+
+	return plan, tx.Commit()
+}
+
+// AdvanceRampPlans applies the due steps of the active plans and returns the number of steps applied.
+// Each plan advances in its own transaction, so a failing plan does not hold back the others.
+func (r *RampDB) AdvanceRampPlans() (int, error) {
+	now := time.Now()
+	getDueQuery := fmt.Sprintf("SELECT id FROM %s WHERE status = $1 AND next_step_at <= $2 ORDER BY next_step_at", rampPlansTable)
+	rows, err := r.db.Query(getDueQuery, utils.RampPlanActive, now)
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	var firstErr error
+	for _, id := range ids {
+		count, err := r.advance(id, now)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("ramp plan %d: %w", id, err)
+			}
+			continue
+		}
+		applied += count
+	}
+
+	return applied, firstErr
+}
+
+func (r *RampDB) advance(id int, now time.Time) (int, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	applied, err := advanceRampPlan(tx, id, now)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return applied, tx.Commit()
+}
+
+// advanceRampPlan applies the steps of the plan that are due at the moment.
+// A plan locked by another run or no longer active is skipped.
+func advanceRampPlan(tx *sql.Tx, id int, now time.Time) (int, error) {
+	var slug string
+	var nextStep, bucketingVersion int
+	var nextStepAt time.Time
+	lockPlanQuery := fmt.Sprintf(
+		`SELECT p.segment, p.next_step, p.next_step_at, s.bucketing_version FROM %s p
+		JOIN %s s ON s.slug = p.segment
+		WHERE p.id = $1 AND p.status = $2 FOR UPDATE OF p SKIP LOCKED`,
+		rampPlansTable, segmentsTable)
+	err := tx.QueryRow(lockPlanQuery, id, utils.RampPlanActive).Scan(&slug, &nextStep, &nextStepAt, &bucketingVersion)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	steps, err := getRampSteps(tx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	applyStepQuery := fmt.Sprintf("UPDATE %s SET applied_at = NOW() WHERE plan_id = $1 AND position = $2", rampStepsTable)
+	applied := 0
+	for nextStep < len(steps) && !nextStepAt.After(now) {
+		update := structures.SegmentUpdate{Slug: slug}
+		percentage := steps[nextStep].Percentage
+		if bucketingVersion == utils.BucketingV2 {
+			basisPoints := percentage * 100
+			update.BasisPoints = &basisPoints
+		} else {
+			update.Percentage = &percentage
+		}
+		if _, err := updateSegment(tx, update); err != nil {
+			return 0, err
+		}
+
+		if _, err := tx.Exec(applyStepQuery, id, nextStep); err != nil {
+			return 0, err
+		}
+		applied++
+
+		nextStep++
+		if nextStep < len(steps) {
+			previous, _ := utils.ParseRampOffset(steps[nextStep-1].After)
+			offset, _ := utils.ParseRampOffset(steps[nextStep].After)
+			nextStepAt = nextStepAt.Add(offset - previous)
+		}
+	}
+
+	status, due := utils.RampPlanActive, &nextStepAt
+	if nextStep == len(steps) {
+		status, due = utils.RampPlanCompleted, nil
+	}
+
+	updatePlanQuery := fmt.Sprintf("UPDATE %s SET next_step = $2, next_step_at = $3, status = $4 WHERE id = $1", rampPlansTable)
+	if _, err := tx.Exec(updatePlanQuery, id, nextStep, due, status); err != nil {
+		return 0, err
+	}
+
+	return applied, nil
+}
+
+func getRampPlan(tx *sql.Tx, slug string) (structures.RampPlan, error) {
+	var plan structures.RampPlan
+	getPlanQuery := fmt.Sprintf(
+		"SELECT id, segment, status, next_step_at, created_at FROM %s WHERE segment = $1 ORDER BY id DESC LIMIT 1",
+		rampPlansTable)
+	err := tx.QueryRow(getPlanQuery, slug).Scan(&plan.Id, &plan.Segment, &plan.Status, &plan.NextStepAt, &plan.CreatedAt)
+	if err == sql.ErrNoRows {
+		return structures.RampPlan{}, structures.RampPlanNotFoundError{Slug: slug}
+	}
+	if err != nil {
+		return structures.RampPlan{}, err
+	}
+
+	plan.Steps, err = getRampSteps(tx, plan.Id)
+	if err != nil {
+		return structures.RampPlan{}, err
+	}
+
+	return plan, nil
+}
+
+func getRampSteps(tx *sql.Tx, id int) ([]structures.RampStep, error) {
+	getStepsQuery := fmt.Sprintf("SELECT percentage, after, applied_at FROM %s WHERE plan_id = $1 ORDER BY position", rampStepsTable)
+	rows, err := tx.Query(getStepsQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	steps := []structures.RampStep{}
+	for rows.Next() {
+		var step structures.RampStep
+		if err := rows.Scan(&step.Percentage, &step.After, &step.AppliedAt); err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+
+	return steps, rows.Err()
+}
@@ -0,0 +1,389 @@
+package repository_test
+
+import (
+	"avito/pkg/repository"
+	"avito/pkg/structures"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	rampPlanColumns    = []string{"id", "segment", "status", "next_step_at", "created_at"}
+	rampStepColumns    = []string{"percentage", "after", "applied_at"}
+	rampSegmentColumns = []string{"id", "slug", "percent", "display_name", "description", "owner", "bucketing_version", "salt", "hash_function", "basis_points", "created_at", "updated_at", "layer", "layer_offset", "state", "starts_at", "ends_at", "schedule", "max_members", "default_ttl", "max_ttl"}
+)
+
+func TestRamp_CreateRampPlan(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewRampDB(db)
+
+	createdAt := time.Now().Add(-time.Minute)
+	nextStepAt := createdAt.Add(24 * time.Hour)
+	steps := []structures.RampStep{{Percentage: 1}, {Percentage: 5, After: "24h"}}
+
+	type mockBehavior func(plan structures.RampPlan)
+
+	tests := []struct {
+		name          string
+		plan          structures.RampPlan
+		mockBehavior  mockBehavior
+		wantStatus    string
+		wantErr       bool
+		expectedError string
+	}{
+		{
+			name: "OK",
+			plan: structures.RampPlan{Segment: "example", Steps: steps},
+			mockBehavior: func(plan structures.RampPlan) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT state FROM segments").
+					WithArgs(plan.Segment).
+					WillReturnRows(sqlmock.NewRows([]string{"state"}).AddRow("active"))
+				mock.ExpectQuery("SELECT status FROM ramp_plans").
+					WithArgs(plan.Segment, "active", "paused").
+					WillReturnRows(sqlmock.NewRows([]string{"status"}))
+				mock.ExpectQuery("INSERT INTO ramp_plans").
+					WithArgs(plan.Segment, "active", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				mock.ExpectExec("INSERT INTO ramp_steps").
+					WithArgs(1, 0, 1, "").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO ramp_steps").
+					WithArgs(1, 1, 5, "24h").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT p.segment, p.next_step, p.next_step_at, s.bucketing_version FROM ramp_plans").
+					WithArgs(1, "active").
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "next_step", "next_step_at", "bucketing_version"}).
+						AddRow(plan.Segment, 0, createdAt, 1))
+				mock.ExpectQuery("SELECT percentage, after, applied_at FROM ramp_steps").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows(rampStepColumns).AddRow(1, "", nil).AddRow(5, "24h", nil))
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(plan.Segment, 1, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(rampSegmentColumns).
+						AddRow(1, plan.Segment, 1, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT user_id FROM user_percentage_segments").
+					WithArgs(plan.Segment).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(plan.Segment).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(plan.Segment).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(plan.Segment).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{plan.Segment})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{plan.Segment})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectExec("UPDATE ramp_steps SET applied_at").
+					WithArgs(1, 0).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE ramp_plans SET next_step").
+					WithArgs(1, 1, nextStepAt, "active").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT id, segment, status, next_step_at, created_at FROM ramp_plans").
+					WithArgs(plan.Segment).
+					WillReturnRows(sqlmock.NewRows(rampPlanColumns).AddRow(1, plan.Segment, "active", nextStepAt, createdAt))
+				mock.ExpectQuery("SELECT percentage, after, applied_at FROM ramp_steps").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows(rampStepColumns).AddRow(1, "", createdAt).AddRow(5, "24h", nil))
+				mock.ExpectCommit()
+			},
+			wantStatus: "active",
+		},
+		{
+			name: "SegmentNotFound",
+			plan: structures.RampPlan{Segment: "example", Steps: steps},
+			mockBehavior: func(plan structures.RampPlan) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT state FROM segments").
+					WithArgs(plan.Segment).
+					WillReturnRows(sqlmock.NewRows([]string{"state"}))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "segment with slug example does not exist",
+		},
+		{
+			name: "Archived",
+			plan: structures.RampPlan{Segment: "example", Steps: steps},
+			mockBehavior: func(plan structures.RampPlan) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT state FROM segments").
+					WithArgs(plan.Segment).
+					WillReturnRows(sqlmock.NewRows([]string{"state"}).AddRow("archived"))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "segment with slug example is archived",
+		},
+		{
+			name: "RunningPlan",
+			plan: structures.RampPlan{Segment: "example", Steps: steps},
+			mockBehavior: func(plan structures.RampPlan) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT state FROM segments").
+					WithArgs(plan.Segment).
+					WillReturnRows(sqlmock.NewRows([]string{"state"}).AddRow("active"))
+				mock.ExpectQuery("SELECT status FROM ramp_plans").
+					WithArgs(plan.Segment, "active", "paused").
+					WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("paused"))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "segment example already has a running ramp plan",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior(testCase.plan)
+
+			got, err := repo.CreateRampPlan(testCase.plan)
+			if testCase.wantErr {
+				assert.Error(t, err)
+				assert.EqualError(t, err, testCase.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testCase.wantStatus, got.Status)
+				assert.Len(t, got.Steps, len(testCase.plan.Steps))
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestRamp_SetRampPlanStatus(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewRampDB(db)
+
+	createdAt := time.Date(2023, 8, 28, 20, 0, 0, 0, time.UTC)
+
+	type mockBehavior func(change structures.RampPlanStatusChange)
+
+	tests := []struct {
+		name          string
+		change        structures.RampPlanStatusChange
+		mockBehavior  mockBehavior
+		wantErr       bool
+		expectedError string
+	}{
+		{
+			name:   "OK",
+			change: structures.RampPlanStatusChange{Segment: "example", Status: "paused"},
+			mockBehavior: func(change structures.RampPlanStatusChange) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id, status FROM ramp_plans").
+					WithArgs(change.Segment).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "status"}).AddRow(1, "active"))
+				mock.ExpectExec("UPDATE ramp_plans SET").
+					WithArgs(1, change.Status, "paused", "active").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT id, segment, status, next_step_at, created_at FROM ramp_plans").
+					WithArgs(change.Segment).
+					WillReturnRows(sqlmock.NewRows(rampPlanColumns).AddRow(1, change.Segment, "paused", createdAt, createdAt))
+				mock.ExpectQuery("SELECT percentage, after, applied_at FROM ramp_steps").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows(rampStepColumns).AddRow(1, "", createdAt))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:   "Completed",
+			change: structures.RampPlanStatusChange{Segment: "example", Status: "paused"},
+			mockBehavior: func(change structures.RampPlanStatusChange) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id, status FROM ramp_plans").
+					WithArgs(change.Segment).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "status"}).AddRow(1, "completed"))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "ramp plan cannot go from completed to paused",
+		},
+		{
+			name:   "NotFound",
+			change: structures.RampPlanStatusChange{Segment: "example", Status: "aborted"},
+			mockBehavior: func(change structures.RampPlanStatusChange) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id, status FROM ramp_plans").
+					WithArgs(change.Segment).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "status"}))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "segment with slug example has no ramp plan",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior(testCase.change)
+
+			got, err := repo.SetRampPlanStatus(testCase.change)
+			if testCase.wantErr {
+				assert.Error(t, err)
+				assert.EqualError(t, err, testCase.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testCase.change.Status, got.Status)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestRamp_AdvanceRampPlans(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewRampDB(db)
+
+	createdAt := time.Date(2023, 8, 28, 20, 0, 0, 0, time.UTC)
+
+	type mockBehavior func()
+
+	tests := []struct {
+		name          string
+		mockBehavior  mockBehavior
+		wantApplied   int
+		wantErr       bool
+		expectedError string
+	}{
+		{
+			name: "LastStep",
+			mockBehavior: func() {
+				mock.ExpectQuery("SELECT id FROM ramp_plans").
+					WithArgs("active", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT p.segment, p.next_step, p.next_step_at, s.bucketing_version FROM ramp_plans").
+					WithArgs(1, "active").
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "next_step", "next_step_at", "bucketing_version"}).
+						AddRow("example", 1, createdAt, 2))
+				mock.ExpectQuery("SELECT percentage, after, applied_at FROM ramp_steps").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows(rampStepColumns).AddRow(1, "", createdAt).AddRow(5, "24h", nil))
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs("example", nil, nil, nil, nil, nil, nil, nil, 500, nil, nil, nil, nil, nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(rampSegmentColumns).
+						AddRow(1, "example", nil, nil, nil, nil, 2, "example", "murmur3", 500, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT user_id FROM user_percentage_segments").
+					WithArgs("example").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs("example").
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs("example").
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs("example").
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{"example"})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{"example"})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectExec("UPDATE ramp_steps SET applied_at").
+					WithArgs(1, 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("UPDATE ramp_plans SET next_step").
+					WithArgs(1, 2, nil, "completed").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			wantApplied: 1,
+		},
+		{
+			name: "Locked",
+			mockBehavior: func() {
+				mock.ExpectQuery("SELECT id FROM ramp_plans").
+					WithArgs("active", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT p.segment, p.next_step, p.next_step_at, s.bucketing_version FROM ramp_plans").
+					WithArgs(1, "active").
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "next_step", "next_step_at", "bucketing_version"}))
+				mock.ExpectCommit()
+			},
+			wantApplied: 0,
+		},
+		{
+			name: "PlanError",
+			mockBehavior: func() {
+				mock.ExpectQuery("SELECT id FROM ramp_plans").
+					WithArgs("active", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT p.segment, p.next_step, p.next_step_at, s.bucketing_version FROM ramp_plans").
+					WithArgs(1, "active").
+					WillReturnError(errors.New("query error"))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "ramp plan 1: query error",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior()
+
+			got, err := repo.AdvanceRampPlans()
+			if testCase.wantErr {
+				assert.Error(t, err)
+				assert.EqualError(t, err, testCase.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testCase.wantApplied, got)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestRamp_GetRampPlan(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewRampDB(db)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, segment, status, next_step_at, created_at FROM ramp_plans").
+		WithArgs("example").
+		WillReturnRows(sqlmock.NewRows(rampPlanColumns))
+	mock.ExpectRollback()
+
+	_, err = repo.GetRampPlan(structures.Segment{Slug: "example"})
+	assert.EqualError(t, err, "segment with slug example has no ramp plan")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -7,14 +7,53 @@ import (
 
 type Segment interface {
 	Create(segment structures.Segment) (string, error)
-	Delete(segment structures.Segment) (string, error)
-	GetPercentageSegments() (map[string]int, error)
+	Delete(segment structures.Segment, children string) (structures.SegmentDeletion, error)
+	DeleteDryRun(segment structures.Segment, children string) (structures.SegmentDeletion, error)
+	GetPercentageSegments() ([]structures.Segment, error)
+	GetCompositeSegments() ([]structures.Segment, error)
+	Get(segment structures.Segment) (structures.Segment, error)
+	List(filter structures.SegmentsFilter) ([]structures.Segment, int, error)
+	Rename(rename structures.SegmentRename) (string, error)
+	Clone(clone structures.SegmentClone) (structures.SegmentCloneResult, error)
+	Update(update structures.SegmentUpdate) (structures.Segment, error)
+	SetState(change structures.SegmentStateChange) (structures.Segment, error)
+	GetStateHistory(segment structures.Segment) ([]structures.SegmentStateTransition, error)
+	GetImpliedSegments(slugs []string) ([]string, error)
+	GetSegmentLayers(slugs []string) ([]string, error)
 }
 
 type UserSegments interface {
-	Patch(userSegments structures.UserSegments) (int, error)
+	Patch(userSegments structures.UserSegments) (structures.PatchResult, error)
+	SetUserSegments(set structures.UserSegmentsSet) (structures.PatchResult, error)
 	GetUserSegments(user structures.User) ([]string, error)
-	GetSegmentUsers(segment structures.Segment) ([]int, error)
+	GetSegmentUsers(filter structures.SegmentUsersFilter) ([]int, error)
+	RecordPercentageSegments(user structures.User, segments []string) error
+	ClosePercentageSegments(user structures.User, segments []string) error
+	GetUserVariants(user structures.User, segments []string) (map[string]string, error)
+	GetUpcomingActivations(filter structures.ActivationsFilter) ([]structures.Activation, error)
+}
+
+type Layer interface {
+	CreateLayer(layer structures.Layer) (string, error)
+	GetLayer(layer structures.Layer) (structures.Layer, error)
+}
+
+type Ramp interface {
+	CreateRampPlan(plan structures.RampPlan) (structures.RampPlan, error)
+	GetRampPlan(segment structures.Segment) (structures.RampPlan, error)
+	SetRampPlanStatus(change structures.RampPlanStatusChange) (structures.RampPlan, error)
+	AdvanceRampPlans() (int, error)
+}
+
+type Rule interface {
+	CreateRule(rule structures.Rule) (structures.Rule, error)
+	GetRules() ([]structures.Rule, error)
+	DeleteRule(id int) error
+}
+
+type ChangeSet interface {
+	GetChangeSet(id int) (structures.ChangeSet, error)
+	RevertChangeSet(id int) (structures.ChangeSet, error)
 }
 
 type User interface {
@@ -26,16 +65,28 @@ type Repository struct {
 	Segment      Segment
 	UserSegments UserSegments
 	User         User
+	Layer        Layer
+	Ramp         Ramp
+	ChangeSet    ChangeSet
+	Rule         Rule
 }
 
 func NewRepository(db *sql.DB) *Repository {
 	segmentDB := NewSegmentDB(db)
 	userSegmentsDB := NewUserSegmentsDB(db)
 	userDB := NewUserDB(db)
+	layerDB := NewLayerDB(db)
+	rampDB := NewRampDB(db)
+	changeSetDB := NewChangeSetDB(db)
+	ruleDB := NewRuleDB(db)
 
 	return &Repository{
 		Segment:      segmentDB,
 		UserSegments: userSegmentsDB,
 		User:         userDB,
+		Layer:        layerDB,
+		Ramp:         rampDB,
+		ChangeSet:    changeSetDB,
+		Rule:         ruleDB,
 	}
 }
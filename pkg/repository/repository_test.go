@@ -37,7 +37,7 @@ func TestRepository_NewRepository(t *testing.T) {
 
 				rows := sqlmock.NewRows([]string{"slug"}).AddRow(args.Slug)
 				mock.ExpectQuery("INSERT").
-					WithArgs(args.Slug).
+					WithArgs(args.Slug, nil, nil, nil, nil, 1, nil, nil, nil, nil, nil, "active", nil, nil, nil, nil, nil, nil).
 					WillReturnRows(rows)
 
 				mock.ExpectCommit()
@@ -0,0 +1,198 @@
+package repository
+
+import (
+	"avito/pkg/structures"
+	"avito/pkg/utils"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type RuleDB struct {
+	db *sql.DB
+}
+
+func NewRuleDB(db *sql.DB) *RuleDB {
+	return &RuleDB{db: db}
+}
+
+// CreateRule stores the rule, it applies to the changes made from then on: users who already break it are not changed.
+func (r *RuleDB) CreateRule(rule structures.Rule) (structures.Rule, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return structures.Rule{}, err
+	}
+
+	for _, slug := range []*string{rule.Segment, rule.Other} {
+		if slug == nil {
+			continue
+		}
+
+		var id int
+		getSegmentQuery := fmt.Sprintf("SELECT id FROM %s WHERE slug = $1", segmentsTable)
+		err := tx.QueryRow(getSegmentQuery, *slug).Scan(&id)
+		if err == sql.ErrNoRows {
+			tx.Rollback()
+			return structures.Rule{}, structures.SegmentNotFoundError{Slug: *slug}
+		}
+		if err != nil {
+			tx.Rollback()
+			return structures.Rule{}, err
+		}
+	}
+
+	var createdAt time.Time
+	createRuleQuery := fmt.Sprintf(
+		"INSERT INTO %s (kind, segment, other, tag, max_segments) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+		segmentRulesTable)
+	err = tx.QueryRow(createRuleQuery, rule.Kind, rule.Segment, rule.Other, rule.Tag, rule.MaxSegments).Scan(&rule.Id, &createdAt)
+	if err != nil {
+		tx.Rollback()
+		return structures.Rule{}, err
+	}
+	rule.CreatedAt = &createdAt
+
+	return rule, tx.Commit()
+}
+
+func (r *RuleDB) GetRules() ([]structures.Rule, error) {
+	return getSegmentRules(r.db)
+}
+
+func (r *RuleDB) DeleteRule(id int) error {
+	deleteRuleQuery := fmt.Sprintf("DELETE FROM %s WHERE id = $1", segmentRulesTable)
+	res, err := r.db.Exec(deleteRuleQuery, id)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return structures.RuleNotFoundError{Id: id}
+	}
+
+	return nil
+}
+
+// getSegmentRules returns all rules, the oldest first.
+func getSegmentRules(q queryer) ([]structures.Rule, error) {
+	getRulesQuery := fmt.Sprintf("SELECT id, kind, segment, other, tag, max_segments, created_at FROM %s ORDER BY id", segmentRulesTable)
+	rows, err := q.Query(getRulesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []structures.Rule{}
+	for rows.Next() {
+		var rule structures.Rule
+		var createdAt time.Time
+		if err := rows.Scan(&rule.Id, &rule.Kind, &rule.Segment, &rule.Other, &rule.Tag, &rule.MaxSegments, &createdAt); err != nil {
+			return nil, err
+		}
+		rule.CreatedAt = &createdAt
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+// checkSegmentRules fails with the first rule broken by the explicit segments of the user once the changed ones are written.
+// Only memberships that are active and not expired count, and rules apply to explicit membership only: percentage rollouts
+// are decided on read and are not checked. Changes of the same user are serialized by an advisory lock,
+// shared with SetUserSegments, so two concurrent changes cannot break a rule together.
+func checkSegmentRules(tx *sql.Tx, rules []structures.Rule, userId int, changed []string) error {
+	if len(rules) == 0 || len(changed) == 0 {
+		return nil
+	}
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", userId); err != nil {
+		return err
+	}
+
+	getSegmentsQuery := fmt.Sprintf("SELECT segment FROM %s WHERE user_id = $1 AND %s ORDER BY segment", userSegmentsTable, fmt.Sprintf(membershipActive, ""))
+	rows, err := tx.Query(getSegmentsQuery, userId)
+	if err != nil {
+		return err
+	}
+
+	var segments []string
+	for rows.Next() {
+		var segment string
+		if err := rows.Scan(&segment); err != nil {
+			rows.Close()
+			return err
+		}
+		segments = append(segments, segment)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tags := map[string][]string{}
+	for _, rule := range rules {
+		if rule.Kind == utils.RuleMaxTagged {
+			if tags, err = getSegmentsTags(tx, segments); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	if rule, message, violated := utils.ViolatedRule(rules, segments, changed, tags); violated {
+		return structures.RuleViolationError{Rule: rule.Id, UserId: userId, Message: message}
+	}
+
+	return nil
+}
+
+// checkClonedRules fails with the first max_tagged rule on a tag of the clone broken by one of its copied members.
+// Members are copied in one statement, so each rule is checked for all of them at once rather than user by user;
+// requires and excludes rules cannot name the new segment yet.
+func checkClonedRules(tx *sql.Tx, slug string, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	rules, err := getSegmentRules(tx)
+	if err != nil {
+		return err
+	}
+
+	tagged := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tagged[tag] = true
+	}
+
+	getViolatorQuery := fmt.Sprintf(
+		`SELECT us.user_id FROM %[1]s us JOIN %[2]s t ON t.segment = us.segment
+		WHERE t.tag = $2 AND %[3]s AND us.user_id IN (SELECT user_id FROM %[1]s WHERE segment = $1 AND %[4]s)
+		GROUP BY us.user_id HAVING count(*) > $3 ORDER BY us.user_id LIMIT 1`,
+		userSegmentsTable, segmentTagsTable, fmt.Sprintf(membershipActive, "us."), fmt.Sprintf(membershipActive, ""))
+	for _, rule := range rules {
+		if rule.Kind != utils.RuleMaxTagged || !tagged[*rule.Tag] {
+			continue
+		}
+
+		var userId int
+		err := tx.QueryRow(getViolatorQuery, slug, *rule.Tag, *rule.MaxSegments).Scan(&userId)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		return structures.RuleViolationError{
+			Rule:    rule.Id,
+			UserId:  userId,
+			Message: fmt.Sprintf("at most %d segments tagged %s are allowed", *rule.MaxSegments, *rule.Tag),
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package repository_test
+
+import (
+	"avito/pkg/repository"
+	"avito/pkg/structures"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRule_CreateRule(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewRuleDB(db)
+
+	segment, other := "AVITO_DISCOUNT_50", "AVITO_DISCOUNT_30"
+	tag := "discount"
+	two := 2
+	createdAt := time.Date(2023, 8, 28, 20, 0, 0, 0, time.UTC)
+
+	type mockBehavior func(rule structures.Rule)
+
+	tests := []struct {
+		name          string
+		rule          structures.Rule
+		mockBehavior  mockBehavior
+		wantErr       bool
+		expectedError string
+	}{
+		{
+			name: "Requires",
+			rule: structures.Rule{Kind: "requires", Segment: &segment, Other: &other},
+			mockBehavior: func(rule structures.Rule) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id FROM segments WHERE slug").
+					WithArgs(segment).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				mock.ExpectQuery("SELECT id FROM segments WHERE slug").
+					WithArgs(other).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+				mock.ExpectQuery("INSERT INTO segment_rules").
+					WithArgs("requires", segment, other, nil, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(3, createdAt))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "MaxTagged",
+			rule: structures.Rule{Kind: "max_tagged", Tag: &tag, MaxSegments: &two},
+			mockBehavior: func(rule structures.Rule) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("INSERT INTO segment_rules").
+					WithArgs("max_tagged", nil, nil, tag, two).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(3, createdAt))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "SegmentNotFound",
+			rule: structures.Rule{Kind: "excludes", Segment: &segment, Other: &other},
+			mockBehavior: func(rule structures.Rule) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id FROM segments WHERE slug").
+					WithArgs(segment).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				mock.ExpectQuery("SELECT id FROM segments WHERE slug").
+					WithArgs(other).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "segment with slug AVITO_DISCOUNT_30 does not exist",
+		},
+		{
+			name: "InsertError",
+			rule: structures.Rule{Kind: "max_tagged", Tag: &tag, MaxSegments: &two},
+			mockBehavior: func(rule structures.Rule) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("INSERT INTO segment_rules").
+					WithArgs("max_tagged", nil, nil, tag, two).
+					WillReturnError(errors.New("insert error"))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "insert error",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior(testCase.rule)
+
+			got, err := repo.CreateRule(testCase.rule)
+			if testCase.wantErr {
+				assert.EqualError(t, err, testCase.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, 3, got.Id)
+				assert.Equal(t, testCase.rule.Kind, got.Kind)
+				assert.Equal(t, &createdAt, got.CreatedAt)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestRule_DeleteRule(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewRuleDB(db)
+
+	tests := []struct {
+		name          string
+		id            int
+		deleted       int64
+		expectedError string
+	}{
+		{name: "OK", id: 3, deleted: 1},
+		{name: "NotFound", id: 4, deleted: 0, expectedError: "rule 4 does not exist"},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			mock.ExpectExec("DELETE FROM segment_rules").
+				WithArgs(testCase.id).
+				WillReturnResult(sqlmock.NewResult(0, testCase.deleted))
+
+			err := repo.DeleteRule(testCase.id)
+			if testCase.expectedError != "" {
+				assert.EqualError(t, err, testCase.expectedError)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -2,8 +2,14 @@ package repository
 
 import (
 	"avito/pkg/structures"
+	"avito/pkg/utils"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 type SegmentDB struct {
@@ -20,87 +26,862 @@ func (r *SegmentDB) Create(segment structures.Segment) (string, error) {
 		return "", err
 	}
 
-	var slug string
-	var row *sql.Row
-	if segment.Percentage != nil {
-		createSegmentQuery := fmt.Sprintf("INSERT INTO %s (slug, percent) VALUES ($1, $2) RETURNING slug", segmentsTable)
-		row = tx.QueryRow(createSegmentQuery, segment.Slug, *segment.Percentage)
+	if segment.BucketingVersion == 0 {
+		segment.BucketingVersion = utils.BucketingV1
+	}
+
+	if segment.BucketingVersion == utils.BucketingV2 {
+		if segment.Salt == nil {
+			segment.Salt = &segment.Slug
+		}
+		if segment.HashFunction == nil {
+			hashFunction := utils.HashMurmur3
+			segment.HashFunction = &hashFunction
+		}
+	}
+
+	if segment.Layer != nil {
+		offset, err := allocateLayerRange(tx, *segment.Layer, segment.Slug, utils.RolloutWidth(segment), segment.LayerOffset)
+		if err != nil {
+			tx.Rollback()
+			return "", err
+		}
+		segment.LayerOffset = &offset
 	} else {
-		createSegmentQuery := fmt.Sprintf("INSERT INTO %s (slug) VALUES ($1) RETURNING slug", segmentsTable)
-		row = tx.QueryRow(createSegmentQuery, segment.Slug)
+		segment.LayerOffset = nil
 	}
-	if err := row.Scan(&slug); err != nil {
+
+	if segment.State == "" {
+		segment.State = utils.SegmentStateActive
+	}
+
+	slug, err := insertSegment(tx, segment)
+	if err != nil {
 		tx.Rollback()
 		return "", err
 	}
 
+	if segment.Parent != nil && *segment.Parent != "" {
+		if err := setSegmentParent(tx, slug, *segment.Parent); err != nil {
+			tx.Rollback()
+			return "", err
+		}
+	}
+
+	if segment.Expression != nil && *segment.Expression != "" {
+		if err := setSegmentExpression(tx, slug, *segment.Expression); err != nil {
+			tx.Rollback()
+			return "", err
+		}
+	}
+
+	if segment.Targeting != nil && *segment.Targeting != "" {
+		if err := setSegmentTargeting(tx, slug, *segment.Targeting); err != nil {
+			tx.Rollback()
+			return "", err
+		}
+	}
+
 	return slug, tx.Commit()
 }
 
-func (r *SegmentDB) Delete(segment structures.Segment) (string, error) {
+// insertSegment inserts the segment with its variants and tags as it is, the defaults are applied by the caller.
+func insertSegment(tx *sql.Tx, segment structures.Segment) (string, error) {
+	schedule, err := scheduleParam(segment.Schedule)
+	if err != nil {
+		return "", err
+	}
+
+	var slug string
+	createSegmentQuery := fmt.Sprintf(
+		`INSERT INTO %s (slug, percent, display_name, description, owner, bucketing_version, salt, hash_function, basis_points, layer, layer_offset, state, starts_at, ends_at, schedule, max_members, default_ttl, max_ttl)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, NULLIF($15::jsonb, 'null'::jsonb), $16, $17, $18) RETURNING slug`,
+		segmentsTable)
+	row := tx.QueryRow(createSegmentQuery, segment.Slug, segment.Percentage, segment.DisplayName, segment.Description, segment.Owner,
+		segment.BucketingVersion, segment.Salt, segment.HashFunction, segment.BasisPoints, segment.Layer, segment.LayerOffset, segment.State,
+		segment.StartsAt, segment.EndsAt, schedule, segment.MaxMembers, segment.DefaultTTL, segment.MaxTTL)
+	if err := row.Scan(&slug); err != nil {
+		return "", err
+	}
+
+	if err := insertSegmentVariants(tx, slug, segment.Variants); err != nil {
+		return "", err
+	}
+
+	if err := insertSegmentTags(tx, slug, segment.Tags); err != nil {
+		return "", err
+	}
+
+	return slug, nil
+}
+
+// Clone creates a segment with the settings, variants, tags, parent and expression of the source. The clone keeps the salt
+// of the source, so the percentage rollout of a source outside of a layer reaches the same users. The clone is left out
+// of the layer, whose ranges cannot overlap, so the clone of a layered source buckets users by its salt rather than
+// by its range of the layer and reaches other users; the clone of an archived segment is a draft.
+// Members are copied in a single statement and recorded in history as one change set, so large segments do not
+// take a round trip per user. Expired memberships are skipped, delayed ones keep their active_from and are recorded
+// once they become active. The copied members must fit the max_members the clone takes over from the source
+// and the max_tagged rules on its tags.
+func (r *SegmentDB) Clone(clone structures.SegmentClone) (structures.SegmentCloneResult, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return structures.SegmentCloneResult{}, err
+	}
+
+	getSourceQuery := fmt.Sprintf("SELECT %s FROM %s WHERE slug = $1 FOR SHARE", segmentColumns, segmentsTable)
+	segment, err := scanSegment(tx.QueryRow(getSourceQuery, clone.Slug))
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return structures.SegmentCloneResult{}, structures.SegmentNotFoundError{Slug: clone.Slug}
+	}
+	if err != nil {
+		tx.Rollback()
+		return structures.SegmentCloneResult{}, err
+	}
+
+	segment.Variants, err = getSegmentVariants(tx, clone.Slug)
+	if err != nil {
+		tx.Rollback()
+		return structures.SegmentCloneResult{}, err
+	}
+
+	segment.Tags, err = getSegmentTags(tx, clone.Slug)
+	if err != nil {
+		tx.Rollback()
+		return structures.SegmentCloneResult{}, err
+	}
+
+	segment.Parent, _, err = getSegmentFamily(tx, clone.Slug)
+	if err != nil {
+		tx.Rollback()
+		return structures.SegmentCloneResult{}, err
+	}
+
+	segment.Expression, err = getSegmentExpression(tx, clone.Slug)
+	if err != nil {
+		tx.Rollback()
+		return structures.SegmentCloneResult{}, err
+	}
+
+	segment.Targeting, err = getSegmentTargeting(tx, clone.Slug)
+	if err != nil {
+		tx.Rollback()
+		return structures.SegmentCloneResult{}, err
+	}
+
+	segment.Slug = clone.NewSlug
+	if segment.Salt == nil {
+		segment.Salt = &clone.Slug
+	}
+	segment.Layer, segment.LayerOffset = nil, nil
+	if segment.State == utils.SegmentStateArchived {
+		segment.State = utils.SegmentStateDraft
+	}
+
+	if _, err := insertSegment(tx, segment); err != nil {
+		tx.Rollback()
+		return structures.SegmentCloneResult{}, err
+	}
+
+	if segment.Parent != nil {
+		if err := setSegmentParent(tx, clone.NewSlug, *segment.Parent); err != nil {
+			tx.Rollback()
+			return structures.SegmentCloneResult{}, err
+		}
+	}
+
+	if segment.Expression != nil {
+		if err := setSegmentExpression(tx, clone.NewSlug, *segment.Expression); err != nil {
+			tx.Rollback()
+			return structures.SegmentCloneResult{}, err
+		}
+	}
+
+	if segment.Targeting != nil {
+		if err := setSegmentTargeting(tx, clone.NewSlug, *segment.Targeting); err != nil {
+			tx.Rollback()
+			return structures.SegmentCloneResult{}, err
+		}
+	}
+
+	result := structures.SegmentCloneResult{Slug: clone.NewSlug, Source: clone.Slug}
+	if clone.CopyMembers {
+		result.Members, result.ChangeSet, err = copySegmentMembers(tx, clone.Slug, clone.NewSlug, clone.CopyExpirations)
+		if err != nil {
+			tx.Rollback()
+			return structures.SegmentCloneResult{}, err
+		}
+
+		if err := checkClonedCapacity(tx, segment); err != nil {
+			tx.Rollback()
+			return structures.SegmentCloneResult{}, err
+		}
+
+		if err := checkClonedRules(tx, clone.NewSlug, segment.Tags); err != nil {
+			tx.Rollback()
+			return structures.SegmentCloneResult{}, err
+		}
+	}
+
+	return result, tx.Commit()
+}
+
+// copySegmentMembers copies the explicit memberships of the source to the target and records the active ones
+// in history under a new change set, reporting how many were copied.
+func copySegmentMembers(tx *sql.Tx, source, target string, withExpirations bool) (int, *int, error) {
+	copyMembersQuery := fmt.Sprintf(
+		`INSERT INTO %[1]s (user_id, segment, expiration_time, active_from)
+		SELECT user_id, $2, CASE WHEN $3 THEN expiration_time END, active_from FROM %[1]s
+		WHERE segment = $1 AND (expiration_time IS NULL OR expiration_time > NOW())`,
+		userSegmentsTable)
+	res, err := tx.Exec(copyMembersQuery, source, target, withExpirations)
+	if err != nil {
+		return 0, nil, err
+	}
+	copied, err := res.RowsAffected()
+	if err != nil {
+		return 0, nil, err
+	}
+	if copied == 0 {
+		return 0, nil, nil
+	}
+
+	// Variants are assigned in code, so they are passed along as arrays.
+	userIds, variants, err := targetVariants(tx, target)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	history := newHistoryLog(changeSetSegmentClone)
+	if err := history.open(tx); err != nil {
+		return 0, nil, err
+	}
+
+	recordMembersQuery := fmt.Sprintf(
+		`INSERT INTO %[1]s (user_id, segment, segment_id, operation, reason, variant, change_set, expiration_time)
+		SELECT us.user_id, us.segment, s.id, true, $2, v.variant, $3, us.expiration_time
+		FROM %[2]s us JOIN %[3]s s ON s.slug = us.segment
+		LEFT JOIN unnest($4::integer[], $5::varchar[]) AS v(user_id, variant) ON v.user_id = us.user_id
+		WHERE us.segment = $1 AND us.active_from IS NULL`,
+		userSegmentsHistoryTable, userSegmentsTable, segmentsTable)
+	res, err = tx.Exec(recordMembersQuery, target, reasonSegmentCloned, *history.changeSet, pq.Array(userIds), pq.Array(variants))
+	if err != nil {
+		return 0, nil, err
+	}
+	recorded, err := res.RowsAffected()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Delayed copies are not recorded yet, so reverting the change set would leave them behind.
+	if recorded < copied {
+		if err := history.skip(tx); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return int(copied), history.changeSet, nil
+}
+
+// checkClonedCapacity fails when the clone got more members than its max_members allows,
+// the members are copied in one statement and are not counted one by one like added users.
+func checkClonedCapacity(tx *sql.Tx, segment structures.Segment) error {
+	if segment.MaxMembers == nil {
+		return nil
+	}
+
+	var members int
+	countMembersQuery := fmt.Sprintf("SELECT count(*) FROM %s WHERE segment = $1 AND %s", userSegmentsTable, fmt.Sprintf(membershipUnexpired, ""))
+	if err := tx.QueryRow(countMembersQuery, segment.Slug).Scan(&members); err != nil {
+		return err
+	}
+	if members > *segment.MaxMembers {
+		return structures.SegmentFullError{Slug: segment.Slug, MaxMembers: *segment.MaxMembers}
+	}
+
+	return nil
+}
+
+// targetVariants returns the active members of a segment with variants along with the variant of each,
+// nothing for a segment without variants.
+func targetVariants(tx *sql.Tx, slug string) ([]int64, []string, error) {
+	segmentVariants, salts, err := getSegmentsVariants(tx, []string{slug})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(segmentVariants[slug]) == 0 {
+		return []int64{}, []string{}, nil
+	}
+
+	getMembersQuery := fmt.Sprintf("SELECT user_id FROM %s WHERE segment = $1 AND active_from IS NULL ORDER BY user_id", userSegmentsTable)
+	rows, err := tx.Query(getMembersQuery, slug)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	userIds := []int64{}
+	variants := []string{}
+	for rows.Next() {
+		var userId int64
+		if err := rows.Scan(&userId); err != nil {
+			return nil, nil, err
+		}
+		userIds = append(userIds, userId)
+		variants = append(variants, utils.AssignVariant(salts[slug], segmentVariants[slug], userId))
+	}
+
+	return userIds, variants, rows.Err()
+}
+
+type segmentMembership struct {
+	userId     int
+	activeFrom *time.Time
+	expiration *time.Time
+}
+
+// getDueSegmentMemberships returns the explicit memberships of the segment that are active or due,
+// the ones still waiting for their active_from are left out.
+func getDueSegmentMemberships(tx *sql.Tx, slug string) ([]segmentMembership, error) {
+	getMembershipsQuery := fmt.Sprintf(
+		"SELECT user_id, active_from, expiration_time FROM %s WHERE segment = $1 AND (active_from IS NULL OR active_from <= NOW()) ORDER BY user_id",
+		userSegmentsTable)
+	rows, err := tx.Query(getMembershipsQuery, slug)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var memberships []segmentMembership
+	for rows.Next() {
+		var membership segmentMembership
+		if err := rows.Scan(&membership.userId, &membership.activeFrom, &membership.expiration); err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, membership)
+	}
+
+	return memberships, rows.Err()
+}
+
+// Delete deletes the segment along with its memberships, its children are detached or reparented as decided.
+// A segment used by the expression of a composite segment cannot be deleted.
+func (r *SegmentDB) Delete(segment structures.Segment, children string) (structures.SegmentDeletion, error) {
+	return r.delete(segment, children, false)
+}
+
+// DeleteDryRun reports the memberships and history rows deleting the segment would remove and write,
+// the deletion runs in a transaction that is rolled back.
+func (r *SegmentDB) DeleteDryRun(segment structures.Segment, children string) (structures.SegmentDeletion, error) {
+	return r.delete(segment, children, true)
+}
+
+func (r *SegmentDB) delete(segment structures.Segment, children string, dryRun bool) (structures.SegmentDeletion, error) {
 	existsQuery := fmt.Sprintf("SELECT COUNT(slug) FROM %s WHERE slug = $1", segmentsTable)
 	var count int
 	err := r.db.QueryRow(existsQuery, segment.Slug).Scan(&count)
 	if err != nil {
-		return "", err
+		return structures.SegmentDeletion{}, err
 	}
 
 	if count == 0 {
-		return "", fmt.Errorf("segment with slug %s does not exist", segment.Slug)
+		return structures.SegmentDeletion{}, structures.SegmentNotFoundError{Slug: segment.Slug}
 	}
 
 	tx, err := r.db.Begin()
 	if err != nil {
-		return "", err
+		return structures.SegmentDeletion{}, err
+	}
+
+	released, err := releaseSegmentChildren(tx, segment.Slug, children)
+	if err != nil {
+		tx.Rollback()
+		return structures.SegmentDeletion{}, err
+	}
+
+	if err := checkSegmentUnreferenced(tx, segment.Slug); err != nil {
+		tx.Rollback()
+		return structures.SegmentDeletion{}, err
+	}
+
+	memberships, err := getDueSegmentMemberships(tx, segment.Slug)
+	if err != nil {
+		tx.Rollback()
+		return structures.SegmentDeletion{}, err
+	}
+
+	percentageUserIds, err := getPercentageSegmentUsers(tx, segment.Slug)
+	if err != nil {
+		tx.Rollback()
+		return structures.SegmentDeletion{}, err
+	}
+
+	// History goes first: its segment_id is resolved from the segment row.
+	// A removal is written only after the add, so a due membership the expired segments job
+	// has not activated yet gets its add written first.
+	history := newHistoryLog(changeSetSegmentDeletion)
+	closed := make(map[int]bool)
+	user_ids := []int{}
+	for _, membership := range memberships {
+		user_ids = append(user_ids, membership.userId)
+
+		added, err := recordDueActivation(tx, &history, membership.userId, segment.Slug, membership.activeFrom, membership.expiration)
+		if err != nil {
+			tx.Rollback()
+			return structures.SegmentDeletion{}, err
+		}
+		if !added {
+			continue
+		}
+		closed[membership.userId] = true
+
+		if err := history.write(tx, segment.Slug, membership.userId, false, reasonSegmentDeleted, nil, nil); err != nil {
+			tx.Rollback()
+			return structures.SegmentDeletion{}, err
+		}
+	}
+
+	for _, user_id := range percentageUserIds {
+		if closed[user_id] {
+			continue
+		}
+		closed[user_id] = true
+
+		if err := history.write(tx, segment.Slug, user_id, false, reasonSegmentDeleted, nil, nil); err != nil {
+			tx.Rollback()
+			return structures.SegmentDeletion{}, err
+		}
 	}
 
 	deleteSegmentQuery := fmt.Sprintf("DELETE FROM %s WHERE slug = $1", segmentsTable)
 	_, err = tx.Exec(deleteSegmentQuery, segment.Slug)
 	if err != nil {
 		tx.Rollback()
+		return structures.SegmentDeletion{}, err
+	}
+
+	deletion := structures.SegmentDeletion{
+		Slug:            segment.Slug,
+		Children:        released,
+		DryRun:          dryRun,
+		AffectedUsers:   len(closed),
+		Users:           user_ids,
+		PercentageUsers: append([]int{}, percentageUserIds...),
+		History:         append([]structures.HistoryEntry{}, history.entries...),
+	}
+	if dryRun {
+		return deletion, tx.Rollback()
+	}
+
+	deletion.ChangeSet = history.changeSet
+	return deletion, tx.Commit()
+}
+
+func (r *SegmentDB) Rename(rename structures.SegmentRename) (string, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
 		return "", err
 	}
 
-	repo := NewRepository(r.db)
-	user_ids, err := repo.UserSegments.GetSegmentUsers(segment)
+	// user_segments follows the new slug through ON UPDATE CASCADE,
+	// history rows stay linked to the segment through segment_id.
+	// The salt keeps the old slug, so the rollout population does not change.
+	// Expressions referring to the segment are rewritten with the new slug.
+	var state string
+	renameSegmentQuery := fmt.Sprintf("UPDATE %s SET slug = $2, salt = COALESCE(salt, slug), updated_at = NOW() WHERE slug = $1 RETURNING state", segmentsTable)
+	err = tx.QueryRow(renameSegmentQuery, rename.Slug, rename.NewSlug).Scan(&state)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return "", structures.SegmentNotFoundError{Slug: rename.Slug}
+	}
 	if err != nil {
 		tx.Rollback()
 		return "", err
 	}
 
-	for _, user_id := range user_ids {
-		_, err := historyUpdate(tx, segment.Slug, user_id, false)
+	if state == utils.SegmentStateArchived {
+		tx.Rollback()
+		return "", structures.SegmentArchivedError{Slug: rename.Slug}
+	}
+
+	if err := renameExpressionRefs(tx, rename.Slug, rename.NewSlug); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	return rename.NewSlug, tx.Commit()
+}
+
+func (r *SegmentDB) Update(update structures.SegmentUpdate) (structures.Segment, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return structures.Segment{}, err
+	}
+
+	segment, err := updateSegment(tx, update)
+	if err != nil {
+		tx.Rollback()
+		return structures.Segment{}, err
+	}
+
+	return segment, tx.Commit()
+}
+
+// updateSegment applies the update within the transaction, ramp plans apply their steps through it as well.
+func updateSegment(tx *sql.Tx, update structures.SegmentUpdate) (structures.Segment, error) {
+	schedule, err := scheduleParam(update.Schedule)
+	if err != nil {
+		return structures.Segment{}, err
+	}
+
+	if err := checkVariantBucketing(tx, update); err != nil {
+		return structures.Segment{}, err
+	}
+
+	if update.Layer != nil && *update.Layer != "" {
+		if err := lockLayer(tx, *update.Layer); err != nil {
+			return structures.Segment{}, err
+		}
+	}
+
+	// Switching the bucketing version carries the rollout over:
+	// v2 gets the percentage as basis points, v1 gets the basis points as a percentage.
+	// Moving the segment to another layer drops its range, a new one is allocated below.
+	updateSegmentQuery := fmt.Sprintf(
+		`UPDATE %s SET
+			percent = CASE WHEN COALESCE($6, bucketing_version) = 2 THEN NULL ELSE COALESCE($2, percent, basis_points / 100) END,
+			display_name = COALESCE($3, display_name),
+			description = COALESCE($4, description),
+			owner = COALESCE($5, owner),
+			bucketing_version = COALESCE($6, bucketing_version),
+			salt = COALESCE($7, salt, slug),
+			hash_function = CASE WHEN COALESCE($6, bucketing_version) = 2 THEN COALESCE($8, hash_function, '%s') END,
+			basis_points = CASE WHEN COALESCE($6, bucketing_version) = 2 THEN COALESCE($9, basis_points, percent * 100) END,
+			layer = CASE WHEN $10::varchar IS NULL THEN layer ELSE NULLIF($10, '') END,
+			layer_offset = CASE WHEN $10::varchar IS NULL OR $10 = layer THEN layer_offset END,
+			starts_at = CASE WHEN $17 THEN NULL ELSE COALESCE($11, starts_at) END,
+			ends_at = CASE WHEN $18 THEN NULL ELSE COALESCE($12, ends_at) END,
+			schedule = CASE WHEN $13::jsonb IS NULL THEN schedule ELSE NULLIF($13::jsonb, 'null'::jsonb) END,
+			max_members = CASE WHEN $14::integer IS NULL THEN max_members ELSE NULLIF($14, 0) END,
+			default_ttl = CASE WHEN $15::varchar IS NULL THEN default_ttl ELSE NULLIF($15, '') END,
+			max_ttl = CASE WHEN $16::varchar IS NULL THEN max_ttl ELSE NULLIF($16, '') END,
+			updated_at = NOW()
+		WHERE slug = $1
+		RETURNING %s`,
+		segmentsTable, utils.HashMurmur3, segmentColumns)
+	row := tx.QueryRow(updateSegmentQuery, update.Slug, update.Percentage, update.DisplayName, update.Description, update.Owner,
+		update.BucketingVersion, update.Salt, update.HashFunction, update.BasisPoints, update.Layer,
+		update.StartsAt, update.EndsAt, schedule, update.MaxMembers, update.DefaultTTL, update.MaxTTL,
+		update.ClearStartsAt, update.ClearEndsAt)
+
+	segment, err := scanSegment(row)
+	if err == sql.ErrNoRows {
+		return structures.Segment{}, structures.SegmentNotFoundError{Slug: update.Slug}
+	}
+	if err != nil {
+		return structures.Segment{}, err
+	}
+
+	if segment.State == utils.SegmentStateArchived {
+		return structures.Segment{}, structures.SegmentArchivedError{Slug: update.Slug}
+	}
+
+	if err := utils.ValidateWindow(segment.StartsAt, segment.EndsAt); err != nil {
+		return structures.Segment{}, structures.ValidationError{Message: err.Error()}
+	}
+
+	if err := utils.ValidateTTL(segment.DefaultTTL, segment.MaxTTL); err != nil {
+		return structures.Segment{}, structures.ValidationError{Message: err.Error()}
+	}
+
+	if update.Percentage != nil && segment.BucketingVersion == utils.BucketingV2 {
+		return structures.Segment{}, structures.ValidationError{Message: "percentage is not supported by bucketing version 2, use basis points"}
+	}
+
+	if update.BasisPoints != nil && segment.BucketingVersion != utils.BucketingV2 {
+		return structures.Segment{}, structures.ValidationError{Message: "basis points require bucketing version 2"}
+	}
+
+	rolloutChanged := update.Percentage != nil || update.BucketingVersion != nil ||
+		update.Salt != nil || update.HashFunction != nil || update.BasisPoints != nil || update.Layer != nil
+
+	// A segment staying in its layer may only grow in place, so its users keep their range.
+	if segment.Layer != nil && rolloutChanged {
+		offset, err := allocateLayerRange(tx, *segment.Layer, segment.Slug, utils.RolloutWidth(segment), segment.LayerOffset)
 		if err != nil {
-			tx.Rollback()
-			return "", err
+			return structures.Segment{}, err
+		}
+
+		if segment.LayerOffset == nil {
+			updateOffsetQuery := fmt.Sprintf("UPDATE %s SET layer_offset = $2 WHERE slug = $1", segmentsTable)
+			if _, err := tx.Exec(updateOffsetQuery, segment.Slug, offset); err != nil {
+				return structures.Segment{}, err
+			}
+			segment.LayerOffset = &offset
 		}
 	}
 
-	return segment.Slug, tx.Commit()
+	if update.Layer != nil && *update.Layer != "" {
+		if err := checkLayerSegmentMembers(tx, segment.Slug, *update.Layer); err != nil {
+			return structures.Segment{}, err
+		}
+	}
+
+	if rolloutChanged {
+		if err := dropPercentageSegmentUsers(tx, segment); err != nil {
+			return structures.Segment{}, err
+		}
+	}
+
+	if update.Variants != nil {
+		if err := replaceSegmentVariants(tx, segment.Slug, *update.Variants); err != nil {
+			return structures.Segment{}, err
+		}
+	}
+
+	if update.Tags != nil {
+		if err := replaceSegmentTags(tx, segment.Slug, *update.Tags); err != nil {
+			return structures.Segment{}, err
+		}
+	}
+
+	if update.Parent != nil {
+		if err := setSegmentParent(tx, segment.Slug, *update.Parent); err != nil {
+			return structures.Segment{}, err
+		}
+	}
+
+	if update.Expression != nil {
+		if err := setSegmentExpression(tx, segment.Slug, *update.Expression); err != nil {
+			return structures.Segment{}, err
+		}
+	}
+
+	if update.Targeting != nil {
+		if err := setSegmentTargeting(tx, segment.Slug, *update.Targeting); err != nil {
+			return structures.Segment{}, err
+		}
+	}
+
+	segment.Variants, err = getSegmentVariants(tx, segment.Slug)
+	if err != nil {
+		return structures.Segment{}, err
+	}
+
+	segment.Tags, err = getSegmentTags(tx, segment.Slug)
+	if err != nil {
+		return structures.Segment{}, err
+	}
+
+	segment.Parent, segment.Children, err = getSegmentFamily(tx, segment.Slug)
+	if err != nil {
+		return structures.Segment{}, err
+	}
+
+	segment.Expression, err = getSegmentExpression(tx, segment.Slug)
+	if err != nil {
+		return structures.Segment{}, err
+	}
+	if segment.Expression != nil && (segment.Percentage != nil || segment.BasisPoints != nil) {
+		return structures.Segment{}, structures.ValidationError{Message: fmt.Sprintf("composite segment %s cannot have a percentage", segment.Slug)}
+	}
+
+	segment.Targeting, err = getSegmentTargeting(tx, segment.Slug)
+	if err != nil {
+		return structures.Segment{}, err
+	}
+	if segment.Targeting != nil && segment.Percentage == nil && segment.BasisPoints == nil {
+		return structures.Segment{}, structures.ValidationError{Message: fmt.Sprintf("targeted segment %s needs a percentage", segment.Slug)}
+	}
+
+	return segment, nil
 }
 
-func (r *SegmentDB) GetPercentageSegments() (map[string]int, error) {
+// SetState moves the segment to another state and records the transition.
+// Memberships are kept in every state, only active segments are given to users.
+func (r *SegmentDB) SetState(change structures.SegmentStateChange) (structures.Segment, error) {
 	tx, err := r.db.Begin()
+	if err != nil {
+		return structures.Segment{}, err
+	}
+
+	var id int
+	var from string
+	getStateQuery := fmt.Sprintf("SELECT id, state FROM %s WHERE slug = $1 FOR UPDATE", segmentsTable)
+	err = tx.QueryRow(getStateQuery, change.Slug).Scan(&id, &from)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return structures.Segment{}, structures.SegmentNotFoundError{Slug: change.Slug}
+	}
+	if err != nil {
+		tx.Rollback()
+		return structures.Segment{}, err
+	}
+
+	if err := utils.ValidateSegmentStateTransition(from, change.State); err != nil {
+		tx.Rollback()
+		return structures.Segment{}, structures.ValidationError{Message: err.Error()}
+	}
+
+	setStateQuery := fmt.Sprintf("UPDATE %s SET state = $2, updated_at = NOW() WHERE slug = $1 RETURNING %s", segmentsTable, segmentColumns)
+	segment, err := scanSegment(tx.QueryRow(setStateQuery, change.Slug, change.State))
+	if err != nil {
+		tx.Rollback()
+		return structures.Segment{}, err
+	}
+
+	recordStateQuery := fmt.Sprintf(
+		"INSERT INTO %s (segment_id, segment, from_state, to_state, comment) VALUES ($1, $2, $3, $4, $5)",
+		segmentStateHistoryTable)
+	if _, err := tx.Exec(recordStateQuery, id, change.Slug, from, change.State, change.Comment); err != nil {
+		tx.Rollback()
+		return structures.Segment{}, err
+	}
+
+	segment.Variants, err = getSegmentVariants(tx, segment.Slug)
+	if err != nil {
+		tx.Rollback()
+		return structures.Segment{}, err
+	}
+
+	segment.Tags, err = getSegmentTags(tx, segment.Slug)
+	if err != nil {
+		tx.Rollback()
+		return structures.Segment{}, err
+	}
+
+	segment.Parent, segment.Children, err = getSegmentFamily(tx, segment.Slug)
+	if err != nil {
+		tx.Rollback()
+		return structures.Segment{}, err
+	}
+
+	segment.Expression, err = getSegmentExpression(tx, segment.Slug)
+	if err != nil {
+		tx.Rollback()
+		return structures.Segment{}, err
+	}
+
+	segment.Targeting, err = getSegmentTargeting(tx, segment.Slug)
+	if err != nil {
+		tx.Rollback()
+		return structures.Segment{}, err
+	}
+
+	return segment, tx.Commit()
+}
+
+// GetStateHistory returns the state transitions of the segment, oldest first.
+// Transitions are linked to the segment by id, so they survive renames.
+func (r *SegmentDB) GetStateHistory(segment structures.Segment) ([]structures.SegmentStateTransition, error) {
+	var id int
+	getIdQuery := fmt.Sprintf("SELECT id FROM %s WHERE slug = $1", segmentsTable)
+	err := r.db.QueryRow(getIdQuery, segment.Slug).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, structures.SegmentNotFoundError{Slug: segment.Slug}
+	}
 	if err != nil {
 		return nil, err
 	}
-	segments := make(map[string]int)
-	getSegmentsQuery := fmt.Sprintf("SELECT slug, percent FROM %s WHERE percent IS NOT NULL", segmentsTable)
-	rows, err := tx.Query(getSegmentsQuery)
+
+	getHistoryQuery := fmt.Sprintf(
+		"SELECT from_state, to_state, comment, changed_at FROM %s WHERE segment_id = $1 ORDER BY changed_at, id",
+		segmentStateHistoryTable)
+	rows, err := r.db.Query(getHistoryQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transitions := []structures.SegmentStateTransition{}
+	for rows.Next() {
+		var transition structures.SegmentStateTransition
+		if err := rows.Scan(&transition.From, &transition.To, &transition.Comment, &transition.ChangedAt); err != nil {
+			return nil, err
+		}
+		transitions = append(transitions, transition)
+	}
+
+	return transitions, rows.Err()
+}
+
+// dropPercentageSegmentUsers closes the percentage placements that no longer
+// pass the rollout check after the rollout of the segment has changed.
+// Targeting is left to the reads, which close the placements of users whose attributes no longer match.
+func dropPercentageSegmentUsers(tx *sql.Tx, segment structures.Segment) error {
+	user_ids, err := getPercentageSegmentUsers(tx, segment.Slug)
+	if err != nil {
+		return err
+	}
+
+	deleteUserQuery := fmt.Sprintf("DELETE FROM %s WHERE user_id = $1 AND segment = $2", userPercentageSegments)
+	for _, user_id := range user_ids {
+		if utils.InRollout(segment, int64(user_id)) {
+			continue
+		}
+
+		if _, err := tx.Exec(deleteUserQuery, user_id, segment.Slug); err != nil {
+			return err
+		}
+
+		if _, err := historyUpdate(tx, segment.Slug, user_id, false, reasonPercentage); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getPercentageSegmentUsers(tx *sql.Tx, slug string) ([]int, error) {
+	getUsersQuery := fmt.Sprintf("SELECT user_id FROM %s WHERE segment = $1", userPercentageSegments)
+	rows, err := tx.Query(getUsersQuery, slug)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []int
+	for rows.Next() {
+		var user int
+		if err := rows.Scan(&user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+func (r *SegmentDB) GetPercentageSegments() ([]structures.Segment, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var segments []structures.Segment
+	getSegmentsQuery := fmt.Sprintf(
+		"SELECT %s FROM %s WHERE (percent IS NOT NULL OR basis_points IS NOT NULL) AND state = $1 AND %s",
+		segmentColumns, segmentsTable, fmt.Sprintf(segmentInWindow, ""))
+	rows, err := tx.Query(getSegmentsQuery, utils.SegmentStateActive)
 	if err != nil {
 		tx.Rollback()
 		return nil, err
 	}
 	defer rows.Close()
 
+	now := time.Now()
+	var slugs []string
 	for rows.Next() {
-		var slug string
-		var percent int
-		if err := rows.Scan(&slug, &percent); err != nil {
+		segment, err := scanSegment(rows)
+		if err != nil {
 			tx.Rollback()
 			return nil, err
 		}
-		segments[slug] = percent
+		if !utils.InSchedule(segment.Schedule, now) {
+			continue
+		}
+		segments = append(segments, segment)
+		slugs = append(slugs, segment.Slug)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -108,5 +889,211 @@ func (r *SegmentDB) GetPercentageSegments() (map[string]int, error) {
 		return nil, err
 	}
 
+	rules, err := getSegmentsTargeting(tx, slugs)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for i := range segments {
+		if rule, ok := rules[segments[i].Slug]; ok {
+			segments[i].Targeting = &rule
+			if targeting, err := utils.ParseTargeting(rule); err == nil {
+				segments[i].TargetingRule = targeting
+			}
+		}
+	}
+
 	return segments, tx.Commit()
 }
+
+func (r *SegmentDB) Get(segment structures.Segment) (structures.Segment, error) {
+	getSegmentQuery := fmt.Sprintf(
+		"SELECT %s FROM %s WHERE slug = $1",
+		segmentColumns, segmentsTable)
+
+	result, err := scanSegment(r.db.QueryRow(getSegmentQuery, segment.Slug))
+	if err == sql.ErrNoRows {
+		return structures.Segment{}, structures.SegmentNotFoundError{Slug: segment.Slug}
+	}
+	if err != nil {
+		return structures.Segment{}, err
+	}
+
+	result.Variants, err = getSegmentVariants(r.db, result.Slug)
+	if err != nil {
+		return structures.Segment{}, err
+	}
+
+	result.Tags, err = getSegmentTags(r.db, result.Slug)
+	if err != nil {
+		return structures.Segment{}, err
+	}
+
+	result.Parent, result.Children, err = getSegmentFamily(r.db, result.Slug)
+	if err != nil {
+		return structures.Segment{}, err
+	}
+
+	result.Expression, err = getSegmentExpression(r.db, result.Slug)
+	if err != nil {
+		return structures.Segment{}, err
+	}
+
+	result.Targeting, err = getSegmentTargeting(r.db, result.Slug)
+	if err != nil {
+		return structures.Segment{}, err
+	}
+
+	var members int
+	countMembersQuery := fmt.Sprintf("SELECT count(*) FROM %s WHERE segment = $1 AND %s", userSegmentsTable, fmt.Sprintf(membershipUnexpired, ""))
+	if err := r.db.QueryRow(countMembersQuery, result.Slug).Scan(&members); err != nil {
+		return structures.Segment{}, err
+	}
+	result.Members = &members
+
+	return result, nil
+}
+
+// likeEscaper escapes the wildcards of a search string, so it is matched literally by ILIKE ... ESCAPE '\'.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (r *SegmentDB) List(filter structures.SegmentsFilter) ([]structures.Segment, int, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var conditions []string
+	var args []interface{}
+	if filter.Owner != nil {
+		args = append(args, *filter.Owner)
+		conditions = append(conditions, fmt.Sprintf("owner = $%d", len(args)))
+	}
+	if filter.Search != nil {
+		args = append(args, "%"+likeEscaper.Replace(*filter.Search)+"%")
+		conditions = append(conditions, fmt.Sprintf(`(slug ILIKE $%d ESCAPE '\' OR display_name ILIKE $%d ESCAPE '\')`, len(args), len(args)))
+	}
+	if filter.State != nil {
+		args = append(args, *filter.State)
+		conditions = append(conditions, fmt.Sprintf("state = $%d", len(args)))
+	} else {
+		args = append(args, utils.SegmentStateArchived)
+		conditions = append(conditions, fmt.Sprintf("state <> $%d", len(args)))
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	countQuery := fmt.Sprintf("SELECT COUNT(*) FROM %s%s", segmentsTable, where)
+	if err := tx.QueryRow(countQuery, args...).Scan(&total); err != nil {
+		tx.Rollback()
+		return nil, 0, err
+	}
+
+	listQuery := fmt.Sprintf(
+		"SELECT %s FROM %s%s ORDER BY slug LIMIT $%d OFFSET $%d",
+		segmentColumns, segmentsTable, where, len(args)+1, len(args)+2)
+	rows, err := tx.Query(listQuery, append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		tx.Rollback()
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	segments := []structures.Segment{}
+	for rows.Next() {
+		segment, err := scanSegment(rows)
+		if err != nil {
+			tx.Rollback()
+			return nil, 0, err
+		}
+		segments = append(segments, segment)
+	}
+
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, 0, err
+	}
+
+	return segments, total, tx.Commit()
+}
+
+const segmentColumns = "id, slug, percent, display_name, description, owner, bucketing_version, salt, hash_function, basis_points, created_at, updated_at, layer, layer_offset, state, starts_at, ends_at, schedule, max_members, default_ttl, max_ttl"
+
+// segmentInWindow is the condition of a segment being in its activation window,
+// formatted with the alias prefix of the segments table.
+const segmentInWindow = "(%[1]sstarts_at IS NULL OR %[1]sstarts_at <= NOW()) AND (%[1]sends_at IS NULL OR %[1]sends_at > NOW())"
+
+// membershipActive is the condition of a membership being active and not expired,
+// formatted with the alias prefix of the user segments table.
+const membershipActive = "(%[1]sactive_from IS NULL OR %[1]sactive_from <= NOW()) AND (%[1]sexpiration_time IS NULL OR %[1]sexpiration_time > NOW())"
+
+// membershipUnexpired is the condition of a membership not being expired, the members counted against max_members:
+// delayed memberships are counted too, as they become active without another check.
+const membershipUnexpired = "(%[1]sexpiration_time IS NULL OR %[1]sexpiration_time > NOW())"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSegment(row rowScanner) (structures.Segment, error) {
+	var segment structures.Segment
+	var createdAt, updatedAt time.Time
+	var schedule []byte
+	err := row.Scan(
+		&segment.Id,
+		&segment.Slug,
+		&segment.Percentage,
+		&segment.DisplayName,
+		&segment.Description,
+		&segment.Owner,
+		&segment.BucketingVersion,
+		&segment.Salt,
+		&segment.HashFunction,
+		&segment.BasisPoints,
+		&createdAt,
+		&updatedAt,
+		&segment.Layer,
+		&segment.LayerOffset,
+		&segment.State,
+		&segment.StartsAt,
+		&segment.EndsAt,
+		&schedule,
+		&segment.MaxMembers,
+		&segment.DefaultTTL,
+		&segment.MaxTTL,
+	)
+	if err != nil {
+		return structures.Segment{}, err
+	}
+
+	if schedule != nil {
+		if err := json.Unmarshal(schedule, &segment.Schedule); err != nil {
+			return structures.Segment{}, err
+		}
+	}
+
+	segment.CreatedAt = &createdAt
+	segment.UpdatedAt = &updatedAt
+	return segment, nil
+}
+
+// scheduleParam returns the schedule as a jsonb parameter: NULL keeps the schedule,
+// JSON null removes it and a schedule with intervals replaces it.
+func scheduleParam(schedule *structures.SegmentSchedule) (interface{}, error) {
+	if schedule == nil {
+		return nil, nil
+	}
+	if len(schedule.Intervals) == 0 {
+		return "null", nil
+	}
+
+	data, err := json.Marshal(schedule)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
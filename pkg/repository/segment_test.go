@@ -3,11 +3,14 @@ package repository_test
 import (
 	"avito/pkg/repository"
 	"avito/pkg/structures"
+	"avito/pkg/utils"
 	"errors"
 	"log"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -25,6 +28,16 @@ func TestSegment_Create(t *testing.T) {
 	}
 
 	var validPercentage = 77
+	var displayName = "Example"
+	var owner = "example-team"
+	var layer = "checkout"
+	var expression = "(beta OR staff) AND android_new_ui"
+	var targeting = `city in ["Moscow", "SPb"] && semver(app_version) >= "7.0"`
+	var invalidTargeting = `app_version >= "7.0"`
+	var schedule = structures.SegmentSchedule{
+		Timezone:  "Europe/Moscow",
+		Intervals: []structures.ScheduleInterval{{Days: []string{"sat", "sun"}, Start: "18:00", End: "23:00"}},
+	}
 
 	type mockBehavior func(args args, slug string)
 
@@ -42,7 +55,7 @@ func TestSegment_Create(t *testing.T) {
 
 				rows := sqlmock.NewRows([]string{"slug"}).AddRow(slug)
 				mock.ExpectQuery("INSERT INTO segments").
-					WithArgs(args.Slug).
+					WithArgs(args.Slug, args.Percentage, args.DisplayName, args.Description, args.Owner, 1, nil, nil, nil, nil, nil, "active", nil, nil, nil, nil, nil, nil).
 					WillReturnRows(rows)
 
 				mock.ExpectCommit()
@@ -61,8 +74,254 @@ func TestSegment_Create(t *testing.T) {
 
 				rows := sqlmock.NewRows([]string{"slug"}).AddRow(slug)
 				mock.ExpectQuery("INSERT INTO segments").
-					WithArgs(args.Slug, &args.Percentage).
+					WithArgs(args.Slug, args.Percentage, args.DisplayName, args.Description, args.Owner, 1, nil, nil, nil, nil, nil, "active", nil, nil, nil, nil, nil, nil).
+					WillReturnRows(rows)
+
+				mock.ExpectCommit()
+			},
+			args: args{
+				structures.Segment{
+					Slug:       "example",
+					Percentage: &validPercentage,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "WithSchedule",
+			mockBehavior: func(args args, slug string) {
+				mock.ExpectBegin()
+
+				rows := sqlmock.NewRows([]string{"slug"}).AddRow(slug)
+				mock.ExpectQuery("INSERT INTO segments").
+					WithArgs(args.Slug, nil, nil, nil, nil, 1, nil, nil, nil, nil, nil, "active", nil, nil,
+						`{"timezone":"Europe/Moscow","intervals":[{"days":["sat","sun"],"start":"18:00","end":"23:00"}]}`, nil, nil, nil).
+					WillReturnRows(rows)
+
+				mock.ExpectCommit()
+			},
+			args: args{
+				structures.Segment{
+					Slug:     "example",
+					Schedule: &schedule,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "WithMetadata",
+			mockBehavior: func(args args, slug string) {
+				mock.ExpectBegin()
+
+				rows := sqlmock.NewRows([]string{"slug"}).AddRow(slug)
+				mock.ExpectQuery("INSERT INTO segments").
+					WithArgs(args.Slug, nil, displayName, nil, owner, 1, nil, nil, nil, nil, nil, "active", nil, nil, nil, nil, nil, nil).
+					WillReturnRows(rows)
+
+				mock.ExpectCommit()
+			},
+			args: args{
+				structures.Segment{
+					Slug:        "example",
+					DisplayName: &displayName,
+					Owner:       &owner,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "WithLayer",
+			mockBehavior: func(args args, slug string) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM layers WHERE slug = (.+) FOR UPDATE").
+					WithArgs(layer).
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(layer))
+				mock.ExpectQuery("SELECT slug, layer_offset, (.+) FROM segments WHERE layer").
+					WithArgs(layer, args.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "layer_offset", "width"}).AddRow("other", 0, 2000))
+
+				rows := sqlmock.NewRows([]string{"slug"}).AddRow(slug)
+				mock.ExpectQuery("INSERT INTO segments").
+					WithArgs(args.Slug, args.Percentage, nil, nil, nil, 1, nil, nil, nil, layer, 2000, "active", nil, nil, nil, nil, nil, nil).
+					WillReturnRows(rows)
+
+				mock.ExpectCommit()
+			},
+			args: args{
+				structures.Segment{
+					Slug:       "example",
+					Percentage: &validPercentage,
+					Layer:      &layer,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "WithVariants",
+			mockBehavior: func(args args, slug string) {
+				mock.ExpectBegin()
+
+				rows := sqlmock.NewRows([]string{"slug"}).AddRow(slug)
+				mock.ExpectQuery("INSERT INTO segments").
+					WithArgs(args.Slug, nil, nil, nil, nil, 1, nil, nil, nil, nil, nil, "active", nil, nil, nil, nil, nil, nil).
+					WillReturnRows(rows)
+				mock.ExpectExec("INSERT INTO segment_variants").
+					WithArgs(slug, "control", 50, 0).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO segment_variants").
+					WithArgs(slug, "a", 25, 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO segment_variants").
+					WithArgs(slug, "b", 25, 2).
+					WillReturnError(errors.New("variant error"))
+
+				mock.ExpectRollback()
+			},
+			args: args{
+				structures.Segment{
+					Slug:     "example",
+					Variants: []structures.SegmentVariant{{Name: "control", Weight: 50}, {Name: "a", Weight: 25}, {Name: "b", Weight: 25}},
+				},
+			},
+			wantErr:       true,
+			expectedError: "variant error",
+		},
+		{
+			name: "WithTags",
+			mockBehavior: func(args args, slug string) {
+				mock.ExpectBegin()
+
+				rows := sqlmock.NewRows([]string{"slug"}).AddRow(slug)
+				mock.ExpectQuery("INSERT INTO segments").
+					WithArgs(args.Slug, nil, nil, nil, nil, 1, nil, nil, nil, nil, nil, "active", nil, nil, nil, nil, nil, nil).
+					WillReturnRows(rows)
+				mock.ExpectExec("INSERT INTO segment_tags").
+					WithArgs(slug, "discount").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO segment_tags").
+					WithArgs(slug, "messenger").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+
+				mock.ExpectCommit()
+			},
+			args: args{
+				structures.Segment{
+					Slug: "example",
+					Tags: []string{"discount", "messenger"},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "Composite",
+			mockBehavior: func(args args, slug string) {
+				mock.ExpectBegin()
+
+				rows := sqlmock.NewRows([]string{"slug"}).AddRow(slug)
+				mock.ExpectQuery("INSERT INTO segments").
+					WithArgs(args.Slug, nil, nil, nil, nil, 1, nil, nil, nil, nil, nil, "active", nil, nil, nil, nil, nil, nil).
+					WillReturnRows(rows)
+				mock.ExpectExec("LOCK TABLE segment_expression_refs").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array([]string{"android_new_ui", "beta", "staff"})).
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow("android_new_ui").AddRow("beta").AddRow("staff"))
+				mock.ExpectQuery("WITH RECURSIVE reached").
+					WithArgs(pq.Array([]string{"android_new_ui", "beta", "staff"}), slug).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectQuery("SELECT EXISTS (.+) FROM user_segments").
+					WithArgs(slug).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec("INSERT INTO segment_expressions").
+					WithArgs(slug, "(beta OR staff) AND android_new_ui").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("DELETE FROM segment_expression_refs").
+					WithArgs(slug).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				for _, ref := range []string{"android_new_ui", "beta", "staff"} {
+					mock.ExpectExec("INSERT INTO segment_expression_refs").
+						WithArgs(slug, ref).
+						WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+
+				mock.ExpectCommit()
+			},
+			args: args{
+				structures.Segment{
+					Slug:       "example",
+					Expression: &expression,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "CompositeUnknownSegment",
+			mockBehavior: func(args args, slug string) {
+				mock.ExpectBegin()
+
+				rows := sqlmock.NewRows([]string{"slug"}).AddRow(slug)
+				mock.ExpectQuery("INSERT INTO segments").
+					WithArgs(args.Slug, nil, nil, nil, nil, 1, nil, nil, nil, nil, nil, "active", nil, nil, nil, nil, nil, nil).
+					WillReturnRows(rows)
+				mock.ExpectExec("LOCK TABLE segment_expression_refs").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array([]string{"android_new_ui", "beta", "staff"})).
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow("android_new_ui").AddRow("beta"))
+
+				mock.ExpectRollback()
+			},
+			args: args{
+				structures.Segment{
+					Slug:       "example",
+					Expression: &expression,
+				},
+			},
+			wantErr:       true,
+			expectedError: "segment with slug staff does not exist",
+		},
+		{
+			name: "CompositeCycle",
+			mockBehavior: func(args args, slug string) {
+				mock.ExpectBegin()
+
+				rows := sqlmock.NewRows([]string{"slug"}).AddRow(slug)
+				mock.ExpectQuery("INSERT INTO segments").
+					WithArgs(args.Slug, nil, nil, nil, nil, 1, nil, nil, nil, nil, nil, "active", nil, nil, nil, nil, nil, nil).
+					WillReturnRows(rows)
+				mock.ExpectExec("LOCK TABLE segment_expression_refs").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array([]string{"android_new_ui", "beta", "staff"})).
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow("android_new_ui").AddRow("beta").AddRow("staff"))
+				mock.ExpectQuery("WITH RECURSIVE reached").
+					WithArgs(pq.Array([]string{"android_new_ui", "beta", "staff"}), slug).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+				mock.ExpectRollback()
+			},
+			args: args{
+				structures.Segment{
+					Slug:       "example",
+					Expression: &expression,
+				},
+			},
+			wantErr:       true,
+			expectedError: "expression of segment example refers to a segment whose expression refers back to it",
+		},
+		{
+			name: "Targeting",
+			mockBehavior: func(args args, slug string) {
+				mock.ExpectBegin()
+
+				rows := sqlmock.NewRows([]string{"slug"}).AddRow(slug)
+				mock.ExpectQuery("INSERT INTO segments").
+					WithArgs(args.Slug, args.Percentage, nil, nil, nil, 1, nil, nil, nil, nil, nil, "active", nil, nil, nil, nil, nil, nil).
 					WillReturnRows(rows)
+				mock.ExpectExec("INSERT INTO segment_targeting").
+					WithArgs(slug, targeting).
+					WillReturnResult(sqlmock.NewResult(0, 1))
 
 				mock.ExpectCommit()
 			},
@@ -70,17 +329,85 @@ func TestSegment_Create(t *testing.T) {
 				structures.Segment{
 					Slug:       "example",
 					Percentage: &validPercentage,
+					Targeting:  &targeting,
 				},
 			},
 			wantErr: false,
 		},
+		{
+			name: "InvalidTargeting",
+			mockBehavior: func(args args, slug string) {
+				mock.ExpectBegin()
+
+				rows := sqlmock.NewRows([]string{"slug"}).AddRow(slug)
+				mock.ExpectQuery("INSERT INTO segments").
+					WithArgs(args.Slug, args.Percentage, nil, nil, nil, 1, nil, nil, nil, nil, nil, "active", nil, nil, nil, nil, nil, nil).
+					WillReturnRows(rows)
+
+				mock.ExpectRollback()
+			},
+			args: args{
+				structures.Segment{
+					Slug:       "example",
+					Percentage: &validPercentage,
+					Targeting:  &invalidTargeting,
+				},
+			},
+			wantErr:       true,
+			expectedError: "invalid targeting, >= compares numbers, use semver(app_version) for versions",
+		},
+		{
+			name: "LayerFull",
+			mockBehavior: func(args args, slug string) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM layers WHERE slug = (.+) FOR UPDATE").
+					WithArgs(layer).
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(layer))
+				mock.ExpectQuery("SELECT slug, layer_offset, (.+) FROM segments WHERE layer").
+					WithArgs(layer, args.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "layer_offset", "width"}).AddRow("other", 0, 5000))
+
+				mock.ExpectRollback()
+			},
+			args: args{
+				structures.Segment{
+					Slug:       "example",
+					Percentage: &validPercentage,
+					Layer:      &layer,
+				},
+			},
+			wantErr:       true,
+			expectedError: "layer checkout has no free range of 7700 basis points",
+		},
+		{
+			name: "LayerNotFound",
+			mockBehavior: func(args args, slug string) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM layers WHERE slug = (.+) FOR UPDATE").
+					WithArgs(layer).
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectRollback()
+			},
+			args: args{
+				structures.Segment{
+					Slug:       "example",
+					Percentage: &validPercentage,
+					Layer:      &layer,
+				},
+			},
+			wantErr:       true,
+			expectedError: "layer with slug checkout does not exist",
+		},
 		{
 			name: "DuplicateSlug",
 			mockBehavior: func(args args, slug string) {
 				mock.ExpectBegin()
 
 				mock.ExpectQuery("INSERT INTO segments").
-					WithArgs(args.Slug).
+					WithArgs(args.Slug, args.Percentage, args.DisplayName, args.Description, args.Owner, 1, nil, nil, nil, nil, nil, "active", nil, nil, nil, nil, nil, nil).
 					WillReturnError(errors.New("duplicate slug"))
 
 				mock.ExpectRollback()
@@ -113,7 +440,7 @@ func TestSegment_Create(t *testing.T) {
 
 				rows := sqlmock.NewRows([]string{"slug"}).AddRow(slug)
 				mock.ExpectQuery("INSERT INTO segments").
-					WithArgs(args.Slug).
+					WithArgs(args.Slug, args.Percentage, args.DisplayName, args.Description, args.Owner, 1, nil, nil, nil, nil, nil, "active", nil, nil, nil, nil, nil, nil).
 					WillReturnRows(rows)
 
 				mock.ExpectCommit().WillReturnError(errors.New("commit error"))
@@ -132,7 +459,7 @@ func TestSegment_Create(t *testing.T) {
 				mock.ExpectBegin()
 
 				mock.ExpectQuery("INSERT INTO segments").
-					WithArgs(args.Slug).
+					WithArgs(args.Slug, args.Percentage, args.DisplayName, args.Description, args.Owner, 1, nil, nil, nil, nil, nil, "active", nil, nil, nil, nil, nil, nil).
 					WillReturnError(errors.New("query error"))
 
 				mock.ExpectRollback()
@@ -178,6 +505,9 @@ func TestSegment_Delete(t *testing.T) {
 
 	type mockBehavior func(args args, slug string)
 
+	membershipColumns := []string{"user_id", "active_from", "expiration_time"}
+	dueActiveFrom := time.Now().Add(-time.Hour)
+
 	tests := []struct {
 		name          string
 		mockBehavior  mockBehavior
@@ -193,18 +523,83 @@ func TestSegment_Delete(t *testing.T) {
 					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(1))
 
 				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment FROM segment_expression_refs").
+					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT user_id, active_from, expiration_time FROM user_segments").
+					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows(membershipColumns).AddRow(1, nil, nil))
+				mock.ExpectQuery("SELECT user_id FROM user_percentage_segments").
+					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1).AddRow(2))
+				mock.ExpectQuery("INSERT INTO change_sets").
+					WithArgs("segment_deletion", false).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, time.Now()))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{args.Slug})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, args.Slug, false, "segment_deleted", nil, nil, 7, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{args.Slug})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(2, args.Slug, false, "segment_deleted", nil, nil, 7, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(2))
 				mock.ExpectExec("DELETE").
 					WithArgs(args.Slug).
 					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			args: args{
+				structures.Segment{
+					Slug: "example",
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "DeleteDueMembership",
+			mockBehavior: func(args args, slug string) {
+				mock.ExpectQuery("SELECT").
+					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(1))
 
 				mock.ExpectBegin()
-				mock.ExpectQuery("SELECT").
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment FROM segment_expression_refs").
+					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT user_id, active_from, expiration_time FROM user_segments").
+					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows(membershipColumns).AddRow(1, dueActiveFrom, nil))
+				mock.ExpectQuery("SELECT user_id FROM user_percentage_segments").
 					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+				mock.ExpectQuery("INSERT INTO change_sets").
+					WithArgs("segment_deletion", false).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, time.Now()))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{args.Slug})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, args.Slug, true, "manual", nil, dueActiveFrom, 7, nil).
 					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
-				mock.ExpectCommit()
-				mock.ExpectQuery("INSERT").
-					WithArgs(1, args.Slug, false).
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{args.Slug})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, args.Slug, false, "segment_deleted", nil, nil, 7, nil).
 					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				mock.ExpectExec("DELETE").
+					WithArgs(args.Slug).
+					WillReturnResult(sqlmock.NewResult(0, 1))
 				mock.ExpectCommit()
 			},
 			args: args{
@@ -247,11 +642,17 @@ func TestSegment_Delete(t *testing.T) {
 			expectedError: "transaction error",
 		},
 		{
-			name: "SelectError",
+			name: "ChildrenUndecided",
 			mockBehavior: func(args args, slug string) {
 				mock.ExpectQuery("SELECT").
 					WithArgs(args.Slug).
-					WillReturnError(errors.New("error reading segment"))
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(1))
+
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}).AddRow("example-child", args.Slug))
+				mock.ExpectRollback()
 			},
 			args: args{
 				structures.Segment{
@@ -259,21 +660,22 @@ func TestSegment_Delete(t *testing.T) {
 				},
 			},
 			wantErr:       true,
-			expectedError: "error reading segment",
+			expectedError: "segment example has children, use children=detach or children=reparent",
 		},
 		{
-			name: "DeleteError",
+			name: "ReferencedByExpression",
 			mockBehavior: func(args args, slug string) {
 				mock.ExpectQuery("SELECT").
 					WithArgs(args.Slug).
 					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(1))
 
 				mock.ExpectBegin()
-
-				mock.ExpectExec("DELETE").
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
 					WithArgs(args.Slug).
-					WillReturnError(errors.New("delete error"))
-
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment FROM segment_expression_refs").
+					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}).AddRow("example-composite"))
 				mock.ExpectRollback()
 			},
 			args: args{
@@ -282,22 +684,48 @@ func TestSegment_Delete(t *testing.T) {
 				},
 			},
 			wantErr:       true,
-			expectedError: "delete error",
+			expectedError: "segment example is used by the expression of segment example-composite",
 		},
 		{
-			name: "CreateRepoForHistoryError",
+			name: "SelectError",
+			mockBehavior: func(args args, slug string) {
+				mock.ExpectQuery("SELECT").
+					WithArgs(args.Slug).
+					WillReturnError(errors.New("error reading segment"))
+			},
+			args: args{
+				structures.Segment{
+					Slug: "example",
+				},
+			},
+			wantErr:       true,
+			expectedError: "error reading segment",
+		},
+		{
+			name: "DeleteError",
 			mockBehavior: func(args args, slug string) {
 				mock.ExpectQuery("SELECT").
 					WithArgs(args.Slug).
 					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(1))
 
 				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment FROM segment_expression_refs").
+					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT user_id, active_from, expiration_time FROM user_segments").
+					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows(membershipColumns))
+				mock.ExpectQuery("SELECT user_id FROM user_percentage_segments").
+					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
 
 				mock.ExpectExec("DELETE").
 					WithArgs(args.Slug).
-					WillReturnResult(sqlmock.NewResult(0, 1))
+					WillReturnError(errors.New("delete error"))
 
-				mock.ExpectBegin().WillReturnError(errors.New("repo for history error"))
 				mock.ExpectRollback()
 			},
 			args: args{
@@ -306,27 +734,63 @@ func TestSegment_Delete(t *testing.T) {
 				},
 			},
 			wantErr:       true,
-			expectedError: "repo for history error",
+			expectedError: "delete error",
 		},
 		{
-			name: "HistoryError",
+			name: "MembershipsError",
 			mockBehavior: func(args args, slug string) {
 				mock.ExpectQuery("SELECT").
 					WithArgs(args.Slug).
 					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(1))
 
 				mock.ExpectBegin()
-				mock.ExpectExec("DELETE").
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
 					WithArgs(args.Slug).
-					WillReturnResult(sqlmock.NewResult(0, 1))
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment FROM segment_expression_refs").
+					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT user_id, active_from, expiration_time FROM user_segments").
+					WithArgs(args.Slug).
+					WillReturnError(errors.New("memberships error"))
+				mock.ExpectRollback()
+			},
+			args: args{
+				structures.Segment{
+					Slug: "example",
+				},
+			},
+			wantErr:       true,
+			expectedError: "memberships error",
+		},
+		{
+			name: "HistoryError",
+			mockBehavior: func(args args, slug string) {
+				mock.ExpectQuery("SELECT").
+					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(1))
 
 				mock.ExpectBegin()
-				mock.ExpectQuery("SELECT").
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
 					WithArgs(args.Slug).
-					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
-				mock.ExpectCommit()
-				mock.ExpectQuery("INSERT").
-					WithArgs(1, args.Slug, false).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment FROM segment_expression_refs").
+					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT user_id, active_from, expiration_time FROM user_segments").
+					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows(membershipColumns).AddRow(1, nil, nil))
+				mock.ExpectQuery("SELECT user_id FROM user_percentage_segments").
+					WithArgs(args.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+				mock.ExpectQuery("INSERT INTO change_sets").
+					WithArgs("segment_deletion", false).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, time.Now()))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{args.Slug})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, args.Slug, false, "segment_deleted", nil, nil, 7, nil).
 					WillReturnError(errors.New("history error"))
 				mock.ExpectRollback()
 			},
@@ -344,18 +808,79 @@ func TestSegment_Delete(t *testing.T) {
 		t.Run(testCase.name, func(t *testing.T) {
 			testCase.mockBehavior(testCase.args, testCase.args.Slug)
 
-			got, err := repo.Delete(structures.Segment(testCase.args.Segment))
+			got, err := repo.Delete(structures.Segment(testCase.args.Segment), "")
 			if testCase.wantErr {
 				assert.Error(t, err)
 				assert.EqualError(t, err, testCase.expectedError)
 			} else {
 				assert.NoError(t, err)
-				assert.Equal(t, testCase.args.Slug, got)
+				assert.Equal(t, testCase.args.Slug, got.Slug)
+				if assert.NotNil(t, got.ChangeSet) {
+					assert.Equal(t, 7, *got.ChangeSet)
+				}
 			}
 		})
 	}
 }
 
+func TestSegment_DeleteDryRun(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewSegmentDB(db)
+
+	mock.ExpectQuery("SELECT COUNT").
+		WithArgs("example").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+		WithArgs("example").
+		WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+	mock.ExpectQuery("SELECT segment FROM segment_expression_refs").
+		WithArgs("example").
+		WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+	mock.ExpectQuery("SELECT user_id, active_from, expiration_time FROM user_segments").
+		WithArgs("example").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "active_from", "expiration_time"}).AddRow(1, nil, nil))
+	mock.ExpectQuery("SELECT user_id FROM user_percentage_segments").
+		WithArgs("example").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1).AddRow(2))
+	mock.ExpectQuery("INSERT INTO change_sets").
+		WithArgs("segment_deletion", false).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, time.Now()))
+	for _, userId := range []int{1, 2} {
+		mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+			WithArgs(pq.Array([]string{"example"})).
+			WillReturnRows(sqlmock.NewRows(variantColumns))
+		mock.ExpectQuery("INSERT INTO user_segments_history").
+			WithArgs(userId, "example", false, "segment_deleted", nil, nil, 7, nil).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(userId))
+	}
+	mock.ExpectExec("DELETE FROM segments").
+		WithArgs("example").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+
+	got, err := repo.DeleteDryRun(structures.Segment{Slug: "example"}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, structures.SegmentDeletion{
+		Slug:            "example",
+		DryRun:          true,
+		AffectedUsers:   2,
+		Users:           []int{1},
+		PercentageUsers: []int{1, 2},
+		History: []structures.HistoryEntry{
+			{UserId: 1, Segment: "example", Operation: "remove", Reason: "segment_deleted"},
+			{UserId: 2, Segment: "example", Operation: "remove", Reason: "segment_deleted"},
+		},
+	}, got)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestSegment_GetPercentageSegments(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -365,6 +890,9 @@ func TestSegment_GetPercentageSegments(t *testing.T) {
 
 	repo := repository.NewSegmentDB(db)
 
+	columns := []string{"id", "slug", "percent", "display_name", "description", "owner", "bucketing_version", "salt", "hash_function", "basis_points", "created_at", "updated_at", "layer", "layer_offset", "state", "starts_at", "ends_at", "schedule", "max_members", "default_ttl", "max_ttl"}
+	createdAt := time.Date(2023, 8, 28, 20, 0, 0, 0, time.UTC)
+
 	type mockBehavior func()
 
 	tests := []struct {
@@ -378,8 +906,15 @@ func TestSegment_GetPercentageSegments(t *testing.T) {
 			mockBehavior: func() {
 				mock.ExpectBegin()
 
-				mock.ExpectQuery("SELECT").
-					WillReturnRows(sqlmock.NewRows([]string{"slug", "percent"}).AddRow("example", 100))
+				mock.ExpectQuery("SELECT (.+) AND state = \\$1").
+					WithArgs("active").
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, "example", 100, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil).
+						AddRow(2, "example-v2", nil, nil, nil, nil, 2, "example-v2", "murmur3", 1250, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{"example", "example-v2"})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}).AddRow("example-v2", `city in ["Moscow", "SPb"]`))
 
 				mock.ExpectCommit()
 			},
@@ -422,12 +957,12 @@ func TestSegment_GetPercentageSegments(t *testing.T) {
 				mock.ExpectBegin()
 
 				mock.ExpectQuery("SELECT").
-					WillReturnRows(sqlmock.NewRows([]string{"slug", "percent"}).AddRow(nil, nil))
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, "active", nil, nil, nil, nil, nil, nil))
 
 				mock.ExpectRollback()
 			},
 			wantErr:       true,
-			expectedError: "sql: Scan error on column index 0, name \"slug\": converting NULL to string is unsupported",
+			expectedError: "sql: Scan error on column index 0, name \"id\": converting NULL to int is unsupported",
 		},
 	}
 
@@ -445,3 +980,1566 @@ func TestSegment_GetPercentageSegments(t *testing.T) {
 		})
 	}
 }
+
+func TestSegment_Get(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewSegmentDB(db)
+
+	columns := []string{"id", "slug", "percent", "display_name", "description", "owner", "bucketing_version", "salt", "hash_function", "basis_points", "created_at", "updated_at", "layer", "layer_offset", "state", "starts_at", "ends_at", "schedule", "max_members", "default_ttl", "max_ttl"}
+	createdAt := time.Date(2023, 8, 28, 20, 0, 0, 0, time.UTC)
+
+	type mockBehavior func(slug string)
+
+	tests := []struct {
+		name          string
+		slug          string
+		mockBehavior  mockBehavior
+		wantErr       bool
+		expectedError string
+	}{
+		{
+			name: "OK",
+			slug: "example",
+			mockBehavior: func(slug string) {
+				mock.ExpectQuery("SELECT (.+) FROM segments WHERE slug").
+					WithArgs(slug).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, slug, 50, "Example", "Example segment", "example-team", 1, nil, nil, nil, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}).AddRow("control", 50).AddRow("treatment", 50))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectQuery("SELECT count(.+) FROM user_segments").
+					WithArgs(slug).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(250))
+			},
+		},
+		{
+			name: "Capped",
+			slug: "example",
+			mockBehavior: func(slug string) {
+				mock.ExpectQuery("SELECT (.+) FROM segments WHERE slug").
+					WithArgs(slug).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, slug, 50, "Example", "Example segment", "example-team", 1, nil, nil, nil, createdAt, createdAt, nil, nil, "active", nil, nil, nil, 1000, nil, nil))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}).AddRow("control", 50).AddRow("treatment", 50))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectQuery("SELECT count(.+) FROM user_segments").
+					WithArgs(slug).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(250))
+			},
+		},
+		{
+			name: "NotFound",
+			slug: "example",
+			mockBehavior: func(slug string) {
+				mock.ExpectQuery("SELECT (.+) FROM segments WHERE slug").
+					WithArgs(slug).
+					WillReturnRows(sqlmock.NewRows(columns))
+			},
+			wantErr:       true,
+			expectedError: "segment with slug example does not exist",
+		},
+		{
+			name: "QueryError",
+			slug: "example",
+			mockBehavior: func(slug string) {
+				mock.ExpectQuery("SELECT (.+) FROM segments WHERE slug").
+					WithArgs(slug).
+					WillReturnError(errors.New("query error"))
+			},
+			wantErr:       true,
+			expectedError: "query error",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior(testCase.slug)
+
+			got, err := repo.Get(structures.Segment{Slug: testCase.slug})
+			if testCase.wantErr {
+				assert.Error(t, err)
+				assert.EqualError(t, err, testCase.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, 1, got.Id)
+				assert.Equal(t, testCase.slug, got.Slug)
+				assert.Equal(t, 50, *got.Percentage)
+				assert.Equal(t, "example-team", *got.Owner)
+				assert.Equal(t, createdAt, *got.CreatedAt)
+				assert.Equal(t, []structures.SegmentVariant{{Name: "control", Weight: 50}, {Name: "treatment", Weight: 50}}, got.Variants)
+				assert.Equal(t, 250, *got.Members)
+			}
+		})
+	}
+}
+
+func TestSegment_List(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewSegmentDB(db)
+
+	columns := []string{"id", "slug", "percent", "display_name", "description", "owner", "bucketing_version", "salt", "hash_function", "basis_points", "created_at", "updated_at", "layer", "layer_offset", "state", "starts_at", "ends_at", "schedule", "max_members", "default_ttl", "max_ttl"}
+	createdAt := time.Date(2023, 8, 28, 20, 0, 0, 0, time.UTC)
+	owner := "example-team"
+	search := "AVITO"
+	wildcardSearch := `50%_off\`
+	archived := "archived"
+
+	type mockBehavior func(filter structures.SegmentsFilter)
+
+	tests := []struct {
+		name          string
+		filter        structures.SegmentsFilter
+		mockBehavior  mockBehavior
+		wantCount     int
+		wantTotal     int
+		wantErr       bool
+		expectedError string
+	}{
+		{
+			name:   "OK",
+			filter: structures.SegmentsFilter{Limit: 2, Offset: 0},
+			mockBehavior: func(filter structures.SegmentsFilter) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT COUNT").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+				mock.ExpectQuery("SELECT (.+) WHERE state <> \\$1 ORDER BY slug LIMIT").
+					WithArgs("archived", filter.Limit, filter.Offset).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, "AVITO_DISCOUNT_30", nil, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil).
+						AddRow(2, "AVITO_DISCOUNT_50", 50, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectCommit()
+			},
+			wantCount: 2,
+			wantTotal: 3,
+		},
+		{
+			name:   "Filtered",
+			filter: structures.SegmentsFilter{Limit: 20, Offset: 0, Owner: &owner, Search: &search},
+			mockBehavior: func(filter structures.SegmentsFilter) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT COUNT(.+) WHERE owner = \\$1 AND \\(slug ILIKE \\$2(.+) AND state <> \\$3").
+					WithArgs(owner, "%AVITO%", "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+				mock.ExpectQuery("SELECT (.+) LIMIT \\$4 OFFSET \\$5").
+					WithArgs(owner, "%AVITO%", "archived", filter.Limit, filter.Offset).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, "AVITO_DISCOUNT_30", nil, nil, nil, owner, 1, nil, nil, nil, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectCommit()
+			},
+			wantCount: 1,
+			wantTotal: 1,
+		},
+		{
+			name:   "SearchWildcards",
+			filter: structures.SegmentsFilter{Limit: 20, Offset: 0, Search: &wildcardSearch},
+			mockBehavior: func(filter structures.SegmentsFilter) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT COUNT(.+) WHERE \\(slug ILIKE \\$1 ESCAPE (.+) AND state <> \\$2").
+					WithArgs(`%50\%\_off\\%`, "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectQuery("SELECT (.+) LIMIT \\$3 OFFSET \\$4").
+					WithArgs(`%50\%\_off\\%`, "archived", filter.Limit, filter.Offset).
+					WillReturnRows(sqlmock.NewRows(columns))
+				mock.ExpectCommit()
+			},
+			wantCount: 0,
+			wantTotal: 0,
+		},
+		{
+			name:   "Archived",
+			filter: structures.SegmentsFilter{Limit: 20, Offset: 0, State: &archived},
+			mockBehavior: func(filter structures.SegmentsFilter) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT COUNT(.+) WHERE state = \\$1").
+					WithArgs(archived).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+				mock.ExpectQuery("SELECT (.+) WHERE state = \\$1 ORDER BY slug LIMIT \\$2 OFFSET \\$3").
+					WithArgs(archived, filter.Limit, filter.Offset).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, "AVITO_DISCOUNT_30", nil, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, archived, nil, nil, nil, nil, nil, nil))
+				mock.ExpectCommit()
+			},
+			wantCount: 1,
+			wantTotal: 1,
+		},
+		{
+			name:   "BeginError",
+			filter: structures.SegmentsFilter{Limit: 20},
+			mockBehavior: func(filter structures.SegmentsFilter) {
+				mock.ExpectBegin().WillReturnError(errors.New("begin error"))
+			},
+			wantErr:       true,
+			expectedError: "begin error",
+		},
+		{
+			name:   "CountError",
+			filter: structures.SegmentsFilter{Limit: 20},
+			mockBehavior: func(filter structures.SegmentsFilter) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT COUNT").
+					WillReturnError(errors.New("count error"))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "count error",
+		},
+		{
+			name:   "QueryError",
+			filter: structures.SegmentsFilter{Limit: 20},
+			mockBehavior: func(filter structures.SegmentsFilter) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT COUNT").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+				mock.ExpectQuery("SELECT (.+) ORDER BY slug LIMIT").
+					WillReturnError(errors.New("query error"))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "query error",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior(testCase.filter)
+
+			got, total, err := repo.List(testCase.filter)
+			if testCase.wantErr {
+				assert.Error(t, err)
+				assert.EqualError(t, err, testCase.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Len(t, got, testCase.wantCount)
+				assert.Equal(t, testCase.wantTotal, total)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSegment_Rename(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewSegmentDB(db)
+
+	type mockBehavior func(rename structures.SegmentRename)
+
+	tests := []struct {
+		name          string
+		rename        structures.SegmentRename
+		mockBehavior  mockBehavior
+		wantErr       bool
+		expectedError string
+	}{
+		{
+			name:   "OK",
+			rename: structures.SegmentRename{Slug: "example", NewSlug: "example-v2"},
+			mockBehavior: func(rename structures.SegmentRename) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET slug (.+) RETURNING state").
+					WithArgs(rename.Slug, rename.NewSlug).
+					WillReturnRows(sqlmock.NewRows([]string{"state"}).AddRow("active"))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(rename.NewSlug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:   "RewritesExpressions",
+			rename: structures.SegmentRename{Slug: "example", NewSlug: "example-v2"},
+			mockBehavior: func(rename structures.SegmentRename) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET slug (.+) RETURNING state").
+					WithArgs(rename.Slug, rename.NewSlug).
+					WillReturnRows(sqlmock.NewRows([]string{"state"}).AddRow("active"))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(rename.NewSlug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}).
+						AddRow("example-composite", "example AND NOT (example_excluded OR example)"))
+				mock.ExpectExec("UPDATE segment_expressions SET expression").
+					WithArgs("example-composite", "example-v2 AND NOT (example_excluded OR example-v2)").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:   "NotFound",
+			rename: structures.SegmentRename{Slug: "example", NewSlug: "example-v2"},
+			mockBehavior: func(rename structures.SegmentRename) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET slug (.+) RETURNING state").
+					WithArgs(rename.Slug, rename.NewSlug).
+					WillReturnRows(sqlmock.NewRows([]string{"state"}))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "segment with slug example does not exist",
+		},
+		{
+			name:   "Archived",
+			rename: structures.SegmentRename{Slug: "example", NewSlug: "example-v2"},
+			mockBehavior: func(rename structures.SegmentRename) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET slug (.+) RETURNING state").
+					WithArgs(rename.Slug, rename.NewSlug).
+					WillReturnRows(sqlmock.NewRows([]string{"state"}).AddRow("archived"))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "segment with slug example is archived",
+		},
+		{
+			name:   "DuplicateSlug",
+			rename: structures.SegmentRename{Slug: "example", NewSlug: "example-v2"},
+			mockBehavior: func(rename structures.SegmentRename) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET slug (.+) RETURNING state").
+					WithArgs(rename.Slug, rename.NewSlug).
+					WillReturnError(errors.New("duplicate slug"))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "duplicate slug",
+		},
+		{
+			name:   "BeginError",
+			rename: structures.SegmentRename{Slug: "example", NewSlug: "example-v2"},
+			mockBehavior: func(rename structures.SegmentRename) {
+				mock.ExpectBegin().WillReturnError(errors.New("begin error"))
+			},
+			wantErr:       true,
+			expectedError: "begin error",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior(testCase.rename)
+
+			got, err := repo.Rename(testCase.rename)
+			if testCase.wantErr {
+				assert.Error(t, err)
+				assert.EqualError(t, err, testCase.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testCase.rename.NewSlug, got)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSegment_Clone(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewSegmentDB(db)
+
+	now := time.Now()
+	variants := []structures.SegmentVariant{{Name: "control", Weight: 50}, {Name: "treatment", Weight: 50}}
+	cloneChangeSet := 7
+
+	type mockBehavior func(clone structures.SegmentClone)
+
+	tests := []struct {
+		name          string
+		clone         structures.SegmentClone
+		mockBehavior  mockBehavior
+		want          structures.SegmentCloneResult
+		expectedError string
+	}{
+		{
+			name:  "Settings",
+			clone: structures.SegmentClone{Slug: "example", NewSlug: "example-v2"},
+			mockBehavior: func(clone structures.SegmentClone) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM segments WHERE slug = (.+) FOR SHARE").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows(rampSegmentColumns).
+						AddRow(1, clone.Slug, 30, "Example", nil, "team", 1, nil, nil, nil, now, now, "checkout", 10, "archived", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{clone.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{clone.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectQuery("INSERT INTO segments").
+					WithArgs(clone.NewSlug, 30, "Example", nil, "team", 1, clone.Slug, nil, nil, nil, nil, "draft", nil, nil, nil, nil, nil, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(clone.NewSlug))
+				mock.ExpectCommit()
+			},
+			want: structures.SegmentCloneResult{Slug: "example-v2", Source: "example"},
+		},
+		{
+			name:  "Members",
+			clone: structures.SegmentClone{Slug: "example", NewSlug: "example-v2", CopyMembers: true, CopyExpirations: true},
+			mockBehavior: func(clone structures.SegmentClone) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM segments WHERE slug = (.+) FOR SHARE").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows(rampSegmentColumns).
+						AddRow(1, clone.Slug, 30, nil, nil, nil, 1, "salt", nil, nil, now, now, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}).AddRow("control", 50).AddRow("treatment", 50))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{clone.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{clone.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectQuery("INSERT INTO segments").
+					WithArgs(clone.NewSlug, 30, nil, nil, nil, 1, "salt", nil, nil, nil, nil, "active", nil, nil, nil, nil, nil, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(clone.NewSlug))
+				for position, variant := range variants {
+					mock.ExpectExec("INSERT INTO segment_variants").
+						WithArgs(clone.NewSlug, variant.Name, variant.Weight, position).
+						WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+
+				mock.ExpectExec("INSERT INTO user_segments (.+) SELECT (.+) FROM user_segments").
+					WithArgs(clone.Slug, clone.NewSlug, true).
+					WillReturnResult(sqlmock.NewResult(0, 3))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{clone.NewSlug})).
+					WillReturnRows(sqlmock.NewRows(variantColumns).
+						AddRow(clone.NewSlug, "salt", "control", 50).
+						AddRow(clone.NewSlug, "salt", "treatment", 50))
+				mock.ExpectQuery("SELECT user_id FROM user_segments WHERE segment = (.+) AND active_from IS NULL").
+					WithArgs(clone.NewSlug).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1).AddRow(2))
+				mock.ExpectQuery("INSERT INTO change_sets").
+					WithArgs("segment_clone", false).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, now))
+				mock.ExpectExec("INSERT INTO user_segments_history (.+) SELECT (.+) unnest").
+					WithArgs(clone.NewSlug, "segment_cloned", 7, pq.Array([]int64{1, 2}),
+						pq.Array([]string{utils.AssignVariant("salt", variants, 1), utils.AssignVariant("salt", variants, 2)})).
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectExec("UPDATE change_sets SET irreversible = true").
+					WithArgs(7).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			want: structures.SegmentCloneResult{Slug: "example-v2", Source: "example", Members: 3, ChangeSet: &cloneChangeSet},
+		},
+		{
+			name:  "MembersOverCapacity",
+			clone: structures.SegmentClone{Slug: "example", NewSlug: "example-v2", CopyMembers: true},
+			mockBehavior: func(clone structures.SegmentClone) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM segments WHERE slug = (.+) FOR SHARE").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows(rampSegmentColumns).
+						AddRow(1, clone.Slug, nil, nil, nil, nil, 1, nil, nil, nil, now, now, nil, nil, "active", nil, nil, nil, 2, nil, nil))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{clone.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{clone.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectQuery("INSERT INTO segments").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(clone.NewSlug))
+				mock.ExpectExec("INSERT INTO user_segments (.+) SELECT (.+) FROM user_segments").
+					WithArgs(clone.Slug, clone.NewSlug, false).
+					WillReturnResult(sqlmock.NewResult(0, 3))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{clone.NewSlug})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO change_sets").
+					WithArgs("segment_clone", false).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, now))
+				mock.ExpectExec("INSERT INTO user_segments_history (.+) SELECT (.+) unnest").
+					WithArgs(clone.NewSlug, "segment_cloned", 7, pq.Array([]int64{}), pq.Array([]string{})).
+					WillReturnResult(sqlmock.NewResult(0, 3))
+				mock.ExpectQuery("SELECT count(.+) FROM user_segments WHERE segment = (.+) AND").
+					WithArgs(clone.NewSlug).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+				mock.ExpectRollback()
+			},
+			expectedError: "segment with slug example-v2 is full, it is limited to 2 members",
+		},
+		{
+			name:  "TagsAndParent",
+			clone: structures.SegmentClone{Slug: "example", NewSlug: "example-v2"},
+			mockBehavior: func(clone structures.SegmentClone) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM segments WHERE slug = (.+) FOR SHARE").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows(rampSegmentColumns).
+						AddRow(1, clone.Slug, 30, nil, nil, nil, 1, nil, nil, nil, now, now, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}).AddRow("discount"))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}).AddRow(clone.Slug, "example-parent").AddRow("example-child", clone.Slug))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{clone.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{clone.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectQuery("INSERT INTO segments").
+					WithArgs(clone.NewSlug, 30, nil, nil, nil, 1, clone.Slug, nil, nil, nil, nil, "active", nil, nil, nil, nil, nil, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(clone.NewSlug))
+				mock.ExpectExec("INSERT INTO segment_tags").
+					WithArgs(clone.NewSlug, "discount").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("LOCK TABLE segment_parents").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT id FROM segments").
+					WithArgs("example-parent").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+				mock.ExpectQuery("WITH RECURSIVE ancestors").
+					WithArgs("example-parent", clone.NewSlug).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec("INSERT INTO segment_parents").
+					WithArgs(clone.NewSlug, "example-parent").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			want: structures.SegmentCloneResult{Slug: "example-v2", Source: "example"},
+		},
+		{
+			name:  "MembersBreakMaxTagged",
+			clone: structures.SegmentClone{Slug: "example", NewSlug: "example-v2", CopyMembers: true},
+			mockBehavior: func(clone structures.SegmentClone) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM segments WHERE slug = (.+) FOR SHARE").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows(rampSegmentColumns).
+						AddRow(1, clone.Slug, nil, nil, nil, nil, 1, nil, nil, nil, now, now, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}).AddRow("discount"))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{clone.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{clone.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectQuery("INSERT INTO segments").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(clone.NewSlug))
+				mock.ExpectExec("INSERT INTO segment_tags").
+					WithArgs(clone.NewSlug, "discount").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO user_segments (.+) SELECT (.+) FROM user_segments").
+					WithArgs(clone.Slug, clone.NewSlug, false).
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{clone.NewSlug})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO change_sets").
+					WithArgs("segment_clone", false).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, now))
+				mock.ExpectExec("INSERT INTO user_segments_history (.+) SELECT (.+) unnest").
+					WithArgs(clone.NewSlug, "segment_cloned", 7, pq.Array([]int64{}), pq.Array([]string{})).
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectQuery("SELECT (.+) FROM segment_rules").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "kind", "segment", "other", "tag", "max_segments", "created_at"}).
+						AddRow(3, "max_tagged", nil, nil, "discount", 1, now))
+				mock.ExpectQuery("SELECT us.user_id FROM user_segments us JOIN segment_tags t").
+					WithArgs(clone.NewSlug, "discount", 1).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(4))
+				mock.ExpectRollback()
+			},
+			expectedError: "user 4 breaks rule 3: at most 1 segments tagged discount are allowed",
+		},
+		{
+			name:  "NoMembers",
+			clone: structures.SegmentClone{Slug: "example", NewSlug: "example-v2", CopyMembers: true},
+			mockBehavior: func(clone structures.SegmentClone) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM segments WHERE slug = (.+) FOR SHARE").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows(rampSegmentColumns).
+						AddRow(1, clone.Slug, 30, nil, nil, nil, 1, nil, nil, nil, now, now, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{clone.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{clone.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectQuery("INSERT INTO segments").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(clone.NewSlug))
+				mock.ExpectExec("INSERT INTO user_segments (.+) SELECT (.+) FROM user_segments").
+					WithArgs(clone.Slug, clone.NewSlug, false).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectCommit()
+			},
+			want: structures.SegmentCloneResult{Slug: "example-v2", Source: "example"},
+		},
+		{
+			name:  "NotFound",
+			clone: structures.SegmentClone{Slug: "example", NewSlug: "example-v2"},
+			mockBehavior: func(clone structures.SegmentClone) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM segments WHERE slug = (.+) FOR SHARE").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows(rampSegmentColumns))
+				mock.ExpectRollback()
+			},
+			expectedError: "segment with slug example does not exist",
+		},
+		{
+			name:  "DuplicateSlug",
+			clone: structures.SegmentClone{Slug: "example", NewSlug: "example-v2"},
+			mockBehavior: func(clone structures.SegmentClone) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT (.+) FROM segments WHERE slug = (.+) FOR SHARE").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows(rampSegmentColumns).
+						AddRow(1, clone.Slug, 30, nil, nil, nil, 1, nil, nil, nil, now, now, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(clone.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{clone.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{clone.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectQuery("INSERT INTO segments").
+					WillReturnError(errors.New("duplicate slug"))
+				mock.ExpectRollback()
+			},
+			expectedError: "duplicate slug",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior(testCase.clone)
+
+			got, err := repo.Clone(testCase.clone)
+			if testCase.expectedError != "" {
+				assert.EqualError(t, err, testCase.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testCase.want, got)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSegment_Update(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewSegmentDB(db)
+
+	columns := []string{"id", "slug", "percent", "display_name", "description", "owner", "bucketing_version", "salt", "hash_function", "basis_points", "created_at", "updated_at", "layer", "layer_offset", "state", "starts_at", "ends_at", "schedule", "max_members", "default_ttl", "max_ttl"}
+	createdAt := time.Date(2023, 8, 28, 20, 0, 0, 0, time.UTC)
+	percentage := 30
+	layer := "checkout"
+	variants := []structures.SegmentVariant{{Name: "control", Weight: 50}, {Name: "treatment", Weight: 50}}
+	startsAt := time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+	parent := "example-parent"
+	targeting := `semver(app_version) >= "7.0"`
+	salt := "example-v1"
+
+	type mockBehavior func(update structures.SegmentUpdate)
+
+	tests := []struct {
+		name          string
+		update        structures.SegmentUpdate
+		mockBehavior  mockBehavior
+		wantErr       bool
+		expectedError string
+	}{
+		{
+			name:   "OK",
+			update: structures.SegmentUpdate{Slug: "example", Percentage: &percentage},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(update.Slug, percentage, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, update.Slug, percentage, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT user_id FROM user_percentage_segments").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1).AddRow(4))
+				mock.ExpectExec("DELETE FROM user_percentage_segments").
+					WithArgs(4, update.Slug).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(4, update.Slug, false, "percentage", nil, nil, nil, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(4))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:   "Archived",
+			update: structures.SegmentUpdate{Slug: "example", Percentage: &percentage},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(update.Slug, percentage, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, update.Slug, percentage, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, "archived", nil, nil, nil, nil, nil, nil))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "segment with slug example is archived",
+		},
+		{
+			name:   "RemoveSchedule",
+			update: structures.SegmentUpdate{Slug: "example", Schedule: &structures.SegmentSchedule{}},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(update.Slug, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, "null", nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, update.Slug, percentage, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:   "EmptyWindow",
+			update: structures.SegmentUpdate{Slug: "example", EndsAt: &startsAt},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(update.Slug, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, startsAt, nil, nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, update.Slug, percentage, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, "active", startsAt, startsAt, nil, nil, nil, nil))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "starts_at must be before ends_at",
+		},
+		{
+			name:   "ClearWindow",
+			update: structures.SegmentUpdate{Slug: "example", ClearStartsAt: true, ClearEndsAt: true},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(update.Slug, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, true, true).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, update.Slug, percentage, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:   "LayerGrowsInPlace",
+			update: structures.SegmentUpdate{Slug: "example", Percentage: &percentage},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(update.Slug, percentage, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, update.Slug, percentage, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, layer, 1000, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT slug FROM layers WHERE slug = (.+) FOR UPDATE").
+					WithArgs(layer).
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(layer))
+				mock.ExpectQuery("SELECT slug, layer_offset, (.+) FROM segments WHERE layer").
+					WithArgs(layer, update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "layer_offset", "width"}).AddRow("other", 0, 1000))
+				mock.ExpectQuery("SELECT user_id FROM user_percentage_segments").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:   "LayerRangeTaken",
+			update: structures.SegmentUpdate{Slug: "example", Percentage: &percentage},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(update.Slug, percentage, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, update.Slug, percentage, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, layer, 0, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT slug FROM layers WHERE slug = (.+) FOR UPDATE").
+					WithArgs(layer).
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(layer))
+				mock.ExpectQuery("SELECT slug, layer_offset, (.+) FROM segments WHERE layer").
+					WithArgs(layer, update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "layer_offset", "width"}).AddRow("other", 2000, 1000))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "layer checkout has no free range of 3000 basis points at offset 0",
+		},
+		{
+			name:   "MoveToLayer",
+			update: structures.SegmentUpdate{Slug: "example", Layer: &layer},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT slug FROM layers WHERE slug = (.+) FOR UPDATE").
+					WithArgs(layer).
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(layer))
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(update.Slug, nil, nil, nil, nil, nil, nil, nil, nil, layer, nil, nil, nil, nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, update.Slug, percentage, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, layer, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT slug FROM layers WHERE slug = (.+) FOR UPDATE").
+					WithArgs(layer).
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(layer))
+				mock.ExpectQuery("SELECT slug, layer_offset, (.+) FROM segments WHERE layer").
+					WithArgs(layer, update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "layer_offset", "width"}).AddRow("other", 0, 1000))
+				mock.ExpectExec("UPDATE segments SET layer_offset").
+					WithArgs(update.Slug, 1000).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT us.user_id, MIN\\(o.segment\\) FROM user_segments").
+					WithArgs(update.Slug, layer).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "segment"}))
+				mock.ExpectQuery("SELECT user_id FROM user_percentage_segments").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1).AddRow(3))
+				mock.ExpectExec("DELETE FROM user_percentage_segments").
+					WithArgs(3, update.Slug).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(3, update.Slug, false, "percentage", nil, nil, nil, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(3))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:   "MoveToLayerMemberConflict",
+			update: structures.SegmentUpdate{Slug: "example", Layer: &layer},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT slug FROM layers WHERE slug = (.+) FOR UPDATE").
+					WithArgs(layer).
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(layer))
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(update.Slug, nil, nil, nil, nil, nil, nil, nil, nil, layer, nil, nil, nil, nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, update.Slug, percentage, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, layer, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT slug FROM layers WHERE slug = (.+) FOR UPDATE").
+					WithArgs(layer).
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(layer))
+				mock.ExpectQuery("SELECT slug, layer_offset, (.+) FROM segments WHERE layer").
+					WithArgs(layer, update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "layer_offset", "width"}).AddRow("other", 0, 1000))
+				mock.ExpectExec("UPDATE segments SET layer_offset").
+					WithArgs(update.Slug, 1000).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT us.user_id, MIN\\(o.segment\\) FROM user_segments").
+					WithArgs(update.Slug, layer).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "segment"}).AddRow(7, "other"))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "user 7 cannot be in both example and other, layer checkout gives a user at most one segment",
+		},
+		{
+			name:   "MoveToUnknownLayer",
+			update: structures.SegmentUpdate{Slug: "example", Layer: &layer},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT slug FROM layers WHERE slug = (.+) FOR UPDATE").
+					WithArgs(layer).
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "layer with slug checkout does not exist",
+		},
+		{
+			name:   "ReplaceVariants",
+			update: structures.SegmentUpdate{Slug: "example", Variants: &variants},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(update.Slug, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, update.Slug, percentage, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}).AddRow("control", 90).AddRow("treatment", 10))
+				mock.ExpectQuery("SELECT EXISTS").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec("DELETE FROM segment_variants").
+					WithArgs(update.Slug).
+					WillReturnResult(sqlmock.NewResult(0, 3))
+				mock.ExpectExec("INSERT INTO segment_variants").
+					WithArgs(update.Slug, "control", 50, 0).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO segment_variants").
+					WithArgs(update.Slug, "treatment", 50, 1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}).AddRow("control", 50).AddRow("treatment", 50))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:   "ReplaceVariantsOfReachedSegment",
+			update: structures.SegmentUpdate{Slug: "example", Variants: &variants},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(update.Slug, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, update.Slug, percentage, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}).AddRow("control", 90).AddRow("treatment", 10))
+				mock.ExpectQuery("SELECT EXISTS").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "segment example already has users, its variants cannot be changed, clone it to start a new split",
+		},
+		{
+			name:   "SaltOfReachedSegmentWithVariants",
+			update: structures.SegmentUpdate{Slug: "example", Salt: &salt},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT COALESCE\\(salt, slug\\), COALESCE\\(hash_function, ''\\), EXISTS").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"salt", "hash_function", "exists"}).AddRow("example", "", true))
+				mock.ExpectQuery("SELECT EXISTS").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "segment example already has users, the salt and hash function of its variants cannot be changed, clone it to start a new split",
+		},
+		{
+			name:   "SaltUnchanged",
+			update: structures.SegmentUpdate{Slug: "example", Salt: &salt},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT COALESCE\\(salt, slug\\), COALESCE\\(hash_function, ''\\), EXISTS").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"salt", "hash_function", "exists"}).AddRow(salt, "", true))
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(update.Slug, nil, nil, nil, nil, nil, salt, nil, nil, nil, nil, nil, nil, nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, update.Slug, percentage, nil, nil, nil, 1, salt, nil, nil, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT user_id FROM user_percentage_segments").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}).AddRow("control", 50).AddRow("treatment", 50))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:   "MoveUnderParent",
+			update: structures.SegmentUpdate{Slug: "example", Parent: &parent},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(update.Slug, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, update.Slug, percentage, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectExec("LOCK TABLE segment_parents").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT id FROM segments").
+					WithArgs(parent).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+				mock.ExpectQuery("WITH RECURSIVE ancestors").
+					WithArgs(parent, update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectExec("INSERT INTO segment_parents").
+					WithArgs(update.Slug, parent).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}).AddRow(update.Slug, parent))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:   "ParentCycle",
+			update: structures.SegmentUpdate{Slug: "example", Parent: &parent},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(update.Slug, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, update.Slug, percentage, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectExec("LOCK TABLE segment_parents").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT id FROM segments").
+					WithArgs(parent).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+				mock.ExpectQuery("WITH RECURSIVE ancestors").
+					WithArgs(parent, update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "segment example-parent cannot be the parent of example, it descends from it",
+		},
+		{
+			name:   "TargetingKeepsPlacements",
+			update: structures.SegmentUpdate{Slug: "example", Targeting: &targeting},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(update.Slug, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, update.Slug, percentage, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectExec("INSERT INTO segment_targeting").
+					WithArgs(update.Slug, targeting).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}).AddRow(update.Slug, targeting))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:   "TargetingWithoutPercentage",
+			update: structures.SegmentUpdate{Slug: "example", Targeting: &targeting},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(update.Slug, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, update.Slug, nil, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectExec("INSERT INTO segment_targeting").
+					WithArgs(update.Slug, targeting).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(update.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{update.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}).AddRow(update.Slug, targeting))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "targeted segment example needs a percentage",
+		},
+		{
+			name:   "PercentageOnV2",
+			update: structures.SegmentUpdate{Slug: "example", Percentage: &percentage},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(update.Slug, percentage, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, update.Slug, nil, nil, nil, nil, 2, update.Slug, "murmur3", 3000, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "percentage is not supported by bucketing version 2, use basis points",
+		},
+		{
+			name:   "DropUsersError",
+			update: structures.SegmentUpdate{Slug: "example", Percentage: &percentage},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(update.Slug, percentage, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, update.Slug, percentage, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, "active", nil, nil, nil, nil, nil, nil))
+				mock.ExpectQuery("SELECT user_id FROM user_percentage_segments").
+					WithArgs(update.Slug).
+					WillReturnError(errors.New("select error"))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "select error",
+		},
+		{
+			name:   "NotFound",
+			update: structures.SegmentUpdate{Slug: "example", Percentage: &percentage},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET").
+					WithArgs(update.Slug, percentage, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false, false).
+					WillReturnRows(sqlmock.NewRows(columns))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "segment with slug example does not exist",
+		},
+		{
+			name:   "QueryError",
+			update: structures.SegmentUpdate{Slug: "example", Percentage: &percentage},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("UPDATE segments SET").
+					WillReturnError(errors.New("query error"))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "query error",
+		},
+		{
+			name:   "BeginError",
+			update: structures.SegmentUpdate{Slug: "example", Percentage: &percentage},
+			mockBehavior: func(update structures.SegmentUpdate) {
+				mock.ExpectBegin().WillReturnError(errors.New("begin error"))
+			},
+			wantErr:       true,
+			expectedError: "begin error",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior(testCase.update)
+
+			got, err := repo.Update(testCase.update)
+			if testCase.wantErr {
+				assert.Error(t, err)
+				assert.EqualError(t, err, testCase.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testCase.update.Slug, got.Slug)
+				assert.Equal(t, percentage, *got.Percentage)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSegment_SetState(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewSegmentDB(db)
+
+	columns := []string{"id", "slug", "percent", "display_name", "description", "owner", "bucketing_version", "salt", "hash_function", "basis_points", "created_at", "updated_at", "layer", "layer_offset", "state", "starts_at", "ends_at", "schedule", "max_members", "default_ttl", "max_ttl"}
+	createdAt := time.Date(2023, 8, 28, 20, 0, 0, 0, time.UTC)
+	comment := "incident"
+
+	type mockBehavior func(change structures.SegmentStateChange)
+
+	tests := []struct {
+		name          string
+		change        structures.SegmentStateChange
+		mockBehavior  mockBehavior
+		wantErr       bool
+		expectedError string
+	}{
+		{
+			name:   "OK",
+			change: structures.SegmentStateChange{Slug: "example", State: "paused", Comment: &comment},
+			mockBehavior: func(change structures.SegmentStateChange) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id, state FROM segments WHERE slug = (.+) FOR UPDATE").
+					WithArgs(change.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "state"}).AddRow(1, "active"))
+				mock.ExpectQuery("UPDATE segments SET state").
+					WithArgs(change.Slug, change.State).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, change.Slug, 30, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, change.State, nil, nil, nil, nil, nil, nil))
+				mock.ExpectExec("INSERT INTO segment_state_history").
+					WithArgs(1, change.Slug, "active", change.State, &comment).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery("SELECT name, weight FROM segment_variants").
+					WithArgs(change.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"name", "weight"}))
+				mock.ExpectQuery("SELECT tag FROM segment_tags").
+					WithArgs(change.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"tag"}))
+				mock.ExpectQuery("SELECT segment, parent FROM segment_parents").
+					WithArgs(change.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "parent"}))
+				mock.ExpectQuery("SELECT segment, expression FROM segment_expressions").
+					WithArgs(pq.Array([]string{change.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "expression"}))
+				mock.ExpectQuery("SELECT segment, rule FROM segment_targeting").
+					WithArgs(pq.Array([]string{change.Slug})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "rule"}))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:   "NotFound",
+			change: structures.SegmentStateChange{Slug: "example", State: "paused"},
+			mockBehavior: func(change structures.SegmentStateChange) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id, state FROM segments WHERE slug = (.+) FOR UPDATE").
+					WithArgs(change.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "state"}))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "segment with slug example does not exist",
+		},
+		{
+			name:   "InvalidTransition",
+			change: structures.SegmentStateChange{Slug: "example", State: "active"},
+			mockBehavior: func(change structures.SegmentStateChange) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id, state FROM segments WHERE slug = (.+) FOR UPDATE").
+					WithArgs(change.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "state"}).AddRow(1, "archived"))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "segment cannot go from archived to active",
+		},
+		{
+			name:   "HistoryError",
+			change: structures.SegmentStateChange{Slug: "example", State: "archived"},
+			mockBehavior: func(change structures.SegmentStateChange) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id, state FROM segments WHERE slug = (.+) FOR UPDATE").
+					WithArgs(change.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "state"}).AddRow(1, "paused"))
+				mock.ExpectQuery("UPDATE segments SET state").
+					WithArgs(change.Slug, change.State).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, change.Slug, 30, nil, nil, nil, 1, nil, nil, nil, createdAt, createdAt, nil, nil, change.State, nil, nil, nil, nil, nil, nil))
+				mock.ExpectExec("INSERT INTO segment_state_history").
+					WithArgs(1, change.Slug, "paused", change.State, nil).
+					WillReturnError(errors.New("history error"))
+				mock.ExpectRollback()
+			},
+			wantErr:       true,
+			expectedError: "history error",
+		},
+		{
+			name:   "BeginError",
+			change: structures.SegmentStateChange{Slug: "example", State: "paused"},
+			mockBehavior: func(change structures.SegmentStateChange) {
+				mock.ExpectBegin().WillReturnError(errors.New("begin error"))
+			},
+			wantErr:       true,
+			expectedError: "begin error",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior(testCase.change)
+
+			got, err := repo.SetState(testCase.change)
+			if testCase.wantErr {
+				assert.Error(t, err)
+				assert.EqualError(t, err, testCase.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testCase.change.State, got.State)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSegment_GetStateHistory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewSegmentDB(db)
+
+	changedAt := time.Date(2023, 8, 28, 20, 0, 0, 0, time.UTC)
+	columns := []string{"from_state", "to_state", "comment", "changed_at"}
+
+	type mockBehavior func(segment structures.Segment)
+
+	tests := []struct {
+		name          string
+		segment       structures.Segment
+		mockBehavior  mockBehavior
+		wantCount     int
+		wantErr       bool
+		expectedError string
+	}{
+		{
+			name:    "OK",
+			segment: structures.Segment{Slug: "example"},
+			mockBehavior: func(segment structures.Segment) {
+				mock.ExpectQuery("SELECT id FROM segments").
+					WithArgs(segment.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				mock.ExpectQuery("SELECT from_state, to_state, comment, changed_at FROM segment_state_history").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow("active", "paused", "incident", changedAt).
+						AddRow("paused", "active", nil, changedAt))
+			},
+			wantCount: 2,
+		},
+		{
+			name:    "NotFound",
+			segment: structures.Segment{Slug: "example"},
+			mockBehavior: func(segment structures.Segment) {
+				mock.ExpectQuery("SELECT id FROM segments").
+					WithArgs(segment.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			},
+			wantErr:       true,
+			expectedError: "segment with slug example does not exist",
+		},
+		{
+			name:    "QueryError",
+			segment: structures.Segment{Slug: "example"},
+			mockBehavior: func(segment structures.Segment) {
+				mock.ExpectQuery("SELECT id FROM segments").
+					WithArgs(segment.Slug).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				mock.ExpectQuery("SELECT from_state, to_state, comment, changed_at FROM segment_state_history").
+					WithArgs(1).
+					WillReturnError(errors.New("query error"))
+			},
+			wantErr:       true,
+			expectedError: "query error",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior(testCase.segment)
+
+			got, err := repo.GetStateHistory(testCase.segment)
+			if testCase.wantErr {
+				assert.Error(t, err)
+				assert.EqualError(t, err, testCase.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Len(t, got, testCase.wantCount)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+func getSegmentTags(q queryer, slug string) ([]string, error) {
+	getTagsQuery := fmt.Sprintf("SELECT tag FROM %s WHERE segment = $1 ORDER BY tag", segmentTagsTable)
+	rows, err := q.Query(getTagsQuery, slug)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+func replaceSegmentTags(tx *sql.Tx, slug string, tags []string) error {
+	deleteTagsQuery := fmt.Sprintf("DELETE FROM %s WHERE segment = $1", segmentTagsTable)
+	if _, err := tx.Exec(deleteTagsQuery, slug); err != nil {
+		return err
+	}
+
+	return insertSegmentTags(tx, slug, tags)
+}
+
+func insertSegmentTags(tx *sql.Tx, slug string, tags []string) error {
+	insertTagQuery := fmt.Sprintf("INSERT INTO %s (segment, tag) VALUES ($1, $2)", segmentTagsTable)
+	for _, tag := range tags {
+		if _, err := tx.Exec(insertTagQuery, slug, tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getSegmentsTags returns the tags of the given segments, segments without tags are left out.
+func getSegmentsTags(q queryer, slugs []string) (map[string][]string, error) {
+	getTagsQuery := fmt.Sprintf("SELECT segment, tag FROM %s WHERE segment = ANY($1) ORDER BY segment, tag", segmentTagsTable)
+	rows, err := q.Query(getTagsQuery, pq.Array(slugs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make(map[string][]string)
+	for rows.Next() {
+		var slug, tag string
+		if err := rows.Scan(&slug, &tag); err != nil {
+			return nil, err
+		}
+		tags[slug] = append(tags[slug], tag)
+	}
+
+	return tags, rows.Err()
+}
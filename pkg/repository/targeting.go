@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"avito/pkg/structures"
+	"avito/pkg/utils"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+func getSegmentTargeting(q queryer, slug string) (*string, error) {
+	rules, err := getSegmentsTargeting(q, []string{slug})
+	if err != nil {
+		return nil, err
+	}
+
+	if rule, ok := rules[slug]; ok {
+		return &rule, nil
+	}
+	return nil, nil
+}
+
+func getSegmentsTargeting(q queryer, slugs []string) (map[string]string, error) {
+	rules := map[string]string{}
+	if len(slugs) == 0 {
+		return rules, nil
+	}
+
+	getRulesQuery := fmt.Sprintf("SELECT segment, rule FROM %s WHERE segment = ANY($1)", segmentTargetingTable)
+	rows, err := q.Query(getRulesQuery, pq.Array(slugs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var slug, rule string
+		if err := rows.Scan(&slug, &rule); err != nil {
+			return nil, err
+		}
+		rules[slug] = rule
+	}
+
+	return rules, rows.Err()
+}
+
+// setSegmentTargeting replaces the targeting rule of the segment, an empty rule removes it.
+// The rule is stored as given once it parses, it is evaluated when the segments of a user are read.
+func setSegmentTargeting(tx *sql.Tx, slug string, rule string) error {
+	if rule == "" {
+		removeQuery := fmt.Sprintf("DELETE FROM %s WHERE segment = $1", segmentTargetingTable)
+		_, err := tx.Exec(removeQuery, slug)
+		return err
+	}
+
+	if _, err := utils.ParseTargeting(rule); err != nil {
+		return structures.ValidationError{Message: err.Error()}
+	}
+
+	setRuleQuery := fmt.Sprintf(
+		"INSERT INTO %s (segment, rule) VALUES ($1, $2) ON CONFLICT (segment) DO UPDATE SET rule = EXCLUDED.rule",
+		segmentTargetingTable)
+	_, err := tx.Exec(setRuleQuery, slug, rule)
+	return err
+}
@@ -46,7 +46,9 @@ func (r *UserDB) GetUserHistory(userHistory structures.UserHistory) (string, err
 	writer := csv.NewWriter(reportFile)
 	defer writer.Flush()
 
-	createSegmentQuery := fmt.Sprintf("SELECT user_id, segment, operation, operation_datetime FROM %s WHERE user_id = $1 AND to_char(operation_datetime, 'YYYY-MM') = $2", userSegmentsHistoryTable)
+	createSegmentQuery := fmt.Sprintf(
+		"SELECT h.user_id, %s, h.operation, h.reason, h.variant, h.operation_datetime FROM %s WHERE h.user_id = $1 AND to_char(h.operation_datetime, 'YYYY-MM') = $2 ORDER BY h.id",
+		historySegment, historyWithSegments)
 	rows, err := tx.Query(createSegmentQuery, userHistory.Id, userHistory.YearMonth)
 	if err != nil {
 		tx.Rollback()
@@ -58,9 +60,11 @@ func (r *UserDB) GetUserHistory(userHistory structures.UserHistory) (string, err
 		var userID int
 		var segment string
 		var operation bool
+		var reason string
+		var variant sql.NullString
 		var operationDatetime time.Time
 
-		err := rows.Scan(&userID, &segment, &operation, &operationDatetime)
+		err := rows.Scan(&userID, &segment, &operation, &reason, &variant, &operationDatetime)
 		if err != nil {
 			tx.Rollback()
 			return "", err
@@ -75,6 +79,8 @@ func (r *UserDB) GetUserHistory(userHistory structures.UserHistory) (string, err
 			fmt.Sprintf("%d", userID),
 			segment,
 			operationStr,
+			reason,
+			variant.String,
 			operationDatetime.Format("2006-01-02 15:04:05"),
 		}
 
@@ -97,16 +103,124 @@ func (r *UserDB) GetUserHistory(userHistory structures.UserHistory) (string, err
 	return reportFileName, nil
 }
 
-func historyUpdate(tx *sql.Tx, segment string, userId int, operation bool) (int, error) {
+// historyWithSegments joins history rows h to the segments they were written for through segment_id,
+// and historySegment is the current slug of that segment: history written before a rename reads under the new slug,
+// history of a deleted segment keeps the slug it was written with.
+var (
+	historyWithSegments = fmt.Sprintf("%s h LEFT JOIN %s s ON s.id = h.segment_id", userSegmentsHistoryTable, segmentsTable)
+	historySegment      = "COALESCE(s.slug, h.segment)"
+)
+
+const (
+	// reasonManual marks memberships changed through the API.
+	reasonManual = "manual"
+	// reasonPercentage marks users placed into or dropped out of a percentage segment.
+	reasonPercentage = "percentage"
+	// reasonSegmentDeleted marks memberships closed by deleting the segment.
+	reasonSegmentDeleted = "segment_deleted"
+	// reasonSegmentEnded marks memberships closed when the activation window of the segment has ended.
+	reasonSegmentEnded = "segment_ended"
+	// reasonRevert marks memberships restored or removed by reverting a change set.
+	reasonRevert = "revert"
+	// reasonSegmentCloned marks memberships copied from the segment a clone was made of.
+	reasonSegmentCloned = "segment_cloned"
+)
+
+// Kinds of change sets, named after the mutation that wrote them.
+const (
+	changeSetPatch           = "patch"
+	changeSetSet             = "set"
+	changeSetSegmentDeletion = "segment_deletion"
+	changeSetSegmentClone    = "segment_clone"
+	changeSetRevert          = "revert"
+)
+
+func historyUpdate(tx *sql.Tx, segment string, userId int, operation bool, reason string) (int, error) {
+	return historyUpdateAt(tx, segment, userId, operation, reason, nil, nil, nil)
+}
+
+// historyLog collects the history rows written in a transaction, so a dry run can report them.
+// The rows are grouped into a change set of the kind, created along with the first of them.
+// A change set is irreversible once the transaction makes a change without a history row.
+type historyLog struct {
+	kind         string
+	changeSet    *int
+	createdAt    time.Time
+	irreversible bool
+	entries      []structures.HistoryEntry
+}
+
+func newHistoryLog(kind string) historyLog {
+	return historyLog{kind: kind}
+}
+
+// open creates the change set of the log, unless it already has one.
+func (l *historyLog) open(tx *sql.Tx) error {
+	if l.changeSet != nil {
+		return nil
+	}
+
+	var id int
+	createChangeSetQuery := fmt.Sprintf("INSERT INTO %s (kind, irreversible) VALUES ($1, $2) RETURNING id, created_at", changeSetsTable)
+	if err := tx.QueryRow(createChangeSetQuery, l.kind, l.irreversible).Scan(&id, &l.createdAt); err != nil {
+		return err
+	}
+	l.changeSet = &id
+	return nil
+}
+
+// skip notes a change that is not written to history, such as a new expiration or a delayed add,
+// which a revert of the change set could not undo.
+func (l *historyLog) skip(tx *sql.Tx) error {
+	if l.irreversible {
+		return nil
+	}
+	l.irreversible = true
+	if l.changeSet == nil {
+		return nil
+	}
+
+	markIrreversibleQuery := fmt.Sprintf("UPDATE %s SET irreversible = true WHERE id = $1", changeSetsTable)
+	_, err := tx.Exec(markIrreversibleQuery, *l.changeSet)
+	return err
+}
+
+func (l *historyLog) write(tx *sql.Tx, segment string, userId int, operation bool, reason string, expiration, at *time.Time) error {
+	if err := l.open(tx); err != nil {
+		return err
+	}
+
+	if _, err := historyUpdateAt(tx, segment, userId, operation, reason, at, l.changeSet, expiration); err != nil {
+		return err
+	}
+
+	entry := structures.HistoryEntry{UserId: userId, Segment: segment, Operation: "remove", Reason: reason, ExpiresAt: expiration, At: at}
+	if operation {
+		entry.Operation = "add"
+	}
+	l.entries = append(l.entries, entry)
+	return nil
+}
+
+// historyUpdateAt records the operation at the moment, or now when it is nil,
+// along with its change set and the expiration of the membership, if any.
+func historyUpdateAt(tx *sql.Tx, segment string, userId int, operation bool, reason string, at *time.Time, changeSet *int, expiration *time.Time) (int, error) {
 	// operation:
 	// 		true - insert
 	//		false - delete
+	variant, err := userVariant(tx, segment, userId)
+	if err != nil {
+		tx.Rollback()
+		return -1, err
+	}
+
 	var user_id int
 	createUserSegmentsHistoryQuery := fmt.Sprintf(
-		"INSERT INTO %s (user_id, segment, operation) VALUES ($1, $2, $3) RETURNING user_id",
-		userSegmentsHistoryTable)
+		`INSERT INTO %s (user_id, segment, segment_id, operation, reason, variant, operation_datetime, change_set, expiration_time)
+		VALUES ($1, $2, (SELECT id FROM %s WHERE slug = $2), $3, $4, $5, COALESCE($6::timestamptz, CURRENT_TIMESTAMP), $7, $8) RETURNING user_id`,
+		userSegmentsHistoryTable, segmentsTable)
 
-	row := tx.QueryRow(createUserSegmentsHistoryQuery, userId, segment, operation)
+	row := tx.QueryRow(createUserSegmentsHistoryQuery, userId, segment, operation, reason, variant, at, changeSet, expiration)
 	if err := row.Scan(&user_id); err != nil {
 		tx.Rollback()
 		return -1, err
@@ -120,6 +234,11 @@ func (r *UserDB) DeleteExpiredSegments() error {
 		return err
 	}
 
+	if err := activateDueSegments(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	deleteSegmentQuery := fmt.Sprintf("DELETE FROM %s WHERE expiration_time IS NOT NULL AND expiration_time <= NOW()", userSegmentsTable)
 	_, err = tx.Exec(deleteSegmentQuery)
 	if err != nil {
@@ -127,5 +246,108 @@ func (r *UserDB) DeleteExpiredSegments() error {
 		return err
 	}
 
+	if err := closeEndedSegments(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	return tx.Commit()
 }
+
+type membership struct {
+	userId  int
+	segment string
+}
+
+// activateDueSegments records in history the delayed memberships that became active, at their active_from,
+// and clears it, so they count as regular memberships from then on.
+func activateDueSegments(tx *sql.Tx) error {
+	getDueQuery := fmt.Sprintf(
+		"SELECT user_id, segment, active_from FROM %s WHERE active_from <= NOW() ORDER BY active_from, segment, user_id FOR UPDATE",
+		userSegmentsTable)
+	rows, err := tx.Query(getDueQuery)
+	if err != nil {
+		return err
+	}
+
+	type activation struct {
+		membership
+		activeFrom time.Time
+	}
+	var due []activation
+	for rows.Next() {
+		var a activation
+		if err := rows.Scan(&a.userId, &a.segment, &a.activeFrom); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(due) == 0 {
+		return nil
+	}
+
+	for _, a := range due {
+		if _, err := historyUpdateAt(tx, a.segment, a.userId, true, reasonManual, &a.activeFrom, nil, nil); err != nil {
+			return err
+		}
+	}
+
+	activateQuery := fmt.Sprintf("UPDATE %s SET active_from = NULL WHERE active_from <= NOW()", userSegmentsTable)
+	_, err = tx.Exec(activateQuery)
+	return err
+}
+
+// closeEndedSegments closes the explicit and percentage memberships of the segments
+// whose activation window has ended, with a history entry per user and segment.
+// Delayed memberships that never became active are closed without one.
+func closeEndedSegments(tx *sql.Tx) error {
+	getMembershipsQuery := fmt.Sprintf(
+		`SELECT us.user_id, us.segment FROM %[1]s us JOIN %[3]s s ON s.slug = us.segment WHERE s.ends_at <= NOW() AND us.active_from IS NULL
+		UNION
+		SELECT ups.user_id, ups.segment FROM %[2]s ups JOIN %[3]s s ON s.slug = ups.segment WHERE s.ends_at <= NOW()
+		ORDER BY segment, user_id`,
+		userSegmentsTable, userPercentageSegments, segmentsTable)
+	rows, err := tx.Query(getMembershipsQuery)
+	if err != nil {
+		return err
+	}
+
+	var memberships []membership
+	for rows.Next() {
+		var m membership
+		if err := rows.Scan(&m.userId, &m.segment); err != nil {
+			rows.Close()
+			return err
+		}
+		memberships = append(memberships, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(memberships) == 0 {
+		return nil
+	}
+
+	for _, m := range memberships {
+		if _, err := historyUpdate(tx, m.segment, m.userId, false, reasonSegmentEnded); err != nil {
+			return err
+		}
+	}
+
+	for _, table := range []string{userSegmentsTable, userPercentageSegments} {
+		deleteQuery := fmt.Sprintf("DELETE FROM %s WHERE segment IN (SELECT slug FROM %s WHERE ends_at <= NOW())", table, segmentsTable)
+		if _, err := tx.Exec(deleteQuery); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -2,9 +2,14 @@ package repository
 
 import (
 	"avito/pkg/structures"
+	"avito/pkg/utils"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 type UserSegmentsDB struct {
@@ -15,76 +20,396 @@ func NewUserSegmentsDB(db *sql.DB) *UserSegmentsDB {
 	return &UserSegmentsDB{db: db}
 }
 
-func (r *UserSegmentsDB) Patch(userSegments structures.UserSegments) (int, error) {
+func (r *UserSegmentsDB) Patch(userSegments structures.UserSegments) (structures.PatchResult, error) {
 	tx, err := r.db.Begin()
 	if err != nil {
-		return -1, err
+		return structures.PatchResult{}, err
+	}
+
+	now := time.Now()
+	if _, err := utils.ResolveExpiration("segments_to_add_expiration", userSegments.SegmentsToAddExpiration, userSegments.TTL, now); err != nil {
+		tx.Rollback()
+		return structures.PatchResult{}, structures.ValidationError{Message: err.Error()}
 	}
 
-	if userSegments.SegmentsToAddExpiration != nil {
-		_, err = time.Parse("2006-01-02 15:04:05", *userSegments.SegmentsToAddExpiration)
+	// A segment with its own expiration or ttl does not take the one of the request,
+	// and the ttl of a delayed membership counts from its activation.
+	starts := make([]time.Time, len(userSegments.SegmentsToAdd))
+	activeFroms := make([]*time.Time, len(userSegments.SegmentsToAdd))
+	expirations := make([]*time.Time, len(userSegments.SegmentsToAdd))
+	for i, segment := range userSegments.SegmentsToAdd {
+		activeFroms[i], err = utils.ResolveActiveFrom(segment.ActiveFrom, now)
+		if err != nil {
+			tx.Rollback()
+			return structures.PatchResult{}, structures.ValidationError{Message: fmt.Sprintf("%s (segment to add: %s)", err.Error(), segment.Slug)}
+		}
+		starts[i] = now
+		if activeFroms[i] != nil {
+			starts[i] = *activeFroms[i]
+		}
+
+		field, expiresAt, ttl := "segments_to_add_expiration", userSegments.SegmentsToAddExpiration, userSegments.TTL
+		if segment.ExpiresAt != nil || segment.TTL != nil {
+			field, expiresAt, ttl = "expires_at", segment.ExpiresAt, segment.TTL
+		}
+
+		expirations[i], err = utils.ResolveExpiration(field, expiresAt, ttl, starts[i])
 		if err != nil {
 			tx.Rollback()
-			return -1, err
+			return structures.PatchResult{}, structures.ValidationError{Message: fmt.Sprintf("%s (segment to add: %s)", err.Error(), segment.Slug)}
 		}
 	}
 
-	for _, segment := range userSegments.SegmentsToAdd {
-		if userSegments.SegmentsToAddExpiration == nil {
+	slugsToAdd := userSegments.SlugsToAdd()
+	if err := checkSegmentsNotArchived(tx, append(slugsToAdd, userSegments.SegmentsToDelete...)); err != nil {
+		tx.Rollback()
+		return structures.PatchResult{}, err
+	}
+
+	if err := checkSegmentsNotComposite(tx, slugsToAdd); err != nil {
+		tx.Rollback()
+		return structures.PatchResult{}, err
+	}
+
+	if err := checkSegmentsCapacity(tx, userSegments.UserId, slugsToAdd); err != nil {
+		tx.Rollback()
+		return structures.PatchResult{}, err
+	}
+
+	ttls, err := getSegmentsTTL(tx, slugsToAdd)
+	if err != nil {
+		tx.Rollback()
+		return structures.PatchResult{}, err
+	}
+
+	upsert := userSegments.Mode == utils.PatchModeUpsert
+	result := structures.PatchResult{UserId: userSegments.UserId}
+	if upsert || userSegments.DryRun {
+		result.Changes = map[string]string{}
+	}
+	history := newHistoryLog(changeSetPatch)
+	for i, segment := range slugsToAdd {
+		segmentExpiration, err := ttls[segment].resolve(segment, expirations[i], starts[i])
+		if err != nil {
+			tx.Rollback()
+			return structures.PatchResult{}, err
+		}
+		if err := checkActiveBeforeExpiration(segment, activeFroms[i], segmentExpiration); err != nil {
+			tx.Rollback()
+			return structures.PatchResult{}, err
+		}
+
+		change := utils.MembershipAdded
+		if upsert {
+			change, err = upsertUserSegment(tx, userSegments.UserId, segment, segmentExpiration, activeFroms[i])
+			if err != nil {
+				tx.Rollback()
+				return structures.PatchResult{}, fmt.Errorf("error occurred while processing segment to add '%s': %v", segment, err)
+			}
+
+		} else if activeFroms[i] != nil {
+
+			createSegmentQuery := fmt.Sprintf("INSERT INTO %s (user_id, segment, expiration_time, active_from) VALUES ($1, $2, $3, $4)", userSegmentsTable)
+			_, err = tx.Exec(createSegmentQuery, userSegments.UserId, segment, segmentExpiration, *activeFroms[i])
+			if err != nil {
+				tx.Rollback()
+				return structures.PatchResult{}, fmt.Errorf("error occurred while processing segment to add '%s': %v", segment, err)
+			}
+
+		} else if segmentExpiration == nil {
 
 			createSegmentQuery := fmt.Sprintf("INSERT INTO %s (user_id, segment) VALUES ($1, $2)", userSegmentsTable)
 			_, err = tx.Exec(createSegmentQuery, userSegments.UserId, segment)
 			if err != nil {
 				tx.Rollback()
-				return -1, fmt.Errorf("error occurred while processing segment to add '%s': %v", segment, err)
+				return structures.PatchResult{}, fmt.Errorf("error occurred while processing segment to add '%s': %v", segment, err)
 			}
 
 		} else {
 
 			createSegmentQuery := fmt.Sprintf("INSERT INTO %s (user_id, segment, expiration_time) VALUES ($1, $2, $3)", userSegmentsTable)
-			_, err = tx.Exec(createSegmentQuery, userSegments.UserId, segment, *userSegments.SegmentsToAddExpiration)
+			_, err = tx.Exec(createSegmentQuery, userSegments.UserId, segment, *segmentExpiration)
 			if err != nil {
 				tx.Rollback()
-				return -1, fmt.Errorf("error occurred while processing segment to add '%s': %v", segment, err)
+				return structures.PatchResult{}, fmt.Errorf("error occurred while processing segment to add '%s': %v", segment, err)
 			}
 		}
 
-		_, err = historyUpdate(tx, segment, userSegments.UserId, true)
-		if err != nil {
+		if result.Changes != nil {
+			result.Changes[segment] = change
+		}
+		if segmentExpiration != nil && change != utils.MembershipUnchanged {
+			if result.Expirations == nil {
+				result.Expirations = map[string]time.Time{}
+			}
+			result.Expirations[segment] = *segmentExpiration
+		}
+		// New expirations and delayed adds are not in history, so the change set cannot undo them.
+		if change == utils.MembershipExpirationUpdated || (change == utils.MembershipAdded && activeFroms[i] != nil) {
+			if err := history.skip(tx); err != nil {
+				tx.Rollback()
+				return structures.PatchResult{}, err
+			}
+		}
+		if change != utils.MembershipAdded {
+			continue
+		}
+
+		// A delayed membership goes to history once it becomes active.
+		if activeFroms[i] != nil {
+			if result.ActiveFrom == nil {
+				result.ActiveFrom = map[string]time.Time{}
+			}
+			result.ActiveFrom[segment] = *activeFroms[i]
+			continue
+		}
+
+		if err := history.write(tx, segment, userSegments.UserId, true, reasonManual, segmentExpiration, nil); err != nil {
 			tx.Rollback()
-			return -1, err
+			return structures.PatchResult{}, err
 		}
 	}
 
 	for _, segment := range userSegments.SegmentsToDelete {
-		existsQuery := fmt.Sprintf("SELECT count(*) FROM %s WHERE user_id = $1 AND segment = $2", userSegmentsTable)
-		var count int
-		err := r.db.QueryRow(existsQuery, userSegments.UserId, segment).Scan(&count)
+		if !upsert {
+			existsQuery := fmt.Sprintf("SELECT count(*) FROM %s WHERE user_id = $1 AND segment = $2", userSegmentsTable)
+			var count int
+			err := r.db.QueryRow(existsQuery, userSegments.UserId, segment).Scan(&count)
+			if err != nil {
+				tx.Rollback()
+				return structures.PatchResult{}, fmt.Errorf("error occurred while checking segment to delete existence '%s': %v", segment, err)
+			}
+
+			if count < 1 {
+				tx.Rollback()
+				return structures.PatchResult{}, fmt.Errorf("error occurred while checking segment to delete existence '%s': user(%d) is not in this segment", segment, userSegments.UserId)
+			}
+		}
+
+		deleted, err := deleteUserSegment(tx, &history, userSegments.UserId, segment, reasonManual)
+		if err != nil {
+			tx.Rollback()
+			return structures.PatchResult{}, err
+		}
+
+		if result.Changes != nil {
+			result.Changes[segment] = utils.MembershipRemoved
+			if !deleted {
+				result.Changes[segment] = utils.MembershipUnchanged
+			}
+		}
+	}
+
+	rules, err := getSegmentRules(tx)
+	if err != nil {
+		tx.Rollback()
+		return structures.PatchResult{}, err
+	}
+
+	if err := checkSegmentRules(tx, rules, userSegments.UserId, append(slugsToAdd, userSegments.SegmentsToDelete...)); err != nil {
+		tx.Rollback()
+		return structures.PatchResult{}, err
+	}
+
+	if err := checkLayerMemberships(tx, userSegments.UserId, slugsToAdd); err != nil {
+		tx.Rollback()
+		return structures.PatchResult{}, err
+	}
+
+	if userSegments.DryRun {
+		result.DryRun = true
+		result.History = history.entries
+		return result, tx.Rollback()
+	}
+
+	result.ChangeSet = history.changeSet
+	return result, tx.Commit()
+}
+
+// SetUserSegments makes the set the explicit segments of the user: the missing ones are added,
+// those left out are removed and the kept ones get the expiration of the set; only additions and removals go to history.
+// Memberships in archived segments are read-only and are kept whether the set names them or not.
+// Concurrent sets of the same user are serialized by an advisory lock, as the user may have no rows to lock yet.
+func (r *UserSegmentsDB) SetUserSegments(set structures.UserSegmentsSet) (structures.PatchResult, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return structures.PatchResult{}, err
+	}
+
+	now := time.Now()
+	starts := make([]time.Time, len(set.Segments))
+	activeFroms := make([]*time.Time, len(set.Segments))
+	expirations := make([]*time.Time, len(set.Segments))
+	for i, segment := range set.Segments {
+		activeFroms[i], err = utils.ResolveActiveFrom(segment.ActiveFrom, now)
 		if err != nil {
 			tx.Rollback()
-			return -1, fmt.Errorf("error occurred while checking segment to delete existence '%s': %v", segment, err)
+			return structures.PatchResult{}, structures.ValidationError{Message: fmt.Sprintf("%s (segment: %s)", err.Error(), segment.Slug)}
+		}
+		starts[i] = now
+		if activeFroms[i] != nil {
+			starts[i] = *activeFroms[i]
 		}
 
-		if count < 1 {
+		expirations[i], err = utils.ResolveExpiration("expires_at", segment.ExpiresAt, segment.TTL, starts[i])
+		if err != nil {
 			tx.Rollback()
-			return -1, fmt.Errorf("error occurred while checking segment to delete existence '%s': user(%d) is not in this segment", segment, userSegments.UserId)
+			return structures.PatchResult{}, structures.ValidationError{Message: fmt.Sprintf("%s (segment: %s)", err.Error(), segment.Slug)}
 		}
+	}
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", set.UserId); err != nil {
+		tx.Rollback()
+		return structures.PatchResult{}, err
+	}
+
+	getCurrentQuery := fmt.Sprintf(
+		"SELECT us.segment, s.state = $2 FROM %s us JOIN %s s ON s.slug = us.segment WHERE us.user_id = $1 ORDER BY us.segment",
+		userSegmentsTable, segmentsTable)
+	rows, err := tx.Query(getCurrentQuery, set.UserId, utils.SegmentStateArchived)
+	if err != nil {
+		tx.Rollback()
+		return structures.PatchResult{}, err
+	}
+
+	slugs := set.Slugs()
+	desired := map[string]bool{}
+	for _, slug := range slugs {
+		desired[slug] = true
+	}
 
-		deleteSegmentQuery := fmt.Sprintf("DELETE FROM %s WHERE user_id = $1 AND segment = $2", userSegmentsTable)
-		_, err = tx.Exec(deleteSegmentQuery, userSegments.UserId, segment)
+	var toDelete []string
+	kept := map[string]bool{}
+	for rows.Next() {
+		var segment string
+		var archived bool
+		if err := rows.Scan(&segment, &archived); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return structures.PatchResult{}, err
+		}
+		switch {
+		case archived:
+			kept[segment] = true
+		case !desired[segment]:
+			toDelete = append(toDelete, segment)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return structures.PatchResult{}, err
+	}
+
+	var toSet []string
+	for _, slug := range slugs {
+		if !kept[slug] {
+			toSet = append(toSet, slug)
+		}
+	}
+
+	if err := checkSegmentsNotArchived(tx, toSet); err != nil {
+		tx.Rollback()
+		return structures.PatchResult{}, err
+	}
+
+	if err := checkSegmentsNotComposite(tx, toSet); err != nil {
+		tx.Rollback()
+		return structures.PatchResult{}, err
+	}
+
+	if err := checkSegmentsCapacity(tx, set.UserId, toSet); err != nil {
+		tx.Rollback()
+		return structures.PatchResult{}, err
+	}
+
+	ttls, err := getSegmentsTTL(tx, toSet)
+	if err != nil {
+		tx.Rollback()
+		return structures.PatchResult{}, err
+	}
+
+	result := structures.PatchResult{UserId: set.UserId, Changes: map[string]string{}}
+	history := newHistoryLog(changeSetSet)
+	for i, segment := range slugs {
+		if kept[segment] {
+			result.Changes[segment] = utils.MembershipUnchanged
+			continue
+		}
+
+		segmentExpiration, err := ttls[segment].resolve(segment, expirations[i], starts[i])
 		if err != nil {
 			tx.Rollback()
-			return -1, fmt.Errorf("error occurred while processing segment to delete '%s': %v", segment, err)
+			return structures.PatchResult{}, err
+		}
+		if err := checkActiveBeforeExpiration(segment, activeFroms[i], segmentExpiration); err != nil {
+			tx.Rollback()
+			return structures.PatchResult{}, err
 		}
 
-		_, err = historyUpdate(tx, segment, userSegments.UserId, false)
+		change, err := upsertUserSegment(tx, set.UserId, segment, segmentExpiration, activeFroms[i])
 		if err != nil {
 			tx.Rollback()
-			return -1, err
+			return structures.PatchResult{}, fmt.Errorf("error occurred while processing segment to add '%s': %v", segment, err)
 		}
+		result.Changes[segment] = change
+
+		if segmentExpiration != nil && change != utils.MembershipUnchanged {
+			if result.Expirations == nil {
+				result.Expirations = map[string]time.Time{}
+			}
+			result.Expirations[segment] = *segmentExpiration
+		}
+		if change == utils.MembershipExpirationUpdated || (change == utils.MembershipAdded && activeFroms[i] != nil) {
+			if err := history.skip(tx); err != nil {
+				tx.Rollback()
+				return structures.PatchResult{}, err
+			}
+		}
+		if change != utils.MembershipAdded {
+			continue
+		}
+
+		if activeFroms[i] != nil {
+			if result.ActiveFrom == nil {
+				result.ActiveFrom = map[string]time.Time{}
+			}
+			result.ActiveFrom[segment] = *activeFroms[i]
+			continue
+		}
+
+		if err := history.write(tx, segment, set.UserId, true, reasonManual, segmentExpiration, nil); err != nil {
+			tx.Rollback()
+			return structures.PatchResult{}, err
+		}
+	}
+
+	for _, segment := range toDelete {
+		if _, err := deleteUserSegment(tx, &history, set.UserId, segment, reasonManual); err != nil {
+			tx.Rollback()
+			return structures.PatchResult{}, err
+		}
+		result.Changes[segment] = utils.MembershipRemoved
+	}
+
+	rules, err := getSegmentRules(tx)
+	if err != nil {
+		tx.Rollback()
+		return structures.PatchResult{}, err
 	}
 
-	return userSegments.UserId, tx.Commit()
+	if err := checkSegmentRules(tx, rules, set.UserId, append(toSet, toDelete...)); err != nil {
+		tx.Rollback()
+		return structures.PatchResult{}, err
+	}
+
+	if err := checkLayerMemberships(tx, set.UserId, toSet); err != nil {
+		tx.Rollback()
+		return structures.PatchResult{}, err
+	}
+
+	result.ChangeSet = history.changeSet
+	return result, tx.Commit()
 }
 
 func (r *UserSegmentsDB) GetUserSegments(user structures.User) ([]string, error) {
@@ -93,21 +418,40 @@ func (r *UserSegmentsDB) GetUserSegments(user structures.User) ([]string, error)
 		return nil, err
 	}
 
+	// Memberships in draft, paused and archived segments, and in segments outside
+	// of their activation window or schedule, are kept but not given to the user,
+	// just like delayed memberships before their active_from.
 	var slugs []string
-	createSegmentQuery := fmt.Sprintf("SELECT segment FROM %s WHERE user_id = $1", userSegmentsTable)
-	rows, err := tx.Query(createSegmentQuery, user.Id)
+	createSegmentQuery := fmt.Sprintf(
+		"SELECT us.segment, s.schedule FROM %s us JOIN %s s ON s.slug = us.segment WHERE us.user_id = $1 AND (us.active_from IS NULL OR us.active_from <= NOW()) AND s.state = $2 AND %s",
+		userSegmentsTable, segmentsTable, fmt.Sprintf(segmentInWindow, "s."))
+	rows, err := tx.Query(createSegmentQuery, user.Id, utils.SegmentStateActive)
 	if err != nil {
 		tx.Rollback()
 		return nil, err
 	}
 	defer rows.Close()
 
+	now := time.Now()
 	for rows.Next() {
 		var slug string
-		if err := rows.Scan(&slug); err != nil {
+		var schedule []byte
+		if err := rows.Scan(&slug, &schedule); err != nil {
 			tx.Rollback()
 			return nil, err
 		}
+
+		if schedule != nil {
+			var segmentSchedule structures.SegmentSchedule
+			if err := json.Unmarshal(schedule, &segmentSchedule); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			if !utils.InSchedule(&segmentSchedule, now) {
+				continue
+			}
+		}
+
 		slugs = append(slugs, slug)
 	}
 
@@ -123,15 +467,279 @@ func (r *UserSegmentsDB) GetUserSegments(user structures.User) ([]string, error)
 	return slugs, nil
 }
 
-func (r *UserSegmentsDB) GetSegmentUsers(segment structures.Segment) ([]int, error) {
+// checkSegmentsNotArchived fails with the first archived segment of the slugs,
+// memberships of archived segments are read-only.
+func checkSegmentsNotArchived(tx *sql.Tx, slugs []string) error {
+	if len(slugs) == 0 {
+		return nil
+	}
+
+	var slug string
+	getArchivedQuery := fmt.Sprintf("SELECT slug FROM %s WHERE slug = ANY($1) AND state = $2 ORDER BY slug LIMIT 1", segmentsTable)
+	err := tx.QueryRow(getArchivedQuery, pq.Array(slugs), utils.SegmentStateArchived).Scan(&slug)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return structures.SegmentArchivedError{Slug: slug}
+}
+
+// upsertUserSegment adds the segment to the user or, if they already have it, sets its expiration;
+// the activation of a membership the user already has is left as it is.
+// The insert skips a conflicting row instead of failing, so concurrent retries of the same patch do not abort each other.
+func upsertUserSegment(tx *sql.Tx, userId int, segment string, expiration, activeFrom *time.Time) (string, error) {
+	insertQuery := fmt.Sprintf(
+		"INSERT INTO %s (user_id, segment, expiration_time, active_from) VALUES ($1, $2, $3, $4) ON CONFLICT (user_id, segment) DO NOTHING",
+		userSegmentsTable)
+	res, err := tx.Exec(insertQuery, userId, segment, expiration, activeFrom)
+	if err != nil {
+		return "", err
+	}
+	if inserted, err := res.RowsAffected(); err != nil {
+		return "", err
+	} else if inserted > 0 {
+		return utils.MembershipAdded, nil
+	}
+
+	updateQuery := fmt.Sprintf(
+		"UPDATE %s SET expiration_time = $3 WHERE user_id = $1 AND segment = $2 AND expiration_time IS DISTINCT FROM $3",
+		userSegmentsTable)
+	res, err = tx.Exec(updateQuery, userId, segment, expiration)
+	if err != nil {
+		return "", err
+	}
+	if updated, err := res.RowsAffected(); err != nil {
+		return "", err
+	} else if updated > 0 {
+		return utils.MembershipExpirationUpdated, nil
+	}
+
+	return utils.MembershipUnchanged, nil
+}
+
+// deleteUserSegment removes the membership and records it in history for the reason, reporting whether the user had it.
+// A membership that has not become active yet leaves no trace in history and makes the change set irreversible,
+// one that became active but was not recorded yet gets its add recorded first.
+func deleteUserSegment(tx *sql.Tx, history *historyLog, userId int, segment string, reason string) (bool, error) {
+	var activeFrom, expiration *time.Time
+	deleteSegmentQuery := fmt.Sprintf("DELETE FROM %s WHERE user_id = $1 AND segment = $2 RETURNING active_from, expiration_time", userSegmentsTable)
+	err := tx.QueryRow(deleteSegmentQuery, userId, segment).Scan(&activeFrom, &expiration)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error occurred while processing segment to delete '%s': %v", segment, err)
+	}
+
+	added, err := recordDueActivation(tx, history, userId, segment, activeFrom, expiration)
+	if err != nil {
+		return false, err
+	}
+	if !added {
+		if err := history.skip(tx); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	if err := history.write(tx, segment, userId, false, reason, expiration, nil); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// recordDueActivation reports whether the add of a membership is in history, so its removal can be written.
+// A delayed membership that is due but not activated yet by the expired segments job gets its add written
+// at its active_from, one still pending has no add and leaves no history.
+func recordDueActivation(tx *sql.Tx, history *historyLog, userId int, segment string, activeFrom, expiration *time.Time) (bool, error) {
+	if activeFrom == nil {
+		return true, nil
+	}
+	if activeFrom.After(time.Now()) {
+		return false, nil
+	}
+
+	if err := history.write(tx, segment, userId, true, reasonManual, expiration, activeFrom); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// checkActiveBeforeExpiration fails when a delayed membership would expire before it becomes active.
+func checkActiveBeforeExpiration(segment string, activeFrom, expiration *time.Time) error {
+	if activeFrom == nil || expiration == nil || expiration.After(*activeFrom) {
+		return nil
+	}
+	return structures.ValidationError{Message: fmt.Sprintf("expiration of segment %s must come after its active_from", segment)}
+}
+
+// checkSegmentsCapacity fails with the first capped segment of the slugs that has no room for one more member,
+// the user is not counted, so a segment they already have never fails.
+// The capped segments are locked first, so concurrent patches count the members one after another;
+// the members are counted in a separate statement, as it must see the rows committed while waiting for the lock.
+func checkSegmentsCapacity(tx *sql.Tx, userId int, slugs []string) error {
+	if len(slugs) == 0 {
+		return nil
+	}
+
+	lockCappedQuery := fmt.Sprintf(
+		"SELECT slug, max_members FROM %s WHERE slug = ANY($1) AND max_members IS NOT NULL ORDER BY slug FOR UPDATE",
+		segmentsTable)
+	rows, err := tx.Query(lockCappedQuery, pq.Array(slugs))
+	if err != nil {
+		return err
+	}
+
+	var capped []string
+	maxMembers := map[string]int{}
+	for rows.Next() {
+		var slug string
+		var max int
+		if err := rows.Scan(&slug, &max); err != nil {
+			rows.Close()
+			return err
+		}
+		capped = append(capped, slug)
+		maxMembers[slug] = max
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(capped) == 0 {
+		return nil
+	}
+
+	countMembersQuery := fmt.Sprintf(
+		"SELECT segment, count(*) FROM %s WHERE segment = ANY($1) AND user_id <> $2 AND %s GROUP BY segment",
+		userSegmentsTable, fmt.Sprintf(membershipUnexpired, ""))
+	rows, err = tx.Query(countMembersQuery, pq.Array(capped), userId)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	members := map[string]int{}
+	for rows.Next() {
+		var slug string
+		var count int
+		if err := rows.Scan(&slug, &count); err != nil {
+			return err
+		}
+		members[slug] = count
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, slug := range capped {
+		if members[slug] >= maxMembers[slug] {
+			return structures.SegmentFullError{Slug: slug, MaxMembers: maxMembers[slug]}
+		}
+	}
+
+	return nil
+}
+
+// segmentTTL holds the membership durations of a segment, a segment without them has the zero value.
+type segmentTTL struct {
+	defaultTTL *time.Duration
+	max        *time.Duration
+	maxValue   string
+}
+
+// resolve returns the expiration of a membership of the segment: the requested one within the maximum,
+// otherwise the default duration, or the longest allowed one when there is no default.
+func (t segmentTTL) resolve(segment string, expiration *time.Time, now time.Time) (*time.Time, error) {
+	if expiration != nil {
+		if t.max != nil && expiration.After(now.Add(*t.max)) {
+			return nil, structures.ValidationError{Message: fmt.Sprintf("expiration of segment %s is beyond its max_ttl of %s", segment, t.maxValue)}
+		}
+		return expiration, nil
+	}
+
+	var resolved time.Time
+	switch {
+	case t.defaultTTL != nil:
+		resolved = now.Add(*t.defaultTTL)
+	case t.max != nil:
+		resolved = now.Add(*t.max)
+	default:
+		return nil, nil
+	}
+	return &resolved, nil
+}
+
+// getSegmentsTTL returns the membership durations of the slugs that have them.
+func getSegmentsTTL(tx *sql.Tx, slugs []string) (map[string]segmentTTL, error) {
+	ttls := map[string]segmentTTL{}
+	if len(slugs) == 0 {
+		return ttls, nil
+	}
+
+	getTTLQuery := fmt.Sprintf(
+		"SELECT slug, default_ttl, max_ttl FROM %s WHERE slug = ANY($1) AND (default_ttl IS NOT NULL OR max_ttl IS NOT NULL)",
+		segmentsTable)
+	rows, err := tx.Query(getTTLQuery, pq.Array(slugs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var slug string
+		var defaultTTL, maxTTL *string
+		if err := rows.Scan(&slug, &defaultTTL, &maxTTL); err != nil {
+			return nil, err
+		}
+
+		var ttl segmentTTL
+		if defaultTTL != nil {
+			duration, err := utils.ParseDuration(*defaultTTL)
+			if err != nil {
+				return nil, err
+			}
+			ttl.defaultTTL = &duration
+		}
+		if maxTTL != nil {
+			duration, err := utils.ParseDuration(*maxTTL)
+			if err != nil {
+				return nil, err
+			}
+			ttl.max = &duration
+			ttl.maxValue = *maxTTL
+		}
+		ttls[slug] = ttl
+	}
+
+	return ttls, rows.Err()
+}
+
+// GetSegmentUsers returns the users with an active explicit membership in the segment,
+// or in any of its descendants as well when the filter asks for them, each user once.
+func (r *UserSegmentsDB) GetSegmentUsers(filter structures.SegmentUsersFilter) ([]int, error) {
 	tx, err := r.db.Begin()
 	if err != nil {
 		return nil, err
 	}
 
 	var users []int
-	createSegmentQuery := fmt.Sprintf("SELECT user_id FROM %s WHERE segment = $1", userSegmentsTable)
-	rows, err := tx.Query(createSegmentQuery, segment.Slug)
+	createSegmentQuery := fmt.Sprintf("SELECT user_id FROM %s WHERE segment = $1 AND (active_from IS NULL OR active_from <= NOW())", userSegmentsTable)
+	if filter.IncludeDescendants {
+		createSegmentQuery = fmt.Sprintf(
+			`WITH RECURSIVE tree AS (
+				SELECT $1::varchar AS slug
+				UNION
+				SELECT p.segment FROM %[1]s p JOIN tree t ON p.parent = t.slug
+			)
+			SELECT DISTINCT user_id FROM %[2]s WHERE segment IN (SELECT slug FROM tree) AND (active_from IS NULL OR active_from <= NOW()) ORDER BY user_id`,
+			segmentParentsTable, userSegmentsTable)
+	}
+	rows, err := tx.Query(createSegmentQuery, filter.Slug)
 	if err != nil {
 		tx.Rollback()
 		return nil, err
@@ -158,3 +766,138 @@ func (r *UserSegmentsDB) GetSegmentUsers(segment structures.Segment) ([]int, err
 
 	return users, nil
 }
+
+// GetUpcomingActivations lists the delayed memberships that are not active yet, the soonest first.
+func (r *UserSegmentsDB) GetUpcomingActivations(filter structures.ActivationsFilter) ([]structures.Activation, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	conditions := []string{"active_from > NOW()"}
+	var args []interface{}
+	if filter.UserId != nil {
+		args = append(args, *filter.UserId)
+		conditions = append(conditions, fmt.Sprintf("user_id = $%d", len(args)))
+	}
+	if filter.Segment != nil {
+		args = append(args, *filter.Segment)
+		conditions = append(conditions, fmt.Sprintf("segment = $%d", len(args)))
+	}
+
+	getActivationsQuery := fmt.Sprintf(
+		"SELECT user_id, segment, active_from, expiration_time FROM %s WHERE %s ORDER BY active_from, segment, user_id",
+		userSegmentsTable, strings.Join(conditions, " AND "))
+	rows, err := tx.Query(getActivationsQuery, args...)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	defer rows.Close()
+
+	activations := []structures.Activation{}
+	for rows.Next() {
+		var activation structures.Activation
+		if err := rows.Scan(&activation.UserId, &activation.Segment, &activation.ActiveFrom, &activation.ExpiresAt); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		activations = append(activations, activation)
+	}
+
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return activations, tx.Commit()
+}
+
+func (r *UserSegmentsDB) RecordPercentageSegments(user structures.User, segments []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Only the first evaluation that places the user into the segment inserts a row,
+	// so history gets exactly one entry per placement.
+	recordSegmentQuery := fmt.Sprintf(
+		"INSERT INTO %s (user_id, segment) SELECT $1, slug FROM %s WHERE slug = $2 ON CONFLICT DO NOTHING",
+		userPercentageSegments, segmentsTable)
+	for _, segment := range segments {
+		result, err := tx.Exec(recordSegmentQuery, user.Id, segment)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error occurred while recording percentage segment '%s': %v", segment, err)
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if affected == 0 {
+			continue
+		}
+
+		_, err = historyUpdate(tx, segment, user.Id, true, reasonPercentage)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ClosePercentageSegments closes the recorded placements of the user in targeted segments
+// whose rule no longer matches the attributes of the read, with a history entry per closed placement.
+// Segments the user was never placed into are skipped.
+func (r *UserSegmentsDB) ClosePercentageSegments(user structures.User, segments []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	closeSegmentQuery := fmt.Sprintf("DELETE FROM %s WHERE user_id = $1 AND segment = $2", userPercentageSegments)
+	for _, segment := range segments {
+		result, err := tx.Exec(closeSegmentQuery, user.Id, segment)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error occurred while closing percentage segment '%s': %v", segment, err)
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if affected == 0 {
+			continue
+		}
+
+		_, err = historyUpdate(tx, segment, user.Id, false, reasonPercentage)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *UserSegmentsDB) GetUserVariants(user structures.User, segments []string) (map[string]string, error) {
+	variants, salts, err := getSegmentsVariants(r.db, segments)
+	if err != nil {
+		return nil, err
+	}
+
+	assigned := make(map[string]string, len(variants))
+	for slug, segmentVariants := range variants {
+		assigned[slug] = utils.AssignVariant(salts[slug], segmentVariants, int64(user.Id))
+	}
+
+	return assigned, nil
+}
@@ -5,8 +5,10 @@ import (
 	"avito/pkg/structures"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -27,6 +29,15 @@ func TestUserSegments_Patch(t *testing.T) {
 
 	var validDateTime = "2023-08-28 20:00:00"
 	var invalidDateTime = "2023-08-28 202:00:00"
+	var validTime, _ = time.ParseInLocation("2006-01-02 15:04:05", validDateTime, time.Local)
+	var offsetDateTime = "2023-08-28T20:00:00+03:00"
+	var offsetTime, _ = time.Parse(time.RFC3339, offsetDateTime)
+	var ttl = "72h"
+	var farExpiration = time.Now().AddDate(0, 2, 0).Format("2006-01-02 15:04:05")
+	var activeFrom = time.Now().Add(48 * time.Hour).Truncate(time.Second).UTC()
+	var activeFromValue = activeFrom.Format(time.RFC3339)
+	var pastActiveFrom = time.Now().Add(-time.Hour).Truncate(time.Second).UTC()
+	var changeSetId = 7
 
 	tests := []struct {
 		name         string
@@ -35,27 +46,54 @@ func TestUserSegments_Patch(t *testing.T) {
 		wantUserID   int
 		wantErr      bool
 		expectError  string
+
+		wantExpirations map[string]time.Time
+		wantChanges     map[string]string
+		wantChangeSet   *int
+		wantHistory     []structures.HistoryEntry
 	}{
 		{
 			name: "AddSegments_Success",
 			mockBehavior: func(args args, userSegments structures.UserSegments) {
 				mock.ExpectBegin()
 
-				for _, segment := range userSegments.SegmentsToAdd {
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(append(userSegments.SlugsToAdd(), userSegments.SegmentsToDelete...)), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}))
+
+				for i, segment := range userSegments.SlugsToAdd() {
 					mock.ExpectExec("INSERT").
-						WithArgs(userSegments.UserId, segment, &validDateTime).
+						WithArgs(userSegments.UserId, segment, validTime).
 						WillReturnResult(sqlmock.NewResult(0, 1))
-					mock.ExpectQuery("INSERT").
-						WithArgs(1, segment, true).
+					if i == 0 {
+						expectChangeSet(mock, "patch")
+					}
+					mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+						WithArgs(pq.Array([]string{segment})).
+						WillReturnRows(sqlmock.NewRows(variantColumns))
+					mock.ExpectQuery("INSERT INTO user_segments_history").
+						WithArgs(1, segment, true, "manual", nil, nil, 7, validTime).
 						WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
 				}
 
+				expectNoRules(mock)
+				expectNoLayerConflict(mock, 1)
 				mock.ExpectCommit()
 			},
 			args: args{
 				UserSegments: structures.UserSegments{
 					UserId:                  1,
-					SegmentsToAdd:           []string{"segment1", "segment2"},
+					SegmentsToAdd:           []structures.SegmentToAdd{{Slug: "segment1"}, {Slug: "segment2"}},
 					SegmentsToAddExpiration: &validDateTime,
 					SegmentsToDelete:        nil,
 				},
@@ -69,21 +107,43 @@ func TestUserSegments_Patch(t *testing.T) {
 			mockBehavior: func(args args, userSegments structures.UserSegments) {
 				mock.ExpectBegin()
 
-				for _, segment := range userSegments.SegmentsToAdd {
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(append(userSegments.SlugsToAdd(), userSegments.SegmentsToDelete...)), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}))
+
+				for i, segment := range userSegments.SlugsToAdd() {
 					mock.ExpectExec("INSERT").
 						WithArgs(userSegments.UserId, segment).
 						WillReturnResult(sqlmock.NewResult(0, 1))
-					mock.ExpectQuery("INSERT").
-						WithArgs(1, segment, true).
+					if i == 0 {
+						expectChangeSet(mock, "patch")
+					}
+					mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+						WithArgs(pq.Array([]string{segment})).
+						WillReturnRows(sqlmock.NewRows(variantColumns))
+					mock.ExpectQuery("INSERT INTO user_segments_history").
+						WithArgs(1, segment, true, "manual", nil, nil, 7, nil).
 						WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
 				}
 
+				expectNoRules(mock)
+				expectNoLayerConflict(mock, 1)
 				mock.ExpectCommit()
 			},
 			args: args{
 				UserSegments: structures.UserSegments{
 					UserId:           1,
-					SegmentsToAdd:    []string{"segment1", "segment2"},
+					SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1"}, {Slug: "segment2"}},
 					SegmentsToDelete: nil,
 				},
 			},
@@ -101,23 +161,37 @@ func TestUserSegments_Patch(t *testing.T) {
 			args: args{
 				UserSegments: structures.UserSegments{
 					UserId:                  1,
-					SegmentsToAdd:           []string{"segment1", "segment2"},
+					SegmentsToAdd:           []structures.SegmentToAdd{{Slug: "segment1"}, {Slug: "segment2"}},
 					SegmentsToAddExpiration: &invalidDateTime,
 					SegmentsToDelete:        nil,
 				},
 			},
 			wantUserID:  1,
 			wantErr:     true,
-			expectError: "parsing time \"2023-08-28 202:00:00\" as \"2006-01-02 15:04:05\": cannot parse \"2:00:00\" as \":\"",
+			expectError: "invalid segments_to_add_expiration 2023-08-28 202:00:00, use RFC 3339 such as 2023-08-30T12:00:00+03:00",
 		},
 		{
 			name: "AddSegments_ErrorWithValidTime",
 			mockBehavior: func(args args, userSegments structures.UserSegments) {
 				mock.ExpectBegin()
 
-				for _, segment := range userSegments.SegmentsToAdd {
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(append(userSegments.SlugsToAdd(), userSegments.SegmentsToDelete...)), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}))
+
+				for _, segment := range userSegments.SlugsToAdd() {
 					mock.ExpectExec("INSERT").
-						WithArgs(userSegments.UserId, segment, &validDateTime).
+						WithArgs(userSegments.UserId, segment, validTime).
 						WillReturnError(errors.New("uwaaa"))
 					break
 				}
@@ -127,7 +201,7 @@ func TestUserSegments_Patch(t *testing.T) {
 			args: args{
 				UserSegments: structures.UserSegments{
 					UserId:                  1,
-					SegmentsToAdd:           []string{"segment1", "segment2"},
+					SegmentsToAdd:           []structures.SegmentToAdd{{Slug: "segment1"}, {Slug: "segment2"}},
 					SegmentsToAddExpiration: &validDateTime,
 					SegmentsToDelete:        nil,
 				},
@@ -141,19 +215,30 @@ func TestUserSegments_Patch(t *testing.T) {
 			mockBehavior: func(args args, userSegments structures.UserSegments) {
 				mock.ExpectBegin()
 
-				for _, segment := range userSegments.SegmentsToDelete {
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(append(userSegments.SlugsToAdd(), userSegments.SegmentsToDelete...)), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				for i, segment := range userSegments.SegmentsToDelete {
 					mock.ExpectQuery("SELECT").
 						WithArgs(userSegments.UserId, segment).
 						WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(1))
 
-					mock.ExpectExec("DELETE").
+					mock.ExpectQuery("DELETE").
 						WithArgs(userSegments.UserId, segment).
-						WillReturnResult(sqlmock.NewResult(0, 1))
-					mock.ExpectQuery("INSERT").
-						WithArgs(1, segment, false).
+						WillReturnRows(sqlmock.NewRows([]string{"active_from", "expiration_time"}).AddRow(nil, nil))
+					if i == 0 {
+						expectChangeSet(mock, "patch")
+					}
+					mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+						WithArgs(pq.Array([]string{segment})).
+						WillReturnRows(sqlmock.NewRows(variantColumns))
+					mock.ExpectQuery("INSERT INTO user_segments_history").
+						WithArgs(1, segment, false, "manual", nil, nil, 7, nil).
 						WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
 				}
 
+				expectNoRules(mock)
 				mock.ExpectCommit()
 			},
 			args: args{
@@ -163,9 +248,853 @@ func TestUserSegments_Patch(t *testing.T) {
 					SegmentsToDelete: []string{"segment1", "segment2"},
 				},
 			},
+			wantUserID:    1,
+			wantErr:       false,
+			expectError:   "",
+			wantChangeSet: &changeSetId,
+		},
+		{
+			name: "ArchivedSegment",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(append(userSegments.SlugsToAdd(), userSegments.SegmentsToDelete...)), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow("segment2"))
+
+				mock.ExpectRollback()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:           1,
+					SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1"}},
+					SegmentsToDelete: []string{"segment2"},
+				},
+			},
 			wantUserID:  1,
-			wantErr:     false,
-			expectError: "",
+			wantErr:     true,
+			expectError: "segment with slug segment2 is archived",
+		},
+		{
+			name: "CompositeSegment",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(userSegments.SlugsToAdd()), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}).AddRow("segment1"))
+
+				mock.ExpectRollback()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:        1,
+					SegmentsToAdd: []structures.SegmentToAdd{{Slug: "segment1"}},
+				},
+			},
+			wantUserID:  1,
+			wantErr:     true,
+			expectError: "segment segment1 is composite, its members are computed from its expression",
+		},
+		{
+			name: "SegmentFull",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(userSegments.SlugsToAdd()), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}).AddRow("segment2", 100))
+				mock.ExpectQuery("SELECT segment, count(.+) FROM user_segments WHERE (.+) AND user_id <> \\$2 AND \\(expiration_time IS NULL OR expiration_time > NOW\\(\\)\\) GROUP BY segment").
+					WithArgs(pq.Array([]string{"segment2"}), 1).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "count"}).AddRow("segment2", 100))
+
+				mock.ExpectRollback()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:        1,
+					SegmentsToAdd: []structures.SegmentToAdd{{Slug: "segment1"}, {Slug: "segment2"}},
+				},
+			},
+			wantUserID:  1,
+			wantErr:     true,
+			expectError: "segment with slug segment2 is full, it is limited to 100 members",
+		},
+		{
+			name: "RuleViolation_Excludes",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(userSegments.SlugsToAdd()), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}))
+
+				mock.ExpectExec("INSERT").
+					WithArgs(1, "segment1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectChangeSet(mock, "patch")
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"segment1"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, "segment1", true, "manual", nil, nil, 7, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+
+				mock.ExpectQuery("SELECT (.+) FROM segment_rules").
+					WillReturnRows(sqlmock.NewRows(ruleColumns).AddRow(3, "excludes", "segment1", "segment2", nil, nil, time.Now()))
+				mock.ExpectExec("SELECT pg_advisory_xact_lock").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT segment FROM user_segments WHERE user_id = \\$1 AND \\(active_from IS NULL OR active_from <= NOW\\(\\)\\) AND \\(expiration_time IS NULL OR expiration_time > NOW\\(\\)\\)").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}).AddRow("segment1").AddRow("segment2"))
+
+				mock.ExpectRollback()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:        1,
+					SegmentsToAdd: []structures.SegmentToAdd{{Slug: "segment1"}},
+				},
+			},
+			wantUserID:  1,
+			wantErr:     true,
+			expectError: "user 1 breaks rule 3: segment segment1 excludes segment segment2",
+		},
+		{
+			name: "LayerConflict",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(userSegments.SlugsToAdd()), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}))
+
+				mock.ExpectExec("INSERT").
+					WithArgs(1, "checkout-b").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectChangeSet(mock, "patch")
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"checkout-b"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, "checkout-b", true, "manual", nil, nil, 7, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+
+				expectNoRules(mock)
+				mock.ExpectExec("SELECT pg_advisory_xact_lock").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT s.layer, MIN\\(s.slug\\), MAX\\(s.slug\\) FROM user_segments").
+					WithArgs(1, pq.Array([]string{"checkout-b"})).
+					WillReturnRows(sqlmock.NewRows([]string{"layer", "min", "max"}).AddRow("checkout", "checkout-a", "checkout-b"))
+
+				mock.ExpectRollback()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:        1,
+					SegmentsToAdd: []structures.SegmentToAdd{{Slug: "checkout-b"}},
+				},
+			},
+			wantUserID:  1,
+			wantErr:     true,
+			expectError: "user 1 cannot be in both checkout-a and checkout-b, layer checkout gives a user at most one segment",
+		},
+		{
+			name: "RuleViolation_MaxTagged",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(userSegments.SlugsToAdd()), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}))
+
+				mock.ExpectExec("INSERT").
+					WithArgs(1, "segment2").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectChangeSet(mock, "patch")
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"segment2"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, "segment2", true, "manual", nil, nil, 7, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+
+				mock.ExpectQuery("SELECT (.+) FROM segment_rules").
+					WillReturnRows(sqlmock.NewRows(ruleColumns).AddRow(4, "max_tagged", nil, nil, "discount", 1, time.Now()))
+				mock.ExpectExec("SELECT pg_advisory_xact_lock").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT segment FROM user_segments WHERE user_id").
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}).AddRow("segment1").AddRow("segment2"))
+				mock.ExpectQuery("SELECT segment, tag FROM segment_tags").
+					WithArgs(pq.Array([]string{"segment1", "segment2"})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "tag"}).AddRow("segment1", "discount").AddRow("segment2", "discount"))
+
+				mock.ExpectRollback()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:        1,
+					SegmentsToAdd: []structures.SegmentToAdd{{Slug: "segment2"}},
+				},
+			},
+			wantUserID:  1,
+			wantErr:     true,
+			expectError: "user 1 breaks rule 4: at most 1 segments tagged discount are allowed",
+		},
+		{
+			name: "CappedSegment_Success",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(userSegments.SlugsToAdd()), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}).AddRow("segment1", 100))
+				mock.ExpectQuery("SELECT segment, count(.+) FROM user_segments").
+					WithArgs(pq.Array([]string{"segment1"}), 1).
+					WillReturnRows(sqlmock.NewRows([]string{"segment", "count"}).AddRow("segment1", 99))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}))
+
+				mock.ExpectExec("INSERT").
+					WithArgs(userSegments.UserId, "segment1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectChangeSet(mock, "patch")
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"segment1"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, "segment1", true, "manual", nil, nil, 7, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+
+				expectNoRules(mock)
+				expectNoLayerConflict(mock, 1)
+				mock.ExpectCommit()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:        1,
+					SegmentsToAdd: []structures.SegmentToAdd{{Slug: "segment1"}},
+				},
+			},
+			wantUserID: 1,
+		},
+		{
+			name: "DefaultTTL",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(userSegments.SlugsToAdd()), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}).AddRow("segment1", "14d", "30d").AddRow("segment2", nil, "1h"))
+
+				mock.ExpectExec("INSERT INTO user_segments").
+					WithArgs(userSegments.UserId, "segment1", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectChangeSet(mock, "patch")
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"segment1"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, "segment1", true, "manual", nil, nil, 7, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+
+				mock.ExpectExec("INSERT INTO user_segments").
+					WithArgs(userSegments.UserId, "segment2", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"segment2"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, "segment2", true, "manual", nil, nil, 7, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+
+				expectNoRules(mock)
+				expectNoLayerConflict(mock, 1)
+				mock.ExpectCommit()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:        1,
+					SegmentsToAdd: []structures.SegmentToAdd{{Slug: "segment1"}, {Slug: "segment2"}},
+				},
+			},
+			wantUserID: 1,
+		},
+		{
+			name: "BeyondMaxTTL",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(userSegments.SlugsToAdd()), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}).AddRow("segment1", nil, "30d"))
+
+				mock.ExpectRollback()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:                  1,
+					SegmentsToAdd:           []structures.SegmentToAdd{{Slug: "segment1"}},
+					SegmentsToAddExpiration: &farExpiration,
+				},
+			},
+			wantUserID:  1,
+			wantErr:     true,
+			expectError: "expiration of segment segment1 is beyond its max_ttl of 30d",
+		},
+		{
+			name: "AddSegments_OffsetTime",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(userSegments.SlugsToAdd()), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}))
+
+				mock.ExpectExec("INSERT").
+					WithArgs(userSegments.UserId, "segment1", offsetTime).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectChangeSet(mock, "patch")
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"segment1"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, "segment1", true, "manual", nil, nil, 7, offsetTime).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+
+				expectNoRules(mock)
+				expectNoLayerConflict(mock, 1)
+				mock.ExpectCommit()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:                  1,
+					SegmentsToAdd:           []structures.SegmentToAdd{{Slug: "segment1"}},
+					SegmentsToAddExpiration: &offsetDateTime,
+				},
+			},
+			wantUserID:      1,
+			wantExpirations: map[string]time.Time{"segment1": offsetTime},
+		},
+		{
+			name: "ExpirationAndTTL",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+				mock.ExpectRollback()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:                  1,
+					SegmentsToAdd:           []structures.SegmentToAdd{{Slug: "segment1"}},
+					SegmentsToAddExpiration: &offsetDateTime,
+					TTL:                     &ttl,
+				},
+			},
+			wantUserID:  1,
+			wantErr:     true,
+			expectError: "use either segments_to_add_expiration or ttl",
+		},
+		{
+			name: "AddSegments_PerSegmentExpiration",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(userSegments.SlugsToAdd()), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}))
+
+				for i, add := range []struct {
+					segment    string
+					expiration time.Time
+				}{{"segment1", offsetTime}, {"segment2", validTime}} {
+					mock.ExpectExec("INSERT").
+						WithArgs(userSegments.UserId, add.segment, add.expiration).
+						WillReturnResult(sqlmock.NewResult(0, 1))
+					if i == 0 {
+						expectChangeSet(mock, "patch")
+					}
+					mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+						WithArgs(pq.Array([]string{add.segment})).
+						WillReturnRows(sqlmock.NewRows(variantColumns))
+					mock.ExpectQuery("INSERT INTO user_segments_history").
+						WithArgs(1, add.segment, true, "manual", nil, nil, 7, add.expiration).
+						WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				}
+
+				expectNoRules(mock)
+				expectNoLayerConflict(mock, 1)
+				mock.ExpectCommit()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:                  1,
+					SegmentsToAdd:           []structures.SegmentToAdd{{Slug: "segment1", ExpiresAt: &offsetDateTime}, {Slug: "segment2"}},
+					SegmentsToAddExpiration: &validDateTime,
+				},
+			},
+			wantUserID:      1,
+			wantExpirations: map[string]time.Time{"segment1": offsetTime, "segment2": validTime},
+		},
+		{
+			name: "PerSegmentExpirationAndTTL",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+				mock.ExpectRollback()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:        1,
+					SegmentsToAdd: []structures.SegmentToAdd{{Slug: "segment1", ExpiresAt: &offsetDateTime, TTL: &ttl}},
+				},
+			},
+			wantUserID:  1,
+			wantErr:     true,
+			expectError: "use either expires_at or ttl (segment to add: segment1)",
+		},
+		{
+			name: "Upsert",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(append(userSegments.SlugsToAdd(), userSegments.SegmentsToDelete...)), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}))
+
+				mock.ExpectExec("INSERT INTO user_segments (.+) ON CONFLICT").
+					WithArgs(1, "segment1", offsetTime, nil).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectChangeSet(mock, "patch")
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"segment1"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, "segment1", true, "manual", nil, nil, 7, offsetTime).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+
+				mock.ExpectExec("INSERT INTO user_segments (.+) ON CONFLICT").
+					WithArgs(1, "segment2", offsetTime, nil).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("UPDATE user_segments SET expiration_time").
+					WithArgs(1, "segment2", offsetTime).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectIrreversible(mock)
+
+				mock.ExpectExec("INSERT INTO user_segments (.+) ON CONFLICT").
+					WithArgs(1, "segment3", offsetTime, nil).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("UPDATE user_segments SET expiration_time").
+					WithArgs(1, "segment3", offsetTime).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+
+				mock.ExpectQuery("DELETE").
+					WithArgs(1, "segment4").
+					WillReturnRows(sqlmock.NewRows([]string{"active_from", "expiration_time"}).AddRow(nil, nil))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"segment4"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, "segment4", false, "manual", nil, nil, 7, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+
+				mock.ExpectQuery("DELETE").
+					WithArgs(1, "segment5").
+					WillReturnRows(sqlmock.NewRows([]string{"active_from"}))
+
+				expectNoRules(mock)
+				expectNoLayerConflict(mock, 1)
+				mock.ExpectCommit()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:                  1,
+					SegmentsToAdd:           []structures.SegmentToAdd{{Slug: "segment1"}, {Slug: "segment2"}, {Slug: "segment3"}},
+					SegmentsToAddExpiration: &offsetDateTime,
+					SegmentsToDelete:        []string{"segment4", "segment5"},
+					Mode:                    "upsert",
+				},
+			},
+			wantUserID: 1,
+			wantExpirations: map[string]time.Time{
+				"segment1": offsetTime,
+				"segment2": offsetTime,
+			},
+			wantChanges: map[string]string{
+				"segment1": "added",
+				"segment2": "expiration_updated",
+				"segment3": "unchanged",
+				"segment4": "removed",
+				"segment5": "unchanged",
+			},
+		},
+		{
+			name: "Upsert_ClearExpiration",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(userSegments.SlugsToAdd()), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}))
+
+				mock.ExpectExec("INSERT INTO user_segments (.+) ON CONFLICT").
+					WithArgs(1, "segment1", nil, nil).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("UPDATE user_segments SET expiration_time").
+					WithArgs(1, "segment1", nil).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+
+				expectNoRules(mock)
+				expectNoLayerConflict(mock, 1)
+				mock.ExpectCommit()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:        1,
+					SegmentsToAdd: []structures.SegmentToAdd{{Slug: "segment1"}},
+					Mode:          "upsert",
+				},
+			},
+			wantUserID:  1,
+			wantChanges: map[string]string{"segment1": "expiration_updated"},
+		},
+		{
+			name: "Upsert_Error",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(userSegments.SlugsToAdd()), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}))
+
+				mock.ExpectExec("INSERT INTO user_segments (.+) ON CONFLICT").
+					WithArgs(1, "segment1", nil, nil).
+					WillReturnError(errors.New("uwaaa"))
+
+				mock.ExpectRollback()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:        1,
+					SegmentsToAdd: []structures.SegmentToAdd{{Slug: "segment1"}},
+					Mode:          "upsert",
+				},
+			},
+			wantUserID:  1,
+			wantErr:     true,
+			expectError: "error occurred while processing segment to add 'segment1': uwaaa",
+		},
+		{
+			name: "DelayedActivation",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(userSegments.SlugsToAdd()), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}))
+
+				mock.ExpectExec("INSERT INTO user_segments \\(user_id, segment, expiration_time, active_from\\)").
+					WithArgs(1, "segment1", activeFrom.Add(72*time.Hour), activeFrom).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+
+				expectNoRules(mock)
+				expectNoLayerConflict(mock, 1)
+				mock.ExpectCommit()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:        1,
+					SegmentsToAdd: []structures.SegmentToAdd{{Slug: "segment1", ActiveFrom: &activeFromValue}},
+					TTL:           &ttl,
+				},
+			},
+			wantUserID:      1,
+			wantExpirations: map[string]time.Time{"segment1": activeFrom.Add(72 * time.Hour)},
+		},
+		{
+			name: "DelayedActivation_ExpiresFirst",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(userSegments.SlugsToAdd()), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}))
+
+				mock.ExpectRollback()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:                  1,
+					SegmentsToAdd:           []structures.SegmentToAdd{{Slug: "segment1", ActiveFrom: &activeFromValue}},
+					SegmentsToAddExpiration: &offsetDateTime,
+				},
+			},
+			wantUserID:  1,
+			wantErr:     true,
+			expectError: "expiration of segment segment1 must come after its active_from",
+		},
+		{
+			name: "DelayedActivation_InvalidActiveFrom",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+				mock.ExpectRollback()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:        1,
+					SegmentsToAdd: []structures.SegmentToAdd{{Slug: "segment1", ActiveFrom: &invalidDateTime}},
+				},
+			},
+			wantUserID:  1,
+			wantErr:     true,
+			expectError: "invalid active_from 2023-08-28 202:00:00, use RFC 3339 such as 2023-08-30T12:00:00+03:00 (segment to add: segment1)",
+		},
+		{
+			name: "DeletePending",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(userSegments.SegmentsToDelete), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("DELETE FROM user_segments").
+					WithArgs(1, "segment1").
+					WillReturnRows(sqlmock.NewRows([]string{"active_from", "expiration_time"}).AddRow(activeFrom, nil))
+
+				mock.ExpectQuery("DELETE FROM user_segments").
+					WithArgs(1, "segment2").
+					WillReturnRows(sqlmock.NewRows([]string{"active_from", "expiration_time"}).AddRow(pastActiveFrom, nil))
+				mock.ExpectQuery("INSERT INTO change_sets").
+					WithArgs("patch", true).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, time.Now()))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"segment2"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, "segment2", true, "manual", nil, pastActiveFrom, 7, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"segment2"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, "segment2", false, "manual", nil, nil, 7, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+
+				expectNoRules(mock)
+				mock.ExpectCommit()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:           1,
+					SegmentsToDelete: []string{"segment1", "segment2"},
+					Mode:             "upsert",
+				},
+			},
+			wantUserID:  1,
+			wantChanges: map[string]string{"segment1": "removed", "segment2": "removed"},
+		},
+		{
+			name: "DryRun",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(append(userSegments.SlugsToAdd(), userSegments.SegmentsToDelete...)), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}))
+
+				mock.ExpectExec("INSERT").
+					WithArgs(1, "segment1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectChangeSet(mock, "patch")
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"segment1"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, "segment1", true, "manual", nil, nil, 7, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+
+				mock.ExpectQuery("SELECT").
+					WithArgs(1, "segment2").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+				mock.ExpectQuery("DELETE").
+					WithArgs(1, "segment2").
+					WillReturnRows(sqlmock.NewRows([]string{"active_from", "expiration_time"}).AddRow(nil, nil))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"segment2"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, "segment2", false, "manual", nil, nil, 7, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+
+				expectNoRules(mock)
+				expectNoLayerConflict(mock, 1)
+				mock.ExpectRollback()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:           1,
+					SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1"}},
+					SegmentsToDelete: []string{"segment2"},
+					DryRun:           true,
+				},
+			},
+			wantUserID:  1,
+			wantChanges: map[string]string{"segment1": "added", "segment2": "removed"},
+			wantHistory: []structures.HistoryEntry{
+				{UserId: 1, Segment: "segment1", Operation: "add", Reason: "manual"},
+				{UserId: 1, Segment: "segment2", Operation: "remove", Reason: "manual"},
+			},
 		},
 		{
 			name: "TransactionError",
@@ -175,7 +1104,7 @@ func TestUserSegments_Patch(t *testing.T) {
 			args: args{
 				UserSegments: structures.UserSegments{
 					UserId:           1,
-					SegmentsToAdd:    []string{"segment1", "segment2"},
+					SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1"}, {Slug: "segment2"}},
 					SegmentsToDelete: nil,
 				},
 			},
@@ -188,7 +1117,21 @@ func TestUserSegments_Patch(t *testing.T) {
 			mockBehavior: func(args args, userSegments structures.UserSegments) {
 				mock.ExpectBegin()
 
-				for _, segment := range userSegments.SegmentsToAdd {
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(append(userSegments.SlugsToAdd(), userSegments.SegmentsToDelete...)), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}))
+
+				for _, segment := range userSegments.SlugsToAdd() {
 					mock.ExpectExec("INSERT").
 						WithArgs(userSegments.UserId, segment).
 						WillReturnError(errors.New("insert error"))
@@ -200,7 +1143,7 @@ func TestUserSegments_Patch(t *testing.T) {
 			args: args{
 				UserSegments: structures.UserSegments{
 					UserId:           1,
-					SegmentsToAdd:    []string{"segment1", "segment2"},
+					SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1"}, {Slug: "segment2"}},
 					SegmentsToDelete: nil,
 				},
 			},
@@ -213,12 +1156,16 @@ func TestUserSegments_Patch(t *testing.T) {
 			mockBehavior: func(args args, userSegments structures.UserSegments) {
 				mock.ExpectBegin()
 
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(append(userSegments.SlugsToAdd(), userSegments.SegmentsToDelete...)), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
 				for _, segment := range userSegments.SegmentsToDelete {
 					mock.ExpectQuery("SELECT").
 						WithArgs(userSegments.UserId, segment).
 						WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(1))
 
-					mock.ExpectExec("DELETE").
+					mock.ExpectQuery("DELETE").
 						WithArgs(userSegments.UserId, segment).
 						WillReturnError(errors.New("delete error"))
 					break
@@ -242,6 +1189,10 @@ func TestUserSegments_Patch(t *testing.T) {
 			mockBehavior: func(args args, userSegments structures.UserSegments) {
 				mock.ExpectBegin()
 
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(append(userSegments.SlugsToAdd(), userSegments.SegmentsToDelete...)), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
 				for _, segment := range userSegments.SegmentsToDelete {
 					mock.ExpectQuery("SELECT").
 						WithArgs(userSegments.UserId, segment).
@@ -263,103 +1214,380 @@ func TestUserSegments_Patch(t *testing.T) {
 			expectError: "error occurred while checking segment to delete existence 'segment1': user(1) is not in this segment",
 		},
 		{
-			name: "DeleteSegments_ErrorNonExistanceError",
-			mockBehavior: func(args args, userSegments structures.UserSegments) {
+			name: "DeleteSegments_ErrorNonExistanceError",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(append(userSegments.SlugsToAdd(), userSegments.SegmentsToDelete...)), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				for _, segment := range userSegments.SegmentsToDelete {
+					mock.ExpectQuery("SELECT").
+						WithArgs(userSegments.UserId, segment).
+						WillReturnError(errors.New("existance select error"))
+					break
+				}
+
+				mock.ExpectRollback()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:           1,
+					SegmentsToAdd:    nil,
+					SegmentsToDelete: []string{"segment1", "segment2"},
+				},
+			},
+			wantUserID:  -1,
+			wantErr:     true,
+			expectError: "error occurred while checking segment to delete existence 'segment1': existance select error",
+		},
+		{
+			name: "AddSegments_HistoryError",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(append(userSegments.SlugsToAdd(), userSegments.SegmentsToDelete...)), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(userSegments.SlugsToAdd())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}))
+
+				for i, segment := range userSegments.SlugsToAdd() {
+					mock.ExpectExec("INSERT").
+						WithArgs(userSegments.UserId, segment).
+						WillReturnResult(sqlmock.NewResult(0, 1))
+					if i == 0 {
+						expectChangeSet(mock, "patch")
+					}
+					mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+						WithArgs(pq.Array([]string{segment})).
+						WillReturnRows(sqlmock.NewRows(variantColumns))
+					mock.ExpectQuery("INSERT INTO user_segments_history").
+						WithArgs(1, segment, true, "manual", nil, nil, 7, nil).
+						WillReturnError(errors.New("history error"))
+					break
+				}
+
+				mock.ExpectRollback()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:           1,
+					SegmentsToAdd:    []structures.SegmentToAdd{{Slug: "segment1"}, {Slug: "segment2"}},
+					SegmentsToDelete: nil,
+				},
+			},
+			wantUserID:  -1,
+			wantErr:     true,
+			expectError: "history error",
+		},
+		{
+			name: "DeleteSegments_HistoryError",
+			mockBehavior: func(args args, userSegments structures.UserSegments) {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array(append(userSegments.SlugsToAdd(), userSegments.SegmentsToDelete...)), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+
+				for i, segment := range userSegments.SegmentsToDelete {
+					mock.ExpectQuery("SELECT").
+						WithArgs(userSegments.UserId, segment).
+						WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(1))
+
+					mock.ExpectQuery("DELETE").
+						WithArgs(userSegments.UserId, segment).
+						WillReturnRows(sqlmock.NewRows([]string{"active_from", "expiration_time"}).AddRow(nil, nil))
+					if i == 0 {
+						expectChangeSet(mock, "patch")
+					}
+					mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+						WithArgs(pq.Array([]string{segment})).
+						WillReturnRows(sqlmock.NewRows(variantColumns))
+					mock.ExpectQuery("INSERT INTO user_segments_history").
+						WithArgs(1, segment, false, "manual", nil, nil, 7, nil).
+						WillReturnError(errors.New("history error"))
+				}
+
+				mock.ExpectRollback()
+			},
+			args: args{
+				UserSegments: structures.UserSegments{
+					UserId:           1,
+					SegmentsToAdd:    nil,
+					SegmentsToDelete: []string{"segment1", "segment2"},
+				},
+			},
+			wantUserID:  -1,
+			wantErr:     true,
+			expectError: "history error",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior(testCase.args, testCase.args.UserSegments)
+
+			got, err := repo.Patch(testCase.args.UserSegments)
+			if testCase.wantErr {
+				assert.Error(t, err)
+				assert.Equal(t, testCase.expectError, err.Error())
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testCase.wantUserID, got.UserId)
+				if testCase.wantExpirations != nil {
+					assert.Equal(t, testCase.wantExpirations, got.Expirations)
+				}
+				if testCase.wantChanges != nil {
+					assert.Equal(t, testCase.wantChanges, got.Changes)
+				}
+				if testCase.wantChangeSet != nil {
+					assert.Equal(t, testCase.wantChangeSet, got.ChangeSet)
+				}
+				if testCase.wantHistory != nil {
+					assert.True(t, got.DryRun)
+					assert.Nil(t, got.ChangeSet)
+					assert.Equal(t, testCase.wantHistory, got.History)
+				}
+			}
+		})
+	}
+}
+
+func TestUserSegments_SetUserSegments(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewUserSegmentsDB(db)
+
+	type mockBehavior func(set structures.UserSegmentsSet)
+
+	var ttl = "72h"
+	currentColumns := []string{"segment", "archived"}
+
+	tests := []struct {
+		name         string
+		set          structures.UserSegmentsSet
+		mockBehavior mockBehavior
+		wantChanges  map[string]string
+		expectError  string
+	}{
+		{
+			name: "Success",
+			set: structures.UserSegmentsSet{
+				UserId:   1,
+				Segments: []structures.SegmentToAdd{{Slug: "segment1"}, {Slug: "segment2"}},
+			},
+			mockBehavior: func(set structures.UserSegmentsSet) {
+				mock.ExpectBegin()
+				mock.ExpectExec("SELECT pg_advisory_xact_lock").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT us.segment, s.state = (.+) FROM user_segments us JOIN segments s").
+					WithArgs(1, "archived").
+					WillReturnRows(sqlmock.NewRows(currentColumns).AddRow("segment1", false).AddRow("segment3", false))
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array([]string{"segment1", "segment2"}), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array(set.Slugs())).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array(set.Slugs())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array(set.Slugs())).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}))
+
+				mock.ExpectExec("INSERT INTO user_segments (.+) ON CONFLICT").
+					WithArgs(1, "segment1", nil, nil).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("UPDATE user_segments SET expiration_time").
+					WithArgs(1, "segment1", nil).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+
+				mock.ExpectExec("INSERT INTO user_segments (.+) ON CONFLICT").
+					WithArgs(1, "segment2", nil, nil).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectChangeSet(mock, "set")
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"segment2"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, "segment2", true, "manual", nil, nil, 7, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+
+				mock.ExpectQuery("DELETE FROM user_segments").
+					WithArgs(1, "segment3").
+					WillReturnRows(sqlmock.NewRows([]string{"active_from", "expiration_time"}).AddRow(nil, nil))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"segment3"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, "segment3", false, "manual", nil, nil, 7, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+
+				expectNoRules(mock)
+				expectNoLayerConflict(mock, 1)
+				mock.ExpectCommit()
+			},
+			wantChanges: map[string]string{
+				"segment1": "unchanged",
+				"segment2": "added",
+				"segment3": "removed",
+			},
+		},
+		{
+			name: "Empty",
+			set:  structures.UserSegmentsSet{UserId: 1, Segments: []structures.SegmentToAdd{}},
+			mockBehavior: func(set structures.UserSegmentsSet) {
+				mock.ExpectBegin()
+				mock.ExpectExec("SELECT pg_advisory_xact_lock").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT us.segment, s.state = (.+) FROM user_segments us JOIN segments s").
+					WithArgs(1, "archived").
+					WillReturnRows(sqlmock.NewRows(currentColumns))
+				expectNoRules(mock)
+				mock.ExpectCommit()
+			},
+			wantChanges: map[string]string{},
+		},
+		{
+			name: "KeepArchivedMemberships",
+			set: structures.UserSegmentsSet{
+				UserId:   1,
+				Segments: []structures.SegmentToAdd{{Slug: "segment1"}, {Slug: "segment2"}},
+			},
+			mockBehavior: func(set structures.UserSegmentsSet) {
+				mock.ExpectBegin()
+				mock.ExpectExec("SELECT pg_advisory_xact_lock").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT us.segment, s.state = (.+) FROM user_segments us JOIN segments s").
+					WithArgs(1, "archived").
+					WillReturnRows(sqlmock.NewRows(currentColumns).AddRow("segment1", false).AddRow("segment2", true).AddRow("segment3", true))
+
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array([]string{"segment1"}), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}))
+				mock.ExpectQuery("SELECT segment FROM segment_expressions").
+					WithArgs(pq.Array([]string{"segment1"})).
+					WillReturnRows(sqlmock.NewRows([]string{"segment"}))
+				mock.ExpectQuery("SELECT slug, max_members FROM segments").
+					WithArgs(pq.Array([]string{"segment1"})).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "max_members"}))
+				mock.ExpectQuery("SELECT slug, default_ttl, max_ttl FROM segments").
+					WithArgs(pq.Array([]string{"segment1"})).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "default_ttl", "max_ttl"}))
+
+				mock.ExpectExec("INSERT INTO user_segments (.+) ON CONFLICT").
+					WithArgs(1, "segment1", nil, nil).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("UPDATE user_segments SET expiration_time").
+					WithArgs(1, "segment1", nil).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+
+				expectNoRules(mock)
+				expectNoLayerConflict(mock, 1)
+				mock.ExpectCommit()
+			},
+			wantChanges: map[string]string{
+				"segment1": "unchanged",
+				"segment2": "unchanged",
+			},
+		},
+		{
+			name: "InvalidExpiration",
+			set: structures.UserSegmentsSet{
+				UserId:   1,
+				Segments: []structures.SegmentToAdd{{Slug: "segment1", TTL: &ttl, ExpiresAt: &ttl}},
+			},
+			mockBehavior: func(set structures.UserSegmentsSet) {
 				mock.ExpectBegin()
-
-				for _, segment := range userSegments.SegmentsToDelete {
-					mock.ExpectQuery("SELECT").
-						WithArgs(userSegments.UserId, segment).
-						WillReturnError(errors.New("existance select error"))
-					break
-				}
-
 				mock.ExpectRollback()
 			},
-			args: args{
-				UserSegments: structures.UserSegments{
-					UserId:           1,
-					SegmentsToAdd:    nil,
-					SegmentsToDelete: []string{"segment1", "segment2"},
-				},
-			},
-			wantUserID:  -1,
-			wantErr:     true,
-			expectError: "error occurred while checking segment to delete existence 'segment1': existance select error",
+			expectError: "use either expires_at or ttl (segment: segment1)",
 		},
 		{
-			name: "AddSegments_HistoryError",
-			mockBehavior: func(args args, userSegments structures.UserSegments) {
+			name: "ArchivedSegmentToAdd",
+			set: structures.UserSegmentsSet{
+				UserId:   1,
+				Segments: []structures.SegmentToAdd{{Slug: "segment1"}},
+			},
+			mockBehavior: func(set structures.UserSegmentsSet) {
 				mock.ExpectBegin()
-
-				for _, segment := range userSegments.SegmentsToAdd {
-					mock.ExpectExec("INSERT").
-						WithArgs(userSegments.UserId, segment).
-						WillReturnResult(sqlmock.NewResult(0, 1))
-					mock.ExpectQuery("INSERT").
-						WithArgs(1, segment, true).
-						WillReturnError(errors.New("history error"))
-					break
-				}
-
+				mock.ExpectExec("SELECT pg_advisory_xact_lock").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT us.segment, s.state = (.+) FROM user_segments us JOIN segments s").
+					WithArgs(1, "archived").
+					WillReturnRows(sqlmock.NewRows(currentColumns).AddRow("segment2", false))
+				mock.ExpectQuery("SELECT slug FROM segments WHERE slug = ANY").
+					WithArgs(pq.Array([]string{"segment1"}), "archived").
+					WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow("segment1"))
 				mock.ExpectRollback()
 			},
-			args: args{
-				UserSegments: structures.UserSegments{
-					UserId:           1,
-					SegmentsToAdd:    []string{"segment1", "segment2"},
-					SegmentsToDelete: nil,
-				},
-			},
-			wantUserID:  -1,
-			wantErr:     true,
-			expectError: "history error",
+			expectError: "segment with slug segment1 is archived",
 		},
 		{
-			name: "DeleteSegments_HistoryError",
-			mockBehavior: func(args args, userSegments structures.UserSegments) {
+			name: "DeleteError",
+			set:  structures.UserSegmentsSet{UserId: 1, Segments: []structures.SegmentToAdd{}},
+			mockBehavior: func(set structures.UserSegmentsSet) {
 				mock.ExpectBegin()
-
-				for _, segment := range userSegments.SegmentsToDelete {
-					mock.ExpectQuery("SELECT").
-						WithArgs(userSegments.UserId, segment).
-						WillReturnRows(sqlmock.NewRows([]string{"slug"}).AddRow(1))
-
-					mock.ExpectExec("DELETE").
-						WithArgs(userSegments.UserId, segment).
-						WillReturnResult(sqlmock.NewResult(0, 1))
-					mock.ExpectQuery("INSERT").
-						WithArgs(1, segment, false).
-						WillReturnError(errors.New("history error"))
-				}
-
+				mock.ExpectExec("SELECT pg_advisory_xact_lock").
+					WithArgs(1).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("SELECT us.segment, s.state = (.+) FROM user_segments us JOIN segments s").
+					WithArgs(1, "archived").
+					WillReturnRows(sqlmock.NewRows(currentColumns).AddRow("segment1", false))
+				mock.ExpectQuery("DELETE FROM user_segments").
+					WithArgs(1, "segment1").
+					WillReturnError(errors.New("uwaaa"))
 				mock.ExpectRollback()
 			},
-			args: args{
-				UserSegments: structures.UserSegments{
-					UserId:           1,
-					SegmentsToAdd:    nil,
-					SegmentsToDelete: []string{"segment1", "segment2"},
-				},
+			expectError: "error occurred while processing segment to delete 'segment1': uwaaa",
+		},
+		{
+			name: "LockError",
+			set:  structures.UserSegmentsSet{UserId: 1, Segments: []structures.SegmentToAdd{}},
+			mockBehavior: func(set structures.UserSegmentsSet) {
+				mock.ExpectBegin()
+				mock.ExpectExec("SELECT pg_advisory_xact_lock").
+					WithArgs(1).
+					WillReturnError(errors.New("lock error"))
+				mock.ExpectRollback()
 			},
-			wantUserID:  -1,
-			wantErr:     true,
-			expectError: "history error",
+			expectError: "lock error",
 		},
 	}
 
 	for _, testCase := range tests {
 		t.Run(testCase.name, func(t *testing.T) {
-			testCase.mockBehavior(testCase.args, testCase.args.UserSegments)
+			testCase.mockBehavior(testCase.set)
 
-			gotUserID, err := repo.Patch(testCase.args.UserSegments)
-			if testCase.wantErr {
-				assert.Error(t, err)
-				assert.Equal(t, testCase.expectError, err.Error())
+			got, err := repo.SetUserSegments(testCase.set)
+			if testCase.expectError != "" {
+				assert.EqualError(t, err, testCase.expectError)
 			} else {
 				assert.NoError(t, err)
-				assert.Equal(t, testCase.wantUserID, gotUserID)
+				assert.Equal(t, testCase.set.UserId, got.UserId)
+				assert.Equal(t, testCase.wantChanges, got.Changes)
 			}
+			assert.NoError(t, mock.ExpectationsWereMet())
 		})
 	}
 }
@@ -392,12 +1620,12 @@ func TestUserSegments_GetUserSegments(t *testing.T) {
 			mockBehavior: func(args args, user structures.User) {
 				mock.ExpectBegin()
 
-				rows := sqlmock.NewRows([]string{"segment"}).
-					AddRow("segment1").
-					AddRow("segment2")
+				rows := sqlmock.NewRows([]string{"segment", "schedule"}).
+					AddRow("segment1", nil).
+					AddRow("segment2", nil)
 
-				mock.ExpectQuery("SELECT segment").
-					WithArgs(user.Id).
+				mock.ExpectQuery("SELECT us.segment, s.schedule FROM user_segments us JOIN segments").
+					WithArgs(user.Id, "active").
 					WillReturnRows(rows)
 
 				mock.ExpectCommit()
@@ -411,15 +1639,39 @@ func TestUserSegments_GetUserSegments(t *testing.T) {
 			wantErr:     false,
 			expectError: "",
 		},
+		{
+			name: "Schedule",
+			mockBehavior: func(args args, user structures.User) {
+				mock.ExpectBegin()
+
+				rows := sqlmock.NewRows([]string{"segment", "schedule"}).
+					AddRow("segment1", `{"timezone": "Europe/Moscow", "intervals": [{"days": ["mon", "tue", "wed", "thu", "fri", "sat", "sun"], "start": "00:00", "end": "24:00"}]}`).
+					AddRow("segment2", `{"timezone": "Mars/Olympus", "intervals": [{"days": ["mon"], "start": "00:00", "end": "24:00"}]}`)
+
+				mock.ExpectQuery("SELECT us.segment, s.schedule FROM user_segments us JOIN segments").
+					WithArgs(user.Id, "active").
+					WillReturnRows(rows)
+
+				mock.ExpectCommit()
+			},
+			args: args{
+				User: structures.User{
+					Id: 1,
+				},
+			},
+			wantSlugs:   []string{"segment1"},
+			wantErr:     false,
+			expectError: "",
+		},
 		{
 			name: "NoRows",
 			mockBehavior: func(args args, user structures.User) {
 				mock.ExpectBegin()
 
-				rows := sqlmock.NewRows([]string{"segment"})
+				rows := sqlmock.NewRows([]string{"segment", "schedule"})
 
-				mock.ExpectQuery("SELECT segment").
-					WithArgs(user.Id).
+				mock.ExpectQuery("SELECT us.segment, s.schedule FROM user_segments us JOIN segments").
+					WithArgs(user.Id, "active").
 					WillReturnRows(rows)
 
 				mock.ExpectCommit()
@@ -452,8 +1704,8 @@ func TestUserSegments_GetUserSegments(t *testing.T) {
 			mockBehavior: func(args args, user structures.User) {
 				mock.ExpectBegin()
 
-				mock.ExpectQuery("SELECT segment").
-					WithArgs(user.Id).
+				mock.ExpectQuery("SELECT us.segment, s.schedule FROM user_segments us JOIN segments").
+					WithArgs(user.Id, "active").
 					WillReturnError(errors.New("query error"))
 
 				mock.ExpectRollback()
@@ -472,11 +1724,11 @@ func TestUserSegments_GetUserSegments(t *testing.T) {
 			mockBehavior: func(args args, user structures.User) {
 				mock.ExpectBegin()
 
-				rows := sqlmock.NewRows([]string{"segment"}).
-					AddRow(nil)
+				rows := sqlmock.NewRows([]string{"segment", "schedule"}).
+					AddRow(nil, nil)
 
-				mock.ExpectQuery("SELECT segment").
-					WithArgs(user.Id).
+				mock.ExpectQuery("SELECT us.segment, s.schedule FROM user_segments us JOIN segments").
+					WithArgs(user.Id, "active").
 					WillReturnRows(rows)
 
 				mock.ExpectRollback()
@@ -495,11 +1747,11 @@ func TestUserSegments_GetUserSegments(t *testing.T) {
 			mockBehavior: func(args args, user structures.User) {
 				mock.ExpectBegin()
 
-				rows := sqlmock.NewRows([]string{"segment"}).
-					AddRow(nil).RowError(0, errors.New("Row error"))
+				rows := sqlmock.NewRows([]string{"segment", "schedule"}).
+					AddRow(nil, nil).RowError(0, errors.New("Row error"))
 
-				mock.ExpectQuery("SELECT segment").
-					WithArgs(user.Id).
+				mock.ExpectQuery("SELECT us.segment, s.schedule FROM user_segments us JOIN segments").
+					WithArgs(user.Id, "active").
 					WillReturnRows(rows)
 
 				mock.ExpectRollback()
@@ -518,12 +1770,12 @@ func TestUserSegments_GetUserSegments(t *testing.T) {
 			mockBehavior: func(args args, user structures.User) {
 				mock.ExpectBegin()
 
-				rows := sqlmock.NewRows([]string{"segment"}).
-					AddRow("segment1").
-					AddRow("segment2")
+				rows := sqlmock.NewRows([]string{"segment", "schedule"}).
+					AddRow("segment1", nil).
+					AddRow("segment2", nil)
 
-				mock.ExpectQuery("SELECT segment").
-					WithArgs(user.Id).
+				mock.ExpectQuery("SELECT us.segment, s.schedule FROM user_segments us JOIN segments").
+					WithArgs(user.Id, "active").
 					WillReturnRows(rows)
 
 				mock.ExpectCommit().WillReturnError(errors.New("Commit error"))
@@ -736,7 +1988,7 @@ func TestUserSegments_GetSegmentUsers(t *testing.T) {
 		t.Run(testCase.name, func(t *testing.T) {
 			testCase.mockBehavior(testCase.args, testCase.args.Segment)
 
-			gotSlugs, err := repo.GetSegmentUsers(testCase.args.Segment)
+			gotSlugs, err := repo.GetSegmentUsers(structures.SegmentUsersFilter{Slug: testCase.args.Segment.Slug})
 
 			assert.Equal(t, testCase.wantUsers, gotSlugs)
 
@@ -749,3 +2001,313 @@ func TestUserSegments_GetSegmentUsers(t *testing.T) {
 		})
 	}
 }
+
+func TestUserSegments_GetSegmentUsersWithDescendants(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewUserSegmentsDB(db)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("WITH RECURSIVE tree (.+) SELECT DISTINCT user_id FROM user_segments").
+		WithArgs("vip").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1).AddRow(3))
+	mock.ExpectCommit()
+
+	users, err := repo.GetSegmentUsers(structures.SegmentUsersFilter{Slug: "vip", IncludeDescendants: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 3}, users)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUserSegments_RecordPercentageSegments(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewUserSegmentsDB(db)
+
+	type mockBehavior func(user structures.User, segments []string)
+
+	tests := []struct {
+		name         string
+		user         structures.User
+		segments     []string
+		mockBehavior mockBehavior
+		wantErr      bool
+		expectError  string
+	}{
+		{
+			name:     "FirstPlacement",
+			user:     structures.User{Id: 1},
+			segments: []string{"segment1", "segment2"},
+			mockBehavior: func(user structures.User, segments []string) {
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO user_percentage_segments").
+					WithArgs(user.Id, "segment1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"segment1"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(user.Id, "segment1", true, "percentage", nil, nil, nil, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(user.Id))
+				mock.ExpectExec("INSERT INTO user_percentage_segments").
+					WithArgs(user.Id, "segment2").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:     "InsertError",
+			user:     structures.User{Id: 1},
+			segments: []string{"segment1"},
+			mockBehavior: func(user structures.User, segments []string) {
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO user_percentage_segments").
+					WithArgs(user.Id, "segment1").
+					WillReturnError(errors.New("insert error"))
+				mock.ExpectRollback()
+			},
+			wantErr:     true,
+			expectError: "error occurred while recording percentage segment 'segment1': insert error",
+		},
+		{
+			name:     "HistoryError",
+			user:     structures.User{Id: 1},
+			segments: []string{"segment1"},
+			mockBehavior: func(user structures.User, segments []string) {
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO user_percentage_segments").
+					WithArgs(user.Id, "segment1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"segment1"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(user.Id, "segment1", true, "percentage", nil, nil, nil, nil).
+					WillReturnError(errors.New("history error"))
+				mock.ExpectRollback()
+			},
+			wantErr:     true,
+			expectError: "history error",
+		},
+		{
+			name:     "BeginError",
+			user:     structures.User{Id: 1},
+			segments: []string{"segment1"},
+			mockBehavior: func(user structures.User, segments []string) {
+				mock.ExpectBegin().WillReturnError(errors.New("begin error"))
+			},
+			wantErr:     true,
+			expectError: "begin error",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior(testCase.user, testCase.segments)
+
+			err := repo.RecordPercentageSegments(testCase.user, testCase.segments)
+			if testCase.wantErr {
+				assert.EqualError(t, err, testCase.expectError)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestUserSegments_ClosePercentageSegments(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewUserSegmentsDB(db)
+
+	type mockBehavior func(user structures.User, segments []string)
+
+	tests := []struct {
+		name         string
+		user         structures.User
+		segments     []string
+		mockBehavior mockBehavior
+		wantErr      bool
+		expectError  string
+	}{
+		{
+			name:     "RecordedPlacement",
+			user:     structures.User{Id: 1},
+			segments: []string{"segment1", "segment2"},
+			mockBehavior: func(user structures.User, segments []string) {
+				mock.ExpectBegin()
+				mock.ExpectExec("DELETE FROM user_percentage_segments").
+					WithArgs(user.Id, "segment1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"segment1"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(user.Id, "segment1", false, "percentage", nil, nil, nil, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(user.Id))
+				mock.ExpectExec("DELETE FROM user_percentage_segments").
+					WithArgs(user.Id, "segment2").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:     "DeleteError",
+			user:     structures.User{Id: 1},
+			segments: []string{"segment1"},
+			mockBehavior: func(user structures.User, segments []string) {
+				mock.ExpectBegin()
+				mock.ExpectExec("DELETE FROM user_percentage_segments").
+					WithArgs(user.Id, "segment1").
+					WillReturnError(errors.New("delete error"))
+				mock.ExpectRollback()
+			},
+			wantErr:     true,
+			expectError: "error occurred while closing percentage segment 'segment1': delete error",
+		},
+		{
+			name:     "BeginError",
+			user:     structures.User{Id: 1},
+			segments: []string{"segment1"},
+			mockBehavior: func(user structures.User, segments []string) {
+				mock.ExpectBegin().WillReturnError(errors.New("begin error"))
+			},
+			wantErr:     true,
+			expectError: "begin error",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior(testCase.user, testCase.segments)
+
+			err := repo.ClosePercentageSegments(testCase.user, testCase.segments)
+			if testCase.wantErr {
+				assert.EqualError(t, err, testCase.expectError)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestUserSegments_GetUpcomingActivations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewUserSegmentsDB(db)
+
+	activeFrom := time.Date(2023, 9, 1, 10, 0, 0, 0, time.UTC)
+	expiresAt := activeFrom.Add(72 * time.Hour)
+	userId := 1
+	segment := "AVITO_LAUNCH"
+	columns := []string{"user_id", "segment", "active_from", "expiration_time"}
+
+	tests := []struct {
+		name         string
+		filter       structures.ActivationsFilter
+		mockBehavior func()
+		want         []structures.Activation
+		expectError  string
+	}{
+		{
+			name: "All",
+			mockBehavior: func() {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id, segment, active_from, expiration_time FROM user_segments WHERE active_from > NOW\\(\\) ORDER BY").
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, "AVITO_LAUNCH", activeFrom, expiresAt).
+						AddRow(2, "AVITO_LAUNCH", activeFrom, nil))
+				mock.ExpectCommit()
+			},
+			want: []structures.Activation{
+				{UserId: 1, Segment: "AVITO_LAUNCH", ActiveFrom: activeFrom, ExpiresAt: &expiresAt},
+				{UserId: 2, Segment: "AVITO_LAUNCH", ActiveFrom: activeFrom},
+			},
+		},
+		{
+			name:   "Filtered",
+			filter: structures.ActivationsFilter{UserId: &userId, Segment: &segment},
+			mockBehavior: func() {
+				mock.ExpectBegin()
+				mock.ExpectQuery("WHERE active_from > NOW\\(\\) AND user_id = \\$1 AND segment = \\$2").
+					WithArgs(1, "AVITO_LAUNCH").
+					WillReturnRows(sqlmock.NewRows(columns))
+				mock.ExpectCommit()
+			},
+			want: []structures.Activation{},
+		},
+		{
+			name: "QueryError",
+			mockBehavior: func() {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT user_id, segment, active_from").
+					WillReturnError(errors.New("query error"))
+				mock.ExpectRollback()
+			},
+			expectError: "query error",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior()
+
+			got, err := repo.GetUpcomingActivations(testCase.filter)
+			if testCase.expectError != "" {
+				assert.EqualError(t, err, testCase.expectError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testCase.want, got)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+// expectChangeSet expects the change set of the kind to be created along with the first history entry of the transaction.
+func expectChangeSet(mock sqlmock.Sqlmock, kind string) {
+	mock.ExpectQuery("INSERT INTO change_sets").
+		WithArgs(kind, false).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, time.Now()))
+}
+
+func expectIrreversible(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("UPDATE change_sets SET irreversible = true").
+		WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+var ruleColumns = []string{"id", "kind", "segment", "other", "tag", "max_segments", "created_at"}
+
+// expectNoRules expects the rules to be read before the transaction ends, there are none.
+func expectNoRules(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT (.+) FROM segment_rules").
+		WillReturnRows(sqlmock.NewRows(ruleColumns))
+}
+
+// expectNoLayerConflict expects the layers of the added segments of the user to be checked, none has two of their segments.
+func expectNoLayerConflict(mock sqlmock.Sqlmock, userId int) {
+	mock.ExpectExec("SELECT pg_advisory_xact_lock").
+		WithArgs(userId).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT s.layer, MIN\\(s.slug\\), MAX\\(s.slug\\) FROM user_segments").
+		WillReturnRows(sqlmock.NewRows([]string{"layer", "min", "max"}))
+}
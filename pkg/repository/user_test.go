@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -39,10 +40,10 @@ func TestUser_GetUserHistory(t *testing.T) {
 			mockBehavior: func(args args, userHistory structures.UserHistory) {
 				mock.ExpectBegin()
 
-				rows := sqlmock.NewRows([]string{"user_id", "segment", "operation", "operation_datetime"}).
-					AddRow(1, "segment1", false, time.Now())
+				rows := sqlmock.NewRows([]string{"user_id", "segment", "operation", "reason", "variant", "operation_datetime"}).
+					AddRow(1, "segment1", false, "manual", "control", time.Now())
 
-				mock.ExpectQuery("SELECT").
+				mock.ExpectQuery("SELECT h.user_id, COALESCE\\(s.slug, h.segment\\)(.+) LEFT JOIN segments s ON s.id = h.segment_id").
 					WithArgs(1, "2023-08").
 					WillReturnRows(rows)
 
@@ -123,8 +124,8 @@ func TestUser_GetUserHistory(t *testing.T) {
 			mockBehavior: func(args args, userHistory structures.UserHistory) {
 				mock.ExpectBegin()
 
-				rows := sqlmock.NewRows([]string{"user_id", "segment", "operation", "operation_datetime"}).
-					AddRow(nil, nil, nil, nil)
+				rows := sqlmock.NewRows([]string{"user_id", "segment", "operation", "reason", "variant", "operation_datetime"}).
+					AddRow(nil, nil, nil, nil, nil, nil)
 
 				mock.ExpectQuery("SELECT").
 					WithArgs(1, "2023-08").
@@ -146,8 +147,8 @@ func TestUser_GetUserHistory(t *testing.T) {
 			mockBehavior: func(args args, userHistory structures.UserHistory) {
 				mock.ExpectBegin()
 
-				rows := sqlmock.NewRows([]string{"user_id", "segment", "operation", "operation_datetime"}).
-					AddRow(1, "segment1", false, time.Now())
+				rows := sqlmock.NewRows([]string{"user_id", "segment", "operation", "reason", "variant", "operation_datetime"}).
+					AddRow(1, "segment1", false, "manual", "control", time.Now())
 
 				mock.ExpectQuery("SELECT").
 					WithArgs(1, "2023-08").
@@ -209,6 +210,8 @@ func TestUser_DeleteExpiredSegments(t *testing.T) {
 
 	type mockBehavior func()
 
+	activeFrom := time.Date(2023, 9, 1, 10, 0, 0, 0, time.UTC)
+
 	tests := []struct {
 		name         string
 		mockBehavior mockBehavior
@@ -220,14 +223,115 @@ func TestUser_DeleteExpiredSegments(t *testing.T) {
 			mockBehavior: func() {
 				mock.ExpectBegin()
 
+				mock.ExpectQuery("SELECT user_id, segment, active_from FROM user_segments").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "segment", "active_from"}))
+
+				mock.ExpectExec("DELETE").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+
+				mock.ExpectQuery("SELECT us.user_id, us.segment FROM user_segments (.+) UNION").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "segment"}))
+
+				mock.ExpectCommit()
+			},
+			wantErr:     false,
+			expectError: "",
+		},
+		{
+			name: "EndedSegment",
+			mockBehavior: func() {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT user_id, segment, active_from FROM user_segments").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "segment", "active_from"}))
+
+				mock.ExpectExec("DELETE").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+
+				mock.ExpectQuery("SELECT us.user_id, us.segment FROM user_segments (.+) UNION").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "segment"}).
+						AddRow(1, "AVITO_SALE").
+						AddRow(2, "AVITO_SALE"))
+
+				for _, userId := range []int{1, 2} {
+					mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+						WithArgs(pq.Array([]string{"AVITO_SALE"})).
+						WillReturnRows(sqlmock.NewRows(variantColumns))
+					mock.ExpectQuery("INSERT INTO user_segments_history").
+						WithArgs(userId, "AVITO_SALE", false, "segment_ended", nil, nil, nil, nil).
+						WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(userId))
+				}
+
+				mock.ExpectExec("DELETE FROM user_segments WHERE segment IN").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("DELETE FROM user_percentage_segments WHERE segment IN").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+
+				mock.ExpectCommit()
+			},
+			wantErr:     false,
+			expectError: "",
+		},
+		{
+			name: "EndedSegmentsError",
+			mockBehavior: func() {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT user_id, segment, active_from FROM user_segments").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "segment", "active_from"}))
+
 				mock.ExpectExec("DELETE").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+
+				mock.ExpectQuery("SELECT us.user_id, us.segment FROM user_segments (.+) UNION").
+					WillReturnError(errors.New("query error"))
+
+				mock.ExpectRollback()
+			},
+			wantErr:     true,
+			expectError: "query error",
+		},
+		{
+			name: "DueActivation",
+			mockBehavior: func() {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT user_id, segment, active_from FROM user_segments").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "segment", "active_from"}).
+						AddRow(1, "AVITO_LAUNCH", activeFrom))
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array([]string{"AVITO_LAUNCH"})).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+				mock.ExpectQuery("INSERT INTO user_segments_history").
+					WithArgs(1, "AVITO_LAUNCH", true, "manual", nil, activeFrom, nil, nil).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+				mock.ExpectExec("UPDATE user_segments SET active_from = NULL").
 					WillReturnResult(sqlmock.NewResult(0, 1))
 
+				mock.ExpectExec("DELETE").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+
+				mock.ExpectQuery("SELECT us.user_id, us.segment FROM user_segments (.+) UNION").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "segment"}))
+
 				mock.ExpectCommit()
 			},
 			wantErr:     false,
 			expectError: "",
 		},
+		{
+			name: "ActivationError",
+			mockBehavior: func() {
+				mock.ExpectBegin()
+
+				mock.ExpectQuery("SELECT user_id, segment, active_from FROM user_segments").
+					WillReturnError(errors.New("activation error"))
+
+				mock.ExpectRollback()
+			},
+			wantErr:     true,
+			expectError: "activation error",
+		},
 		{
 			name: "BeginError",
 			mockBehavior: func() {
@@ -241,6 +345,9 @@ func TestUser_DeleteExpiredSegments(t *testing.T) {
 			mockBehavior: func() {
 				mock.ExpectBegin()
 
+				mock.ExpectQuery("SELECT user_id, segment, active_from FROM user_segments").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "segment", "active_from"}))
+
 				mock.ExpectExec("DELETE").
 					WillReturnError(errors.New("exec error"))
 
@@ -262,6 +369,7 @@ func TestUser_DeleteExpiredSegments(t *testing.T) {
 			} else {
 				assert.NoError(t, err)
 			}
+			assert.NoError(t, mock.ExpectationsWereMet())
 		})
 	}
 }
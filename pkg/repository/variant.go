@@ -0,0 +1,175 @@
+package repository
+
+import (
+	"avito/pkg/structures"
+	"avito/pkg/utils"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func getSegmentVariants(q queryer, slug string) ([]structures.SegmentVariant, error) {
+	getVariantsQuery := fmt.Sprintf("SELECT name, weight FROM %s WHERE segment = $1 ORDER BY position", segmentVariantsTable)
+	rows, err := q.Query(getVariantsQuery, slug)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var variants []structures.SegmentVariant
+	for rows.Next() {
+		var variant structures.SegmentVariant
+		if err := rows.Scan(&variant.Name, &variant.Weight); err != nil {
+			return nil, err
+		}
+		variants = append(variants, variant)
+	}
+
+	return variants, rows.Err()
+}
+
+// replaceSegmentVariants sets new variants of the segment. Users are assigned variants when they are read
+// and the history keeps the variant of the add, so the split of a segment that already reached users is fixed.
+func replaceSegmentVariants(tx *sql.Tx, slug string, variants []structures.SegmentVariant) error {
+	current, err := getSegmentVariants(tx, slug)
+	if err != nil {
+		return err
+	}
+	if sameVariants(current, variants) {
+		return nil
+	}
+
+	reached, err := segmentReached(tx, slug)
+	if err != nil {
+		return err
+	}
+	if reached {
+		return structures.ValidationError{Message: fmt.Sprintf("segment %s already has users, its variants cannot be changed, clone it to start a new split", slug)}
+	}
+
+	deleteVariantsQuery := fmt.Sprintf("DELETE FROM %s WHERE segment = $1", segmentVariantsTable)
+	if _, err := tx.Exec(deleteVariantsQuery, slug); err != nil {
+		return err
+	}
+
+	return insertSegmentVariants(tx, slug, variants)
+}
+
+// checkVariantBucketing fails when the update changes the salt or the hash function of a segment
+// with variants that already reached users: variants are assigned by the salt, so the users would get other ones
+// than the history keeps.
+func checkVariantBucketing(tx *sql.Tx, update structures.SegmentUpdate) error {
+	if update.Salt == nil && update.HashFunction == nil {
+		return nil
+	}
+
+	var salt, hashFunction string
+	var hasVariants bool
+	getBucketingQuery := fmt.Sprintf(
+		"SELECT COALESCE(salt, slug), COALESCE(hash_function, ''), EXISTS (SELECT 1 FROM %s WHERE segment = $1) FROM %s WHERE slug = $1",
+		segmentVariantsTable, segmentsTable)
+	err := tx.QueryRow(getBucketingQuery, update.Slug).Scan(&salt, &hashFunction, &hasVariants)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	changed := (update.Salt != nil && *update.Salt != salt) || (update.HashFunction != nil && *update.HashFunction != hashFunction)
+	if !hasVariants || !changed {
+		return nil
+	}
+
+	reached, err := segmentReached(tx, update.Slug)
+	if err != nil {
+		return err
+	}
+	if reached {
+		return structures.ValidationError{Message: fmt.Sprintf("segment %s already has users, the salt and hash function of its variants cannot be changed, clone it to start a new split", update.Slug)}
+	}
+
+	return nil
+}
+
+// segmentReached reports whether the segment has explicit or percentage users.
+func segmentReached(tx *sql.Tx, slug string) (bool, error) {
+	var reached bool
+	reachedQuery := fmt.Sprintf(
+		"SELECT EXISTS (SELECT 1 FROM %s WHERE segment = $1) OR EXISTS (SELECT 1 FROM %s WHERE segment = $1)",
+		userSegmentsTable, userPercentageSegments)
+	err := tx.QueryRow(reachedQuery, slug).Scan(&reached)
+	return reached, err
+}
+
+func sameVariants(a, b []structures.SegmentVariant) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func insertSegmentVariants(tx *sql.Tx, slug string, variants []structures.SegmentVariant) error {
+	insertVariantQuery := fmt.Sprintf("INSERT INTO %s (segment, name, weight, position) VALUES ($1, $2, $3, $4)", segmentVariantsTable)
+	for position, variant := range variants {
+		if _, err := tx.Exec(insertVariantQuery, slug, variant.Name, variant.Weight, position); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getSegmentsVariants returns the variants of the given segments together with
+// the salt they are assigned with. Segments without variants are left out.
+func getSegmentsVariants(q queryer, slugs []string) (map[string][]structures.SegmentVariant, map[string]string, error) {
+	getVariantsQuery := fmt.Sprintf(
+		`SELECT v.segment, COALESCE(s.salt, s.slug), v.name, v.weight
+		FROM %s v JOIN %s s ON s.slug = v.segment
+		WHERE v.segment = ANY($1) ORDER BY v.segment, v.position`,
+		segmentVariantsTable, segmentsTable)
+	rows, err := q.Query(getVariantsQuery, pq.Array(slugs))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	variants := make(map[string][]structures.SegmentVariant)
+	salts := make(map[string]string)
+	for rows.Next() {
+		var slug, salt string
+		var variant structures.SegmentVariant
+		if err := rows.Scan(&slug, &salt, &variant.Name, &variant.Weight); err != nil {
+			return nil, nil, err
+		}
+		variants[slug] = append(variants[slug], variant)
+		salts[slug] = salt
+	}
+
+	return variants, salts, rows.Err()
+}
+
+// userVariant returns the variant the user is assigned in the segment, nil for a segment without variants.
+func userVariant(q queryer, slug string, userId int) (*string, error) {
+	variants, salts, err := getSegmentsVariants(q, []string{slug})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(variants[slug]) == 0 {
+		return nil, nil
+	}
+
+	variant := utils.AssignVariant(salts[slug], variants[slug], int64(userId))
+	return &variant, nil
+}
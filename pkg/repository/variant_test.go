@@ -0,0 +1,89 @@
+package repository_test
+
+import (
+	"avito/pkg/repository"
+	"avito/pkg/structures"
+	"errors"
+	"log"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+var variantColumns = []string{"segment", "salt", "name", "weight"}
+
+func TestUserSegments_GetUserVariants(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	repo := repository.NewUserSegmentsDB(db)
+
+	type mockBehavior func(user structures.User, segments []string)
+
+	tests := []struct {
+		name          string
+		user          structures.User
+		segments      []string
+		mockBehavior  mockBehavior
+		expected      map[string]string
+		wantErr       bool
+		expectedError string
+	}{
+		{
+			name:     "OK",
+			user:     structures.User{Id: 1},
+			segments: []string{"experiment", "plain"},
+			mockBehavior: func(user structures.User, segments []string) {
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array(segments)).
+					WillReturnRows(sqlmock.NewRows(variantColumns).
+						AddRow("experiment", "experiment", "control", 50).
+						AddRow("experiment", "experiment", "treatment", 50))
+			},
+			expected: map[string]string{"experiment": "control"},
+		},
+		{
+			name:     "NoVariants",
+			user:     structures.User{Id: 1},
+			segments: []string{"plain"},
+			mockBehavior: func(user structures.User, segments []string) {
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array(segments)).
+					WillReturnRows(sqlmock.NewRows(variantColumns))
+			},
+			expected: map[string]string{},
+		},
+		{
+			name:     "QueryError",
+			user:     structures.User{Id: 1},
+			segments: []string{"experiment"},
+			mockBehavior: func(user structures.User, segments []string) {
+				mock.ExpectQuery("SELECT v.segment, (.+) FROM segment_variants").
+					WithArgs(pq.Array(segments)).
+					WillReturnError(errors.New("query error"))
+			},
+			wantErr:       true,
+			expectedError: "query error",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.mockBehavior(testCase.user, testCase.segments)
+
+			got, err := repo.GetUserVariants(testCase.user, testCase.segments)
+			if testCase.wantErr {
+				assert.EqualError(t, err, testCase.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testCase.expected, got)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package service
+
+import (
+	"avito/pkg/repository"
+	"avito/pkg/structures"
+)
+
+type ChangeSetService struct {
+	repo repository.ChangeSet
+}
+
+func NewChangeSetService(repo repository.ChangeSet) *ChangeSetService {
+	return &ChangeSetService{repo: repo}
+}
+
+func (s *ChangeSetService) GetChangeSet(id int) (structures.ChangeSet, error) {
+	return s.repo.GetChangeSet(id)
+}
+
+func (s *ChangeSetService) RevertChangeSet(id int) (structures.ChangeSet, error) {
+	return s.repo.RevertChangeSet(id)
+}
@@ -0,0 +1,22 @@
+package service
+
+import (
+	"avito/pkg/repository"
+	"avito/pkg/structures"
+)
+
+type LayerService struct {
+	repo repository.Layer
+}
+
+func NewLayerService(repo repository.Layer) *LayerService {
+	return &LayerService{repo: repo}
+}
+
+func (s *LayerService) CreateLayer(layer structures.Layer) (string, error) {
+	return s.repo.CreateLayer(layer)
+}
+
+func (s *LayerService) GetLayer(layer structures.Layer) (structures.Layer, error) {
+	return s.repo.GetLayer(layer)
+}
@@ -34,6 +34,21 @@ func (m *MockSegment) EXPECT() *MockSegmentMockRecorder {
 	return m.recorder
 }
 
+// Clone mocks base method.
+func (m *MockSegment) Clone(clone structures.SegmentClone) (structures.SegmentCloneResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Clone", clone)
+	ret0, _ := ret[0].(structures.SegmentCloneResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Clone indicates an expected call of Clone.
+func (mr *MockSegmentMockRecorder) Clone(clone interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Clone", reflect.TypeOf((*MockSegment)(nil).Clone), clone)
+}
+
 // Create mocks base method.
 func (m *MockSegment) Create(segment structures.Segment) (string, error) {
 	m.ctrl.T.Helper()
@@ -50,25 +65,85 @@ func (mr *MockSegmentMockRecorder) Create(segment interface{}) *gomock.Call {
 }
 
 // Delete mocks base method.
-func (m *MockSegment) Delete(segment structures.Segment) (string, error) {
+func (m *MockSegment) Delete(segment structures.Segment, children string) (structures.SegmentDeletion, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Delete", segment)
-	ret0, _ := ret[0].(string)
+	ret := m.ctrl.Call(m, "Delete", segment, children)
+	ret0, _ := ret[0].(structures.SegmentDeletion)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Delete indicates an expected call of Delete.
-func (mr *MockSegmentMockRecorder) Delete(segment interface{}) *gomock.Call {
+func (mr *MockSegmentMockRecorder) Delete(segment, children interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockSegment)(nil).Delete), segment, children)
+}
+
+// DeleteDryRun mocks base method.
+func (m *MockSegment) DeleteDryRun(segment structures.Segment, children string) (structures.SegmentDeletion, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteDryRun", segment, children)
+	ret0, _ := ret[0].(structures.SegmentDeletion)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteDryRun indicates an expected call of DeleteDryRun.
+func (mr *MockSegmentMockRecorder) DeleteDryRun(segment, children interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteDryRun", reflect.TypeOf((*MockSegment)(nil).DeleteDryRun), segment, children)
+}
+
+// Get mocks base method.
+func (m *MockSegment) Get(segment structures.Segment) (structures.Segment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", segment)
+	ret0, _ := ret[0].(structures.Segment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockSegmentMockRecorder) Get(segment interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockSegment)(nil).Get), segment)
+}
+
+// GetCompositeSegments mocks base method.
+func (m *MockSegment) GetCompositeSegments() ([]structures.Segment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetCompositeSegments")
+	ret0, _ := ret[0].([]structures.Segment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetCompositeSegments indicates an expected call of GetCompositeSegments.
+func (mr *MockSegmentMockRecorder) GetCompositeSegments() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCompositeSegments", reflect.TypeOf((*MockSegment)(nil).GetCompositeSegments))
+}
+
+// GetImpliedSegments mocks base method.
+func (m *MockSegment) GetImpliedSegments(slugs []string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetImpliedSegments", slugs)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetImpliedSegments indicates an expected call of GetImpliedSegments.
+func (mr *MockSegmentMockRecorder) GetImpliedSegments(slugs interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockSegment)(nil).Delete), segment)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetImpliedSegments", reflect.TypeOf((*MockSegment)(nil).GetImpliedSegments), slugs)
 }
 
 // GetPercentageSegments mocks base method.
-func (m *MockSegment) GetPercentageSegments() (map[string]int, error) {
+func (m *MockSegment) GetPercentageSegments() ([]structures.Segment, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "GetPercentageSegments")
-	ret0, _ := ret[0].(map[string]int)
+	ret0, _ := ret[0].([]structures.Segment)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
@@ -79,6 +154,97 @@ func (mr *MockSegmentMockRecorder) GetPercentageSegments() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPercentageSegments", reflect.TypeOf((*MockSegment)(nil).GetPercentageSegments))
 }
 
+// GetSegmentLayers mocks base method.
+func (m *MockSegment) GetSegmentLayers(slugs []string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSegmentLayers", slugs)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSegmentLayers indicates an expected call of GetSegmentLayers.
+func (mr *MockSegmentMockRecorder) GetSegmentLayers(slugs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSegmentLayers", reflect.TypeOf((*MockSegment)(nil).GetSegmentLayers), slugs)
+}
+
+// GetStateHistory mocks base method.
+func (m *MockSegment) GetStateHistory(segment structures.Segment) ([]structures.SegmentStateTransition, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetStateHistory", segment)
+	ret0, _ := ret[0].([]structures.SegmentStateTransition)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetStateHistory indicates an expected call of GetStateHistory.
+func (mr *MockSegmentMockRecorder) GetStateHistory(segment interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetStateHistory", reflect.TypeOf((*MockSegment)(nil).GetStateHistory), segment)
+}
+
+// List mocks base method.
+func (m *MockSegment) List(filter structures.SegmentsFilter) ([]structures.Segment, int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List", filter)
+	ret0, _ := ret[0].([]structures.Segment)
+	ret1, _ := ret[1].(int)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// List indicates an expected call of List.
+func (mr *MockSegmentMockRecorder) List(filter interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockSegment)(nil).List), filter)
+}
+
+// Rename mocks base method.
+func (m *MockSegment) Rename(rename structures.SegmentRename) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Rename", rename)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Rename indicates an expected call of Rename.
+func (mr *MockSegmentMockRecorder) Rename(rename interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Rename", reflect.TypeOf((*MockSegment)(nil).Rename), rename)
+}
+
+// SetState mocks base method.
+func (m *MockSegment) SetState(change structures.SegmentStateChange) (structures.Segment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetState", change)
+	ret0, _ := ret[0].(structures.Segment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SetState indicates an expected call of SetState.
+func (mr *MockSegmentMockRecorder) SetState(change interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetState", reflect.TypeOf((*MockSegment)(nil).SetState), change)
+}
+
+// Update mocks base method.
+func (m *MockSegment) Update(update structures.SegmentUpdate) (structures.Segment, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Update", update)
+	ret0, _ := ret[0].(structures.Segment)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Update indicates an expected call of Update.
+func (mr *MockSegmentMockRecorder) Update(update interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockSegment)(nil).Update), update)
+}
+
 // MockUserSegments is a mock of UserSegments interface.
 type MockUserSegments struct {
 	ctrl     *gomock.Controller
@@ -102,19 +268,63 @@ func (m *MockUserSegments) EXPECT() *MockUserSegmentsMockRecorder {
 	return m.recorder
 }
 
+// ClosePercentageSegments mocks base method.
+func (m *MockUserSegments) ClosePercentageSegments(user structures.User, segments []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClosePercentageSegments", user, segments)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ClosePercentageSegments indicates an expected call of ClosePercentageSegments.
+func (mr *MockUserSegmentsMockRecorder) ClosePercentageSegments(user, segments interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClosePercentageSegments", reflect.TypeOf((*MockUserSegments)(nil).ClosePercentageSegments), user, segments)
+}
+
 // GetSegmentUsers mocks base method.
-func (m *MockUserSegments) GetSegmentUsers(segment structures.Segment) ([]int, error) {
+func (m *MockUserSegments) GetSegmentUsers(filter structures.SegmentUsersFilter) ([]int, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetSegmentUsers", segment)
+	ret := m.ctrl.Call(m, "GetSegmentUsers", filter)
 	ret0, _ := ret[0].([]int)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetSegmentUsers indicates an expected call of GetSegmentUsers.
-func (mr *MockUserSegmentsMockRecorder) GetSegmentUsers(segment interface{}) *gomock.Call {
+func (mr *MockUserSegmentsMockRecorder) GetSegmentUsers(filter interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSegmentUsers", reflect.TypeOf((*MockUserSegments)(nil).GetSegmentUsers), segment)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSegmentUsers", reflect.TypeOf((*MockUserSegments)(nil).GetSegmentUsers), filter)
+}
+
+// GetUpcomingActivations mocks base method.
+func (m *MockUserSegments) GetUpcomingActivations(filter structures.ActivationsFilter) ([]structures.Activation, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUpcomingActivations", filter)
+	ret0, _ := ret[0].([]structures.Activation)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUpcomingActivations indicates an expected call of GetUpcomingActivations.
+func (mr *MockUserSegmentsMockRecorder) GetUpcomingActivations(filter interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUpcomingActivations", reflect.TypeOf((*MockUserSegments)(nil).GetUpcomingActivations), filter)
+}
+
+// GetUserVariants mocks base method.
+func (m *MockUserSegments) GetUserVariants(user structures.User, segments []string) (map[string]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserVariants", user, segments)
+	ret0, _ := ret[0].(map[string]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserVariants indicates an expected call of GetUserVariants.
+func (mr *MockUserSegmentsMockRecorder) GetUserVariants(user, segments interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserVariants", reflect.TypeOf((*MockUserSegments)(nil).GetUserVariants), user, segments)
 }
 
 // GetUsersInSegment mocks base method.
@@ -133,10 +343,10 @@ func (mr *MockUserSegmentsMockRecorder) GetUsersInSegment(user interface{}) *gom
 }
 
 // Patch mocks base method.
-func (m *MockUserSegments) Patch(userSegments structures.UserSegments) (int, error) {
+func (m *MockUserSegments) Patch(userSegments structures.UserSegments) (structures.PatchResult, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "Patch", userSegments)
-	ret0, _ := ret[0].(int)
+	ret0, _ := ret[0].(structures.PatchResult)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
@@ -147,6 +357,35 @@ func (mr *MockUserSegmentsMockRecorder) Patch(userSegments interface{}) *gomock.
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Patch", reflect.TypeOf((*MockUserSegments)(nil).Patch), userSegments)
 }
 
+// RecordPercentageSegments mocks base method.
+func (m *MockUserSegments) RecordPercentageSegments(user structures.User, segments []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecordPercentageSegments", user, segments)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RecordPercentageSegments indicates an expected call of RecordPercentageSegments.
+func (mr *MockUserSegmentsMockRecorder) RecordPercentageSegments(user, segments interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordPercentageSegments", reflect.TypeOf((*MockUserSegments)(nil).RecordPercentageSegments), user, segments)
+}
+
+// SetUserSegments mocks base method.
+func (m *MockUserSegments) SetUserSegments(set structures.UserSegmentsSet) (structures.PatchResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetUserSegments", set)
+	ret0, _ := ret[0].(structures.PatchResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SetUserSegments indicates an expected call of SetUserSegments.
+func (mr *MockUserSegmentsMockRecorder) SetUserSegments(set interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetUserSegments", reflect.TypeOf((*MockUserSegments)(nil).SetUserSegments), set)
+}
+
 // MockUser is a mock of User interface.
 type MockUser struct {
 	ctrl     *gomock.Controller
@@ -198,3 +437,259 @@ func (mr *MockUserMockRecorder) GetUserHistory(userHistory interface{}) *gomock.
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserHistory", reflect.TypeOf((*MockUser)(nil).GetUserHistory), userHistory)
 }
+
+// MockLayer is a mock of Layer interface.
+type MockLayer struct {
+	ctrl     *gomock.Controller
+	recorder *MockLayerMockRecorder
+}
+
+// MockLayerMockRecorder is the mock recorder for MockLayer.
+type MockLayerMockRecorder struct {
+	mock *MockLayer
+}
+
+// NewMockLayer creates a new mock instance.
+func NewMockLayer(ctrl *gomock.Controller) *MockLayer {
+	mock := &MockLayer{ctrl: ctrl}
+	mock.recorder = &MockLayerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockLayer) EXPECT() *MockLayerMockRecorder {
+	return m.recorder
+}
+
+// CreateLayer mocks base method.
+func (m *MockLayer) CreateLayer(layer structures.Layer) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateLayer", layer)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateLayer indicates an expected call of CreateLayer.
+func (mr *MockLayerMockRecorder) CreateLayer(layer interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateLayer", reflect.TypeOf((*MockLayer)(nil).CreateLayer), layer)
+}
+
+// GetLayer mocks base method.
+func (m *MockLayer) GetLayer(layer structures.Layer) (structures.Layer, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetLayer", layer)
+	ret0, _ := ret[0].(structures.Layer)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetLayer indicates an expected call of GetLayer.
+func (mr *MockLayerMockRecorder) GetLayer(layer interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLayer", reflect.TypeOf((*MockLayer)(nil).GetLayer), layer)
+}
+
+// MockRamp is a mock of Ramp interface.
+type MockRamp struct {
+	ctrl     *gomock.Controller
+	recorder *MockRampMockRecorder
+}
+
+// MockRampMockRecorder is the mock recorder for MockRamp.
+type MockRampMockRecorder struct {
+	mock *MockRamp
+}
+
+// NewMockRamp creates a new mock instance.
+func NewMockRamp(ctrl *gomock.Controller) *MockRamp {
+	mock := &MockRamp{ctrl: ctrl}
+	mock.recorder = &MockRampMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockRamp) EXPECT() *MockRampMockRecorder {
+	return m.recorder
+}
+
+// AdvanceRampPlans mocks base method.
+func (m *MockRamp) AdvanceRampPlans() (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AdvanceRampPlans")
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AdvanceRampPlans indicates an expected call of AdvanceRampPlans.
+func (mr *MockRampMockRecorder) AdvanceRampPlans() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AdvanceRampPlans", reflect.TypeOf((*MockRamp)(nil).AdvanceRampPlans))
+}
+
+// CreateRampPlan mocks base method.
+func (m *MockRamp) CreateRampPlan(plan structures.RampPlan) (structures.RampPlan, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateRampPlan", plan)
+	ret0, _ := ret[0].(structures.RampPlan)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateRampPlan indicates an expected call of CreateRampPlan.
+func (mr *MockRampMockRecorder) CreateRampPlan(plan interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateRampPlan", reflect.TypeOf((*MockRamp)(nil).CreateRampPlan), plan)
+}
+
+// GetRampPlan mocks base method.
+func (m *MockRamp) GetRampPlan(segment structures.Segment) (structures.RampPlan, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRampPlan", segment)
+	ret0, _ := ret[0].(structures.RampPlan)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRampPlan indicates an expected call of GetRampPlan.
+func (mr *MockRampMockRecorder) GetRampPlan(segment interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRampPlan", reflect.TypeOf((*MockRamp)(nil).GetRampPlan), segment)
+}
+
+// SetRampPlanStatus mocks base method.
+func (m *MockRamp) SetRampPlanStatus(change structures.RampPlanStatusChange) (structures.RampPlan, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetRampPlanStatus", change)
+	ret0, _ := ret[0].(structures.RampPlan)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SetRampPlanStatus indicates an expected call of SetRampPlanStatus.
+func (mr *MockRampMockRecorder) SetRampPlanStatus(change interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetRampPlanStatus", reflect.TypeOf((*MockRamp)(nil).SetRampPlanStatus), change)
+}
+
+// MockRule is a mock of Rule interface.
+type MockRule struct {
+	ctrl     *gomock.Controller
+	recorder *MockRuleMockRecorder
+}
+
+// MockRuleMockRecorder is the mock recorder for MockRule.
+type MockRuleMockRecorder struct {
+	mock *MockRule
+}
+
+// NewMockRule creates a new mock instance.
+func NewMockRule(ctrl *gomock.Controller) *MockRule {
+	mock := &MockRule{ctrl: ctrl}
+	mock.recorder = &MockRuleMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockRule) EXPECT() *MockRuleMockRecorder {
+	return m.recorder
+}
+
+// CreateRule mocks base method.
+func (m *MockRule) CreateRule(rule structures.Rule) (structures.Rule, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateRule", rule)
+	ret0, _ := ret[0].(structures.Rule)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateRule indicates an expected call of CreateRule.
+func (mr *MockRuleMockRecorder) CreateRule(rule interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateRule", reflect.TypeOf((*MockRule)(nil).CreateRule), rule)
+}
+
+// DeleteRule mocks base method.
+func (m *MockRule) DeleteRule(id int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteRule", id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteRule indicates an expected call of DeleteRule.
+func (mr *MockRuleMockRecorder) DeleteRule(id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteRule", reflect.TypeOf((*MockRule)(nil).DeleteRule), id)
+}
+
+// GetRules mocks base method.
+func (m *MockRule) GetRules() ([]structures.Rule, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRules")
+	ret0, _ := ret[0].([]structures.Rule)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRules indicates an expected call of GetRules.
+func (mr *MockRuleMockRecorder) GetRules() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRules", reflect.TypeOf((*MockRule)(nil).GetRules))
+}
+
+// MockChangeSet is a mock of ChangeSet interface.
+type MockChangeSet struct {
+	ctrl     *gomock.Controller
+	recorder *MockChangeSetMockRecorder
+}
+
+// MockChangeSetMockRecorder is the mock recorder for MockChangeSet.
+type MockChangeSetMockRecorder struct {
+	mock *MockChangeSet
+}
+
+// NewMockChangeSet creates a new mock instance.
+func NewMockChangeSet(ctrl *gomock.Controller) *MockChangeSet {
+	mock := &MockChangeSet{ctrl: ctrl}
+	mock.recorder = &MockChangeSetMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockChangeSet) EXPECT() *MockChangeSetMockRecorder {
+	return m.recorder
+}
+
+// GetChangeSet mocks base method.
+func (m *MockChangeSet) GetChangeSet(id int) (structures.ChangeSet, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetChangeSet", id)
+	ret0, _ := ret[0].(structures.ChangeSet)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetChangeSet indicates an expected call of GetChangeSet.
+func (mr *MockChangeSetMockRecorder) GetChangeSet(id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetChangeSet", reflect.TypeOf((*MockChangeSet)(nil).GetChangeSet), id)
+}
+
+// RevertChangeSet mocks base method.
+func (m *MockChangeSet) RevertChangeSet(id int) (structures.ChangeSet, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevertChangeSet", id)
+	ret0, _ := ret[0].(structures.ChangeSet)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RevertChangeSet indicates an expected call of RevertChangeSet.
+func (mr *MockChangeSetMockRecorder) RevertChangeSet(id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevertChangeSet", reflect.TypeOf((*MockChangeSet)(nil).RevertChangeSet), id)
+}
@@ -0,0 +1,30 @@
+package service
+
+import (
+	"avito/pkg/repository"
+	"avito/pkg/structures"
+)
+
+type RampService struct {
+	repo repository.Ramp
+}
+
+func NewRampService(repo repository.Ramp) *RampService {
+	return &RampService{repo: repo}
+}
+
+func (s *RampService) CreateRampPlan(plan structures.RampPlan) (structures.RampPlan, error) {
+	return s.repo.CreateRampPlan(plan)
+}
+
+func (s *RampService) GetRampPlan(segment structures.Segment) (structures.RampPlan, error) {
+	return s.repo.GetRampPlan(segment)
+}
+
+func (s *RampService) SetRampPlanStatus(change structures.RampPlanStatusChange) (structures.RampPlan, error) {
+	return s.repo.SetRampPlanStatus(change)
+}
+
+func (s *RampService) AdvanceRampPlans() (int, error) {
+	return s.repo.AdvanceRampPlans()
+}
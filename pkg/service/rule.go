@@ -0,0 +1,26 @@
+package service
+
+import (
+	"avito/pkg/repository"
+	"avito/pkg/structures"
+)
+
+type RuleService struct {
+	repo repository.Rule
+}
+
+func NewRuleService(repo repository.Rule) *RuleService {
+	return &RuleService{repo: repo}
+}
+
+func (s *RuleService) CreateRule(rule structures.Rule) (structures.Rule, error) {
+	return s.repo.CreateRule(rule)
+}
+
+func (s *RuleService) GetRules() ([]structures.Rule, error) {
+	return s.repo.GetRules()
+}
+
+func (s *RuleService) DeleteRule(id int) error {
+	return s.repo.DeleteRule(id)
+}
@@ -17,10 +17,54 @@ func (s *SegmentService) Create(segment structures.Segment) (string, error) {
 	return s.repo.Create(segment)
 }
 
-func (s *SegmentService) Delete(segment structures.Segment) (string, error) {
-	return s.repo.Delete(segment)
+func (s *SegmentService) Delete(segment structures.Segment, children string) (structures.SegmentDeletion, error) {
+	return s.repo.Delete(segment, children)
 }
 
-func (s *SegmentService) GetPercentageSegments() (map[string]int, error) {
+func (s *SegmentService) DeleteDryRun(segment structures.Segment, children string) (structures.SegmentDeletion, error) {
+	return s.repo.DeleteDryRun(segment, children)
+}
+
+func (s *SegmentService) GetPercentageSegments() ([]structures.Segment, error) {
 	return s.repo.GetPercentageSegments()
 }
+
+func (s *SegmentService) GetCompositeSegments() ([]structures.Segment, error) {
+	return s.repo.GetCompositeSegments()
+}
+
+func (s *SegmentService) Get(segment structures.Segment) (structures.Segment, error) {
+	return s.repo.Get(segment)
+}
+
+func (s *SegmentService) List(filter structures.SegmentsFilter) ([]structures.Segment, int, error) {
+	return s.repo.List(filter)
+}
+
+func (s *SegmentService) Clone(clone structures.SegmentClone) (structures.SegmentCloneResult, error) {
+	return s.repo.Clone(clone)
+}
+
+func (s *SegmentService) Rename(rename structures.SegmentRename) (string, error) {
+	return s.repo.Rename(rename)
+}
+
+func (s *SegmentService) Update(update structures.SegmentUpdate) (structures.Segment, error) {
+	return s.repo.Update(update)
+}
+
+func (s *SegmentService) SetState(change structures.SegmentStateChange) (structures.Segment, error) {
+	return s.repo.SetState(change)
+}
+
+func (s *SegmentService) GetStateHistory(segment structures.Segment) ([]structures.SegmentStateTransition, error) {
+	return s.repo.GetStateHistory(segment)
+}
+
+func (s *SegmentService) GetImpliedSegments(slugs []string) ([]string, error) {
+	return s.repo.GetImpliedSegments(slugs)
+}
+
+func (s *SegmentService) GetSegmentLayers(slugs []string) ([]string, error) {
+	return s.repo.GetSegmentLayers(slugs)
+}
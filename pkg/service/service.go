@@ -9,14 +9,30 @@ import (
 
 type Segment interface {
 	Create(segment structures.Segment) (string, error)
-	Delete(segment structures.Segment) (string, error)
-	GetPercentageSegments() (map[string]int, error)
+	Delete(segment structures.Segment, children string) (structures.SegmentDeletion, error)
+	DeleteDryRun(segment structures.Segment, children string) (structures.SegmentDeletion, error)
+	GetPercentageSegments() ([]structures.Segment, error)
+	GetCompositeSegments() ([]structures.Segment, error)
+	Get(segment structures.Segment) (structures.Segment, error)
+	List(filter structures.SegmentsFilter) ([]structures.Segment, int, error)
+	Rename(rename structures.SegmentRename) (string, error)
+	Clone(clone structures.SegmentClone) (structures.SegmentCloneResult, error)
+	Update(update structures.SegmentUpdate) (structures.Segment, error)
+	SetState(change structures.SegmentStateChange) (structures.Segment, error)
+	GetStateHistory(segment structures.Segment) ([]structures.SegmentStateTransition, error)
+	GetImpliedSegments(slugs []string) ([]string, error)
+	GetSegmentLayers(slugs []string) ([]string, error)
 }
 
 type UserSegments interface {
-	Patch(userSegments structures.UserSegments) (int, error)
+	Patch(userSegments structures.UserSegments) (structures.PatchResult, error)
+	SetUserSegments(set structures.UserSegmentsSet) (structures.PatchResult, error)
 	GetUsersInSegment(user structures.User) ([]string, error)
-	GetSegmentUsers(segment structures.Segment) ([]int, error)
+	GetSegmentUsers(filter structures.SegmentUsersFilter) ([]int, error)
+	RecordPercentageSegments(user structures.User, segments []string) error
+	ClosePercentageSegments(user structures.User, segments []string) error
+	GetUserVariants(user structures.User, segments []string) (map[string]string, error)
+	GetUpcomingActivations(filter structures.ActivationsFilter) ([]structures.Activation, error)
 }
 
 type User interface {
@@ -24,10 +40,37 @@ type User interface {
 	DeleteExpiredSegments() error
 }
 
+type Layer interface {
+	CreateLayer(layer structures.Layer) (string, error)
+	GetLayer(layer structures.Layer) (structures.Layer, error)
+}
+
+type Ramp interface {
+	CreateRampPlan(plan structures.RampPlan) (structures.RampPlan, error)
+	GetRampPlan(segment structures.Segment) (structures.RampPlan, error)
+	SetRampPlanStatus(change structures.RampPlanStatusChange) (structures.RampPlan, error)
+	AdvanceRampPlans() (int, error)
+}
+
+type Rule interface {
+	CreateRule(rule structures.Rule) (structures.Rule, error)
+	GetRules() ([]structures.Rule, error)
+	DeleteRule(id int) error
+}
+
+type ChangeSet interface {
+	GetChangeSet(id int) (structures.ChangeSet, error)
+	RevertChangeSet(id int) (structures.ChangeSet, error)
+}
+
 type Service struct {
 	Segment
 	UserSegments
 	User
+	Layer
+	Ramp
+	ChangeSet
+	Rule
 }
 
 func NewService(repos *repository.Repository) *Service {
@@ -35,5 +78,9 @@ func NewService(repos *repository.Repository) *Service {
 		Segment:      NewSegmentService(repos.Segment),
 		UserSegments: NewUserSegmentsService(repos.UserSegments),
 		User:         NewUserService(repos.User),
+		Layer:        NewLayerService(repos.Layer),
+		Ramp:         NewRampService(repos.Ramp),
+		ChangeSet:    NewChangeSetService(repos.ChangeSet),
+		Rule:         NewRuleService(repos.Rule),
 	}
 }
@@ -13,14 +13,34 @@ func NewUserSegmentsService(repo repository.UserSegments) *UserSegmentsService {
 	return &UserSegmentsService{repo: repo}
 }
 
-func (s *UserSegmentsService) Patch(userSegments structures.UserSegments) (int, error) {
+func (s *UserSegmentsService) Patch(userSegments structures.UserSegments) (structures.PatchResult, error) {
 	return s.repo.Patch(userSegments)
 }
 
+func (s *UserSegmentsService) SetUserSegments(set structures.UserSegmentsSet) (structures.PatchResult, error) {
+	return s.repo.SetUserSegments(set)
+}
+
 func (s *UserSegmentsService) GetUsersInSegment(user structures.User) ([]string, error) {
 	return s.repo.GetUserSegments(user)
 }
 
-func (s *UserSegmentsService) GetSegmentUsers(segment structures.Segment) ([]int, error) {
-	return s.repo.GetSegmentUsers(segment)
+func (s *UserSegmentsService) GetSegmentUsers(filter structures.SegmentUsersFilter) ([]int, error) {
+	return s.repo.GetSegmentUsers(filter)
+}
+
+func (s *UserSegmentsService) RecordPercentageSegments(user structures.User, segments []string) error {
+	return s.repo.RecordPercentageSegments(user, segments)
+}
+
+func (s *UserSegmentsService) ClosePercentageSegments(user structures.User, segments []string) error {
+	return s.repo.ClosePercentageSegments(user, segments)
+}
+
+func (s *UserSegmentsService) GetUserVariants(user structures.User, segments []string) (map[string]string, error) {
+	return s.repo.GetUserVariants(user, segments)
+}
+
+func (s *UserSegmentsService) GetUpcomingActivations(filter structures.ActivationsFilter) ([]structures.Activation, error) {
+	return s.repo.GetUpcomingActivations(filter)
 }
@@ -0,0 +1,15 @@
+package structures
+
+import "time"
+
+// ChangeSet groups the history entries written by one mutation of memberships, so it can be inspected and reverted.
+type ChangeSet struct {
+	Id         int       `json:"id"`
+	Kind       string    `json:"kind" example:"patch"`
+	CreatedAt  time.Time `json:"created_at"`
+	RevertedBy *int      `json:"reverted_by,omitempty"`
+	// Irreversible marks a change set that also made changes history does not record,
+	// such as new expirations or delayed adds, so it cannot be reverted.
+	Irreversible bool           `json:"irreversible,omitempty"`
+	Entries      []HistoryEntry `json:"entries"`
+}
@@ -0,0 +1,91 @@
+package structures
+
+import "fmt"
+
+type SegmentNotFoundError struct {
+	Slug string
+}
+
+func (e SegmentNotFoundError) Error() string {
+	return fmt.Sprintf("segment with slug %s does not exist", e.Slug)
+}
+
+type LayerNotFoundError struct {
+	Slug string
+}
+
+func (e LayerNotFoundError) Error() string {
+	return fmt.Sprintf("layer with slug %s does not exist", e.Slug)
+}
+
+type SegmentArchivedError struct {
+	Slug string
+}
+
+func (e SegmentArchivedError) Error() string {
+	return fmt.Sprintf("segment with slug %s is archived", e.Slug)
+}
+
+type RampPlanNotFoundError struct {
+	Slug string
+}
+
+func (e RampPlanNotFoundError) Error() string {
+	return fmt.Sprintf("segment with slug %s has no ramp plan", e.Slug)
+}
+
+type SegmentFullError struct {
+	Slug       string
+	MaxMembers int
+}
+
+func (e SegmentFullError) Error() string {
+	return fmt.Sprintf("segment with slug %s is full, it is limited to %d members", e.Slug, e.MaxMembers)
+}
+
+type ValidationError struct {
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return e.Message
+}
+
+type ChangeSetNotFoundError struct {
+	Id int
+}
+
+func (e ChangeSetNotFoundError) Error() string {
+	return fmt.Sprintf("change set %d does not exist", e.Id)
+}
+
+// ChangeSetConflictError is returned when a change set cannot be reverted
+// because the memberships it touched have changed since.
+type ChangeSetConflictError struct {
+	Id      int
+	UserId  int
+	Segment string
+}
+
+func (e ChangeSetConflictError) Error() string {
+	return fmt.Sprintf("change set %d cannot be reverted, segment %s of user %d changed since", e.Id, e.Segment, e.UserId)
+}
+
+type RuleNotFoundError struct {
+	Id int
+}
+
+func (e RuleNotFoundError) Error() string {
+	return fmt.Sprintf("rule %d does not exist", e.Id)
+}
+
+// RuleViolationError is returned when a change would leave the user in segments that break the rule.
+type RuleViolationError struct {
+	Rule    int
+	UserId  int
+	Message string
+}
+
+func (e RuleViolationError) Error() string {
+	return fmt.Sprintf("user %d breaks rule %d: %s", e.UserId, e.Rule, e.Message)
+}
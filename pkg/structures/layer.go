@@ -0,0 +1,20 @@
+package structures
+
+import "time"
+
+type Layer struct {
+	Id          int        `json:"id,omitempty"`
+	Slug        string     `json:"slug" binding:"required" example:"checkout-experiments"`
+	Description *string    `json:"description"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+
+	Segments        []LayerSegment `json:"segments"`
+	FreeBasisPoints int            `json:"free_basis_points" example:"8750"`
+}
+
+// LayerSegment is the range of layer buckets [Offset, Offset+Width) taken by a segment.
+type LayerSegment struct {
+	Slug   string `json:"slug"`
+	Offset int    `json:"offset" example:"0"`
+	Width  int    `json:"width" example:"1250"`
+}
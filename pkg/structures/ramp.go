@@ -0,0 +1,25 @@
+package structures
+
+import "time"
+
+// RampPlan raises the rollout of a segment step by step, the offsets of the steps count from the creation of the plan.
+type RampPlan struct {
+	Id         int        `json:"id,omitempty"`
+	Segment    string     `json:"slug"`
+	Status     string     `json:"status,omitempty"`
+	Steps      []RampStep `json:"steps" binding:"required"`
+	NextStepAt *time.Time `json:"next_step_at,omitempty"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+}
+
+// RampStep sets the percentage of the segment once its offset has passed, an empty offset applies the step at once.
+type RampStep struct {
+	Percentage int        `json:"percentage" example:"5"`
+	After      string     `json:"after" example:"24h"`
+	AppliedAt  *time.Time `json:"applied_at,omitempty"`
+}
+
+type RampPlanStatusChange struct {
+	Segment string
+	Status  string
+}
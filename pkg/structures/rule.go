@@ -0,0 +1,15 @@
+package structures
+
+import "time"
+
+// Rule constrains the explicit segments of a user. A requires rule allows Segment only along with Other,
+// an excludes rule never allows both, a max_tagged rule allows at most MaxSegments segments tagged Tag.
+type Rule struct {
+	Id          int        `json:"id,omitempty"`
+	Kind        string     `json:"kind" binding:"required" example:"requires"`
+	Segment     *string    `json:"segment,omitempty" example:"AVITO_DISCOUNT_50"`
+	Other       *string    `json:"other,omitempty" example:"AVITO_DISCOUNT_30"`
+	Tag         *string    `json:"tag,omitempty" example:"discount"`
+	MaxSegments *int       `json:"max_segments,omitempty" example:"2"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+}
@@ -0,0 +1,22 @@
+package structures
+
+import "time"
+
+// SegmentSchedule is a weekly schedule of a segment, the segment is active only within its intervals.
+type SegmentSchedule struct {
+	Timezone  string             `json:"timezone" example:"Europe/Moscow"`
+	Intervals []ScheduleInterval `json:"intervals"`
+}
+
+// ScheduleInterval is active on the days from start to end, an end before the start
+// crosses midnight and an end of 24:00 lasts until midnight.
+type ScheduleInterval struct {
+	Days  []string `json:"days" example:"mon,tue,wed,thu,fri"`
+	Start string   `json:"start" example:"18:00"`
+	End   string   `json:"end" example:"23:00"`
+}
+
+type ActivityInterval struct {
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+}
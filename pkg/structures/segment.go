@@ -1,6 +1,176 @@
 package structures
 
+import "time"
+
 type Segment struct {
-	Slug       string `json:"slug" binding:"required"`
-	Percentage *int   `json:"percentage"`
+	Id          int     `json:"id,omitempty"`
+	Slug        string  `json:"slug" binding:"required"`
+	Percentage  *int    `json:"percentage"`
+	DisplayName *string `json:"display_name" example:"Voice messages"`
+	Description *string `json:"description"`
+	Owner       *string `json:"owner" example:"messenger-team"`
+
+	BucketingVersion int     `json:"bucketing_version,omitempty" example:"2"`
+	Salt             *string `json:"salt,omitempty"`
+	HashFunction     *string `json:"hash_function,omitempty" example:"murmur3"`
+	BasisPoints      *int    `json:"basis_points,omitempty" example:"1250"`
+
+	Layer       *string `json:"layer,omitempty" example:"checkout-experiments"`
+	LayerOffset *int    `json:"layer_offset,omitempty" example:"0"`
+
+	Variants []SegmentVariant `json:"variants,omitempty"`
+
+	// Tags group segments for the rules that limit how many of them a user may be in.
+	Tags []string `json:"tags,omitempty" example:"discount"`
+
+	// Parent is implied for every member of the segment, Children are reported in the details of the segment.
+	Parent   *string  `json:"parent,omitempty" example:"AVITO_DISCOUNTS"`
+	Children []string `json:"children,omitempty"`
+
+	// Expression makes the segment composite: its members are the users for whom the expression
+	// over other segments holds, such as premium AND NOT churn_risk, rather than explicit ones.
+	Expression *string `json:"expression,omitempty" example:"premium AND NOT churn_risk"`
+
+	// Targeting narrows the percentage rollout to users whose attributes, passed when their segments are read,
+	// match the rule, such as city in ["Moscow", "SPb"] && semver(app_version) >= "7.0".
+	Targeting *string `json:"targeting,omitempty" example:"city in [\"Moscow\", \"SPb\"] && semver(app_version) >= \"7.0\""`
+	// TargetingRule is Targeting parsed when percentage segments are loaded, so reads match it without parsing it again.
+	TargetingRule TargetingRule `json:"-"`
+
+	// State is draft or active on creation, active by default.
+	State string `json:"state,omitempty" example:"active"`
+
+	// StartsAt and EndsAt limit the segment to a window, outside of it nobody gets the segment.
+	StartsAt *time.Time `json:"starts_at,omitempty" example:"2023-09-01T00:00:00+03:00"`
+	EndsAt   *time.Time `json:"ends_at,omitempty" example:"2023-09-15T00:00:00+03:00"`
+
+	// Schedule limits the segment to recurring weekly intervals within its window.
+	Schedule *SegmentSchedule `json:"schedule,omitempty"`
+
+	// MaxMembers caps the number of users added to the segment, Members is reported in the details of the segment.
+	MaxMembers *int `json:"max_members,omitempty" example:"1000"`
+	Members    *int `json:"members,omitempty" example:"250"`
+
+	// DefaultTTL is the membership duration applied when a user is added without an expiration,
+	// MaxTTL is the longest allowed one. Both are durations such as 12h or 14d.
+	DefaultTTL *string `json:"default_ttl,omitempty" example:"14d"`
+	MaxTTL     *string `json:"max_ttl,omitempty" example:"30d"`
+
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+type SegmentUpdate struct {
+	Slug        string  `json:"-"`
+	Percentage  *int    `json:"percentage" example:"30"`
+	DisplayName *string `json:"display_name"`
+	Description *string `json:"description"`
+	Owner       *string `json:"owner"`
+
+	BucketingVersion *int    `json:"bucketing_version" example:"2"`
+	Salt             *string `json:"salt"`
+	HashFunction     *string `json:"hash_function" example:"murmur3"`
+	BasisPoints      *int    `json:"basis_points" example:"1250"`
+
+	// Layer moves the segment to another layer, an empty string detaches it.
+	Layer *string `json:"layer" example:"checkout-experiments"`
+
+	// Variants replaces the variants of the segment, an empty list removes them.
+	Variants *[]SegmentVariant `json:"variants"`
+
+	// Tags replaces the tags of the segment, an empty list removes them.
+	Tags *[]string `json:"tags" example:"discount"`
+
+	// Parent moves the segment under another one, an empty string detaches it.
+	Parent *string `json:"parent" example:"AVITO_DISCOUNTS"`
+
+	// Expression replaces the expression of the segment, an empty string makes it a regular segment.
+	Expression *string `json:"expression" example:"(beta OR staff) AND android_new_ui"`
+
+	// Targeting replaces the targeting rule of the segment, an empty string removes it.
+	Targeting *string `json:"targeting" example:"semver(app_version) >= \"7.0\""`
+
+	StartsAt *time.Time `json:"starts_at" example:"2023-09-01T00:00:00+03:00"`
+	EndsAt   *time.Time `json:"ends_at" example:"2023-09-15T00:00:00+03:00"`
+
+	// ClearStartsAt and ClearEndsAt remove the bounds of the window, a null starts_at or ends_at leaves them unchanged.
+	ClearStartsAt bool `json:"clear_starts_at"`
+	ClearEndsAt   bool `json:"clear_ends_at"`
+
+	// Schedule replaces the schedule of the segment, a schedule without intervals removes it.
+	Schedule *SegmentSchedule `json:"schedule"`
+
+	// MaxMembers replaces the cap on the members of the segment, 0 removes it.
+	MaxMembers *int `json:"max_members" example:"1000"`
+
+	// DefaultTTL and MaxTTL replace the membership durations of the segment, an empty string removes them.
+	DefaultTTL *string `json:"default_ttl" example:"14d"`
+	MaxTTL     *string `json:"max_ttl" example:"30d"`
+}
+
+type SegmentsFilter struct {
+	Limit  int     `form:"limit" example:"20"`
+	Offset int     `form:"offset" example:"0"`
+	Owner  *string `form:"owner"`
+	Search *string `form:"search"`
+
+	// State lists the segments in the state, archived segments are listed only this way.
+	State *string `form:"state" example:"paused"`
+}
+
+// SegmentUsersFilter selects the explicit members of the segment, along with the members of its descendants if asked.
+type SegmentUsersFilter struct {
+	Slug               string `form:"-"`
+	IncludeDescendants bool   `form:"include_descendants"`
+}
+
+type SegmentRename struct {
+	Slug    string `json:"-"`
+	NewSlug string `json:"new_slug" binding:"required" example:"AVITO_VOICE_MESSAGES_V2"`
+}
+
+// SegmentClone creates NewSlug with the settings of the segment, optionally along with its explicit members,
+// with or without their expirations.
+type SegmentClone struct {
+	Slug            string `json:"-"`
+	NewSlug         string `json:"new_slug" binding:"required" example:"AVITO_VOICE_MESSAGES_V2"`
+	CopyMembers     bool   `json:"copy_members"`
+	CopyExpirations bool   `json:"copy_expirations"`
+}
+
+type SegmentCloneResult struct {
+	Slug      string `json:"slug"`
+	Source    string `json:"source"`
+	Members   int    `json:"members"`
+	ChangeSet *int   `json:"change_set,omitempty"`
+}
+
+type SegmentStateChange struct {
+	Slug    string  `json:"-"`
+	State   string  `json:"state" binding:"required" example:"paused"`
+	Comment *string `json:"comment" example:"incident INC-123"`
+}
+
+type SegmentStateTransition struct {
+	From      string    `json:"from" example:"active"`
+	To        string    `json:"to" example:"paused"`
+	Comment   *string   `json:"comment,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// SegmentDeletion reports what deleting the segment removes, a dry run returns it without deleting anything.
+type SegmentDeletion struct {
+	Slug            string         `json:"slug"`
+	ChangeSet       *int           `json:"change_set,omitempty"`
+	Children        []string       `json:"children,omitempty"`
+	DryRun          bool           `json:"dry_run"`
+	AffectedUsers   int            `json:"affected_users"`
+	Users           []int          `json:"users"`
+	PercentageUsers []int          `json:"percentage_users"`
+	History         []HistoryEntry `json:"history"`
+}
+
+// TargetingRule is a parsed targeting rule, matched against the attributes passed when the segments of a user are read.
+type TargetingRule interface {
+	Match(ctx map[string]string) bool
 }
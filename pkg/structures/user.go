@@ -1,5 +1,7 @@
 package structures
 
+import "time"
+
 type User struct {
 	Id int `json:"user_id" binding:"required"`
 }
@@ -8,3 +10,14 @@ type UserHistory struct {
 	Id        int    `json:"user_id" binding:"required"`
 	YearMonth string `json:"year_month" binding:"required" example:"YYYY-MM"`
 }
+
+// HistoryEntry is a row of the user segments history, reported by dry runs and change sets.
+// ExpiresAt is the expiration the membership had, a revert restores it.
+type HistoryEntry struct {
+	UserId    int        `json:"user_id"`
+	Segment   string     `json:"slug"`
+	Operation string     `json:"operation" example:"add"`
+	Reason    string     `json:"reason" example:"manual"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	At        *time.Time `json:"at,omitempty"`
+}
@@ -1,8 +1,95 @@
 package structures
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type UserSegments struct {
-	UserId                  int      `json:"user_id" binding:"required"`
-	SegmentsToAdd           []string `json:"segments_to_add" binding:"required"`
-	SegmentsToAddExpiration *string  `json:"segments_to_add_expiration" example:"2023-08-30 12:00:00"`
-	SegmentsToDelete        []string `json:"segments_to_delete" binding:"required"`
+	UserId        int            `json:"user_id" binding:"required"`
+	SegmentsToAdd []SegmentToAdd `json:"segments_to_add" binding:"required"`
+
+	// SegmentsToAddExpiration is an RFC 3339 timestamp, the naive 2006-01-02 15:04:05 is read in the time zone of the server.
+	// TTL sets the expiration relative to the request instead. Both apply to the segments without their own expiration.
+	SegmentsToAddExpiration *string `json:"segments_to_add_expiration" example:"2023-08-30T12:00:00+03:00"`
+	TTL                     *string `json:"ttl" example:"72h"`
+
+	SegmentsToDelete []string `json:"segments_to_delete" binding:"required"`
+
+	// Mode is strict by default. In the upsert mode a segment the user already has gets the expiration of the request,
+	// which extends or clears it, and a segment to delete the user lacks is skipped.
+	Mode string `json:"mode" example:"upsert"`
+
+	// DryRun validates and applies the patch in a transaction that is rolled back, reporting what it would change.
+	DryRun bool `json:"-"`
+}
+
+// SlugsToAdd returns the slugs of the segments to add.
+func (u UserSegments) SlugsToAdd() []string {
+	slugs := make([]string, 0, len(u.SegmentsToAdd))
+	for _, segment := range u.SegmentsToAdd {
+		slugs = append(slugs, segment.Slug)
+	}
+	return slugs
+}
+
+// UserSegmentsSet is the complete set of explicit segments of the user, the segments missing from it are removed.
+type UserSegmentsSet struct {
+	UserId   int            `json:"-"`
+	Segments []SegmentToAdd `json:"segments" binding:"required"`
+}
+
+// Slugs returns the slugs of the segments of the set.
+func (u UserSegmentsSet) Slugs() []string {
+	slugs := make([]string, 0, len(u.Segments))
+	for _, segment := range u.Segments {
+		slugs = append(slugs, segment.Slug)
+	}
+	return slugs
+}
+
+// SegmentToAdd is a segment to add with its own expiration, in JSON it is either an object or just the slug.
+// A new membership with ActiveFrom in the future stays hidden until then, and its ttl counts from that moment.
+type SegmentToAdd struct {
+	Slug       string  `json:"slug" example:"AVITO_VOICE_MESSAGES"`
+	ExpiresAt  *string `json:"expires_at" example:"2023-08-30T12:00:00+03:00"`
+	TTL        *string `json:"ttl" example:"72h"`
+	ActiveFrom *string `json:"active_from" example:"2023-08-28T10:00:00+03:00"`
+}
+
+func (s *SegmentToAdd) UnmarshalJSON(data []byte) error {
+	var slug string
+	if err := json.Unmarshal(data, &slug); err == nil {
+		*s = SegmentToAdd{Slug: slug}
+		return nil
+	}
+
+	type segmentToAdd SegmentToAdd
+	return json.Unmarshal(data, (*segmentToAdd)(s))
+}
+
+// PatchResult echoes the resolved expirations of the added segments, segments added without one are left out.
+// In the upsert mode and in a dry run Changes reports what happened to each segment of the patch.
+// ActiveFrom lists the added memberships that become active later, History the rows a dry run would write.
+type PatchResult struct {
+	UserId      int                  `json:"user_id"`
+	Expirations map[string]time.Time `json:"expirations,omitempty"`
+	ActiveFrom  map[string]time.Time `json:"active_from,omitempty"`
+	Changes     map[string]string    `json:"changes,omitempty"`
+	ChangeSet   *int                 `json:"change_set,omitempty"`
+	DryRun      bool                 `json:"dry_run,omitempty"`
+	History     []HistoryEntry       `json:"history,omitempty"`
+}
+
+// Activation is an upcoming activation of a membership added with active_from.
+type Activation struct {
+	UserId     int        `json:"user_id"`
+	Segment    string     `json:"slug"`
+	ActiveFrom time.Time  `json:"active_from"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+type ActivationsFilter struct {
+	UserId  *int    `form:"user_id"`
+	Segment *string `form:"segment"`
 }
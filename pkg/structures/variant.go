@@ -0,0 +1,6 @@
+package structures
+
+type SegmentVariant struct {
+	Name   string `json:"name" example:"control"`
+	Weight int    `json:"weight" example:"50"`
+}
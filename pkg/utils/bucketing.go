@@ -0,0 +1,230 @@
+package utils
+
+import (
+	"avito/pkg/structures"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+)
+
+const (
+	BucketingV1 = 1
+	BucketingV2 = 2
+
+	// Buckets is the number of buckets of bucketing v2, one bucket is one basis point (0.01%).
+	Buckets = 10000
+)
+
+const (
+	HashMurmur3 = "murmur3"
+	HashXXHash  = "xxhash"
+)
+
+// InRollout reports whether the user falls into the rollout of the segment.
+//
+// v1 is Probability over the salt (the slug unless set) and the percentage.
+// v2 puts the user into bucket Hash(salt + ":" + user_id) mod 10000
+// and checks it against the basis points of the segment.
+// A segment in a layer checks the layer bucket of the user against its range of the layer instead.
+func InRollout(segment structures.Segment, userId int64) bool {
+	if segment.Layer != nil {
+		if segment.LayerOffset == nil {
+			return false
+		}
+		bucket := LayerBucket(*segment.Layer, userId)
+		return *segment.LayerOffset <= bucket && bucket < *segment.LayerOffset+RolloutWidth(segment)
+	}
+
+	salt := segment.Slug
+	if segment.Salt != nil {
+		salt = *segment.Salt
+	}
+
+	if segment.BucketingVersion != BucketingV2 {
+		if segment.Percentage == nil {
+			return false
+		}
+		return Probability(salt, userId, *segment.Percentage)
+	}
+
+	if segment.BasisPoints == nil || segment.HashFunction == nil {
+		return false
+	}
+
+	bucket, err := Bucket(*segment.HashFunction, salt, userId)
+	if err != nil {
+		return false
+	}
+
+	return bucket < *segment.BasisPoints
+}
+
+// Bucket returns the v2 bucket of the user in [0, Buckets).
+func Bucket(hashFunction string, salt string, userId int64) (int, error) {
+	hash, err := Hash(hashFunction, []byte(salt+":"+strconv.FormatInt(userId, 10)))
+	if err != nil {
+		return -1, err
+	}
+
+	return int(hash % Buckets), nil
+}
+
+// Hash returns MurmurHash3 x86_32 or XXH64 of the data, both with seed 0.
+func Hash(hashFunction string, data []byte) (uint64, error) {
+	switch hashFunction {
+	case HashMurmur3:
+		return uint64(murmur3(data)), nil
+	case HashXXHash:
+		return xxhash64(data), nil
+	default:
+		return 0, fmt.Errorf("unknown hash function %s", hashFunction)
+	}
+}
+
+func ValidateHashFunction(hashFunction string) error {
+	_, err := Hash(hashFunction, nil)
+	return err
+}
+
+// ValidateRollout checks that the rollout settings of the segment fit its bucketing version.
+func ValidateRollout(segment structures.Segment) error {
+	switch segment.BucketingVersion {
+	case 0, BucketingV1:
+		if segment.BasisPoints != nil {
+			return errors.New("basis points require bucketing version 2")
+		}
+		if segment.HashFunction != nil {
+			return errors.New("hash function requires bucketing version 2")
+		}
+	case BucketingV2:
+		if segment.Percentage != nil {
+			return errors.New("percentage is not supported by bucketing version 2, use basis points")
+		}
+		if segment.BasisPoints != nil && (0 > *segment.BasisPoints || *segment.BasisPoints > Buckets) {
+			return errors.New("invalid basis points")
+		}
+		if segment.HashFunction != nil {
+			return ValidateHashFunction(*segment.HashFunction)
+		}
+	default:
+		return errors.New("invalid bucketing version")
+	}
+	return nil
+}
+
+func murmur3(data []byte) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+
+	var h uint32
+	tail := len(data) - len(data)%4
+	for i := 0; i < tail; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+
+	var k uint32
+	switch len(data) & 3 {
+	case 3:
+		k ^= uint32(data[tail+2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(data[tail+1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(data[tail])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return h
+}
+
+var (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func xxhash64(data []byte) uint64 {
+	n := len(data)
+	var h uint64
+
+	if n >= 32 {
+		v1 := xxPrime1 + xxPrime2
+		v2 := xxPrime2
+		v3 := uint64(0)
+		v4 := -xxPrime1
+		for len(data) >= 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(data[0:]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(data[8:]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(data[16:]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(data[24:]))
+			data = data[32:]
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = xxPrime5
+	}
+
+	h += uint64(n)
+
+	for ; len(data) >= 8; data = data[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(data))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(data) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(data)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		data = data[4:]
+	}
+	for _, b := range data {
+		h ^= uint64(b) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	val = xxRound(0, val)
+	acc ^= val
+	return acc*xxPrime1 + xxPrime4
+}
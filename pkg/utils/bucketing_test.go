@@ -0,0 +1,144 @@
+package utils_test
+
+import (
+	"avito/pkg/structures"
+	"avito/pkg/utils"
+	"encoding/json"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHash_KnownAnswers(t *testing.T) {
+	tests := []struct {
+		HashFunction string
+		Input        string
+		Expected     uint64
+	}{
+		{utils.HashMurmur3, "", 0x00000000},
+		{utils.HashMurmur3, "test", 0xba6bd213},
+		{utils.HashMurmur3, "Hello, world!", 0xc0363e43},
+		{utils.HashMurmur3, "The quick brown fox jumps over the lazy dog", 0x2e4ff723},
+		{utils.HashXXHash, "", 0xef46db3751d8e999},
+		{utils.HashXXHash, "test", 0x4fdcca5ddb678139},
+		{utils.HashXXHash, "Hello, world!", 0xf58336a78b6f9476},
+		{utils.HashXXHash, "The quick brown fox jumps over the lazy dog", 0x0b242d361fda71bc},
+	}
+
+	for _, testCase := range tests {
+		got, err := utils.Hash(testCase.HashFunction, []byte(testCase.Input))
+		assert.NoError(t, err)
+		assert.Equal(t, testCase.Expected, got, "%s(%q)", testCase.HashFunction, testCase.Input)
+	}
+
+	_, err := utils.Hash("md5", []byte("test"))
+	assert.EqualError(t, err, "unknown hash function md5")
+}
+
+// testdata/bucketing_v2_vectors.json is the reference for other services
+// that need to reproduce bucketing v2 assignments.
+func TestBucket_Vectors(t *testing.T) {
+	data, err := os.ReadFile("testdata/bucketing_v2_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var vectors []struct {
+		HashFunction string `json:"hash_function"`
+		Salt         string `json:"salt"`
+		UserId       int64  `json:"user_id"`
+		Input        string `json:"input"`
+		Hash         string `json:"hash"`
+		Bucket       int    `json:"bucket"`
+	}
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, vector := range vectors {
+		hash, err := utils.Hash(vector.HashFunction, []byte(vector.Input))
+		assert.NoError(t, err)
+		assert.Equal(t, vector.Hash, strconv.FormatUint(hash, 10))
+
+		bucket, err := utils.Bucket(vector.HashFunction, vector.Salt, vector.UserId)
+		assert.NoError(t, err)
+		assert.Equal(t, vector.Bucket, bucket, "%s %s", vector.HashFunction, vector.Input)
+	}
+}
+
+func TestBucket_Distribution(t *testing.T) {
+	const users = 100000
+
+	for _, hashFunction := range []string{utils.HashMurmur3, utils.HashXXHash} {
+		inRollout := 0
+		for userId := int64(0); userId < users; userId++ {
+			bucket, err := utils.Bucket(hashFunction, "AVITO_VOICE_MESSAGES", userId)
+			assert.NoError(t, err)
+			if bucket < 1250 {
+				inRollout++
+			}
+		}
+		assert.InDelta(t, 0.125, float64(inRollout)/users, 0.005, hashFunction)
+	}
+}
+
+func TestInRollout(t *testing.T) {
+	percentage := 50
+	basisPoints := 5000
+	noBasisPoints := 0
+	salt := "reshuffled"
+	murmur3 := utils.HashMurmur3
+
+	v1 := structures.Segment{Slug: "example", Percentage: &percentage}
+	v1Salted := structures.Segment{Slug: "renamed", Percentage: &percentage, Salt: &v1.Slug}
+	v2 := structures.Segment{Slug: "example", BucketingVersion: utils.BucketingV2, BasisPoints: &basisPoints, HashFunction: &murmur3, Salt: &salt}
+	v2Empty := structures.Segment{Slug: "example", BucketingVersion: utils.BucketingV2, BasisPoints: &noBasisPoints, HashFunction: &murmur3, Salt: &salt}
+
+	for userId := int64(1); userId <= 100; userId++ {
+		assert.Equal(t, utils.Probability("example", userId, percentage), utils.InRollout(v1, userId))
+		assert.Equal(t, utils.InRollout(v1, userId), utils.InRollout(v1Salted, userId))
+
+		bucket, err := utils.Bucket(murmur3, salt, userId)
+		assert.NoError(t, err)
+		assert.Equal(t, bucket < basisPoints, utils.InRollout(v2, userId))
+		assert.False(t, utils.InRollout(v2Empty, userId))
+	}
+
+	assert.False(t, utils.InRollout(structures.Segment{Slug: "example"}, 1))
+}
+
+func TestValidateRollout(t *testing.T) {
+	percentage := 50
+	basisPoints := 1250
+	invalidBasisPoints := 10001
+	murmur3 := utils.HashMurmur3
+	unknownHash := "md5"
+
+	tests := []struct {
+		name        string
+		segment     structures.Segment
+		expectedErr string
+	}{
+		{"V1", structures.Segment{Percentage: &percentage}, ""},
+		{"V2", structures.Segment{BucketingVersion: utils.BucketingV2, BasisPoints: &basisPoints, HashFunction: &murmur3}, ""},
+		{"V1BasisPoints", structures.Segment{BasisPoints: &basisPoints}, "basis points require bucketing version 2"},
+		{"V1HashFunction", structures.Segment{BucketingVersion: utils.BucketingV1, HashFunction: &murmur3}, "hash function requires bucketing version 2"},
+		{"V2Percentage", structures.Segment{BucketingVersion: utils.BucketingV2, Percentage: &percentage}, "percentage is not supported by bucketing version 2, use basis points"},
+		{"V2InvalidBasisPoints", structures.Segment{BucketingVersion: utils.BucketingV2, BasisPoints: &invalidBasisPoints}, "invalid basis points"},
+		{"V2UnknownHash", structures.Segment{BucketingVersion: utils.BucketingV2, HashFunction: &unknownHash}, "unknown hash function md5"},
+		{"UnknownVersion", structures.Segment{BucketingVersion: 3}, "invalid bucketing version"},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := utils.ValidateRollout(testCase.segment)
+			if testCase.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, testCase.expectedErr)
+			}
+		})
+	}
+}
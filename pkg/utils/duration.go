@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseDuration parses a Go duration or a number of days such as 14d.
+func ParseDuration(value string) (time.Duration, error) {
+	var duration time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		var count int
+		count, err = strconv.Atoi(days)
+		duration = time.Duration(count) * 24 * time.Hour
+	} else {
+		duration, err = time.ParseDuration(value)
+	}
+	if err != nil || duration < 0 {
+		return 0, errors.New("invalid duration")
+	}
+
+	return duration, nil
+}
+
+// ValidateTTL checks the default and maximum membership durations of a segment, an empty one is not set.
+func ValidateTTL(defaultTTL, maxTTL *string) error {
+	var defaultDuration, maxDuration time.Duration
+	var err error
+	if defaultTTL != nil && *defaultTTL != "" {
+		defaultDuration, err = ParseDuration(*defaultTTL)
+		if err != nil || defaultDuration == 0 {
+			return fmt.Errorf("invalid default_ttl %s, use a duration such as 12h or 14d", *defaultTTL)
+		}
+	}
+	if maxTTL != nil && *maxTTL != "" {
+		maxDuration, err = ParseDuration(*maxTTL)
+		if err != nil || maxDuration == 0 {
+			return fmt.Errorf("invalid max_ttl %s, use a duration such as 12h or 14d", *maxTTL)
+		}
+	}
+
+	if defaultDuration > 0 && maxDuration > 0 && defaultDuration > maxDuration {
+		return errors.New("default_ttl must not exceed max_ttl")
+	}
+
+	return nil
+}
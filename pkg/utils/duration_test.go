@@ -0,0 +1,39 @@
+package utils_test
+
+import (
+	"avito/pkg/utils"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateTTL(t *testing.T) {
+	ttl := func(value string) *string { return &value }
+
+	tests := []struct {
+		name        string
+		defaultTTL  *string
+		maxTTL      *string
+		expectedErr string
+	}{
+		{name: "NotSet"},
+		{name: "DefaultOnly", defaultTTL: ttl("14d")},
+		{name: "MaxOnly", maxTTL: ttl("12h")},
+		{name: "Both", defaultTTL: ttl("14d"), maxTTL: ttl("30d")},
+		{name: "Removed", defaultTTL: ttl(""), maxTTL: ttl("")},
+		{name: "InvalidDefault", defaultTTL: ttl("two weeks"), expectedErr: "invalid default_ttl two weeks, use a duration such as 12h or 14d"},
+		{name: "ZeroMax", maxTTL: ttl("0d"), expectedErr: "invalid max_ttl 0d, use a duration such as 12h or 14d"},
+		{name: "DefaultBeyondMax", defaultTTL: ttl("30d"), maxTTL: ttl("14d"), expectedErr: "default_ttl must not exceed max_ttl"},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := utils.ValidateTTL(testCase.defaultTTL, testCase.maxTTL)
+			if testCase.expectedErr != "" {
+				assert.EqualError(t, err, testCase.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
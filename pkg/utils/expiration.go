@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+)
+
+// legacyExpirationLayout is the naive format of expirations from older clients, read in the time zone of the server.
+const legacyExpirationLayout = "2006-01-02 15:04:05"
+
+// ResolveExpiration returns the absolute expiration given either as a timestamp or as a duration from the moment,
+// nil when neither is given. Timestamps are RFC 3339 or the legacy naive format, field names the timestamp in errors.
+func ResolveExpiration(field string, expiration, ttl *string, now time.Time) (*time.Time, error) {
+	if expiration != nil && ttl != nil {
+		return nil, fmt.Errorf("use either %s or ttl", field)
+	}
+
+	if expiration != nil {
+		return parseTimestamp(field, *expiration)
+	}
+
+	if ttl != nil {
+		duration, err := ParseDuration(*ttl)
+		if err != nil || duration == 0 {
+			return nil, fmt.Errorf("invalid ttl %s, use a duration such as 72h or 14d", *ttl)
+		}
+		resolved := now.Add(duration)
+		return &resolved, nil
+	}
+
+	return nil, nil
+}
+
+// ResolveActiveFrom returns the moment a delayed membership becomes active, nil when it is active right away.
+func ResolveActiveFrom(activeFrom *string, now time.Time) (*time.Time, error) {
+	if activeFrom == nil {
+		return nil, nil
+	}
+
+	resolved, err := parseTimestamp("active_from", *activeFrom)
+	if err != nil {
+		return nil, err
+	}
+	if !resolved.After(now) {
+		return nil, nil
+	}
+	return resolved, nil
+}
+
+func parseTimestamp(field, value string) (*time.Time, error) {
+	resolved, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		resolved, err = time.ParseInLocation(legacyExpirationLayout, value, time.Local)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %s, use RFC 3339 such as 2023-08-30T12:00:00+03:00", field, value)
+	}
+	return &resolved, nil
+}
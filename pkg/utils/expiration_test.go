@@ -0,0 +1,115 @@
+package utils_test
+
+import (
+	"avito/pkg/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveExpiration(t *testing.T) {
+	now := time.Date(2023, 8, 28, 12, 0, 0, 0, time.UTC)
+	value := func(value string) *string { return &value }
+
+	tests := []struct {
+		name        string
+		expiration  *string
+		ttl         *string
+		expected    *time.Time
+		expectedErr string
+	}{
+		{name: "NotSet"},
+		{
+			name:       "RFC3339",
+			expiration: value("2023-08-30T12:00:00+03:00"),
+			expected:   func() *time.Time { t := time.Date(2023, 8, 30, 9, 0, 0, 0, time.UTC); return &t }(),
+		},
+		{
+			name:       "Legacy",
+			expiration: value("2023-08-30 12:00:00"),
+			expected:   func() *time.Time { t := time.Date(2023, 8, 30, 12, 0, 0, 0, time.Local); return &t }(),
+		},
+		{
+			name:     "TTL",
+			ttl:      value("72h"),
+			expected: func() *time.Time { t := now.Add(72 * time.Hour); return &t }(),
+		},
+		{
+			name:        "Both",
+			expiration:  value("2023-08-30T12:00:00+03:00"),
+			ttl:         value("72h"),
+			expectedErr: "use either segments_to_add_expiration or ttl",
+		},
+		{
+			name:        "InvalidExpiration",
+			expiration:  value("30.08.2023"),
+			expectedErr: "invalid segments_to_add_expiration 30.08.2023, use RFC 3339 such as 2023-08-30T12:00:00+03:00",
+		},
+		{
+			name:        "ZeroTTL",
+			ttl:         value("0h"),
+			expectedErr: "invalid ttl 0h, use a duration such as 72h or 14d",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			got, err := utils.ResolveExpiration("segments_to_add_expiration", testCase.expiration, testCase.ttl, now)
+			if testCase.expectedErr != "" {
+				assert.EqualError(t, err, testCase.expectedErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			if testCase.expected == nil {
+				assert.Nil(t, got)
+			} else {
+				assert.True(t, testCase.expected.Equal(*got))
+			}
+		})
+	}
+}
+
+func TestResolveActiveFrom(t *testing.T) {
+	now := time.Date(2023, 8, 28, 12, 0, 0, 0, time.UTC)
+	value := func(value string) *string { return &value }
+
+	tests := []struct {
+		name        string
+		activeFrom  *string
+		expected    *time.Time
+		expectedErr string
+	}{
+		{name: "NotSet"},
+		{
+			name:       "Future",
+			activeFrom: value("2023-09-01T10:00:00+03:00"),
+			expected:   func() *time.Time { t := time.Date(2023, 9, 1, 7, 0, 0, 0, time.UTC); return &t }(),
+		},
+		{name: "Past", activeFrom: value("2023-08-01T10:00:00Z")},
+		{name: "Now", activeFrom: value("2023-08-28T12:00:00Z")},
+		{
+			name:        "Invalid",
+			activeFrom:  value("tomorrow"),
+			expectedErr: "invalid active_from tomorrow, use RFC 3339 such as 2023-08-30T12:00:00+03:00",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			got, err := utils.ResolveActiveFrom(testCase.activeFrom, now)
+			if testCase.expectedErr != "" {
+				assert.EqualError(t, err, testCase.expectedErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			if testCase.expected == nil {
+				assert.Nil(t, got)
+			} else {
+				assert.True(t, testCase.expected.Equal(*got))
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package utils
+
+import (
+	"avito/pkg/structures"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	expressionSlug = "slug"
+	expressionAnd  = "AND"
+	expressionOr   = "OR"
+	expressionNot  = "NOT"
+)
+
+// Expression is a boolean expression over segment slugs that defines the members of a composite segment.
+// NOT binds tighter than AND, which binds tighter than OR; parentheses group.
+type Expression struct {
+	op       string
+	slug     string
+	operands []*Expression
+}
+
+// ParseExpression parses an expression such as (beta OR staff) AND NOT churn_risk,
+// the operators are case-insensitive.
+func ParseExpression(value string) (*Expression, error) {
+	p := expressionParser{tokens: tokenizeExpression(value)}
+	if len(p.tokens) == 0 {
+		return nil, errors.New("invalid expression, it is empty")
+	}
+
+	expression, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("invalid expression, unexpected %s", p.tokens[p.pos])
+	}
+
+	return expression, nil
+}
+
+// ValidateCompositeSegment checks the expression of a new segment, a composite segment takes no percentage rollout.
+func ValidateCompositeSegment(segment structures.Segment) error {
+	if segment.Expression == nil || *segment.Expression == "" {
+		return nil
+	}
+
+	if _, err := ParseExpression(*segment.Expression); err != nil {
+		return err
+	}
+	if segment.Percentage != nil || segment.BasisPoints != nil {
+		return errors.New("composite segment cannot have a percentage")
+	}
+
+	return nil
+}
+
+// Slugs returns the segments the expression refers to, sorted and each once.
+func (e *Expression) Slugs() []string {
+	seen := make(map[string]bool)
+	var slugs []string
+	var walk func(e *Expression)
+	walk = func(e *Expression) {
+		if e.op == expressionSlug {
+			if !seen[e.slug] {
+				seen[e.slug] = true
+				slugs = append(slugs, e.slug)
+			}
+			return
+		}
+		for _, operand := range e.operands {
+			walk(operand)
+		}
+	}
+	walk(e)
+
+	sort.Strings(slugs)
+	return slugs
+}
+
+// Rename replaces the references to a renamed segment.
+func (e *Expression) Rename(slug, newSlug string) {
+	if e.op == expressionSlug {
+		if e.slug == slug {
+			e.slug = newSlug
+		}
+		return
+	}
+	for _, operand := range e.operands {
+		operand.Rename(slug, newSlug)
+	}
+}
+
+// Eval tells whether the expression holds for a user, given whether they are a member of a segment.
+func (e *Expression) Eval(member func(slug string) bool) bool {
+	switch e.op {
+	case expressionSlug:
+		return member(e.slug)
+	case expressionNot:
+		return !e.operands[0].Eval(member)
+	case expressionAnd:
+		for _, operand := range e.operands {
+			if !operand.Eval(member) {
+				return false
+			}
+		}
+		return true
+	default:
+		for _, operand := range e.operands {
+			if operand.Eval(member) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// String formats the expression with uppercase operators and only the parentheses it needs,
+// which is how expressions are stored.
+func (e *Expression) String() string {
+	switch e.op {
+	case expressionSlug:
+		return e.slug
+	case expressionNot:
+		operand := e.operands[0]
+		if operand.op == expressionAnd || operand.op == expressionOr {
+			return "NOT (" + operand.String() + ")"
+		}
+		return "NOT " + operand.String()
+	default:
+		parts := make([]string, 0, len(e.operands))
+		for _, operand := range e.operands {
+			part := operand.String()
+			if e.op == expressionAnd && operand.op == expressionOr {
+				part = "(" + part + ")"
+			}
+			parts = append(parts, part)
+		}
+		return strings.Join(parts, " "+e.op+" ")
+	}
+}
+
+// CompositeSegments returns the composite segments whose expressions hold for a user with the segments,
+// sorted. Expressions may refer to other composite segments, which are evaluated first;
+// a composite segment missing from the list, such as an inactive one, has no members.
+func CompositeSegments(segments []string, composites []structures.Segment) []string {
+	member := make(map[string]bool)
+	for _, slug := range segments {
+		member[slug] = true
+	}
+
+	expressions := make(map[string]*Expression)
+	for _, segment := range composites {
+		if segment.Expression == nil {
+			continue
+		}
+		expression, err := ParseExpression(*segment.Expression)
+		if err != nil {
+			continue
+		}
+		expressions[segment.Slug] = expression
+	}
+
+	// Stored expressions have no cycles, evaluating marks the segments in progress all the same.
+	results := make(map[string]bool)
+	evaluating := make(map[string]bool)
+	var holds func(slug string) bool
+	holds = func(slug string) bool {
+		expression, ok := expressions[slug]
+		if !ok {
+			return member[slug]
+		}
+		if result, ok := results[slug]; ok {
+			return result
+		}
+		if evaluating[slug] {
+			return false
+		}
+		evaluating[slug] = true
+		results[slug] = expression.Eval(holds)
+		return results[slug]
+	}
+
+	var matched []string
+	for slug := range expressions {
+		if holds(slug) {
+			matched = append(matched, slug)
+		}
+	}
+
+	sort.Strings(matched)
+	return matched
+}
+
+func tokenizeExpression(value string) []string {
+	var tokens []string
+	var current strings.Builder
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+
+	for _, r := range value {
+		switch {
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			flush()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+type expressionParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *expressionParser) peekOperator(op string) bool {
+	return p.pos < len(p.tokens) && strings.EqualFold(p.tokens[p.pos], op)
+}
+
+func (p *expressionParser) parseOr() (*Expression, error) {
+	return p.parseBinary(expressionOr, p.parseAnd)
+}
+
+func (p *expressionParser) parseAnd() (*Expression, error) {
+	return p.parseBinary(expressionAnd, p.parseNot)
+}
+
+func (p *expressionParser) parseBinary(op string, parseOperand func() (*Expression, error)) (*Expression, error) {
+	operand, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	operands := []*Expression{operand}
+	for p.peekOperator(op) {
+		p.pos++
+		operand, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+	}
+
+	if len(operands) == 1 {
+		return operand, nil
+	}
+	return &Expression{op: op, operands: operands}, nil
+}
+
+func (p *expressionParser) parseNot() (*Expression, error) {
+	if p.peekOperator(expressionNot) {
+		p.pos++
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &Expression{op: expressionNot, operands: []*Expression{operand}}, nil
+	}
+
+	return p.parseOperand()
+}
+
+func (p *expressionParser) parseOperand() (*Expression, error) {
+	if p.pos == len(p.tokens) {
+		return nil, errors.New("invalid expression, it ends too early")
+	}
+
+	token := p.tokens[p.pos]
+	p.pos++
+
+	if token == "(" {
+		expression, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.pos == len(p.tokens) || p.tokens[p.pos] != ")" {
+			return nil, errors.New("invalid expression, missing )")
+		}
+		p.pos++
+		return expression, nil
+	}
+
+	for _, op := range []string{expressionAnd, expressionOr, expressionNot} {
+		if strings.EqualFold(token, op) {
+			return nil, fmt.Errorf("invalid expression, unexpected %s", token)
+		}
+	}
+	if token == ")" {
+		return nil, errors.New("invalid expression, unexpected )")
+	}
+	if err := ValidateSlug(token); err != nil {
+		return nil, fmt.Errorf("invalid expression, %s %q", err.Error(), token)
+	}
+
+	return &Expression{op: expressionSlug, slug: token}, nil
+}
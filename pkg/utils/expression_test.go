@@ -0,0 +1,82 @@
+package utils_test
+
+import (
+	"avito/pkg/structures"
+	"avito/pkg/utils"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseExpression(t *testing.T) {
+	tests := []struct {
+		name          string
+		expression    string
+		expected      string
+		expectedSlugs []string
+		expectedErr   string
+	}{
+		{name: "Slug", expression: "premium", expected: "premium", expectedSlugs: []string{"premium"}},
+		{name: "AndNot", expression: "premium AND NOT churn_risk", expected: "premium AND NOT churn_risk", expectedSlugs: []string{"churn_risk", "premium"}},
+		{name: "Grouped", expression: "(beta OR staff) AND android_new_ui", expected: "(beta OR staff) AND android_new_ui", expectedSlugs: []string{"android_new_ui", "beta", "staff"}},
+		{name: "Precedence", expression: "beta or staff and android_new_ui", expected: "beta OR staff AND android_new_ui", expectedSlugs: []string{"android_new_ui", "beta", "staff"}},
+		{name: "RedundantParentheses", expression: "((beta)) AND (staff AND NOT(churn_risk OR beta))", expected: "beta AND staff AND NOT (churn_risk OR beta)", expectedSlugs: []string{"beta", "churn_risk", "staff"}},
+		{name: "Empty", expression: "  ", expectedErr: "invalid expression, it is empty"},
+		{name: "TrailingOperator", expression: "premium AND", expectedErr: "invalid expression, it ends too early"},
+		{name: "DoubleOperator", expression: "premium AND OR staff", expectedErr: "invalid expression, unexpected OR"},
+		{name: "MissingParenthesis", expression: "(beta OR staff", expectedErr: "invalid expression, missing )"},
+		{name: "ExtraParenthesis", expression: "beta OR staff)", expectedErr: "invalid expression, unexpected )"},
+		{name: "MissingOperator", expression: "beta staff", expectedErr: "invalid expression, unexpected staff"},
+		{name: "InvalidSlug", expression: "beta AND staff-", expectedErr: `invalid expression, invalid slug "staff-"`},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			expression, err := utils.ParseExpression(testCase.expression)
+			if testCase.expectedErr != "" {
+				assert.EqualError(t, err, testCase.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.expected, expression.String())
+			assert.Equal(t, testCase.expectedSlugs, expression.Slugs())
+		})
+	}
+}
+
+func TestExpression_Rename(t *testing.T) {
+	expression, err := utils.ParseExpression("(beta OR staff) AND NOT beta_excluded AND beta")
+	assert.NoError(t, err)
+
+	expression.Rename("beta", "beta_v2")
+	assert.Equal(t, "(beta_v2 OR staff) AND NOT beta_excluded AND beta_v2", expression.String())
+}
+
+func TestCompositeSegments(t *testing.T) {
+	expression := func(value string) *string { return &value }
+	composites := []structures.Segment{
+		{Slug: "premium_retained", Expression: expression("premium AND NOT churn_risk")},
+		{Slug: "new_ui_testers", Expression: expression("(beta OR staff) AND android_new_ui")},
+		{Slug: "retained_testers", Expression: expression("premium_retained AND new_ui_testers")},
+		{Slug: "inactive_based", Expression: expression("premium AND inactive_composite")},
+	}
+
+	tests := []struct {
+		name     string
+		segments []string
+		expected []string
+	}{
+		{name: "None", segments: nil, expected: nil},
+		{name: "Premium", segments: []string{"premium"}, expected: []string{"premium_retained"}},
+		{name: "ChurnRisk", segments: []string{"premium", "churn_risk"}, expected: nil},
+		{name: "Staff", segments: []string{"staff", "android_new_ui"}, expected: []string{"new_ui_testers"}},
+		{name: "Nested", segments: []string{"premium", "beta", "android_new_ui"}, expected: []string{"new_ui_testers", "premium_retained", "retained_testers"}},
+		{name: "ExplicitCompositeIgnored", segments: []string{"premium_retained", "new_ui_testers"}, expected: nil},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.expected, utils.CompositeSegments(testCase.segments, composites))
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package utils
+
+import "errors"
+
+// What deleting a segment does to its children: detached children become top-level segments,
+// reparented ones move under the parent of the deleted segment.
+const (
+	ChildrenDetach   = "detach"
+	ChildrenReparent = "reparent"
+)
+
+// ValidateChildrenDecision accepts the decisions about the children of a deleted segment,
+// an empty one is only enough for a segment without children.
+func ValidateChildrenDecision(decision string) error {
+	switch decision {
+	case "", ChildrenDetach, ChildrenReparent:
+		return nil
+	}
+	return errors.New("invalid children, use detach or reparent")
+}
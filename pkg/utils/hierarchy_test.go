@@ -0,0 +1,32 @@
+package utils_test
+
+import (
+	"avito/pkg/utils"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateChildrenDecision(t *testing.T) {
+	tests := []struct {
+		name        string
+		decision    string
+		expectedErr string
+	}{
+		{name: "None"},
+		{name: "Detach", decision: "detach"},
+		{name: "Reparent", decision: "reparent"},
+		{name: "Invalid", decision: "delete", expectedErr: "invalid children, use detach or reparent"},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := utils.ValidateChildrenDecision(testCase.decision)
+			if testCase.expectedErr != "" {
+				assert.EqualError(t, err, testCase.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"avito/pkg/structures"
+	"sort"
+)
+
+// LayerBucket returns the bucket of the user shared by all segments of the layer:
+// bucketing v2 with murmur3 and the layer slug as the salt.
+func LayerBucket(layer string, userId int64) int {
+	bucket, _ := Bucket(HashMurmur3, layer, userId)
+	return bucket
+}
+
+// RolloutWidth returns the number of buckets the rollout of the segment takes.
+func RolloutWidth(segment structures.Segment) int {
+	if segment.BucketingVersion == BucketingV2 {
+		if segment.BasisPoints == nil {
+			return 0
+		}
+		return *segment.BasisPoints
+	}
+
+	if segment.Percentage == nil {
+		return 0
+	}
+	return *segment.Percentage * Buckets / 100
+}
+
+// AllocateLayerRange returns the offset of a free range of the given width in a layer
+// where the ranges of the other segments are already taken.
+// With a preferred offset only that offset is checked, so a segment growing in place
+// keeps every user it already had; otherwise the first free range is taken.
+func AllocateLayerRange(taken []structures.LayerSegment, width int, preferred *int) (int, bool) {
+	if preferred != nil {
+		return *preferred, rangeIsFree(taken, *preferred, width)
+	}
+
+	sorted := make([]structures.LayerSegment, len(taken))
+	copy(sorted, taken)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+
+	offset := 0
+	for _, segment := range sorted {
+		if segment.Width == 0 {
+			continue
+		}
+		if segment.Offset-offset >= width {
+			return offset, true
+		}
+		if end := segment.Offset + segment.Width; end > offset {
+			offset = end
+		}
+	}
+
+	return offset, Buckets-offset >= width
+}
+
+func rangeIsFree(taken []structures.LayerSegment, offset int, width int) bool {
+	if offset < 0 || offset+width > Buckets {
+		return false
+	}
+
+	for _, segment := range taken {
+		if offset < segment.Offset+segment.Width && segment.Offset < offset+width {
+			return false
+		}
+	}
+
+	return true
+}
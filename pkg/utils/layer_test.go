@@ -0,0 +1,71 @@
+package utils_test
+
+import (
+	"avito/pkg/structures"
+	"avito/pkg/utils"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllocateLayerRange(t *testing.T) {
+	taken := []structures.LayerSegment{
+		{Slug: "b", Offset: 3000, Width: 2000},
+		{Slug: "a", Offset: 0, Width: 1000},
+		{Slug: "empty", Offset: 1000, Width: 0},
+	}
+	offset := func(value int) *int { return &value }
+
+	tests := []struct {
+		name      string
+		width     int
+		preferred *int
+		expected  int
+		ok        bool
+	}{
+		{"FirstGap", 2000, nil, 1000, true},
+		{"AfterLast", 2500, nil, 5000, true},
+		{"RestOfLayer", 5000, nil, 5000, true},
+		{"TooWide", 5001, nil, 0, false},
+		{"Zero", 0, nil, 0, true},
+		{"PreferredFree", 2000, offset(1000), 1000, true},
+		{"PreferredOverlaps", 2001, offset(1000), 1000, false},
+		{"PreferredOutOfLayer", 1000, offset(9500), 9500, false},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			got, ok := utils.AllocateLayerRange(taken, testCase.width, testCase.preferred)
+			assert.Equal(t, testCase.ok, ok)
+			if ok {
+				assert.Equal(t, testCase.expected, got)
+			}
+		})
+	}
+}
+
+func TestInRollout_LayerIsExclusive(t *testing.T) {
+	layer := "checkout"
+	quarter, half := 25, 50
+	basisPoints := 2500
+	first, second, third := 0, 2500, 7500
+
+	segments := []structures.Segment{
+		{Slug: "a", Percentage: &quarter, Layer: &layer, LayerOffset: &first},
+		{Slug: "b", Percentage: &half, Layer: &layer, LayerOffset: &second},
+		{Slug: "c", BucketingVersion: utils.BucketingV2, BasisPoints: &basisPoints, Layer: &layer, LayerOffset: &third},
+	}
+
+	for userId := int64(0); userId < 10000; userId++ {
+		in := 0
+		for _, segment := range segments {
+			if utils.InRollout(segment, userId) {
+				in++
+			}
+		}
+		// The three ranges cover the whole layer.
+		assert.Equal(t, 1, in, "user %d", userId)
+	}
+
+	assert.False(t, utils.InRollout(structures.Segment{Slug: "d", Percentage: &half, Layer: &layer}, 1))
+}
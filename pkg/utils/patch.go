@@ -0,0 +1,25 @@
+package utils
+
+import "errors"
+
+const (
+	PatchModeStrict = "strict"
+	PatchModeUpsert = "upsert"
+)
+
+// The changes reported for each segment of a patch in the upsert mode.
+const (
+	MembershipAdded             = "added"
+	MembershipRemoved           = "removed"
+	MembershipExpirationUpdated = "expiration_updated"
+	MembershipUnchanged         = "unchanged"
+)
+
+// ValidatePatchMode accepts the modes of a patch, an empty mode is strict.
+func ValidatePatchMode(mode string) error {
+	switch mode {
+	case "", PatchModeStrict, PatchModeUpsert:
+		return nil
+	}
+	return errors.New("invalid mode, use strict or upsert")
+}
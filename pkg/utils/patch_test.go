@@ -0,0 +1,32 @@
+package utils_test
+
+import (
+	"avito/pkg/utils"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePatchMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		expectedErr string
+	}{
+		{name: "Default"},
+		{name: "Strict", mode: "strict"},
+		{name: "Upsert", mode: "upsert"},
+		{name: "Invalid", mode: "merge", expectedErr: "invalid mode, use strict or upsert"},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := utils.ValidatePatchMode(testCase.mode)
+			if testCase.expectedErr != "" {
+				assert.EqualError(t, err, testCase.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"avito/pkg/structures"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	RampPlanActive    = "active"
+	RampPlanPaused    = "paused"
+	RampPlanCompleted = "completed"
+	RampPlanAborted   = "aborted"
+)
+
+// rampPlanActions maps the actions of the API to the statuses they move a plan to.
+var rampPlanActions = map[string]string{
+	"pause":  RampPlanPaused,
+	"resume": RampPlanActive,
+	"abort":  RampPlanAborted,
+}
+
+var rampPlanTransitions = map[string][]string{
+	RampPlanActive: {RampPlanPaused, RampPlanAborted},
+	RampPlanPaused: {RampPlanActive, RampPlanAborted},
+}
+
+func RampPlanActionStatus(action string) (string, error) {
+	status, ok := rampPlanActions[action]
+	if !ok {
+		return "", errors.New("invalid action, use pause, resume or abort")
+	}
+	return status, nil
+}
+
+func ValidateRampPlanTransition(from, to string) error {
+	for _, status := range rampPlanTransitions[from] {
+		if status == to {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("ramp plan cannot go from %s to %s", from, to)
+}
+
+// ParseRampOffset parses the offset of a step, see ParseDuration.
+func ParseRampOffset(after string) (time.Duration, error) {
+	if after == "" {
+		return 0, nil
+	}
+
+	offset, err := ParseDuration(after)
+	if err != nil {
+		return 0, fmt.Errorf("invalid after %s, use a duration such as 30m, 24h or 3d", after)
+	}
+
+	return offset, nil
+}
+
+func ValidateRampSteps(steps []structures.RampStep) error {
+	if len(steps) == 0 {
+		return errors.New("ramp plan needs at least one step")
+	}
+
+	for i, step := range steps {
+		if step.Percentage < 0 || step.Percentage > 100 {
+			return errors.New("invalid percentage")
+		}
+
+		offset, err := ParseRampOffset(step.After)
+		if err != nil {
+			return err
+		}
+
+		if i == 0 {
+			continue
+		}
+		if step.Percentage < steps[i-1].Percentage {
+			return errors.New("ramp percentages must not decrease")
+		}
+		previous, _ := ParseRampOffset(steps[i-1].After)
+		if offset <= previous {
+			return fmt.Errorf("ramp step after %s must come later than the previous one", step.After)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package utils_test
+
+import (
+	"avito/pkg/structures"
+	"avito/pkg/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRampOffset(t *testing.T) {
+	tests := []struct {
+		after          string
+		expectedOffset time.Duration
+		expectedErr    string
+	}{
+		{after: "", expectedOffset: 0},
+		{after: "30m", expectedOffset: 30 * time.Minute},
+		{after: "24h", expectedOffset: 24 * time.Hour},
+		{after: "3d", expectedOffset: 72 * time.Hour},
+		{after: "-1h", expectedErr: "invalid after -1h, use a duration such as 30m, 24h or 3d"},
+		{after: "week", expectedErr: "invalid after week, use a duration such as 30m, 24h or 3d"},
+		{after: "xd", expectedErr: "invalid after xd, use a duration such as 30m, 24h or 3d"},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.after, func(t *testing.T) {
+			offset, err := utils.ParseRampOffset(testCase.after)
+			if testCase.expectedErr != "" {
+				assert.EqualError(t, err, testCase.expectedErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, testCase.expectedOffset, offset)
+			}
+		})
+	}
+}
+
+func TestValidateRampSteps(t *testing.T) {
+	tests := []struct {
+		name        string
+		steps       []structures.RampStep
+		expectedErr string
+	}{
+		{
+			name: "OK",
+			steps: []structures.RampStep{
+				{Percentage: 1}, {Percentage: 5, After: "24h"}, {Percentage: 25, After: "3d"}, {Percentage: 100, After: "7d"},
+			},
+		},
+		{
+			name:        "NoSteps",
+			steps:       []structures.RampStep{},
+			expectedErr: "ramp plan needs at least one step",
+		},
+		{
+			name:        "InvalidPercentage",
+			steps:       []structures.RampStep{{Percentage: 101}},
+			expectedErr: "invalid percentage",
+		},
+		{
+			name:        "DecreasingPercentage",
+			steps:       []structures.RampStep{{Percentage: 5}, {Percentage: 1, After: "1h"}},
+			expectedErr: "ramp percentages must not decrease",
+		},
+		{
+			name:        "SameOffset",
+			steps:       []structures.RampStep{{Percentage: 1, After: "24h"}, {Percentage: 5, After: "1d"}},
+			expectedErr: "ramp step after 1d must come later than the previous one",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := utils.ValidateRampSteps(testCase.steps)
+			if testCase.expectedErr != "" {
+				assert.EqualError(t, err, testCase.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateRampPlanTransition(t *testing.T) {
+	assert.NoError(t, utils.ValidateRampPlanTransition("active", "paused"))
+	assert.NoError(t, utils.ValidateRampPlanTransition("paused", "active"))
+	assert.NoError(t, utils.ValidateRampPlanTransition("paused", "aborted"))
+	assert.EqualError(t, utils.ValidateRampPlanTransition("active", "active"), "ramp plan cannot go from active to active")
+	assert.EqualError(t, utils.ValidateRampPlanTransition("completed", "paused"), "ramp plan cannot go from completed to paused")
+}
@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"avito/pkg/structures"
+	"errors"
+	"fmt"
+)
+
+const (
+	RuleRequires  = "requires"
+	RuleExcludes  = "excludes"
+	RuleMaxTagged = "max_tagged"
+)
+
+// ValidateTags checks that the tags are unique and slug-like.
+func ValidateTags(tags []string) error {
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		if err := ValidateSlug(tag); err != nil {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+		if seen[tag] {
+			return fmt.Errorf("duplicate tag %s", tag)
+		}
+		seen[tag] = true
+	}
+
+	return nil
+}
+
+// ValidateRule checks that the rule has exactly the fields of its kind:
+// two different segments for requires and excludes, a tag and a positive max_segments for max_tagged.
+func ValidateRule(rule structures.Rule) error {
+	switch rule.Kind {
+	case RuleRequires, RuleExcludes:
+		if rule.Segment == nil || rule.Other == nil {
+			return fmt.Errorf("%s rule needs segment and other", rule.Kind)
+		}
+		if err := ValidateSlug(*rule.Segment); err != nil {
+			return fmt.Errorf("%s (segment: %s)", err.Error(), *rule.Segment)
+		}
+		if err := ValidateSlug(*rule.Other); err != nil {
+			return fmt.Errorf("%s (other: %s)", err.Error(), *rule.Other)
+		}
+		if *rule.Segment == *rule.Other {
+			return errors.New("segment and other must differ")
+		}
+		if rule.Tag != nil || rule.MaxSegments != nil {
+			return fmt.Errorf("%s rule takes no tag and max_segments", rule.Kind)
+		}
+	case RuleMaxTagged:
+		if rule.Tag == nil || rule.MaxSegments == nil {
+			return errors.New("max_tagged rule needs tag and max_segments")
+		}
+		if err := ValidateTags([]string{*rule.Tag}); err != nil {
+			return err
+		}
+		if *rule.MaxSegments <= 0 {
+			return errors.New("invalid max_segments")
+		}
+		if rule.Segment != nil || rule.Other != nil {
+			return errors.New("max_tagged rule takes no segment and other")
+		}
+	default:
+		return errors.New("invalid kind, use requires, excludes or max_tagged")
+	}
+
+	return nil
+}
+
+// ViolatedRule returns the first rule broken by the segments of a user after a change of the changed segments,
+// with the reason it is broken. Only the rules the change could have broken are checked: requires and excludes
+// rules on a changed segment, and max_tagged rules on the tag of a changed segment the user has,
+// so a user who broke a rule before it was created can still be changed elsewhere.
+func ViolatedRule(rules []structures.Rule, segments []string, changed []string, tags map[string][]string) (structures.Rule, string, bool) {
+	has := make(map[string]bool, len(segments))
+	for _, segment := range segments {
+		has[segment] = true
+	}
+
+	touched := make(map[string]bool, len(changed))
+	touchedTags := make(map[string]bool)
+	for _, segment := range changed {
+		touched[segment] = true
+		if has[segment] {
+			for _, tag := range tags[segment] {
+				touchedTags[tag] = true
+			}
+		}
+	}
+
+	for _, rule := range rules {
+		switch rule.Kind {
+		case RuleRequires:
+			if (touched[*rule.Segment] || touched[*rule.Other]) && has[*rule.Segment] && !has[*rule.Other] {
+				return rule, fmt.Sprintf("segment %s requires segment %s", *rule.Segment, *rule.Other), true
+			}
+		case RuleExcludes:
+			if (touched[*rule.Segment] || touched[*rule.Other]) && has[*rule.Segment] && has[*rule.Other] {
+				return rule, fmt.Sprintf("segment %s excludes segment %s", *rule.Segment, *rule.Other), true
+			}
+		case RuleMaxTagged:
+			if !touchedTags[*rule.Tag] {
+				continue
+			}
+			count := 0
+			for _, segment := range segments {
+				for _, tag := range tags[segment] {
+					if tag == *rule.Tag {
+						count++
+					}
+				}
+			}
+			if count > *rule.MaxSegments {
+				return rule, fmt.Sprintf("at most %d segments tagged %s are allowed", *rule.MaxSegments, *rule.Tag), true
+			}
+		}
+	}
+
+	return structures.Rule{}, "", false
+}
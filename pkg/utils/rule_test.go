@@ -0,0 +1,142 @@
+package utils_test
+
+import (
+	"avito/pkg/structures"
+	"avito/pkg/utils"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateTags(t *testing.T) {
+	tests := []struct {
+		name        string
+		tags        []string
+		expectedErr string
+	}{
+		{"None", nil, ""},
+		{"OK", []string{"discount", "messenger"}, ""},
+		{"Invalid", []string{"discount", "a b"}, `invalid tag "a b"`},
+		{"Duplicate", []string{"discount", "discount"}, "duplicate tag discount"},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := utils.ValidateTags(testCase.tags)
+			if testCase.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, testCase.expectedErr)
+			}
+		})
+	}
+}
+
+func TestValidateRule(t *testing.T) {
+	segment, other, invalid := "AVITO_DISCOUNT_50", "AVITO_DISCOUNT_30", "AVITO DISCOUNT"
+	tag := "discount"
+	two, zero := 2, 0
+
+	tests := []struct {
+		name        string
+		rule        structures.Rule
+		expectedErr string
+	}{
+		{"Requires", structures.Rule{Kind: "requires", Segment: &segment, Other: &other}, ""},
+		{"Excludes", structures.Rule{Kind: "excludes", Segment: &segment, Other: &other}, ""},
+		{"MaxTagged", structures.Rule{Kind: "max_tagged", Tag: &tag, MaxSegments: &two}, ""},
+		{"InvalidKind", structures.Rule{Kind: "implies", Segment: &segment, Other: &other}, "invalid kind, use requires, excludes or max_tagged"},
+		{"NoOther", structures.Rule{Kind: "requires", Segment: &segment}, "requires rule needs segment and other"},
+		{"InvalidOther", structures.Rule{Kind: "excludes", Segment: &segment, Other: &invalid}, "invalid slug (other: AVITO DISCOUNT)"},
+		{"SameSegment", structures.Rule{Kind: "excludes", Segment: &segment, Other: &segment}, "segment and other must differ"},
+		{"RequiresWithTag", structures.Rule{Kind: "requires", Segment: &segment, Other: &other, Tag: &tag}, "requires rule takes no tag and max_segments"},
+		{"NoMaxSegments", structures.Rule{Kind: "max_tagged", Tag: &tag}, "max_tagged rule needs tag and max_segments"},
+		{"ZeroMaxSegments", structures.Rule{Kind: "max_tagged", Tag: &tag, MaxSegments: &zero}, "invalid max_segments"},
+		{"MaxTaggedWithSegment", structures.Rule{Kind: "max_tagged", Segment: &segment, Tag: &tag, MaxSegments: &two}, "max_tagged rule takes no segment and other"},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := utils.ValidateRule(testCase.rule)
+			if testCase.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, testCase.expectedErr)
+			}
+		})
+	}
+}
+
+func TestViolatedRule(t *testing.T) {
+	sale, discount30, discount50, voice := "AVITO_SALE", "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50", "AVITO_VOICE_MESSAGES"
+	tag := "discount"
+	one := 1
+
+	rules := []structures.Rule{
+		{Id: 1, Kind: "requires", Segment: &discount50, Other: &sale},
+		{Id: 2, Kind: "excludes", Segment: &voice, Other: &discount30},
+		{Id: 3, Kind: "max_tagged", Tag: &tag, MaxSegments: &one},
+	}
+	tags := map[string][]string{discount30: {tag}, discount50: {tag}}
+
+	tests := []struct {
+		name            string
+		segments        []string
+		changed         []string
+		expectedRule    int
+		expectedMessage string
+	}{
+		{
+			name:     "OK",
+			segments: []string{sale, discount50, voice},
+			changed:  []string{discount50, voice},
+		},
+		{
+			name:            "RequiredMissing",
+			segments:        []string{discount50},
+			changed:         []string{discount50},
+			expectedRule:    1,
+			expectedMessage: "segment AVITO_DISCOUNT_50 requires segment AVITO_SALE",
+		},
+		{
+			name:            "RequiredRemoved",
+			segments:        []string{discount50},
+			changed:         []string{sale},
+			expectedRule:    1,
+			expectedMessage: "segment AVITO_DISCOUNT_50 requires segment AVITO_SALE",
+		},
+		{
+			name:            "Excluded",
+			segments:        []string{discount30, voice},
+			changed:         []string{voice},
+			expectedRule:    2,
+			expectedMessage: "segment AVITO_VOICE_MESSAGES excludes segment AVITO_DISCOUNT_30",
+		},
+		{
+			name:            "TooManyTagged",
+			segments:        []string{sale, discount30, discount50},
+			changed:         []string{discount30},
+			expectedRule:    3,
+			expectedMessage: "at most 1 segments tagged discount are allowed",
+		},
+		{
+			name:     "TaggedRemoved",
+			segments: []string{sale, discount30, discount50},
+			changed:  []string{voice},
+		},
+		{
+			name:     "BrokenBeforeUntouched",
+			segments: []string{discount30, voice},
+			changed:  []string{sale},
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			rule, message, violated := utils.ViolatedRule(rules, testCase.segments, testCase.changed, tags)
+			assert.Equal(t, testCase.expectedRule != 0, violated)
+			assert.Equal(t, testCase.expectedRule, rule.Id)
+			assert.Equal(t, testCase.expectedMessage, message)
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package utils
+
+import (
+	"avito/pkg/structures"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	// The time zone database is embedded, so schedules work without tzdata on the host.
+	_ "time/tzdata"
+)
+
+const minutesPerDay = 24 * 60
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// InSchedule reports whether the schedule is active at the moment, a segment without a schedule always is.
+func InSchedule(schedule *structures.SegmentSchedule, now time.Time) bool {
+	if schedule == nil {
+		return true
+	}
+
+	location, err := scheduleLocation(schedule)
+	if err != nil {
+		return false
+	}
+
+	local := now.In(location)
+	minute := local.Hour()*60 + local.Minute()
+	for _, interval := range schedule.Intervals {
+		start, end, err := parseInterval(interval)
+		if err != nil {
+			continue
+		}
+
+		if end > start {
+			if hasWeekday(interval, local.Weekday()) && start <= minute && minute < end {
+				return true
+			}
+			continue
+		}
+
+		if hasWeekday(interval, local.Weekday()) && minute >= start {
+			return true
+		}
+		if hasWeekday(interval, (local.Weekday()+6)%7) && minute < end {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NextActivityIntervals returns up to count intervals of activity of the segment ending after the moment,
+// overlapping and adjacent intervals of the schedule are merged, and all of them are clipped to the window of the segment.
+func NextActivityIntervals(segment structures.Segment, from time.Time, count int) ([]structures.ActivityInterval, error) {
+	if segment.Schedule == nil {
+		return nil, errors.New("segment has no schedule")
+	}
+
+	location, err := scheduleLocation(segment.Schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	// A weekly schedule repeats every 7 days, so count+1 weeks give count intervals
+	// unless the schedule merges into fewer, longer ones.
+	local := from.In(location)
+	firstDay := time.Date(local.Year(), local.Month(), local.Day()-1, 0, 0, 0, 0, location)
+	days := 7*(count+1) + 1
+
+	var intervals []structures.ActivityInterval
+	for day := 0; day < days; day++ {
+		date := firstDay.AddDate(0, 0, day)
+		for _, interval := range segment.Schedule.Intervals {
+			if !hasWeekday(interval, date.Weekday()) {
+				continue
+			}
+
+			start, end, err := parseInterval(interval)
+			if err != nil {
+				return nil, err
+			}
+			if end <= start {
+				end += minutesPerDay
+			}
+
+			intervals = append(intervals, structures.ActivityInterval{
+				StartsAt: atMinute(date, start),
+				EndsAt:   atMinute(date, end),
+			})
+		}
+	}
+
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].StartsAt.Before(intervals[j].StartsAt)
+	})
+
+	result := []structures.ActivityInterval{}
+	for _, interval := range intervals {
+		if segment.StartsAt != nil && interval.StartsAt.Before(*segment.StartsAt) {
+			interval.StartsAt = segment.StartsAt.In(location)
+		}
+		if segment.EndsAt != nil && interval.EndsAt.After(*segment.EndsAt) {
+			interval.EndsAt = segment.EndsAt.In(location)
+		}
+		if !interval.EndsAt.After(from) || !interval.StartsAt.Before(interval.EndsAt) {
+			continue
+		}
+
+		last := len(result) - 1
+		if last >= 0 && !interval.StartsAt.After(result[last].EndsAt) {
+			if interval.EndsAt.After(result[last].EndsAt) {
+				result[last].EndsAt = interval.EndsAt
+			}
+			continue
+		}
+
+		if len(result) == count {
+			break
+		}
+		result = append(result, interval)
+	}
+
+	return result, nil
+}
+
+func ValidateSchedule(schedule structures.SegmentSchedule) error {
+	if _, err := scheduleLocation(&schedule); err != nil {
+		return err
+	}
+
+	if len(schedule.Intervals) == 0 {
+		return errors.New("schedule needs at least one interval")
+	}
+
+	for _, interval := range schedule.Intervals {
+		if len(interval.Days) == 0 {
+			return errors.New("schedule interval needs at least one day")
+		}
+		for _, day := range interval.Days {
+			if _, ok := weekdays[day]; !ok {
+				return fmt.Errorf("invalid day %s, use mon, tue, wed, thu, fri, sat or sun", day)
+			}
+		}
+
+		start, end, err := parseInterval(interval)
+		if err != nil {
+			return err
+		}
+		if start == end {
+			return fmt.Errorf("schedule interval %s-%s is empty", interval.Start, interval.End)
+		}
+	}
+
+	return nil
+}
+
+func scheduleLocation(schedule *structures.SegmentSchedule) (*time.Location, error) {
+	if schedule.Timezone == "" {
+		return time.UTC, nil
+	}
+
+	location, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %s", schedule.Timezone)
+	}
+	return location, nil
+}
+
+func hasWeekday(interval structures.ScheduleInterval, weekday time.Weekday) bool {
+	for _, day := range interval.Days {
+		if weekdays[day] == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// parseInterval returns the start and end of the interval in minutes since midnight.
+func parseInterval(interval structures.ScheduleInterval) (int, int, error) {
+	start, err := parseClock(interval.Start)
+	if err != nil || start == minutesPerDay {
+		return 0, 0, fmt.Errorf("invalid start %s, use HH:MM", interval.Start)
+	}
+
+	end, err := parseClock(interval.End)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid end %s, use HH:MM", interval.End)
+	}
+
+	return start, end, nil
+}
+
+func parseClock(clock string) (int, error) {
+	var hours, minutes int
+	if len(clock) != 5 {
+		return 0, errors.New("invalid clock")
+	}
+	if _, err := fmt.Sscanf(clock, "%02d:%02d", &hours, &minutes); err != nil {
+		return 0, err
+	}
+
+	minute := hours*60 + minutes
+	if hours < 0 || minutes < 0 || minutes > 59 || minute > minutesPerDay {
+		return 0, errors.New("invalid clock")
+	}
+	return minute, nil
+}
+
+func atMinute(date time.Time, minute int) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), minute/60, minute%60, 0, 0, date.Location())
+}
@@ -0,0 +1,179 @@
+package utils_test
+
+import (
+	"avito/pkg/structures"
+	"avito/pkg/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var eveningsAndWeekends = structures.SegmentSchedule{
+	Timezone: "Europe/Moscow",
+	Intervals: []structures.ScheduleInterval{
+		{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "18:00", End: "23:00"},
+		{Days: []string{"sat", "sun"}, Start: "00:00", End: "24:00"},
+	},
+}
+
+func TestInSchedule(t *testing.T) {
+	overnight := structures.SegmentSchedule{
+		Timezone:  "Europe/Moscow",
+		Intervals: []structures.ScheduleInterval{{Days: []string{"fri"}, Start: "22:00", End: "02:00"}},
+	}
+	invalid := structures.SegmentSchedule{
+		Timezone:  "Mars/Olympus",
+		Intervals: []structures.ScheduleInterval{{Days: []string{"mon"}, Start: "00:00", End: "24:00"}},
+	}
+
+	tests := []struct {
+		name     string
+		schedule *structures.SegmentSchedule
+		now      time.Time
+		want     bool
+	}{
+		{name: "NoSchedule", schedule: nil, now: time.Date(2023, 8, 28, 12, 0, 0, 0, time.UTC), want: true},
+		{name: "EveningStart", schedule: &eveningsAndWeekends, now: time.Date(2023, 8, 28, 15, 0, 0, 0, time.UTC), want: true},
+		{name: "BeforeEvening", schedule: &eveningsAndWeekends, now: time.Date(2023, 8, 28, 14, 59, 0, 0, time.UTC), want: false},
+		{name: "EveningEnd", schedule: &eveningsAndWeekends, now: time.Date(2023, 8, 28, 20, 0, 0, 0, time.UTC), want: false},
+		{name: "Saturday", schedule: &eveningsAndWeekends, now: time.Date(2023, 9, 2, 10, 0, 0, 0, time.UTC), want: true},
+		{name: "SundayMidnight", schedule: &eveningsAndWeekends, now: time.Date(2023, 9, 3, 20, 59, 0, 0, time.UTC), want: true},
+		{name: "MondayMidnight", schedule: &eveningsAndWeekends, now: time.Date(2023, 9, 3, 21, 0, 0, 0, time.UTC), want: false},
+		{name: "OvernightStart", schedule: &overnight, now: time.Date(2023, 9, 1, 19, 0, 0, 0, time.UTC), want: true},
+		{name: "OvernightNextDay", schedule: &overnight, now: time.Date(2023, 9, 1, 22, 30, 0, 0, time.UTC), want: true},
+		{name: "OvernightEnd", schedule: &overnight, now: time.Date(2023, 9, 1, 23, 0, 0, 0, time.UTC), want: false},
+		{name: "OvernightPreviousWeek", schedule: &overnight, now: time.Date(2023, 8, 31, 22, 30, 0, 0, time.UTC), want: false},
+		{name: "InvalidTimezone", schedule: &invalid, now: time.Date(2023, 8, 28, 12, 0, 0, 0, time.UTC), want: false},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.want, utils.InSchedule(testCase.schedule, testCase.now))
+		})
+	}
+}
+
+func TestNextActivityIntervals(t *testing.T) {
+	endsAt := time.Date(2023, 8, 30, 19, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		segment structures.Segment
+		from    time.Time
+		count   int
+		want    []string
+	}{
+		{
+			name:    "WeekendsMerged",
+			segment: structures.Segment{Schedule: &eveningsAndWeekends},
+			from:    time.Date(2023, 8, 28, 12, 0, 0, 0, time.UTC),
+			count:   7,
+			want: []string{
+				"2023-08-28T18:00:00+03:00 2023-08-28T23:00:00+03:00",
+				"2023-08-29T18:00:00+03:00 2023-08-29T23:00:00+03:00",
+				"2023-08-30T18:00:00+03:00 2023-08-30T23:00:00+03:00",
+				"2023-08-31T18:00:00+03:00 2023-08-31T23:00:00+03:00",
+				"2023-09-01T18:00:00+03:00 2023-09-01T23:00:00+03:00",
+				"2023-09-02T00:00:00+03:00 2023-09-04T00:00:00+03:00",
+				"2023-09-04T18:00:00+03:00 2023-09-04T23:00:00+03:00",
+			},
+		},
+		{
+			name:    "CurrentInterval",
+			segment: structures.Segment{Schedule: &eveningsAndWeekends},
+			from:    time.Date(2023, 8, 28, 16, 0, 0, 0, time.UTC),
+			count:   1,
+			want:    []string{"2023-08-28T18:00:00+03:00 2023-08-28T23:00:00+03:00"},
+		},
+		{
+			name:    "ClippedToWindow",
+			segment: structures.Segment{Schedule: &eveningsAndWeekends, EndsAt: &endsAt},
+			from:    time.Date(2023, 8, 28, 12, 0, 0, 0, time.UTC),
+			count:   5,
+			want: []string{
+				"2023-08-28T18:00:00+03:00 2023-08-28T23:00:00+03:00",
+				"2023-08-29T18:00:00+03:00 2023-08-29T23:00:00+03:00",
+				"2023-08-30T18:00:00+03:00 2023-08-30T22:00:00+03:00",
+			},
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			intervals, err := utils.NextActivityIntervals(testCase.segment, testCase.from, testCase.count)
+			assert.NoError(t, err)
+
+			got := make([]string, 0, len(intervals))
+			for _, interval := range intervals {
+				got = append(got, interval.StartsAt.Format(time.RFC3339)+" "+interval.EndsAt.Format(time.RFC3339))
+			}
+			assert.Equal(t, testCase.want, got)
+		})
+	}
+}
+
+func TestNextActivityIntervals_NoSchedule(t *testing.T) {
+	_, err := utils.NextActivityIntervals(structures.Segment{}, time.Now(), 5)
+	assert.EqualError(t, err, "segment has no schedule")
+}
+
+func TestValidateSchedule(t *testing.T) {
+	tests := []struct {
+		name        string
+		schedule    structures.SegmentSchedule
+		expectedErr string
+	}{
+		{name: "OK", schedule: eveningsAndWeekends},
+		{
+			name:     "DefaultTimezone",
+			schedule: structures.SegmentSchedule{Intervals: []structures.ScheduleInterval{{Days: []string{"sat"}, Start: "22:00", End: "02:00"}}},
+		},
+		{
+			name:        "InvalidTimezone",
+			schedule:    structures.SegmentSchedule{Timezone: "Mars/Olympus", Intervals: eveningsAndWeekends.Intervals},
+			expectedErr: "invalid timezone Mars/Olympus",
+		},
+		{
+			name:        "NoIntervals",
+			schedule:    structures.SegmentSchedule{Timezone: "UTC"},
+			expectedErr: "schedule needs at least one interval",
+		},
+		{
+			name:        "NoDays",
+			schedule:    structures.SegmentSchedule{Intervals: []structures.ScheduleInterval{{Start: "18:00", End: "23:00"}}},
+			expectedErr: "schedule interval needs at least one day",
+		},
+		{
+			name:        "InvalidDay",
+			schedule:    structures.SegmentSchedule{Intervals: []structures.ScheduleInterval{{Days: []string{"monday"}, Start: "18:00", End: "23:00"}}},
+			expectedErr: "invalid day monday, use mon, tue, wed, thu, fri, sat or sun",
+		},
+		{
+			name:        "InvalidStart",
+			schedule:    structures.SegmentSchedule{Intervals: []structures.ScheduleInterval{{Days: []string{"mon"}, Start: "24:00", End: "23:00"}}},
+			expectedErr: "invalid start 24:00, use HH:MM",
+		},
+		{
+			name:        "InvalidEnd",
+			schedule:    structures.SegmentSchedule{Intervals: []structures.ScheduleInterval{{Days: []string{"mon"}, Start: "18:00", End: "23:60"}}},
+			expectedErr: "invalid end 23:60, use HH:MM",
+		},
+		{
+			name:        "Empty",
+			schedule:    structures.SegmentSchedule{Intervals: []structures.ScheduleInterval{{Days: []string{"mon"}, Start: "18:00", End: "18:00"}}},
+			expectedErr: "schedule interval 18:00-18:00 is empty",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := utils.ValidateSchedule(testCase.schedule)
+			if testCase.expectedErr != "" {
+				assert.EqualError(t, err, testCase.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
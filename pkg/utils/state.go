@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	SegmentStateDraft    = "draft"
+	SegmentStateActive   = "active"
+	SegmentStatePaused   = "paused"
+	SegmentStateArchived = "archived"
+)
+
+// segmentStateTransitions lists the states each state can move to.
+// An archived segment is restored as paused, so nobody gets it back until it is activated again.
+var segmentStateTransitions = map[string][]string{
+	SegmentStateDraft:    {SegmentStateActive, SegmentStateArchived},
+	SegmentStateActive:   {SegmentStatePaused, SegmentStateArchived},
+	SegmentStatePaused:   {SegmentStateActive, SegmentStateArchived},
+	SegmentStateArchived: {SegmentStatePaused},
+}
+
+func ValidateSegmentState(state string) error {
+	if _, ok := segmentStateTransitions[state]; !ok {
+		return errors.New("invalid state")
+	}
+	return nil
+}
+
+func ValidateSegmentStateTransition(from, to string) error {
+	if err := ValidateSegmentState(to); err != nil {
+		return err
+	}
+
+	for _, state := range segmentStateTransitions[from] {
+		if state == to {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("segment cannot go from %s to %s", from, to)
+}
@@ -0,0 +1,40 @@
+package utils_test
+
+import (
+	"avito/pkg/utils"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateSegmentStateTransition(t *testing.T) {
+	tests := []struct {
+		from        string
+		to          string
+		expectedErr string
+	}{
+		{from: "draft", to: "active"},
+		{from: "draft", to: "archived"},
+		{from: "active", to: "paused"},
+		{from: "active", to: "archived"},
+		{from: "paused", to: "active"},
+		{from: "paused", to: "archived"},
+		{from: "archived", to: "paused"},
+		{from: "draft", to: "paused", expectedErr: "segment cannot go from draft to paused"},
+		{from: "active", to: "draft", expectedErr: "segment cannot go from active to draft"},
+		{from: "active", to: "active", expectedErr: "segment cannot go from active to active"},
+		{from: "archived", to: "active", expectedErr: "segment cannot go from archived to active"},
+		{from: "active", to: "deleted", expectedErr: "invalid state"},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.from+"->"+testCase.to, func(t *testing.T) {
+			err := utils.ValidateSegmentStateTransition(testCase.from, testCase.to)
+			if testCase.expectedErr != "" {
+				assert.EqualError(t, err, testCase.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,456 @@
+package utils
+
+import (
+	"avito/pkg/structures"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	targetingAnd     = "&&"
+	targetingOr      = "||"
+	targetingNot     = "!"
+	targetingCompare = "compare"
+	targetingIn      = "in"
+)
+
+// Targeting is a rule over the attributes a caller passes when reading the segments of a user,
+// such as city in ["Moscow", "SPb"] && semver(app_version) >= "7.0".
+// Attributes are compared as strings with == and !=, as numbers with <, <=, > and >=,
+// and as versions when wrapped in semver(). A comparison of a missing attribute does not hold.
+type Targeting struct {
+	op       string
+	attr     string
+	semver   bool
+	compare  string
+	values   []string
+	operands []*Targeting
+}
+
+// ParseTargeting parses a targeting rule. Literals are checked against the way they are compared,
+// so a rule that cannot hold for any attribute is rejected.
+func ParseTargeting(value string) (*Targeting, error) {
+	tokens, err := tokenizeTargeting(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("invalid targeting, it is empty")
+	}
+
+	p := targetingParser{tokens: tokens}
+	targeting, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("invalid targeting, unexpected %s", p.tokens[p.pos].text)
+	}
+
+	return targeting, nil
+}
+
+// ValidateTargeting checks the targeting of a new segment, targeting narrows the percentage rollout
+// and needs one.
+func ValidateTargeting(segment structures.Segment) error {
+	if segment.Targeting == nil || *segment.Targeting == "" {
+		return nil
+	}
+
+	if _, err := ParseTargeting(*segment.Targeting); err != nil {
+		return err
+	}
+	if segment.Percentage == nil && segment.BasisPoints == nil {
+		return errors.New("targeting needs a percentage, use 100 to reach every matching user")
+	}
+
+	return nil
+}
+
+// InTargeting reports whether the attributes match the targeting of the segment, a segment without one matches any.
+// The rule parsed when the segment was loaded is used, the rule of a segment built otherwise is parsed here.
+func InTargeting(segment structures.Segment, ctx map[string]string) bool {
+	if segment.Targeting == nil {
+		return true
+	}
+	if segment.TargetingRule != nil {
+		return segment.TargetingRule.Match(ctx)
+	}
+
+	targeting, err := ParseTargeting(*segment.Targeting)
+	if err != nil {
+		return false
+	}
+	return targeting.Match(ctx)
+}
+
+// Match reports whether the rule holds for the attributes.
+func (t *Targeting) Match(ctx map[string]string) bool {
+	switch t.op {
+	case targetingNot:
+		return !t.operands[0].Match(ctx)
+	case targetingAnd:
+		for _, operand := range t.operands {
+			if !operand.Match(ctx) {
+				return false
+			}
+		}
+		return true
+	case targetingOr:
+		for _, operand := range t.operands {
+			if operand.Match(ctx) {
+				return true
+			}
+		}
+		return false
+	}
+
+	value, ok := ctx[t.attr]
+	if !ok {
+		return false
+	}
+
+	if t.op == targetingIn {
+		for _, item := range t.values {
+			if value == item {
+				return true
+			}
+		}
+		return false
+	}
+
+	var cmp int
+	switch {
+	case t.semver:
+		version, ok := parseVersion(value)
+		if !ok {
+			return false
+		}
+		expected, _ := parseVersion(t.values[0])
+		cmp = compareVersions(version, expected)
+	case t.compare == "==":
+		return value == t.values[0]
+	case t.compare == "!=":
+		return value != t.values[0]
+	default:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+		expected, _ := strconv.ParseFloat(t.values[0], 64)
+		switch {
+		case number < expected:
+			cmp = -1
+		case number > expected:
+			cmp = 1
+		}
+	}
+
+	switch t.compare {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// parseVersion parses a version of up to three numeric parts such as 7, 7.2 or v7.2.1, the missing parts are zero.
+func parseVersion(value string) ([3]int, bool) {
+	var version [3]int
+	parts := strings.Split(strings.TrimPrefix(value, "v"), ".")
+	if len(parts) > len(version) {
+		return version, false
+	}
+
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 {
+			return version, false
+		}
+		version[i] = number
+	}
+
+	return version, true
+}
+
+func compareVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+const (
+	targetingIdent  = "ident"
+	targetingString = "string"
+	targetingNumber = "number"
+	targetingSymbol = "symbol"
+)
+
+type targetingToken struct {
+	kind string
+	text string
+}
+
+func tokenizeTargeting(value string) ([]targetingToken, error) {
+	var tokens []targetingToken
+	for i := 0; i < len(value); {
+		c := value[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.HasPrefix(value[i:], targetingAnd) || strings.HasPrefix(value[i:], targetingOr) ||
+			strings.HasPrefix(value[i:], "==") || strings.HasPrefix(value[i:], "!=") ||
+			strings.HasPrefix(value[i:], "<=") || strings.HasPrefix(value[i:], ">="):
+			tokens = append(tokens, targetingToken{kind: targetingSymbol, text: value[i : i+2]})
+			i += 2
+		case strings.IndexByte("!<>()[],", c) >= 0:
+			tokens = append(tokens, targetingToken{kind: targetingSymbol, text: value[i : i+1]})
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(value) && value[end] != '"' {
+				if value[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(value) {
+				return nil, errors.New("invalid targeting, unterminated string")
+			}
+			text, err := strconv.Unquote(value[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid targeting, invalid string %s", value[i:end+1])
+			}
+			tokens = append(tokens, targetingToken{kind: targetingString, text: text})
+			i = end + 1
+		case isDigit(c) || (c == '-' && i+1 < len(value) && isDigit(value[i+1])):
+			end := i + 1
+			for end < len(value) && (isDigit(value[end]) || value[end] == '.') {
+				end++
+			}
+			if _, err := strconv.ParseFloat(value[i:end], 64); err != nil {
+				return nil, fmt.Errorf("invalid targeting, invalid number %s", value[i:end])
+			}
+			tokens = append(tokens, targetingToken{kind: targetingNumber, text: value[i:end]})
+			i = end
+		case isIdentStart(c):
+			end := i + 1
+			for end < len(value) && (isIdentStart(value[end]) || isDigit(value[end])) {
+				end++
+			}
+			tokens = append(tokens, targetingToken{kind: targetingIdent, text: value[i:end]})
+			i = end
+		default:
+			return nil, fmt.Errorf("invalid targeting, unexpected %q", c)
+		}
+	}
+
+	return tokens, nil
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+type targetingParser struct {
+	tokens []targetingToken
+	pos    int
+}
+
+func (p *targetingParser) peekSymbol(symbol string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == targetingSymbol && p.tokens[p.pos].text == symbol
+}
+
+func (p *targetingParser) next() (targetingToken, error) {
+	if p.pos == len(p.tokens) {
+		return targetingToken{}, errors.New("invalid targeting, it ends too early")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *targetingParser) expectSymbol(symbol string) error {
+	token, err := p.next()
+	if err != nil {
+		return err
+	}
+	if token.kind != targetingSymbol || token.text != symbol {
+		return fmt.Errorf("invalid targeting, expected %s instead of %s", symbol, token.text)
+	}
+	return nil
+}
+
+func (p *targetingParser) parseOr() (*Targeting, error) {
+	return p.parseBinary(targetingOr, p.parseAnd)
+}
+
+func (p *targetingParser) parseAnd() (*Targeting, error) {
+	return p.parseBinary(targetingAnd, p.parseUnary)
+}
+
+func (p *targetingParser) parseBinary(op string, parseOperand func() (*Targeting, error)) (*Targeting, error) {
+	operand, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	operands := []*Targeting{operand}
+	for p.peekSymbol(op) {
+		p.pos++
+		operand, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+	}
+
+	if len(operands) == 1 {
+		return operand, nil
+	}
+	return &Targeting{op: op, operands: operands}, nil
+}
+
+func (p *targetingParser) parseUnary() (*Targeting, error) {
+	if p.peekSymbol(targetingNot) {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Targeting{op: targetingNot, operands: []*Targeting{operand}}, nil
+	}
+
+	if p.peekSymbol("(") {
+		p.pos++
+		targeting, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return targeting, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *targetingParser) parseComparison() (*Targeting, error) {
+	token, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if token.kind != targetingIdent || token.text == targetingIn {
+		return nil, fmt.Errorf("invalid targeting, expected an attribute instead of %s", token.text)
+	}
+
+	targeting := &Targeting{op: targetingCompare, attr: token.text}
+	if token.text == "semver" && p.peekSymbol("(") {
+		p.pos++
+		attr, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if attr.kind != targetingIdent {
+			return nil, fmt.Errorf("invalid targeting, expected an attribute instead of %s", attr.text)
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		targeting.attr, targeting.semver = attr.text, true
+	}
+
+	operator, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if operator.kind == targetingIdent && operator.text == targetingIn {
+		if targeting.semver {
+			return nil, errors.New("invalid targeting, semver() cannot be used with in")
+		}
+		targeting.op = targetingIn
+		targeting.values, err = p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return targeting, nil
+	}
+
+	switch operator.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return nil, fmt.Errorf("invalid targeting, expected a comparison of %s instead of %s", targeting.attr, operator.text)
+	}
+	targeting.compare = operator.text
+
+	literal, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if literal.kind != targetingString && literal.kind != targetingNumber {
+		return nil, fmt.Errorf("invalid targeting, expected a value instead of %s", literal.text)
+	}
+
+	switch {
+	case targeting.semver:
+		if _, ok := parseVersion(literal.text); !ok {
+			return nil, fmt.Errorf("invalid targeting, invalid version %q", literal.text)
+		}
+	case targeting.compare != "==" && targeting.compare != "!=":
+		if literal.kind != targetingNumber {
+			return nil, fmt.Errorf("invalid targeting, %s compares numbers, use semver(%s) for versions", targeting.compare, targeting.attr)
+		}
+	}
+	targeting.values = []string{literal.text}
+
+	return targeting, nil
+}
+
+func (p *targetingParser) parseList() ([]string, error) {
+	if err := p.expectSymbol("["); err != nil {
+		return nil, err
+	}
+
+	var values []string
+	for {
+		literal, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if literal.kind != targetingString && literal.kind != targetingNumber {
+			return nil, fmt.Errorf("invalid targeting, expected a value instead of %s", literal.text)
+		}
+		values = append(values, literal.text)
+
+		if !p.peekSymbol(",") {
+			break
+		}
+		p.pos++
+	}
+
+	if err := p.expectSymbol("]"); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
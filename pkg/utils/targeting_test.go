@@ -0,0 +1,90 @@
+package utils_test
+
+import (
+	"avito/pkg/structures"
+	"avito/pkg/utils"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTargeting(t *testing.T) {
+	tests := []struct {
+		name        string
+		targeting   string
+		expectedErr string
+	}{
+		{name: "In", targeting: `city in ["Moscow", "SPb"]`},
+		{name: "Semver", targeting: `city in ["Moscow","SPb"] && semver(app_version) >= "7.0"`},
+		{name: "Grouped", targeting: `!(platform == "ios" || age < 18) && semver(app_version) != "v7.2.1"`},
+		{name: "Numbers", targeting: `age >= 18 && score < -0.5 && tier in [1, 2]`},
+		{name: "Empty", targeting: "  ", expectedErr: "invalid targeting, it is empty"},
+		{name: "TrailingOperator", targeting: `city == "Moscow" &&`, expectedErr: "invalid targeting, it ends too early"},
+		{name: "MissingParenthesis", targeting: `(city == "Moscow"`, expectedErr: "invalid targeting, it ends too early"},
+		{name: "ExtraParenthesis", targeting: `city == "Moscow")`, expectedErr: "invalid targeting, unexpected )"},
+		{name: "MissingOperator", targeting: `city "Moscow"`, expectedErr: "invalid targeting, expected a comparison of city instead of Moscow"},
+		{name: "UnterminatedString", targeting: `city == "Moscow`, expectedErr: "invalid targeting, unterminated string"},
+		{name: "UnexpectedCharacter", targeting: `city = "Moscow"`, expectedErr: `invalid targeting, unexpected '='`},
+		{name: "AttributeAsValue", targeting: `city == region`, expectedErr: "invalid targeting, expected a value instead of region"},
+		{name: "OrderingOfStrings", targeting: `app_version >= "7.0"`, expectedErr: "invalid targeting, >= compares numbers, use semver(app_version) for versions"},
+		{name: "InvalidVersion", targeting: `semver(app_version) >= "7.x"`, expectedErr: `invalid targeting, invalid version "7.x"`},
+		{name: "SemverIn", targeting: `semver(app_version) in ["7.0"]`, expectedErr: "invalid targeting, semver() cannot be used with in"},
+		{name: "UnclosedList", targeting: `city in ["Moscow", "SPb"`, expectedErr: "invalid targeting, it ends too early"},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := utils.ParseTargeting(testCase.targeting)
+			if testCase.expectedErr != "" {
+				assert.EqualError(t, err, testCase.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestTargeting_Match(t *testing.T) {
+	targeting, err := utils.ParseTargeting(`city in ["Moscow", "SPb"] && semver(app_version) >= "7.0" && !(age < 18)`)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		ctx      map[string]string
+		expected bool
+	}{
+		{name: "Match", ctx: map[string]string{"city": "Moscow", "app_version": "7.2", "age": "30"}, expected: true},
+		{name: "PatchVersion", ctx: map[string]string{"city": "SPb", "app_version": "v7.0.1", "age": "18"}, expected: true},
+		{name: "OtherCity", ctx: map[string]string{"city": "Kazan", "app_version": "7.2", "age": "30"}},
+		{name: "OldVersion", ctx: map[string]string{"city": "Moscow", "app_version": "6.10", "age": "30"}},
+		{name: "NewerMajorVersion", ctx: map[string]string{"city": "Moscow", "app_version": "10.0", "age": "30"}, expected: true},
+		{name: "InvalidVersion", ctx: map[string]string{"city": "Moscow", "app_version": "beta", "age": "30"}},
+		{name: "Underage", ctx: map[string]string{"city": "Moscow", "app_version": "7.2", "age": "17"}},
+		{name: "MissingAttribute", ctx: map[string]string{"city": "Moscow", "age": "30"}},
+		{name: "MissingNegatedAttribute", ctx: map[string]string{"city": "Moscow", "app_version": "7.2"}, expected: true},
+		{name: "Empty", ctx: nil},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.expected, targeting.Match(testCase.ctx))
+		})
+	}
+}
+
+func TestInTargeting(t *testing.T) {
+	targeting := `platform == "android" || platform == "ios"`
+	invalid := `platform ==`
+
+	assert.True(t, utils.InTargeting(structures.Segment{Slug: "example"}, nil))
+	assert.True(t, utils.InTargeting(structures.Segment{Slug: "example", Targeting: &targeting}, map[string]string{"platform": "ios"}))
+	assert.False(t, utils.InTargeting(structures.Segment{Slug: "example", Targeting: &targeting}, map[string]string{"platform": "web"}))
+	assert.False(t, utils.InTargeting(structures.Segment{Slug: "example", Targeting: &invalid}, map[string]string{"platform": "ios"}))
+
+	// A loaded segment carries its parsed rule, which is matched instead of the text.
+	rule, err := utils.ParseTargeting(`platform == "web"`)
+	assert.NoError(t, err)
+	loaded := structures.Segment{Slug: "example", Targeting: &targeting, TargetingRule: rule}
+	assert.True(t, utils.InTargeting(loaded, map[string]string{"platform": "web"}))
+	assert.False(t, utils.InTargeting(loaded, map[string]string{"platform": "ios"}))
+}
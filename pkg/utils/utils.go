@@ -23,6 +23,9 @@ func ValidateYearMonth(yearMonth string) error {
 	return nil
 }
 
+// Probability reports whether the user falls into the first percentage of the segment.
+// The threshold only grows with percentage, so raising it keeps everyone already
+// in the segment, and lowering it drops a deterministic subset of them.
 func Probability(segment string, number int64, percentage int) bool {
 	if percentage <= 0 {
 		return false
@@ -123,3 +123,17 @@ func TestProbability(t *testing.T) {
 		assert.Equal(t, testCase.Expected, utils.Probability(testCase.Slug, int64(testCase.UserId), testCase.Percentage))
 	}
 }
+
+func TestProbability_MonotoneRollout(t *testing.T) {
+	slugs := []string{"example", "AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30"}
+
+	for _, slug := range slugs {
+		for userId := int64(0); userId < 1000; userId++ {
+			for percentage := 1; percentage <= 100; percentage++ {
+				if utils.Probability(slug, userId, percentage-1) && !utils.Probability(slug, userId, percentage) {
+					t.Fatalf("user %d left segment %s when percentage was raised to %d", userId, slug, percentage)
+				}
+			}
+		}
+	}
+}
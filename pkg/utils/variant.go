@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"avito/pkg/structures"
+	"errors"
+	"fmt"
+)
+
+// AssignVariant returns the variant of the user in a segment with the given salt.
+// The user gets bucket murmur3(salt + ":variant:" + user_id) mod 10000, and the buckets
+// are split between the variants in their order, proportionally to the weights.
+func AssignVariant(salt string, variants []structures.SegmentVariant, userId int64) string {
+	total := 0
+	for _, variant := range variants {
+		total += variant.Weight
+	}
+	if total <= 0 {
+		return ""
+	}
+
+	bucket, _ := Bucket(HashMurmur3, salt+":variant", userId)
+	point := bucket * total / Buckets
+
+	cumulative := 0
+	for _, variant := range variants {
+		cumulative += variant.Weight
+		if point < cumulative {
+			return variant.Name
+		}
+	}
+
+	return variants[len(variants)-1].Name
+}
+
+// ValidateVariants checks that the variants have unique slug-like names and positive weights.
+// No variants at all is a plain segment, otherwise at least two are needed.
+func ValidateVariants(variants []structures.SegmentVariant) error {
+	if len(variants) == 0 {
+		return nil
+	}
+
+	if len(variants) == 1 {
+		return errors.New("a segment needs at least two variants")
+	}
+
+	names := make(map[string]bool)
+	for _, variant := range variants {
+		if err := ValidateSlug(variant.Name); err != nil {
+			return fmt.Errorf("invalid variant name %q", variant.Name)
+		}
+		if names[variant.Name] {
+			return fmt.Errorf("duplicate variant %s", variant.Name)
+		}
+		names[variant.Name] = true
+
+		if variant.Weight <= 0 {
+			return fmt.Errorf("invalid weight of variant %s", variant.Name)
+		}
+	}
+
+	return nil
+}
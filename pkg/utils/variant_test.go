@@ -0,0 +1,60 @@
+package utils_test
+
+import (
+	"avito/pkg/structures"
+	"avito/pkg/utils"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssignVariant_Weights(t *testing.T) {
+	const users = 100000
+
+	variants := []structures.SegmentVariant{
+		{Name: "control", Weight: 50},
+		{Name: "a", Weight: 25},
+		{Name: "b", Weight: 25},
+	}
+
+	counts := make(map[string]int)
+	for userId := int64(0); userId < users; userId++ {
+		variant := utils.AssignVariant("AVITO_VOICE_MESSAGES", variants, userId)
+		assert.Equal(t, variant, utils.AssignVariant("AVITO_VOICE_MESSAGES", variants, userId))
+		counts[variant]++
+	}
+
+	assert.InDelta(t, 0.50, float64(counts["control"])/users, 0.01)
+	assert.InDelta(t, 0.25, float64(counts["a"])/users, 0.01)
+	assert.InDelta(t, 0.25, float64(counts["b"])/users, 0.01)
+}
+
+func TestAssignVariant_Empty(t *testing.T) {
+	assert.Equal(t, "", utils.AssignVariant("example", nil, 1))
+}
+
+func TestValidateVariants(t *testing.T) {
+	tests := []struct {
+		name        string
+		variants    []structures.SegmentVariant
+		expectedErr string
+	}{
+		{"None", nil, ""},
+		{"OK", []structures.SegmentVariant{{Name: "control", Weight: 1}, {Name: "treatment", Weight: 3}}, ""},
+		{"Single", []structures.SegmentVariant{{Name: "control", Weight: 1}}, "a segment needs at least two variants"},
+		{"InvalidName", []structures.SegmentVariant{{Name: "control", Weight: 1}, {Name: "a b", Weight: 1}}, `invalid variant name "a b"`},
+		{"Duplicate", []structures.SegmentVariant{{Name: "control", Weight: 1}, {Name: "control", Weight: 1}}, "duplicate variant control"},
+		{"ZeroWeight", []structures.SegmentVariant{{Name: "control", Weight: 1}, {Name: "a", Weight: 0}}, "invalid weight of variant a"},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := utils.ValidateVariants(testCase.variants)
+			if testCase.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, testCase.expectedErr)
+			}
+		})
+	}
+}
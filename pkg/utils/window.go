@@ -0,0 +1,14 @@
+package utils
+
+import (
+	"errors"
+	"time"
+)
+
+// ValidateWindow checks that the activation window of a segment is not empty.
+func ValidateWindow(startsAt, endsAt *time.Time) error {
+	if startsAt != nil && endsAt != nil && !startsAt.Before(*endsAt) {
+		return errors.New("starts_at must be before ends_at")
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package utils_test
+
+import (
+	"avito/pkg/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateWindow(t *testing.T) {
+	startsAt := time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+	endsAt := startsAt.Add(14 * 24 * time.Hour)
+
+	assert.NoError(t, utils.ValidateWindow(nil, nil))
+	assert.NoError(t, utils.ValidateWindow(&startsAt, nil))
+	assert.NoError(t, utils.ValidateWindow(nil, &endsAt))
+	assert.NoError(t, utils.ValidateWindow(&startsAt, &endsAt))
+	assert.EqualError(t, utils.ValidateWindow(&endsAt, &startsAt), "starts_at must be before ends_at")
+	assert.EqualError(t, utils.ValidateWindow(&startsAt, &startsAt), "starts_at must be before ends_at")
+}